@@ -3,10 +3,12 @@
 package amqpconnector
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -39,14 +41,20 @@ type Update struct {
 
 //Consumer structure for NewConsumer result
 type Consumer struct {
-	conn     *amqp.Connection
-	channel  *amqp.Channel
-	done     chan error
-	exchange *Exchange
-	queue    *Queue
-	uri      string
-	name     string // consumer name for logs
-	handlers []func(*Delivery)
+	connection *Connection
+	mu         sync.RWMutex // protects channel replaced on reconnect
+	channel    Channel
+	exchange   *Exchange
+	queue      *Queue
+	uri        string
+	name       string // consumer name for logs
+	handlers   []func(*Delivery)
+	// resultHandlers handlers which control acknowledgement
+	resultHandlers []ResultHandler
+	tag            string // consumer tag of queue consume
+	running        sync.WaitGroup
+	closed         int32
+	republisher    confirmChannel // confirm channel of retried and dead-lettered deliveries
 }
 
 // Exchange struct for receive exchange params
@@ -73,6 +81,13 @@ type Queue struct {
 	Exclusive   bool
 	NoWait      bool
 	Args        map[string]interface{}
+	Retry       *RetryPolicy // delay queues and dead-lettering of Retry and Nack results
+	Prefetch    int          // unacknowledged deliveries limit, 0 is unlimited
+	Workers     int          // concurrent delivery handlers, 0 and 1 handle deliveries serially
+	OrderKey    OrderKey     // deliveries with equal key are handled in order if set
+	// Headers header sets bound to headers exchange
+	Headers      []HeadersBinding
+	HeaderFilter *HeadersBinding // deliveries not matching filter are acked without handlers
 }
 
 type Delivery amqp.Delivery
@@ -81,8 +96,13 @@ type Delivery amqp.Delivery
 var (
 	reconTime = time.Second * 20
 	lifetime  = time.Duration(0)
+	// publishAttempts attempts of Consumer.PublishWithHeaders with reconnect between them
+	publishAttempts = 3
 )
 
+// ErrNilConsumer method is called on nil consumer
+var ErrNilConsumer = errors.New("amqp consumer is nil")
+
 func (c *Consumer) logInfo(log string) string {
 	return "[" + c.name + "]" + log
 }
@@ -91,7 +111,7 @@ func (c *Consumer) logInfo(log string) string {
 func (c *Consumer) ExchangeDeclare() (string, error) {
 	if c.exchange != nil {
 		logrus.Info(c.logInfo("amqp declaring exchange: "), c.exchange.Name, " type: ", c.exchange.Type, " durable: ", c.exchange.Durable, " autodelete: ", c.exchange.AutoDelete)
-		if err := c.channel.ExchangeDeclare(
+		if err := c.getChannel().ExchangeDeclare(
 			c.exchange.Name,       // name of the exchange
 			c.exchange.Type,       // type
 			c.exchange.Durable,    // durable
@@ -122,7 +142,7 @@ func (c *Consumer) BindKeys(keys []string) error {
 				}
 			}
 			if !keyExists {
-				err := c.channel.QueueBind(
+				err := c.getChannel().QueueBind(
 					c.queue.Name,    // name of the queue
 					key,             // bindingKey
 					c.exchange.Name, // sourceExchange
@@ -145,7 +165,7 @@ func (c *Consumer) QueueDeclare(exchange string, keys []string) (<-chan amqp.Del
 	// declare and bind queue
 	if c.queue != nil {
 		logrus.Info(c.logInfo("amqp declare queue: "), c.queue.Name, " durable: ", c.queue.Durable, " autodelete: ", c.queue.AutoDelete)
-		_, err := c.channel.QueueDeclare(
+		_, err := c.getChannel().QueueDeclare(
 			c.queue.Name,       // name of the queue
 			c.queue.Durable,    // durable
 			c.queue.AutoDelete, // delete when unused
@@ -160,22 +180,39 @@ func (c *Consumer) QueueDeclare(exchange string, keys []string) (<-chan amqp.Del
 			err = c.BindKeys(c.queue.Keys)
 		} else if keys != nil && len(keys) > 0 {
 			err = c.BindKeys(keys) // if reconnect or create new consumer cases
-		} else {
+		} else if len(c.queue.Headers) == 0 {
 			err = c.BindKeys([]string{c.queue.ConsumerTag})
 		}
 
 		if err != nil {
 			return nil, err
 		}
+		if err = c.bindHeaders(); err != nil {
+			return nil, err
+		}
+		if err = c.RetryDeclare(); err != nil {
+			return nil, err
+		}
+		if c.queue.Prefetch > 0 {
+			if err = c.getChannel().Qos(c.queue.Prefetch, 0, false); err != nil {
+				return nil, err
+			}
+		}
+		if c.tag == "" {
+			c.tag = c.queue.ConsumerTag
+			if c.tag == "" {
+				c.tag = c.name + "." + *strUtil.NewId()
+			}
+		}
 		logrus.Info(c.logInfo("starting consume for queue: "), c.queue.Name)
-		deliveries, err := c.channel.Consume(
-			c.queue.Name,        // name
-			c.queue.ConsumerTag, // consumerTag,
-			c.queue.NoAck,       // noAck
-			c.queue.Exclusive,   // exclusive
-			c.queue.NoLocal,     // noLocal
-			c.queue.NoWait,      // noWait
-			c.queue.Args,        // arguments
+		deliveries, err := c.getChannel().Consume(
+			c.queue.Name,      // name
+			c.tag,             // consumerTag,
+			c.queue.NoAck,     // noAck
+			c.queue.Exclusive, // exclusive
+			c.queue.NoLocal,   // noLocal
+			c.queue.NoWait,    // noWait
+			c.queue.Args,      // arguments
 		)
 		if err != nil {
 			return nil, err
@@ -186,54 +223,55 @@ func (c *Consumer) QueueDeclare(exchange string, keys []string) (<-chan amqp.Del
 	return nil, nil
 }
 
-// Connect dial amqp server, decrare echange an queue if set
-func (c *Consumer) Connect(reconnect bool, keys []string) (<-chan amqp.Delivery, error) {
-	var err error
-	logrus.Info(c.logInfo("amqp connect to: "), c.uri)
-	c.conn, err = amqp.Dial(c.uri)
-	if err != nil {
-		return nil, err
-	}
+func (c *Consumer) getChannel() Channel {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.channel
+}
 
-	logrus.Info(c.logInfo("amqp get channel"))
-	c.channel, err = c.conn.Channel()
-	if err != nil {
-		return nil, err
-	}
+// setup declares exchange, queue and bindings on new channel and starts consuming
+func (c *Consumer) setup(channel Channel) error {
+	c.mu.Lock()
+	c.channel = channel
+	c.mu.Unlock()
 	// declare exchange
 	exchange, err := c.ExchangeDeclare()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if c.queue == nil {
+		return nil
+	}
+	// bound keys are bound again on new channel
+	keys := c.queue.Keys
+	c.queue.Keys = nil
 	// declare queue and bind routing keys
 	deliveries, err := c.QueueDeclare(exchange, keys)
 	if err != nil {
-		return nil, err
-	}
-	if !reconnect {
-		go c.handleDeliveries(deliveries)
+		c.queue.Keys = keys
+		return err
 	}
-	go func() {
-		logrus.Error(c.logInfo("amqp connection err: "), <-c.conn.NotifyClose(make(chan *amqp.Error)))
-		c.done <- errors.New(c.logInfo("channel closed"))
-	}()
-	return deliveries, nil
+	c.running.Add(1)
+	go c.dispatch(deliveries)
+	return nil
 }
 
-// Reconnect reconnect to amqp server
-func (c *Consumer) Reconnect(keys []string) <-chan amqp.Delivery {
-	if err := c.Shutdown(); err != nil {
-		logrus.Error(c.logInfo("error during shutdown: "), err)
-	}
-	reconnectInterval := 30
-	logrus.Warn(c.logInfo("consumer wait reconnect"), " next try in ", reconnectInterval, "s")
-	time.Sleep(time.Duration(reconnectInterval) * time.Second)
-	deliveries, err := c.Connect(true, keys)
+// connect registers consumer in shared connection of uri
+func (c *Consumer) connect() error {
+	connection, err := GetConnection(c.uri)
 	if err != nil {
-		logrus.Error(c.logInfo("consumer reconnect err: "), err.Error(), " next try in ", reconnectInterval, "s")
-		return c.Reconnect(keys)
+		return err
+	}
+	c.connection = connection
+	return connection.register(c)
+}
+
+// State returns state of consumer connection
+func (c *Consumer) State() ConnectionState {
+	if c.connection == nil {
+		return StateConnecting
 	}
-	return deliveries
+	return c.connection.State()
 }
 
 //NewConsumer create simple consumer for read messages with ack
@@ -241,20 +279,13 @@ func NewConsumer(amqpURI, name string, exchange *Exchange, queue *Queue, handler
 	c := &Consumer{
 		exchange: exchange,
 		queue:    queue,
-		done:     make(chan error),
 		uri:      amqpURI,
 		name:     name,
 	}
 	if len(handlers) > 0 {
 		c.handlers = handlers
 	}
-	var keys []string
-	if len(c.queue.Keys) > 0 {
-		keys = make([]string, len(c.queue.Keys))
-		copy(keys, c.queue.Keys)
-		c.queue.Keys = nil
-	}
-	_, err := c.Connect(false, keys)
+	err := c.connect()
 	return c, err
 }
 
@@ -265,12 +296,17 @@ func NewPublisher(amqpURI, name string, exchange Exchange) (*Consumer, error) {
 		uri:      amqpURI,
 		name:     name,
 	}
-	_, err := c.Connect(false, nil)
+	err := c.connect()
 	return c, err
 }
 
-// PublishWithHeaders sends messages and reconnects in case of error
+// PublishWithHeaders sends messages and reconnects in case of error,
+// use ReliablePublisher for publishing with confirms
 func (c *Consumer) PublishWithHeaders(msg []byte, routingKey string, headers map[string]interface{}) error {
+	if c == nil {
+		logrus.Error("[PublishWithHeaders] publisher is nil")
+		return ErrNilConsumer
+	}
 	content := amqp.Publishing{
 		ContentType: "text/plain",
 		Body:        msg,
@@ -278,28 +314,29 @@ func (c *Consumer) PublishWithHeaders(msg []byte, routingKey string, headers map
 	if headers != nil {
 		content.Headers = headers
 	}
-	if c == nil {
-		logrus.Error(c.logInfo("c == nil"))
-		c.Reconnect(nil)
-		return c.PublishWithHeaders(msg, routingKey, headers)
-	}
-	if c.conn == nil {
-		logrus.Error(c.logInfo("c.conn == nil"))
-		c.Reconnect(nil)
-		return c.PublishWithHeaders(msg, routingKey, headers)
-	}
-	if c.channel == nil {
-		logrus.Error(c.logInfo("c.channel == nil"))
-		c.Reconnect(nil)
-		return c.PublishWithHeaders(msg, routingKey, headers)
-	}
-	errPublish := c.channel.Publish(c.exchange.Name, routingKey, false, false, content)
-	if errPublish != nil {
-		logrus.Error(c.logInfo("try reconnect after publish err: "), errPublish)
-		c.Reconnect(nil)
-		return c.PublishWithHeaders(msg, routingKey, headers)
+	// message id is kept through publish attempts
+	stampPublishing(context.Background(), &content)
+	var err error
+	for attempt := 0; attempt < publishAttempts; attempt++ {
+		if attempt > 0 {
+			// broken channel is reopened by connection
+			time.Sleep(reconnectDelay)
+			if c.connection != nil && !c.connection.WaitConnected(reconTime) {
+				continue
+			}
+		}
+		channel := c.getChannel()
+		if channel == nil {
+			err = amqp.ErrClosed
+			logrus.Error(c.logInfo("connection is not established"))
+			continue
+		}
+		if err = channel.Publish(c.exchange.Name, routingKey, false, false, content); err == nil {
+			return nil
+		}
+		logrus.Error(c.logInfo("wait reconnect after publish err: "), err)
 	}
-	return nil
+	return err
 }
 
 // Publish sends messages and reconnects in case of error
@@ -372,7 +409,7 @@ func PublishFanout(amqpURI, consumerName, exchangeName, routingKey string, msg [
 
 // PublishHeader simple publisher with unique name and one connect
 func PublishHeader(amqpURI, consumerName, exchangeName string, msg []byte, headers map[string]interface{}) error {
-	return Publish(amqpURI, consumerName, exchangeName, "header", "", msg, nil)
+	return Publish(amqpURI, consumerName, exchangeName, "headers", "", msg, headers)
 }
 
 // SendUpdate Send rpc update command to services
@@ -400,14 +437,10 @@ func SendUpdate(amqpURI, collection, id, method string, data interface{}, option
 			}
 		}
 	}
-	msgJSON, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
 	var consumer *Consumer
 	consumerInt, ok := consumers.Load("SendUpdate")
 	if !ok {
-		consumer, err = NewPublisher(amqpURI, "SendUpdate", Exchange{Name: updateExch, Type: "direct", Durable: true})
+		consumer, err = NewPublisher(amqpURI, "SendUpdate", Exchange{Name: updatesExchange(), Type: "direct", Durable: true})
 		if err != nil {
 			return err
 		}
@@ -415,33 +448,11 @@ func SendUpdate(amqpURI, collection, id, method string, data interface{}, option
 	} else {
 		consumer = consumerInt.(*Consumer)
 	}
-	return consumer.Publish(msgJSON, collection)
-}
-
-func (c *Consumer) handleDeliveries(deliveries <-chan amqp.Delivery) {
-	for {
-		logrus.Info(c.logInfo("handle deliveries"))
-		go func() {
-			for d := range deliveries {
-				for i := 0; i < len(c.handlers); i++ {
-					cb := c.handlers[i]
-					dv := Delivery(d)
-					cb(&dv)
-				}
-				d.Ack(false)
-			}
-		}()
-		if <-c.done != nil {
-			logrus.Error(c.logInfo("deliveries channel closed"))
-			if len(c.queue.Keys) > 0 {
-				c.queue.BindedKeys = make([]string, len(c.queue.Keys))
-				copy(c.queue.BindedKeys, c.queue.Keys)
-				c.queue.Keys = nil
-			}
-			deliveries = c.Reconnect(c.queue.BindedKeys)
-			continue
-		}
+	var headers amqp.Table
+	if msg.Initiator != "" {
+		headers = amqp.Table{HeaderInitiator: msg.Initiator}
 	}
+	return consumer.PublishContractWithHeaders(ContractUpdate, msg, collection, headers)
 }
 
 // AddConsumeHandler add handler for queue consumer
@@ -467,12 +478,17 @@ func GenerateName(prefix string) string {
 	return queueName
 }
 
-// OnUpdates Listener to get models events update, create and delete
-func OnUpdates(cb func(data *Delivery), keys []string) {
+// updatesExchange returns exchange of model updates, csx.updates by default
+func updatesExchange() string {
 	if updateExch == "" {
-		updateExch = "csx.updates"
+		return "csx.updates"
 	}
-	exchange := Exchange{Name: updateExch, Type: "direct", Durable: true}
+	return updateExch
+}
+
+// OnUpdates Listener to get models events update, create and delete
+func OnUpdates(cb func(data *Delivery), keys []string) {
+	exchange := Exchange{Name: updatesExchange(), Type: "direct", Durable: true}
 	queueName := GenerateName("onUpdates")
 	queue := Queue{
 		Name:        queueName,
@@ -498,25 +514,41 @@ func OnUpdates(cb func(data *Delivery), keys []string) {
 	}
 }
 
+// forget removes consumer from consumers cache
+func (c *Consumer) forget() {
+	consumers.Range(func(key, value interface{}) bool {
+		if value == c {
+			consumers.Delete(key)
+		}
+		return true
+	})
+}
+
 //Shutdown channel on set app time to live
 func (c *Consumer) Shutdown() error {
+	atomic.StoreInt32(&c.closed, 1)
+	c.forget()
+	if c.connection != nil {
+		c.connection.unregister(c)
+	}
+	c.republisher.mu.Lock()
+	c.republisher.close()
+	c.republisher.mu.Unlock()
+	channel := c.getChannel()
+	if channel == nil {
+		return nil
+	}
 	// will close() the deliveries channel
-	if c.channel != nil {
-		if err := c.channel.Cancel("", true); err != nil {
+	if c.queue != nil {
+		if err := channel.Cancel(c.tag, true); err != nil {
 			logrus.Error(c.logInfo("[Shutdown] consumer cancel err: "), err)
 			return err
 		}
 	}
-
-	if c.conn != nil {
-		if err := c.conn.Close(); err != nil {
-			logrus.Error(c.logInfo("[Shutdown] AMQP connection close err: "), err)
-			return err
-		}
+	if err := channel.Close(); err != nil && err != amqp.ErrClosed {
+		logrus.Error(c.logInfo("[Shutdown] AMQP channel close err: "), err)
+		return err
 	}
-
-	defer logrus.Warn(c.logInfo("[Shutdown] AMQP shutdown OK"))
-
-	// wait for handle() to exit
-	return <-c.done
+	logrus.Warn(c.logInfo("[Shutdown] AMQP shutdown OK"))
+	return nil
 }
@@ -0,0 +1,329 @@
+package amqpconnector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// ConnectionState state of shared connection
+type ConnectionState int32
+
+const (
+	// StateConnecting connection is not dialed yet
+	StateConnecting ConnectionState = iota
+	// StateConnected connection is established
+	StateConnected
+	// StateReconnecting connection is lost and redialed
+	StateReconnecting
+	// StateClosed connection is closed by Close
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+var (
+	connections     = make(map[string]*Connection)
+	connectionsLock sync.Mutex
+	// reconnectDelay initial delay of reconnect, doubled up to reconTime
+	reconnectDelay = time.Second
+)
+
+// client user of shared connection which declares its topology on every channel open
+type client interface {
+	setup(channel Channel) error
+	logInfo(log string) string
+}
+
+// Connection amqp connection shared by consumers and publishers of one uri,
+// every client gets own channel, topology of clients is declared again after reconnect
+type Connection struct {
+	uri       string
+	mu        sync.Mutex
+	conn      Transport
+	state     ConnectionState
+	clients   map[client]bool
+	listeners []func(ConnectionState)
+	connected chan struct{} // closed when state is connected
+	closed    chan struct{}
+}
+
+// GetConnection returns shared connection of uri, connection is dialed on first call
+func GetConnection(amqpURI string) (*Connection, error) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	if m, ok := connections[amqpURI]; ok && m.State() != StateClosed {
+		return m, nil
+	}
+	m := &Connection{
+		uri:       amqpURI,
+		clients:   make(map[client]bool),
+		connected: make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	if err := m.dial(); err != nil {
+		return nil, err
+	}
+	connections[amqpURI] = m
+	return m, nil
+}
+
+// State returns connection state
+func (m *Connection) State() ConnectionState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// OnState add listener of connection state changes
+func (m *Connection) OnState(cb func(ConnectionState)) {
+	m.mu.Lock()
+	m.listeners = append(m.listeners, cb)
+	m.mu.Unlock()
+}
+
+// WaitConnected waits for connected state, timeout 0 waits without limit
+func (m *Connection) WaitConnected(timeout time.Duration) bool {
+	m.mu.Lock()
+	connected := m.connected
+	m.mu.Unlock()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-connected:
+		return true
+	case <-m.closed:
+	case <-expired:
+	}
+	return false
+}
+
+// setState changes state and returns listeners to notify, must be called with lock
+func (m *Connection) setState(state ConnectionState) []func(ConnectionState) {
+	if m.state == state {
+		return nil
+	}
+	if state == StateConnected {
+		close(m.connected)
+	} else if m.state == StateConnected {
+		m.connected = make(chan struct{})
+	}
+	m.state = state
+	return m.listeners
+}
+
+// dial connects to broker and sets up registered clients
+func (m *Connection) dial() error {
+	logrus.Info("[amqp] connect to: ", m.uri)
+	conn, err := Dial(m.uri)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if m.state == StateClosed {
+		m.mu.Unlock()
+		conn.Close()
+		return amqp.ErrClosed
+	}
+	m.conn = conn
+	listeners := m.setState(StateConnected)
+	clients := make([]client, 0, len(m.clients))
+	for c := range m.clients {
+		clients = append(clients, c)
+	}
+	m.mu.Unlock()
+	go m.watch(conn)
+	for _, cb := range listeners {
+		cb(StateConnected)
+	}
+	for _, c := range clients {
+		if err := m.open(c); err != nil {
+			logrus.Error(c.logInfo("setup after reconnect err: "), err)
+			go m.reopen(conn, c)
+		}
+	}
+	return nil
+}
+
+// watch redials connection after it is lost
+func (m *Connection) watch(conn Transport) {
+	err := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+	m.mu.Lock()
+	if m.state == StateClosed || m.conn != conn {
+		m.mu.Unlock()
+		return
+	}
+	listeners := m.setState(StateReconnecting)
+	m.mu.Unlock()
+	for _, cb := range listeners {
+		cb(StateReconnecting)
+	}
+	logrus.Error("[amqp] connection err: ", err)
+	delay := reconnectDelay
+	for {
+		logrus.Warn("[amqp] reconnect in ", delay)
+		select {
+		case <-time.After(delay):
+		case <-m.closed:
+			return
+		}
+		errDial := m.dial()
+		if errDial == nil {
+			return
+		}
+		logrus.Error("[amqp] reconnect err: ", errDial)
+		if delay *= 2; delay > reconTime {
+			delay = reconTime
+		}
+	}
+}
+
+// Channel opens new channel, caller is responsible for channel close
+func (m *Connection) Channel() (Channel, error) {
+	m.mu.Lock()
+	conn, state := m.conn, m.state
+	m.mu.Unlock()
+	if state != StateConnected {
+		return nil, amqp.ErrClosed
+	}
+	return conn.Channel()
+}
+
+// register adds client which topology is declared on every connect
+func (m *Connection) register(c client) error {
+	m.mu.Lock()
+	m.clients[c] = true
+	connected := m.state == StateConnected
+	m.mu.Unlock()
+	if !connected {
+		return nil
+	}
+	if err := m.open(c); err != nil {
+		m.unregister(c)
+		return err
+	}
+	return nil
+}
+
+// unregister removes client
+func (m *Connection) unregister(c client) {
+	m.mu.Lock()
+	delete(m.clients, c)
+	m.mu.Unlock()
+}
+
+// open opens channel of client and declares its topology
+func (m *Connection) open(c client) error {
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+	channel, err := m.Channel()
+	if err != nil {
+		return err
+	}
+	if err = c.setup(channel); err != nil {
+		channel.Close()
+		return err
+	}
+	go m.watchChannel(conn, channel, c)
+	return nil
+}
+
+// current checks if client is registered and connection is not changed
+func (m *Connection) current(conn Transport, c client) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn == conn && m.state == StateConnected && m.clients[c]
+}
+
+// watchChannel reopens channel closed by broker while connection is alive
+func (m *Connection) watchChannel(conn Transport, channel Channel, c client) {
+	err := <-channel.NotifyClose(make(chan *amqp.Error, 1))
+	if err == nil || !m.current(conn, c) {
+		// closed by client or whole connection is lost
+		return
+	}
+	logrus.Error(c.logInfo("amqp channel err: "), err)
+	m.reopen(conn, c)
+}
+
+// reopen retries client setup until success or connection change
+func (m *Connection) reopen(conn Transport, c client) {
+	delay := reconnectDelay
+	for {
+		select {
+		case <-time.After(delay):
+		case <-m.closed:
+			return
+		}
+		if !m.current(conn, c) {
+			return
+		}
+		err := m.open(c)
+		if err == nil {
+			return
+		}
+		logrus.Error(c.logInfo("amqp channel reopen err: "), err)
+		if delay *= 2; delay > reconTime {
+			delay = reconTime
+		}
+	}
+}
+
+// Close closes connection and stops reconnect
+func (m *Connection) Close() error {
+	m.mu.Lock()
+	if m.state == StateClosed {
+		m.mu.Unlock()
+		return nil
+	}
+	conn := m.conn
+	listeners := m.setState(StateClosed)
+	close(m.closed)
+	m.mu.Unlock()
+	for _, cb := range listeners {
+		cb(StateClosed)
+	}
+	connectionsLock.Lock()
+	if connections[m.uri] == m {
+		delete(connections, m.uri)
+	}
+	connectionsLock.Unlock()
+	if conn != nil && !conn.IsClosed() {
+		return conn.Close()
+	}
+	return nil
+}
+
+// CloseConnections closes all shared connections
+func CloseConnections() {
+	connectionsLock.Lock()
+	list := make([]*Connection, 0, len(connections))
+	for _, m := range connections {
+		list = append(list, m)
+	}
+	connectionsLock.Unlock()
+	for _, m := range list {
+		if err := m.Close(); err != nil {
+			logrus.Error("[amqp] connection close err: ", err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package amqpconnector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Headers of message contracts
+const (
+	HeaderMessageType    = "x-message-type"
+	HeaderMessageVersion = "x-message-version"
+)
+
+// ContractUpdate message type of Update
+const ContractUpdate = "update"
+
+// ErrUnknownContract message type or version is not registered
+var ErrUnknownContract = errors.New("unknown message contract")
+
+// ContractError message does not match contract
+type ContractError struct {
+	Type    string
+	Version int
+	Errors  []string
+}
+
+func (e *ContractError) Error() string {
+	return fmt.Sprintf("message %s v%d does not match contract: %s", e.Type, e.Version, strings.Join(e.Errors, "; "))
+}
+
+// Contract registered message type version, validated by json schema or go struct
+type Contract struct {
+	Type    string
+	Version int
+	schema  *gojsonschema.Schema
+	goType  reflect.Type
+}
+
+// Validate checks json body by contract
+func (c *Contract) Validate(body []byte) error {
+	if c.schema != nil {
+		res, err := c.schema.Validate(gojsonschema.NewBytesLoader(body))
+		if err != nil {
+			return &ContractError{Type: c.Type, Version: c.Version, Errors: []string{err.Error()}}
+		}
+		if !res.Valid() {
+			errs := make([]string, len(res.Errors()))
+			for i, desc := range res.Errors() {
+				errs[i] = desc.String()
+			}
+			return &ContractError{Type: c.Type, Version: c.Version, Errors: errs}
+		}
+		return nil
+	}
+	// struct contract rejects unknown fields and mismatched types
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(reflect.New(c.goType).Interface()); err != nil {
+		return &ContractError{Type: c.Type, Version: c.Version, Errors: []string{err.Error()}}
+	}
+	return nil
+}
+
+// ContractRegistry registry of message contracts
+type ContractRegistry struct {
+	mu        sync.RWMutex
+	contracts map[string]map[int]*Contract
+	latest    map[string]int
+	// Strict rejects consumed messages without contract headers
+	Strict bool
+}
+
+// NewContractRegistry create empty contract registry
+func NewContractRegistry() *ContractRegistry {
+	return &ContractRegistry{
+		contracts: make(map[string]map[int]*Contract),
+		latest:    make(map[string]int),
+	}
+}
+
+// DefaultContracts registry of service message contracts
+var DefaultContracts = NewContractRegistry()
+
+// updateSchema json schema of Update v1, command and collection are required
+const updateSchema = `{
+	"type": "object",
+	"properties": {
+		"id": {"type": "string"},
+		"extId": {"type": "string"},
+		"cmd": {"type": "string", "minLength": 1},
+		"collection": {"type": "string", "minLength": 1},
+		"data": {"type": "string"},
+		"groups": {"type": ["array", "null"], "items": {"type": "string"}},
+		"extData": {},
+		"recipients": {"type": ["array", "null"], "items": {"type": "string"}},
+		"initiator": {"type": "string"}
+	},
+	"required": ["cmd", "collection"],
+	"additionalProperties": false
+}`
+
+func init() {
+	DefaultContracts.MustRegisterSchema(ContractUpdate, 1, []byte(updateSchema))
+}
+
+func (r *ContractRegistry) register(c *Contract) error {
+	if c.Type == "" || c.Version < 1 {
+		return errors.New("contract type and version greater than 0 are required")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions, ok := r.contracts[c.Type]
+	if !ok {
+		versions = make(map[int]*Contract)
+		r.contracts[c.Type] = versions
+	}
+	versions[c.Version] = c
+	if c.Version > r.latest[c.Type] {
+		r.latest[c.Type] = c.Version
+	}
+	return nil
+}
+
+// RegisterSchema registers message type version with json schema
+func (r *ContractRegistry) RegisterSchema(msgType string, version int, schema []byte) error {
+	s, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		return err
+	}
+	return r.register(&Contract{Type: msgType, Version: version, schema: s})
+}
+
+// MustRegisterSchema registers message type version with json schema, panics if schema is invalid
+func (r *ContractRegistry) MustRegisterSchema(msgType string, version int, schema []byte) {
+	if err := r.RegisterSchema(msgType, version, schema); err != nil {
+		panic("contract " + msgType + ": " + err.Error())
+	}
+}
+
+// RegisterStruct registers message type version with go struct sample
+func (r *ContractRegistry) RegisterStruct(msgType string, version int, sample interface{}) error {
+	t := reflect.TypeOf(sample)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return errors.New("contract sample must be struct")
+	}
+	return r.register(&Contract{Type: msgType, Version: version, goType: t})
+}
+
+// Contract returns contract of message type version, version 0 is latest
+func (r *ContractRegistry) Contract(msgType string, version int) (*Contract, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if version == 0 {
+		version = r.latest[msgType]
+	}
+	c, ok := r.contracts[msgType][version]
+	if !ok {
+		return nil, ErrUnknownContract
+	}
+	return c, nil
+}
+
+// Encode marshals payload and validates it by latest contract of message type,
+// returned headers contain message type and version
+func (r *ContractRegistry) Encode(msgType string, payload interface{}) ([]byte, amqp.Table, error) {
+	c, err := r.Contract(msgType, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = c.Validate(body); err != nil {
+		return nil, nil, err
+	}
+	return body, amqp.Table{HeaderMessageType: c.Type, HeaderMessageVersion: int32(c.Version)}, nil
+}
+
+// Publishing returns json publishing of payload validated by latest contract
+func (r *ContractRegistry) Publishing(msgType string, payload interface{}) (amqp.Publishing, error) {
+	body, headers, err := r.Encode(msgType, payload)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	return amqp.Publishing{Headers: headers, ContentType: "application/json", Type: msgType, Body: body}, nil
+}
+
+// ValidateDelivery checks delivery by contract of its headers,
+// deliveries without contract headers are valid unless registry is strict
+func (r *ContractRegistry) ValidateDelivery(d *Delivery) error {
+	msgType, _ := d.Headers[HeaderMessageType].(string)
+	if msgType == "" {
+		if r.Strict {
+			return ErrUnknownContract
+		}
+		return nil
+	}
+	version := 0
+	switch v := d.Headers[HeaderMessageVersion].(type) {
+	case int32:
+		version = int(v)
+	case int64:
+		version = int(v)
+	case int:
+		version = v
+	}
+	c, err := r.Contract(msgType, version)
+	if err != nil {
+		return err
+	}
+	return c.Validate(d.Body)
+}
+
+// Decode validates delivery and unmarshals its body
+func (r *ContractRegistry) Decode(d *Delivery, v interface{}) error {
+	if err := r.ValidateDelivery(d); err != nil {
+		return err
+	}
+	return json.Unmarshal(d.Body, v)
+}
+
+// Handler validates deliveries before handler, invalid deliveries are nacked
+func (r *ContractRegistry) Handler(handler ResultHandler) ResultHandler {
+	return func(d *Delivery) HandleResult {
+		if err := r.ValidateDelivery(d); err != nil {
+			logrus.Error("[contracts] invalid delivery ", d.RoutingKey, ": ", err)
+			return Nack
+		}
+		return handler(d)
+	}
+}
+
+// PublishContract publishes payload validated by latest contract of message type
+func (c *Consumer) PublishContract(msgType string, payload interface{}, routingKey string) error {
+	return c.PublishContractWithHeaders(msgType, payload, routingKey, nil)
+}
+
+// PublishContractWithHeaders publishes payload validated by latest contract of message type with extra headers
+func (c *Consumer) PublishContractWithHeaders(msgType string, payload interface{}, routingKey string, headers amqp.Table) error {
+	body, contractHeaders, err := DefaultContracts.Encode(msgType, payload)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		contractHeaders[k] = v
+	}
+	return c.PublishWithHeaders(body, routingKey, contractHeaders)
+}
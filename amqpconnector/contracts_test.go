@@ -0,0 +1,56 @@
+package amqpconnector
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestUpdateContract(t *testing.T) {
+	body, headers, err := DefaultContracts.Encode(ContractUpdate, Update{ID: "1", Cmd: "update", Collection: "users", Data: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers[HeaderMessageType] != ContractUpdate || headers[HeaderMessageVersion] != int32(1) {
+		t.Errorf("contract headers %v", headers)
+	}
+	d := &Delivery{Headers: headers, Body: body}
+	if err = DefaultContracts.ValidateDelivery(d); err != nil {
+		t.Errorf("valid update is rejected: %v", err)
+	}
+	if _, _, err = DefaultContracts.Encode(ContractUpdate, Update{ID: "1", Collection: "users"}); err == nil {
+		t.Error("update without cmd is encoded")
+	}
+	for _, body := range []string{
+		`{"cmd": "update"}`,
+		`{"cmd": "update", "collection": "users", "unknown": 1}`,
+		`{"cmd": "update", "collection": "users", "data": {}}`,
+	} {
+		d = &Delivery{Headers: amqp.Table{HeaderMessageType: ContractUpdate, HeaderMessageVersion: int32(1)}, Body: []byte(body)}
+		if err = DefaultContracts.ValidateDelivery(d); err == nil {
+			t.Errorf("invalid update %s is accepted", body)
+		}
+	}
+}
+
+func TestSendUpdateValidation(t *testing.T) {
+	// SendUpdate publisher is shared, so the uri of memory broker example is used
+	broker := GetMemoryBroker("updates-example")
+	defer broker.ClearPublished()
+	broker.ClearPublished()
+	if err := SendUpdate(memoryScheme+"updates-example", "users", "1", "", nil); err == nil {
+		t.Error("update with empty method is sent")
+	}
+	if err := SendUpdate(memoryScheme+"updates-example", "", "1", "update", nil); err == nil {
+		t.Error("update without collection is sent")
+	}
+	if published := broker.Published(); len(published) != 0 {
+		t.Errorf("invalid updates are published: %+v", published)
+	}
+	if err := SendUpdate(memoryScheme+"updates-example", "users", "1", "update", nil); err != nil {
+		t.Fatal(err)
+	}
+	if updates := broker.Updates(); len(updates) != 1 || updates[0].Cmd != "update" {
+		t.Errorf("updates %+v", updates)
+	}
+}
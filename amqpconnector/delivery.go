@@ -0,0 +1,379 @@
+package amqpconnector
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// HandleResult result of delivery handling
+type HandleResult int
+
+const (
+	// Ack delivery is processed
+	Ack HandleResult = iota
+	// Retry delivery is republished to delay queue and handled later,
+	// dead-lettered when attempts are exhausted
+	Retry
+	// Requeue delivery is returned to queue immediately
+	Requeue
+	// Nack delivery is rejected and dead-lettered
+	Nack
+)
+
+func (r HandleResult) String() string {
+	switch r {
+	case Ack:
+		return "ack"
+	case Retry:
+		return "retry"
+	case Requeue:
+		return "requeue"
+	case Nack:
+		return "nack"
+	}
+	return "unknown"
+}
+
+// Headers of retried and dead-lettered messages
+const (
+	HeaderAttempt     = "x-attempt"
+	HeaderError       = "x-error"
+	HeaderOriginalKey = "x-original-routing-key"
+	HeaderOriginalExc = "x-original-exchange"
+)
+
+// ResultHandler delivery handler which controls acknowledgement
+type ResultHandler func(*Delivery) HandleResult
+
+// RetryPolicy retry settings of queue
+type RetryPolicy struct {
+	MaxAttempts int // deliveries of message including first one, 0 is unlimited
+	// Delays delay before attempt n+1 is Delays[n-1], last delay is reused,
+	// DefaultRetryPolicy delays are used if empty, non-positive delays are replaced by default ones
+	Delays []time.Duration
+	// DeadLetter exchange for nacked and exhausted messages, nil rejects them without requeue
+	// so broker dead-lettering of queue args applies
+	DeadLetter      *Exchange
+	DeadLetterKey   string // routing key in dead letter exchange, original key if empty
+	DeadLetterQueue string // declared and bound to dead letter exchange by DeadLetterKey if set
+}
+
+// DefaultRetryPolicy default retry settings
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Delays:      []time.Duration{time.Second, 10 * time.Second, time.Minute},
+}
+
+// delays returns delays of policy, retry without delay would redeliver message in a loop
+func (p *RetryPolicy) delays() []time.Duration {
+	if len(p.Delays) == 0 {
+		return DefaultRetryPolicy.Delays
+	}
+	res := make([]time.Duration, len(p.Delays))
+	for i, delay := range p.Delays {
+		if delay <= 0 {
+			defaults := DefaultRetryPolicy.Delays
+			if i < len(defaults) {
+				delay = defaults[i]
+			} else {
+				delay = defaults[len(defaults)-1]
+			}
+		}
+		res[i] = delay
+	}
+	return res
+}
+
+// delay returns delay before next attempt
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	delays := p.delays()
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt > len(delays) {
+		attempt = len(delays)
+	}
+	return delays[attempt-1]
+}
+
+// retryQueueName name of delay queue for delay
+func retryQueueName(queue string, delay time.Duration) string {
+	return queue + ".retry." + strconv.FormatInt(int64(delay/time.Millisecond), 10)
+}
+
+// Attempt returns delivery attempt number starting from 1
+func (d *Delivery) Attempt() int {
+	switch v := d.Headers[HeaderAttempt].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int8:
+		return int(v)
+	}
+	return 1
+}
+
+// RetryDeclare declares delay queues and dead letter exchange of queue retry policy
+func (c *Consumer) RetryDeclare() error {
+	if c.queue == nil || c.queue.Retry == nil {
+		return nil
+	}
+	policy := c.queue.Retry
+	delays := policy.delays()
+	declared := make(map[time.Duration]bool, len(delays))
+	for _, delay := range delays {
+		if declared[delay] {
+			continue
+		}
+		declared[delay] = true
+		name := retryQueueName(c.queue.Name, delay)
+		logrus.Info(c.logInfo("amqp declare retry queue: "), name)
+		// expired messages are routed back to queue by default exchange
+		_, err := c.getChannel().QueueDeclare(name, c.queue.Durable, false, false, false, amqp.Table{
+			"x-message-ttl":             int64(delay / time.Millisecond),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": c.queue.Name,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if dlx := policy.DeadLetter; dlx != nil {
+		logrus.Info(c.logInfo("amqp declaring dead letter exchange: "), dlx.Name)
+		if err := c.getChannel().ExchangeDeclare(dlx.Name, dlx.Type, dlx.Durable, dlx.AutoDelete, dlx.Internal, dlx.NoWait, dlx.Args); err != nil {
+			return err
+		}
+		if policy.DeadLetterQueue != "" {
+			if _, err := c.getChannel().QueueDeclare(policy.DeadLetterQueue, true, false, false, false, nil); err != nil {
+				return err
+			}
+			if err := c.getChannel().QueueBind(policy.DeadLetterQueue, policy.DeadLetterKey, dlx.Name, false, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deliveryPublishing copies delivery to publishing with headers copy,
+// original routing key and exchange are kept in headers through retries
+func deliveryPublishing(d *Delivery) amqp.Publishing {
+	headers := make(amqp.Table, len(d.Headers)+4)
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	if _, ok := headers[HeaderOriginalKey]; !ok {
+		headers[HeaderOriginalKey] = d.RoutingKey
+		headers[HeaderOriginalExc] = d.Exchange
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// callHandler calls handler and converts panic to nack
+func (c *Consumer) callHandler(handler ResultHandler, d *Delivery) (result HandleResult, reason string) {
+	defer func() {
+		if r := recover(); r != nil {
+			reason = fmt.Sprint(r)
+			logrus.Error(c.logInfo("delivery handler panic: "), r, "\n", string(debug.Stack()))
+			result = Nack
+		}
+	}()
+	return handler(d), ""
+}
+
+// handleDelivery runs handlers and acknowledges delivery by the most severe result
+func (c *Consumer) handleDelivery(d amqp.Delivery) {
+	dv := Delivery(d)
+	result, reason := Ack, ""
+	if c.filtered(&dv) {
+		if c.queue.NoAck {
+			return
+		}
+		if err := d.Ack(false); err != nil {
+			logrus.Error(c.logInfo("delivery acknowledge err: "), err)
+		}
+		return
+	}
+	for i := 0; i < len(c.handlers); i++ {
+		cb := c.handlers[i]
+		res, err := c.callHandler(func(d *Delivery) HandleResult {
+			cb(d)
+			return Ack
+		}, &dv)
+		if res > result {
+			result, reason = res, err
+		}
+	}
+	for i := 0; i < len(c.resultHandlers); i++ {
+		res, err := c.callHandler(c.resultHandlers[i], &dv)
+		if res > result {
+			result, reason = res, err
+		}
+	}
+	if c.queue != nil && c.queue.NoAck {
+		if result != Ack {
+			logrus.Warn(c.logInfo("delivery result is ignored for noAck queue: "), result)
+		}
+		return
+	}
+	if err := c.acknowledge(&d, result, reason); err != nil {
+		logrus.Error(c.logInfo("delivery acknowledge err: "), err)
+	}
+}
+
+// acknowledge applies handle result to delivery
+func (c *Consumer) acknowledge(d *amqp.Delivery, result HandleResult, reason string) error {
+	var policy *RetryPolicy
+	if c.queue != nil {
+		policy = c.queue.Retry
+	}
+	switch result {
+	case Ack:
+		return d.Ack(false)
+	case Requeue:
+		return d.Nack(false, true)
+	case Retry:
+		if policy == nil {
+			logrus.Warn(c.logInfo("queue has no retry policy, delivery is requeued"))
+			return d.Nack(false, true)
+		}
+		attempt := (*Delivery)(d).Attempt()
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			logrus.Warn(c.logInfo("delivery attempts are exhausted: "), attempt)
+			return c.deadLetter(d, policy, "attempts are exhausted")
+		}
+		msg := deliveryPublishing((*Delivery)(d))
+		msg.Headers[HeaderAttempt] = int32(attempt + 1)
+		key := retryQueueName(c.queue.Name, policy.delay(attempt))
+		if err := c.republish("", key, msg); err != nil {
+			// message is kept in queue by broker
+			d.Nack(false, true)
+			return err
+		}
+		return d.Ack(false)
+	}
+	return c.deadLetter(d, policy, reason)
+}
+
+// deadLetter publishes delivery to dead letter exchange or rejects it without requeue
+func (c *Consumer) deadLetter(d *amqp.Delivery, policy *RetryPolicy, reason string) error {
+	if policy == nil || policy.DeadLetter == nil {
+		return d.Nack(false, false)
+	}
+	msg := deliveryPublishing((*Delivery)(d))
+	if reason != "" {
+		msg.Headers[HeaderError] = reason
+	}
+	key := policy.DeadLetterKey
+	if key == "" {
+		key, _ = msg.Headers[HeaderOriginalKey].(string)
+	}
+	if err := c.republish(policy.DeadLetter.Name, key, msg); err != nil {
+		d.Nack(false, true)
+		return err
+	}
+	return d.Ack(false)
+}
+
+// confirmChannel channel in confirm mode for republish of deliveries,
+// publishes are serialized so every publish waits for its own confirm
+type confirmChannel struct {
+	mu       sync.Mutex
+	channel  Channel
+	confirms chan amqp.Confirmation
+}
+
+// close closes channel after error or shutdown
+func (cc *confirmChannel) close() {
+	if cc.channel != nil {
+		cc.channel.Close()
+	}
+	cc.channel, cc.confirms = nil, nil
+}
+
+// republish publishes message on confirm channel of consumer connection and waits for broker ack,
+// delivery is acknowledged only after its copy is confirmed
+func (c *Consumer) republish(exchange, key string, msg amqp.Publishing) error {
+	cc := &c.republisher
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.channel == nil {
+		if c.connection == nil {
+			return amqp.ErrClosed
+		}
+		channel, err := c.connection.Channel()
+		if err != nil {
+			return err
+		}
+		if err = channel.Confirm(false); err != nil {
+			channel.Close()
+			return err
+		}
+		cc.channel = channel
+		cc.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+	if err := cc.channel.Publish(exchange, key, false, false, msg); err != nil {
+		cc.close()
+		return err
+	}
+	timer := time.NewTimer(DefaultPublisherConfig.ConfirmTimeout)
+	defer timer.Stop()
+	select {
+	case confirm, ok := <-cc.confirms:
+		if !ok {
+			cc.close()
+			return amqp.ErrClosed
+		}
+		if !confirm.Ack {
+			return ErrPublishNack
+		}
+		return nil
+	case <-timer.C:
+		// late confirm would be taken by next publish
+		cc.close()
+		return ErrPublishTimeout
+	}
+}
+
+// NewResultConsumer create consumer with handlers which control acknowledgement
+func NewResultConsumer(amqpURI, name string, exchange *Exchange, queue *Queue, handlers ...ResultHandler) (*Consumer, error) {
+	c := &Consumer{
+		exchange:       exchange,
+		queue:          queue,
+		uri:            amqpURI,
+		name:           name,
+		resultHandlers: handlers,
+	}
+	err := c.connect()
+	return c, err
+}
+
+// AddResultHandler add handler which controls acknowledgement
+func (c *Consumer) AddResultHandler(handler ResultHandler) {
+	c.resultHandlers = append(c.resultHandlers, handler)
+}
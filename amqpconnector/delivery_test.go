@@ -0,0 +1,80 @@
+package amqpconnector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// waitFor polls condition until it is true or timeout
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+func TestRetryDefaultDelays(t *testing.T) {
+	if d := (&RetryPolicy{}).delay(1); d != DefaultRetryPolicy.Delays[0] {
+		t.Errorf("delay of empty policy %v, want %v", d, DefaultRetryPolicy.Delays[0])
+	}
+	policy := RetryPolicy{Delays: []time.Duration{0, 5 * time.Second}}
+	if d := policy.delay(1); d != DefaultRetryPolicy.Delays[0] {
+		t.Errorf("zero delay is replaced by %v, want %v", d, DefaultRetryPolicy.Delays[0])
+	}
+	if d := policy.delay(7); d != 5*time.Second {
+		t.Errorf("last delay %v, want 5s", d)
+	}
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	broker, uri, channel := testBroker(t)
+	queue := &Queue{Name: "jobs", Durable: true, Keys: []string{"job"}, Retry: &RetryPolicy{
+		MaxAttempts:     3,
+		DeadLetter:      &Exchange{Name: "jobs.dlx", Type: "direct", Durable: true},
+		DeadLetterKey:   "dead",
+		DeadLetterQueue: "jobs.dead",
+	}}
+	c, err := NewResultConsumer(uri, "jobs", &Exchange{Name: "jobs", Type: "direct", Durable: true}, queue, func(d *Delivery) HandleResult {
+		if string(d.Body) == "bad" {
+			return Nack
+		}
+		if d.Attempt() == 1 {
+			return Retry
+		}
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	for _, body := range []string{"retry", "bad"} {
+		if err = channel.Publish("jobs", "job", false, false, amqp.Publishing{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	retryQueue := retryQueueName("jobs", DefaultRetryPolicy.Delays[0])
+	ok := waitFor(t, 500*time.Millisecond, func() bool {
+		retried, _ := broker.QueueLen(retryQueue)
+		dead, _ := broker.QueueLen("jobs.dead")
+		ready, unacked := broker.QueueLen("jobs")
+		return retried == 1 && dead == 1 && ready == 0 && unacked == 0
+	})
+	if !ok {
+		t.Fatal("deliveries are not republished and acked")
+	}
+	retried := broker.QueueMessages(retryQueue)[0]
+	if v, _ := retried.Headers[HeaderAttempt].(int32); v != 2 {
+		t.Errorf("retried attempt header %#v, want 2", retried.Headers[HeaderAttempt])
+	}
+	dead := broker.QueueMessages("jobs.dead")[0]
+	if string(dead.Body) != "bad" || dead.Headers[HeaderOriginalKey] != "job" {
+		t.Errorf("dead letter %s headers %v", dead.Body, dead.Headers)
+	}
+}
@@ -0,0 +1,178 @@
+package amqpconnector
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	strUtil "gitlab.com/battler/modules/strings"
+)
+
+// Standard headers set on every publish
+const (
+	HeaderTraceID   = "x-trace-id"
+	HeaderInitiator = "x-initiator"
+)
+
+// Match modes of headers binding
+const (
+	MatchAll = "all"
+	MatchAny = "any"
+)
+
+// HeadersBinding binding of queue to headers exchange
+type HeadersBinding struct {
+	Match   string                 // MatchAll or MatchAny, MatchAll if empty
+	Headers map[string]interface{} // nil value matches any value of header
+}
+
+// args returns binding arguments with x-match
+func (b *HeadersBinding) args() amqp.Table {
+	args := make(amqp.Table, len(b.Headers)+1)
+	for k, v := range b.Headers {
+		args[k] = v
+	}
+	args["x-match"] = MatchAll
+	if b.Match != "" {
+		args["x-match"] = b.Match
+	}
+	return args
+}
+
+// Matches checks headers by binding as headers exchange does
+func (b *HeadersBinding) Matches(headers amqp.Table) bool {
+	return headersMatch(b.args(), headers)
+}
+
+// headerValue normalizes numbers of header value for comparison
+func headerValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case int:
+		return int64(val)
+	case int8:
+		return int64(val)
+	case int16:
+		return int64(val)
+	case int32:
+		return int64(val)
+	case uint8:
+		return int64(val)
+	case float32:
+		return float64(val)
+	}
+	return v
+}
+
+// headersMatch matches headers by binding args with x-match all or any
+func headersMatch(args, headers amqp.Table) bool {
+	mode, _ := args["x-match"].(string)
+	any := strings.HasPrefix(mode, MatchAny)
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		hv, ok := headers[k]
+		matched := ok && (v == nil || reflect.DeepEqual(headerValue(hv), headerValue(v)))
+		if any && matched {
+			return true
+		}
+		if !any && !matched {
+			return false
+		}
+	}
+	return !any
+}
+
+// BindHeaders binds queue to headers exchange by header set
+func (c *Consumer) BindHeaders(binding HeadersBinding) error {
+	if c.queue == nil || c.exchange == nil {
+		return ErrNilConsumer
+	}
+	if err := c.getChannel().QueueBind(c.queue.Name, "", c.exchange.Name, c.queue.NoWait, binding.args()); err != nil {
+		return err
+	}
+	logrus.Info(c.logInfo("amqp bind headers: "), binding.Headers, " match: ", binding.args()["x-match"], " to queue: ", c.queue.Name)
+	return nil
+}
+
+// bindHeaders binds header sets of queue, called on every channel setup
+func (c *Consumer) bindHeaders() error {
+	for i := range c.queue.Headers {
+		if err := c.BindHeaders(c.queue.Headers[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filtered checks if delivery is skipped by header filter of queue
+func (c *Consumer) filtered(d *Delivery) bool {
+	return c.queue != nil && c.queue.HeaderFilter != nil && !c.queue.HeaderFilter.Matches(d.Headers)
+}
+
+type traceKey struct{}
+
+// WithTraceID returns context with trace id for publishes of context
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceID)
+}
+
+// TraceID returns trace id of context
+func TraceID(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceKey{}).(string)
+	return traceID
+}
+
+// TraceID returns trace id header of delivery
+func (d *Delivery) TraceID() string {
+	traceID, _ := d.Headers[HeaderTraceID].(string)
+	return traceID
+}
+
+// Initiator returns initiator header of delivery
+func (d *Delivery) Initiator() string {
+	initiator, _ := d.Headers[HeaderInitiator].(string)
+	return initiator
+}
+
+// Context returns context with trace id of delivery
+func (d *Delivery) Context() context.Context {
+	return WithTraceID(context.Background(), d.TraceID())
+}
+
+// TraceHeaders returns trace id and initiator headers of delivery to pass them to next publishes
+func (d *Delivery) TraceHeaders() amqp.Table {
+	headers := amqp.Table{}
+	if traceID := d.TraceID(); traceID != "" {
+		headers[HeaderTraceID] = traceID
+	}
+	if initiator := d.Initiator(); initiator != "" {
+		headers[HeaderInitiator] = initiator
+	}
+	return headers
+}
+
+// stampPublishing sets message id, timestamp and trace id of publishing if they are not set,
+// trace id is taken from context or generated, headers are copied
+func stampPublishing(ctx context.Context, msg *amqp.Publishing) {
+	headers := make(amqp.Table, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	msg.Headers = headers
+	if msg.MessageId == "" {
+		msg.MessageId = *strUtil.NewId()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	if traceID, _ := headers[HeaderTraceID].(string); traceID == "" {
+		if traceID = TraceID(ctx); traceID == "" {
+			traceID = msg.MessageId
+		}
+		headers[HeaderTraceID] = traceID
+	}
+}
@@ -0,0 +1,997 @@
+package amqpconnector
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// memoryScheme uri scheme of in-process broker
+const memoryScheme = "memory://"
+
+var (
+	memoryBrokers     = make(map[string]*MemoryBroker)
+	memoryBrokersLock sync.Mutex
+)
+
+// PublishedMessage message published to memory broker by client
+type PublishedMessage struct {
+	Exchange   string
+	RoutingKey string
+	Publishing amqp.Publishing
+	Queues     []string // queues message is routed to
+}
+
+// MemoryBroker in-process broker for tests, supports direct, topic, fanout and headers exchanges,
+// acks, redelivery, prefetch, confirms, message ttl and dead-lettering
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	conns     map[*memConnection]bool
+	published []PublishedMessage
+	seq       uint64
+}
+
+// GetMemoryBroker returns in-process broker of name, memory://name uri connects to it
+func GetMemoryBroker(name string) *MemoryBroker {
+	memoryBrokersLock.Lock()
+	defer memoryBrokersLock.Unlock()
+	b, ok := memoryBrokers[name]
+	if !ok {
+		b = NewMemoryBroker()
+		memoryBrokers[name] = b
+	}
+	return b
+}
+
+// NewMemoryBroker create in-process broker with predeclared amq exchanges
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: make(map[string]*memExchange),
+		queues:    make(map[string]*memQueue),
+		conns:     make(map[*memConnection]bool),
+	}
+	for _, kind := range []string{"direct", "fanout", "topic", "headers"} {
+		name := "amq." + kind
+		b.exchanges[name] = &memExchange{name: name, kind: kind, durable: true}
+	}
+	return b
+}
+
+// Connect opens connection to broker
+func (b *MemoryBroker) Connect() Transport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn := &memConnection{broker: b, channels: make(map[*memChannel]bool)}
+	b.conns[conn] = true
+	return conn
+}
+
+// Disconnect closes all connections with error as if broker was restarted,
+// durable exchanges and queues with their messages are kept
+func (b *MemoryBroker) Disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		conn.close(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker forced connection closure", Server: true})
+	}
+	for name, q := range b.queues {
+		if !q.durable {
+			delete(b.queues, name)
+		}
+	}
+	for name, e := range b.exchanges {
+		if !e.durable {
+			delete(b.exchanges, name)
+		}
+	}
+}
+
+// Published returns messages published by clients
+func (b *MemoryBroker) Published() []PublishedMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]PublishedMessage(nil), b.published...)
+}
+
+// Updates returns Update messages published by SendUpdate
+func (b *MemoryBroker) Updates() []Update {
+	var res []Update
+	for _, pub := range b.Published() {
+		if pub.Exchange != updatesExchange() {
+			continue
+		}
+		var update Update
+		if err := json.Unmarshal(pub.Publishing.Body, &update); err == nil {
+			res = append(res, update)
+		}
+	}
+	return res
+}
+
+// ClearPublished clears list of published messages
+func (b *MemoryBroker) ClearPublished() {
+	b.mu.Lock()
+	b.published = nil
+	b.mu.Unlock()
+}
+
+// QueueLen returns count of ready and unacknowledged messages of queue
+func (b *MemoryBroker) QueueLen(name string) (ready, unacked int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, 0
+	}
+	for conn := range b.conns {
+		for ch := range conn.channels {
+			for _, u := range ch.unacked {
+				if u.queue == q {
+					unacked++
+				}
+			}
+		}
+	}
+	return len(q.messages), unacked
+}
+
+// QueueMessages returns ready messages of queue
+func (b *MemoryBroker) QueueMessages(name string) []amqp.Publishing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return nil
+	}
+	res := make([]amqp.Publishing, len(q.messages))
+	for i, m := range q.messages {
+		res[i] = m.msg
+	}
+	return res
+}
+
+// memFIFO runs functions in order on own goroutine, used to send to client channels without broker lock
+type memFIFO struct {
+	mu      sync.Mutex
+	items   []func()
+	signal  chan struct{}
+	stopped bool
+}
+
+func newMemFIFO() *memFIFO {
+	f := &memFIFO{signal: make(chan struct{}, 1)}
+	go f.run()
+	return f
+}
+
+func (f *memFIFO) push(fn func()) {
+	f.mu.Lock()
+	f.items = append(f.items, fn)
+	f.mu.Unlock()
+	select {
+	case f.signal <- struct{}{}:
+	default:
+	}
+}
+
+// stop finishes goroutine after pushed functions
+func (f *memFIFO) stop() {
+	f.push(func() { f.stopped = true })
+}
+
+func (f *memFIFO) run() {
+	for range f.signal {
+		for {
+			f.mu.Lock()
+			if len(f.items) == 0 {
+				f.mu.Unlock()
+				break
+			}
+			fn := f.items[0]
+			f.items[0] = nil
+			f.items = f.items[1:]
+			f.mu.Unlock()
+			fn()
+		}
+		if f.stopped {
+			return
+		}
+	}
+}
+
+type memBinding struct {
+	queue    string
+	exchange string
+	key      string
+	args     amqp.Table
+}
+
+type memExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	bindings   []*memBinding
+}
+
+// match checks binding by exchange type
+func (e *memExchange) match(bd *memBinding, key string, headers amqp.Table) bool {
+	switch e.kind {
+	case "fanout":
+		return true
+	case "topic":
+		return topicMatch(strings.Split(bd.key, "."), strings.Split(key, "."))
+	case "headers":
+		return headersMatch(bd.args, headers)
+	}
+	return bd.key == key
+}
+
+// topicMatch matches routing key words by pattern words with * and # wildcards
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+}
+
+type memMessage struct {
+	exchange    string
+	key         string
+	msg         amqp.Publishing
+	redelivered bool
+	expires     time.Time
+}
+
+type memQueue struct {
+	name         string
+	durable      bool
+	autoDelete   bool
+	exclusive    bool
+	owner        *memConnection
+	args         amqp.Table
+	messages     []*memMessage
+	consumers    []*memConsumer
+	next         int
+	hadConsumers bool
+}
+
+// argInt returns integer queue arg
+func (q *memQueue) argInt(key string) (int64, bool) {
+	switch v := headerValue(q.args[key]).(type) {
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// nextConsumer returns consumer with free prefetch by round robin
+func (q *memQueue) nextConsumer() *memConsumer {
+	for i := 0; i < len(q.consumers); i++ {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		if c.noAck || c.channel.prefetch == 0 || c.unacked < c.channel.prefetch {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
+
+type memConsumer struct {
+	tag     string
+	queue   *memQueue
+	channel *memChannel
+	noAck   bool
+	unacked int
+	out     chan amqp.Delivery
+	fifo    *memFIFO
+}
+
+type memUnacked struct {
+	message  *memMessage
+	queue    *memQueue
+	consumer *memConsumer
+}
+
+// memConnection connection to memory broker
+type memConnection struct {
+	broker   *MemoryBroker
+	channels map[*memChannel]bool
+	closes   []chan *amqp.Error
+	closed   bool
+}
+
+// Channel opens channel
+func (conn *memConnection) Channel() (Channel, error) {
+	b := conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if conn.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memChannel{
+		conn:      conn,
+		broker:    b,
+		consumers: make(map[string]*memConsumer),
+		unacked:   make(map[uint64]*memUnacked),
+		notify:    newMemFIFO(),
+	}
+	conn.channels[ch] = true
+	return ch, nil
+}
+
+// NotifyClose registers listener of connection close
+func (conn *memConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if conn.closed {
+		close(receiver)
+	} else {
+		conn.closes = append(conn.closes, receiver)
+	}
+	return receiver
+}
+
+// IsClosed checks if connection is closed
+func (conn *memConnection) IsClosed() bool {
+	conn.broker.mu.Lock()
+	defer conn.broker.mu.Unlock()
+	return conn.closed
+}
+
+// Close closes connection
+func (conn *memConnection) Close() error {
+	conn.broker.mu.Lock()
+	defer conn.broker.mu.Unlock()
+	if conn.closed {
+		return amqp.ErrClosed
+	}
+	conn.close(nil)
+	return nil
+}
+
+// close closes channels and exclusive queues, must be called with lock
+func (conn *memConnection) close(err *amqp.Error) {
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	b := conn.broker
+	for ch := range conn.channels {
+		ch.close(err)
+	}
+	for name, q := range b.queues {
+		if q.owner == conn {
+			delete(b.queues, name)
+		}
+	}
+	delete(b.conns, conn)
+	closes := conn.closes
+	conn.closes = nil
+	// listeners are notified outside of broker lock
+	go func() {
+		for _, c := range closes {
+			if err != nil {
+				c <- err
+			}
+			close(c)
+		}
+	}()
+}
+
+// memChannel channel of memory broker, implements amqp.Acknowledger for its deliveries
+type memChannel struct {
+	conn       *memConnection
+	broker     *MemoryBroker
+	consumers  map[string]*memConsumer
+	unacked    map[uint64]*memUnacked
+	tagSeq     uint64
+	prefetch   int
+	confirm    bool
+	publishSeq uint64
+	confirms   []chan amqp.Confirmation
+	returns    []chan amqp.Return
+	closes     []chan *amqp.Error
+	notify     *memFIFO
+	replyTo    string
+	closed     bool
+}
+
+// fail closes channel with error as broker does on protocol errors, must be called with lock
+func (ch *memChannel) fail(code int, reason string) error {
+	err := &amqp.Error{Code: code, Reason: reason, Server: true}
+	ch.close(err)
+	return err
+}
+
+// close cancels consumers, requeues unacknowledged messages and notifies listeners,
+// must be called with lock
+func (ch *memChannel) close(err *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	b := ch.broker
+	delete(ch.conn.channels, ch)
+	for _, c := range ch.consumers {
+		b.cancel(c)
+	}
+	ch.requeue(ch.takeUnacked(0, true), true)
+	closes, confirms, returns := ch.closes, ch.confirms, ch.returns
+	ch.notify.push(func() {
+		for _, c := range closes {
+			if err != nil {
+				c <- err
+			}
+			close(c)
+		}
+		for _, c := range confirms {
+			close(c)
+		}
+		for _, c := range returns {
+			close(c)
+		}
+	})
+	ch.notify.stop()
+}
+
+// takeUnacked removes unacknowledged deliveries by tag, tag 0 with multiple takes all
+func (ch *memChannel) takeUnacked(tag uint64, multiple bool) []*memUnacked {
+	var tags []uint64
+	if multiple {
+		for t := range ch.unacked {
+			if tag == 0 || t <= tag {
+				tags = append(tags, t)
+			}
+		}
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = append(tags, tag)
+	}
+	// requeue keeps original order
+	for i := 1; i < len(tags); i++ {
+		for j := i; j > 0 && tags[j] < tags[j-1]; j-- {
+			tags[j], tags[j-1] = tags[j-1], tags[j]
+		}
+	}
+	res := make([]*memUnacked, len(tags))
+	for i, t := range tags {
+		u := ch.unacked[t]
+		delete(ch.unacked, t)
+		u.consumer.unacked--
+		res[i] = u
+	}
+	return res
+}
+
+// requeue returns messages to queue heads or dead-letters them
+func (ch *memChannel) requeue(list []*memUnacked, requeue bool) {
+	b := ch.broker
+	touched := make(map[*memQueue]bool)
+	for i := len(list) - 1; i >= 0; i-- {
+		u := list[i]
+		if _, ok := b.queues[u.queue.name]; !ok || b.queues[u.queue.name] != u.queue {
+			continue
+		}
+		if requeue {
+			u.message.redelivered = true
+			u.queue.messages = append([]*memMessage{u.message}, u.queue.messages...)
+		} else {
+			b.deadLetter(u.queue, u.message, "rejected")
+		}
+		touched[u.queue] = true
+	}
+	for _, c := range ch.consumers {
+		touched[c.queue] = true
+	}
+	for q := range touched {
+		b.pump(q)
+	}
+}
+
+// Ack acknowledges delivery
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	list := ch.takeUnacked(tag, multiple)
+	if len(list) == 0 {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - unknown delivery tag "+strconv.FormatUint(tag, 10))
+	}
+	touched := make(map[*memQueue]bool)
+	for _, u := range list {
+		touched[u.queue] = true
+	}
+	for q := range touched {
+		b.pump(q)
+	}
+	return nil
+}
+
+// Nack rejects deliveries
+func (ch *memChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	list := ch.takeUnacked(tag, multiple)
+	if len(list) == 0 {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - unknown delivery tag "+strconv.FormatUint(tag, 10))
+	}
+	ch.requeue(list, requeue)
+	return nil
+}
+
+// Reject rejects delivery
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// ExchangeDeclare declares exchange
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	switch kind {
+	case "direct", "fanout", "topic", "headers":
+	default:
+		return ch.fail(amqp.CommandInvalid, "COMMAND_INVALID - unknown exchange type '"+kind+"'")
+	}
+	if e, ok := b.exchanges[name]; ok {
+		if e.kind != kind || e.durable != durable || e.autoDelete != autoDelete || e.internal != internal {
+			return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for exchange '"+name+"'")
+		}
+		return nil
+	}
+	if name == "" || strings.HasPrefix(name, "amq.") {
+		return ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - exchange name '"+name+"' contains reserved prefix 'amq.*'")
+	}
+	b.exchanges[name] = &memExchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete, internal: internal}
+	return nil
+}
+
+// bind adds binding to exchange
+func (ch *memChannel) bind(source string, bd *memBinding) error {
+	b := ch.broker
+	if source == "" {
+		return ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange")
+	}
+	e, ok := b.exchanges[source]
+	if !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '"+source+"' in vhost '/'")
+	}
+	for _, old := range e.bindings {
+		if old.queue == bd.queue && old.exchange == bd.exchange && old.key == bd.key && reflect.DeepEqual(old.args, bd.args) {
+			return nil
+		}
+	}
+	e.bindings = append(e.bindings, bd)
+	return nil
+}
+
+// ExchangeBind binds destination exchange to source exchange
+func (ch *memChannel) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[destination]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '"+destination+"' in vhost '/'")
+	}
+	return ch.bind(source, &memBinding{exchange: destination, key: key, args: args})
+}
+
+// QueueDeclare declares queue, empty name generates queue name
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '"+name+"'")
+		}
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive || !reflect.DeepEqual(table(q.args), table(args)) {
+			return amqp.Queue{}, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for queue '"+name+"'")
+		}
+		return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+	}
+	if name == "" {
+		b.seq++
+		name = "amq.gen-" + strconv.FormatUint(b.seq, 10)
+	} else if strings.HasPrefix(name, "amq.") {
+		return amqp.Queue{}, ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - queue name '"+name+"' contains reserved prefix 'amq.*'")
+	}
+	q := &memQueue{name: name, durable: durable, autoDelete: autoDelete, exclusive: exclusive, args: args}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+	return amqp.Queue{Name: name}, nil
+}
+
+// QueueBind binds queue to exchange
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.queues[name]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no queue '"+name+"' in vhost '/'")
+	}
+	return ch.bind(exchange, &memBinding{queue: name, key: key, args: args})
+}
+
+// Qos sets prefetch count of consumers
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	for _, c := range ch.consumers {
+		b.pump(c.queue)
+	}
+	return nil
+}
+
+// Consume starts consumer, amq.rabbitmq.reply-to consumes direct replies of channel
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	if queue == directReplyQueue {
+		if !autoAck {
+			return nil, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer cannot acknowledge")
+		}
+		if ch.replyTo == "" {
+			b.seq++
+			ch.replyTo = directReplyQueue + ".g" + strconv.FormatUint(b.seq, 10)
+			b.queues[ch.replyTo] = &memQueue{name: ch.replyTo, exclusive: true, autoDelete: true, owner: ch.conn}
+		}
+		queue = ch.replyTo
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '"+queue+"' in vhost '/'")
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '"+queue+"'")
+	}
+	if consumer == "" {
+		b.seq++
+		consumer = "ctag-memory-" + strconv.FormatUint(b.seq, 10)
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, ch.fail(amqp.NotAllowed, "NOT_ALLOWED - attempt to reuse consumer tag '"+consumer+"'")
+	}
+	c := &memConsumer{tag: consumer, queue: q, channel: ch, noAck: autoAck, out: make(chan amqp.Delivery), fifo: newMemFIFO()}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	q.hadConsumers = true
+	b.pump(q)
+	return c.out, nil
+}
+
+// Cancel stops consumer, deliveries channel is closed after sent deliveries
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if c, ok := ch.consumers[consumer]; ok {
+		b.cancel(c)
+	}
+	return nil
+}
+
+// Publish routes message to queues
+func (ch *memChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[exchange]; !ok && exchange != "" {
+		// broker closes channel asynchronously, publish itself succeeds
+		ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '"+exchange+"' in vhost '/'")
+		return nil
+	}
+	if msg.ReplyTo == directReplyQueue {
+		msg.ReplyTo = ch.replyTo
+	}
+	msg.Body = append([]byte(nil), msg.Body...)
+	if msg.Headers != nil {
+		headers := make(amqp.Table, len(msg.Headers))
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		msg.Headers = headers
+	}
+	queues := b.enqueue(exchange, key, msg)
+	pub := PublishedMessage{Exchange: exchange, RoutingKey: key, Publishing: msg}
+	for _, q := range queues {
+		pub.Queues = append(pub.Queues, q.name)
+	}
+	b.published = append(b.published, pub)
+	if len(queues) == 0 && mandatory {
+		ret := amqp.Return{
+			ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE", Exchange: exchange, RoutingKey: key,
+			ContentType: msg.ContentType, ContentEncoding: msg.ContentEncoding, Headers: msg.Headers,
+			DeliveryMode: msg.DeliveryMode, Priority: msg.Priority, CorrelationId: msg.CorrelationId,
+			ReplyTo: msg.ReplyTo, Expiration: msg.Expiration, MessageId: msg.MessageId, Timestamp: msg.Timestamp,
+			Type: msg.Type, UserId: msg.UserId, AppId: msg.AppId, Body: msg.Body,
+		}
+		returns := ch.returns
+		ch.notify.push(func() {
+			for _, c := range returns {
+				c <- ret
+			}
+		})
+	}
+	if ch.confirm {
+		ch.publishSeq++
+		confirmation := amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: true}
+		confirms := ch.confirms
+		ch.notify.push(func() {
+			for _, c := range confirms {
+				c <- confirmation
+			}
+		})
+	}
+	return nil
+}
+
+// Confirm puts channel to confirm mode
+func (ch *memChannel) Confirm(noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirm = true
+	return nil
+}
+
+// NotifyPublish registers listener of publish confirms
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(confirm)
+	} else {
+		ch.confirms = append(ch.confirms, confirm)
+	}
+	return confirm
+}
+
+// NotifyReturn registers listener of returned mandatory messages
+func (ch *memChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(returns)
+	} else {
+		ch.returns = append(ch.returns, returns)
+	}
+	return returns
+}
+
+// NotifyClose registers listener of channel close
+func (ch *memChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(receiver)
+	} else {
+		ch.closes = append(ch.closes, receiver)
+	}
+	return receiver
+}
+
+// Close closes channel
+func (ch *memChannel) Close() error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.close(nil)
+	return nil
+}
+
+// cancel removes consumer, must be called with lock
+func (b *MemoryBroker) cancel(c *memConsumer) {
+	q := c.queue
+	delete(c.channel.consumers, c.tag)
+	for i, qc := range q.consumers {
+		if qc == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	out := c.out
+	c.fifo.push(func() { close(out) })
+	c.fifo.stop()
+	if q.autoDelete && q.hadConsumers && len(q.consumers) == 0 && b.queues[q.name] == q {
+		delete(b.queues, q.name)
+	}
+}
+
+// route finds queues of exchange and routing key
+func (b *MemoryBroker) route(exchange, key string, headers amqp.Table, visited map[string]bool, res map[*memQueue]bool) {
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			res[q] = true
+		}
+		return
+	}
+	e, ok := b.exchanges[exchange]
+	if !ok || visited[exchange] {
+		return
+	}
+	visited[exchange] = true
+	for _, bd := range e.bindings {
+		if !e.match(bd, key, headers) {
+			continue
+		}
+		if bd.queue != "" {
+			if q, ok := b.queues[bd.queue]; ok {
+				res[q] = true
+			}
+		} else {
+			b.route(bd.exchange, key, headers, visited, res)
+		}
+	}
+}
+
+// enqueue routes message and puts it to queues, must be called with lock
+func (b *MemoryBroker) enqueue(exchange, key string, msg amqp.Publishing) []*memQueue {
+	routed := make(map[*memQueue]bool)
+	b.route(exchange, key, msg.Headers, make(map[string]bool), routed)
+	queues := make([]*memQueue, 0, len(routed))
+	now := time.Now()
+	for q := range routed {
+		m := &memMessage{exchange: exchange, key: key, msg: msg}
+		ttl, ok := q.argInt("x-message-ttl")
+		if ms, err := strconv.ParseInt(msg.Expiration, 10, 64); err == nil && (!ok || ms < ttl) {
+			ttl, ok = ms, true
+		}
+		if ok {
+			m.expires = now.Add(time.Duration(ttl) * time.Millisecond)
+			time.AfterFunc(time.Duration(ttl)*time.Millisecond, func() {
+				b.mu.Lock()
+				b.pump(q)
+				b.mu.Unlock()
+			})
+		}
+		q.messages = append(q.messages, m)
+		if max, ok := q.argInt("x-max-length"); ok && int64(len(q.messages)) > max {
+			head := q.messages[0]
+			q.messages = q.messages[1:]
+			b.deadLetter(q, head, "maxlen")
+		}
+		queues = append(queues, q)
+		b.pump(q)
+	}
+	return queues
+}
+
+// deadLetter routes message to dead letter exchange of queue or drops it
+func (b *MemoryBroker) deadLetter(q *memQueue, m *memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.key
+	if k, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = k
+	}
+	msg := m.msg
+	headers := make(amqp.Table, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	death := amqp.Table{"queue": q.name, "reason": reason, "count": int64(1), "exchange": m.exchange, "routing-keys": []interface{}{m.key}}
+	deaths, _ := headers["x-death"].([]interface{})
+	headers["x-death"] = append([]interface{}{death}, deaths...)
+	msg.Headers = headers
+	msg.Expiration = ""
+	b.enqueue(dlx, key, msg)
+}
+
+// pump expires messages and delivers them to consumers, must be called with lock
+func (b *MemoryBroker) pump(q *memQueue) {
+	now := time.Now()
+	for len(q.messages) > 0 {
+		m := q.messages[0]
+		if !m.expires.IsZero() && !now.Before(m.expires) {
+			q.messages = q.messages[1:]
+			b.deadLetter(q, m, "expired")
+			continue
+		}
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		q.messages = q.messages[1:]
+		ch := c.channel
+		ch.tagSeq++
+		d := amqp.Delivery{
+			Acknowledger:    ch,
+			Headers:         m.msg.Headers,
+			ContentType:     m.msg.ContentType,
+			ContentEncoding: m.msg.ContentEncoding,
+			DeliveryMode:    m.msg.DeliveryMode,
+			Priority:        m.msg.Priority,
+			CorrelationId:   m.msg.CorrelationId,
+			ReplyTo:         m.msg.ReplyTo,
+			Expiration:      m.msg.Expiration,
+			MessageId:       m.msg.MessageId,
+			Timestamp:       m.msg.Timestamp,
+			Type:            m.msg.Type,
+			UserId:          m.msg.UserId,
+			AppId:           m.msg.AppId,
+			ConsumerTag:     c.tag,
+			DeliveryTag:     ch.tagSeq,
+			Redelivered:     m.redelivered,
+			Exchange:        m.exchange,
+			RoutingKey:      m.key,
+			Body:            m.msg.Body,
+		}
+		if !c.noAck {
+			ch.unacked[d.DeliveryTag] = &memUnacked{message: m, queue: q, consumer: c}
+			c.unacked++
+		}
+		out := c.out
+		c.fifo.push(func() { out <- d })
+	}
+}
@@ -0,0 +1,243 @@
+package amqpconnector
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// testBroker returns new memory broker with uri and open channel
+func testBroker(t *testing.T) (*MemoryBroker, string, Channel) {
+	t.Helper()
+	name := t.Name() + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	broker := GetMemoryBroker(name)
+	channel, err := broker.Connect().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return broker, memoryScheme + name, channel
+}
+
+// declare declares queue bound to exchange by keys
+func declare(t *testing.T, channel Channel, queue, exchange string, args amqp.Table, keys ...string) {
+	t.Helper()
+	if _, err := channel.QueueDeclare(queue, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := channel.QueueBind(queue, key, exchange, false, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// receive waits for delivery
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("delivery is not received")
+	}
+	return amqp.Delivery{}
+}
+
+func TestMemoryRouting(t *testing.T) {
+	broker, _, channel := testBroker(t)
+	for _, kind := range []string{"direct", "topic", "fanout", "headers"} {
+		if err := channel.ExchangeDeclare(kind, kind, false, false, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	declare(t, channel, "direct.a", "direct", nil, "a")
+	declare(t, channel, "topic.temp", "topic", nil, "sensor.*.temp")
+	declare(t, channel, "topic.all", "topic", nil, "sensor.#")
+	declare(t, channel, "fanout.1", "fanout", nil, "ignored")
+	declare(t, channel, "fanout.2", "fanout", nil, "")
+	declare(t, channel, "headers.all", "headers", amqp.Table{"x-match": MatchAll, "type": "a", "v": int32(1)}, "")
+	declare(t, channel, "headers.any", "headers", amqp.Table{"x-match": MatchAny, "type": "a", "v": int32(2)}, "")
+
+	publish := []struct {
+		exchange, key string
+		headers       amqp.Table
+	}{
+		{"direct", "a", nil},
+		{"direct", "b", nil},
+		{"topic", "sensor.1.temp", nil},
+		{"topic", "sensor.1.power.total", nil},
+		{"topic", "other.1.temp", nil},
+		{"fanout", "any", nil},
+		{"headers", "", amqp.Table{"type": "a", "v": int64(1)}},
+		{"headers", "", amqp.Table{"type": "b", "v": int64(2)}},
+		{"headers", "", amqp.Table{"type": "b"}},
+		{"", "direct.a", nil},
+	}
+	for _, p := range publish {
+		if err := channel.Publish(p.exchange, p.key, false, false, amqp.Publishing{Headers: p.headers}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for queue, want := range map[string]int{
+		"direct.a":    2,
+		"topic.temp":  1,
+		"topic.all":   2,
+		"fanout.1":    1,
+		"fanout.2":    1,
+		"headers.all": 1,
+		"headers.any": 2,
+	} {
+		if ready, _ := broker.QueueLen(queue); ready != want {
+			t.Errorf("queue %s has %d messages, want %d", queue, ready, want)
+		}
+	}
+	if published := broker.Published(); len(published) != len(publish) || len(published[1].Queues) != 0 {
+		t.Errorf("published messages %+v", published)
+	}
+}
+
+func TestMemoryAckRedelivery(t *testing.T) {
+	broker, _, channel := testBroker(t)
+	declare(t, channel, "work", "", nil)
+	for _, body := range []string{"1", "2"} {
+		channel.Publish("", "work", false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	if err := channel.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := channel.Consume("work", "worker", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, deliveries)
+	if string(d.Body) != "1" || d.Redelivered {
+		t.Fatalf("first delivery %s redelivered %v", d.Body, d.Redelivered)
+	}
+	// prefetch holds second message until first is acknowledged
+	if ready, unacked := broker.QueueLen("work"); ready != 1 || unacked != 1 {
+		t.Errorf("queue has %d ready and %d unacked messages", ready, unacked)
+	}
+	d.Nack(false, true)
+	d = receive(t, deliveries)
+	if string(d.Body) != "1" || !d.Redelivered {
+		t.Fatalf("requeued delivery %s redelivered %v", d.Body, d.Redelivered)
+	}
+	d.Ack(false)
+	d = receive(t, deliveries)
+	if string(d.Body) != "2" {
+		t.Fatalf("second delivery %s", d.Body)
+	}
+	// unacked message is requeued when channel is closed
+	channel.Close()
+	if ready, unacked := broker.QueueLen("work"); ready != 1 || unacked != 0 {
+		t.Fatalf("after close queue has %d ready and %d unacked messages", ready, unacked)
+	}
+	other, _ := broker.Connect().Channel()
+	deliveries, _ = other.Consume("work", "other", false, false, false, false, nil)
+	d = receive(t, deliveries)
+	if string(d.Body) != "2" || !d.Redelivered {
+		t.Fatalf("delivery after close %s redelivered %v", d.Body, d.Redelivered)
+	}
+	// rejected message without dead letter exchange is dropped
+	d.Reject(false)
+	if ready, unacked := broker.QueueLen("work"); ready != 0 || unacked != 0 {
+		t.Errorf("after reject queue has %d ready and %d unacked messages", ready, unacked)
+	}
+}
+
+func TestMemoryTTLDeadLetter(t *testing.T) {
+	broker, _, channel := testBroker(t)
+	declare(t, channel, "dead", "", nil)
+	_, err := channel.QueueDeclare("short", false, false, false, false, amqp.Table{
+		"x-message-ttl":             int64(20),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "dead",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Publish("", "short", false, false, amqp.Publishing{Body: []byte("queue ttl")})
+	channel.Publish("", "short", false, false, amqp.Publishing{Body: []byte("message ttl"), Expiration: "5"})
+	if ready, _ := broker.QueueLen("short"); ready != 2 {
+		t.Fatalf("short queue has %d messages before ttl", ready)
+	}
+	ok := waitFor(t, time.Second, func() bool {
+		ready, _ := broker.QueueLen("dead")
+		return ready == 2
+	})
+	if !ok {
+		t.Fatal("expired messages are not dead-lettered")
+	}
+	for _, msg := range broker.QueueMessages("dead") {
+		deaths, _ := msg.Headers["x-death"].([]interface{})
+		if len(deaths) != 1 {
+			t.Fatalf("message %s x-death %v", msg.Body, msg.Headers["x-death"])
+		}
+		death := deaths[0].(amqp.Table)
+		if death["reason"] != "expired" || death["queue"] != "short" {
+			t.Errorf("message %s death %v", msg.Body, death)
+		}
+		if msg.Expiration != "" {
+			t.Errorf("dead-lettered message keeps expiration %s", msg.Expiration)
+		}
+	}
+}
+
+func TestMemoryRPC(t *testing.T) {
+	_, uri, _ := testBroker(t)
+	server := NewRPCServer(uri, "calc", &Exchange{Name: "rpc", Type: "direct"}, nil)
+	server.Handle("sum", func(ctx context.Context, req *RPCRequest) (interface{}, error) {
+		var args []int
+		if err := req.Decode(&args); err != nil {
+			return nil, err
+		}
+		sum := 0
+		for _, v := range args {
+			sum += v
+		}
+		return sum, nil
+	})
+	server.Handle("fail", func(ctx context.Context, req *RPCRequest) (interface{}, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Drain(time.Second)
+	client, err := NewRPCClient(uri, "calc-client", "rpc", DefaultRPCClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sum int
+	if err = client.Call(ctx, "sum", []int{1, 2, 3}, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 6 {
+		t.Errorf("sum %d, want 6", sum)
+	}
+	err = client.Call(ctx, "fail", nil, nil)
+	if rpcErr, ok := err.(*RPCError); !ok || rpcErr.Message != "failed" {
+		t.Errorf("call of failing handler err %#v", err)
+	}
+}
+
+// AMQP_URI=memory://<name> switches SendUpdate and SchemaTable updates to in-process broker
+func ExampleMemoryBroker_Updates() {
+	broker := GetMemoryBroker("updates-example")
+	err := SendUpdate(memoryScheme+"updates-example", "users", "1", "create", map[string]interface{}{"name": "Ann"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, update := range broker.Updates() {
+		fmt.Println(update.Cmd, update.Collection, update.ID, update.Data)
+	}
+	// Output: create users 1 {"name":"Ann"}
+}
@@ -0,0 +1,242 @@
+package amqpconnector
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// ErrOutboxFull outbox has no space for message
+var ErrOutboxFull = errors.New("publisher outbox is full")
+
+// OutboxMessage message waiting for publish
+type OutboxMessage struct {
+	ID         uint64
+	RoutingKey string
+	Publishing amqp.Publishing
+}
+
+func init() {
+	// concrete types of header values for gob encoding of disk outbox
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+	gob.Register(amqp.Decimal{})
+}
+
+// Outbox bounded storage of messages waiting for publish
+type Outbox interface {
+	// Push appends message, returns ErrOutboxFull if outbox is full
+	Push(msg *OutboxMessage) error
+	// Peek returns up to n first messages
+	Peek(n int) []*OutboxMessage
+	// Remove removes message by id
+	Remove(id uint64) error
+	Len() int
+}
+
+// MemoryOutbox in memory outbox
+type MemoryOutbox struct {
+	mu   sync.Mutex
+	size int
+	list []*OutboxMessage
+}
+
+// NewMemoryOutbox create in memory outbox with max size, size 0 is unlimited
+func NewMemoryOutbox(size int) *MemoryOutbox {
+	return &MemoryOutbox{size: size}
+}
+
+// Push appends message
+func (o *MemoryOutbox) Push(msg *OutboxMessage) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.size > 0 && len(o.list) >= o.size {
+		return ErrOutboxFull
+	}
+	o.list = append(o.list, msg)
+	return nil
+}
+
+// Peek returns up to n first messages
+func (o *MemoryOutbox) Peek(n int) []*OutboxMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if n > len(o.list) {
+		n = len(o.list)
+	}
+	return append([]*OutboxMessage(nil), o.list[:n]...)
+}
+
+// Remove removes message by id
+func (o *MemoryOutbox) Remove(id uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, msg := range o.list {
+		if msg.ID == id {
+			copy(o.list[i:], o.list[i+1:])
+			o.list[len(o.list)-1] = nil
+			o.list = o.list[:len(o.list)-1]
+			break
+		}
+	}
+	return nil
+}
+
+// Len returns count of messages
+func (o *MemoryOutbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.list)
+}
+
+// DiskOutbox outbox stored as one gob file per message in directory,
+// messages left after restart are published first
+type DiskOutbox struct {
+	mu    sync.Mutex
+	dir   string
+	size  int
+	files []string
+	cache map[string]*OutboxMessage // read messages by file name
+}
+
+// NewDiskOutbox create disk outbox in dir with max size, size 0 is unlimited
+func NewDiskOutbox(dir string, size int) (*DiskOutbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	o := &DiskOutbox{dir: dir, size: size, cache: make(map[string]*OutboxMessage)}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".msg") {
+			o.files = append(o.files, info.Name())
+		}
+	}
+	sort.Strings(o.files)
+	return o, nil
+}
+
+// outboxFile returns file name of message, zero padded id keeps files order
+func outboxFile(id uint64) string {
+	name := strconv.FormatUint(id, 10)
+	return strings.Repeat("0", 20-len(name)) + name + ".msg"
+}
+
+// LastID returns id of last stored message
+func (o *DiskOutbox) LastID() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.files) == 0 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(strings.TrimSuffix(o.files[len(o.files)-1], ".msg"), 10, 64)
+	return id
+}
+
+// Push writes message file, file is synced before it is renamed to message name
+func (o *DiskOutbox) Push(msg *OutboxMessage) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.size > 0 && len(o.files) >= o.size {
+		return ErrOutboxFull
+	}
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(msg); err != nil {
+		return err
+	}
+	name := outboxFile(msg.ID)
+	tmp := filepath.Join(o.dir, name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(o.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	o.files = append(o.files, name)
+	return nil
+}
+
+// read reads message file
+func (o *DiskOutbox) read(name string) (*OutboxMessage, error) {
+	if msg, ok := o.cache[name]; ok {
+		return msg, nil
+	}
+	f, err := os.Open(filepath.Join(o.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	msg := &OutboxMessage{}
+	if err = gob.NewDecoder(f).Decode(msg); err != nil {
+		return nil, err
+	}
+	o.cache[name] = msg
+	return msg, nil
+}
+
+// Peek reads up to n first message files
+func (o *DiskOutbox) Peek(n int) []*OutboxMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var res []*OutboxMessage
+	for i := 0; i < len(o.files) && len(res) < n; {
+		msg, err := o.read(o.files[i])
+		if err != nil {
+			// broken file can not be published
+			logrus.Error("outbox read ", o.files[i], " err: ", err)
+			os.Remove(filepath.Join(o.dir, o.files[i]))
+			o.files = append(o.files[:i], o.files[i+1:]...)
+			continue
+		}
+		res = append(res, msg)
+		i++
+	}
+	return res
+}
+
+// Remove removes message file by id
+func (o *DiskOutbox) Remove(id uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	name := outboxFile(id)
+	i := sort.SearchStrings(o.files, name)
+	if i == len(o.files) || o.files[i] != name {
+		return nil
+	}
+	o.files = append(o.files[:i], o.files[i+1:]...)
+	delete(o.cache, name)
+	return os.Remove(filepath.Join(o.dir, name))
+}
+
+// Len returns count of messages
+func (o *DiskOutbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.files)
+}
@@ -0,0 +1,85 @@
+package amqpconnector
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestDiskOutboxReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewDiskOutbox(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &OutboxMessage{ID: 7, RoutingKey: "key", Publishing: amqp.Publishing{
+		MessageId: "id",
+		Timestamp: time.Unix(1600000000, 0).UTC(),
+		Body:      []byte("body"),
+		Headers: amqp.Table{
+			HeaderMessageVersion: int32(2),
+			HeaderAttempt:        int32(3),
+			"x-death":            []interface{}{amqp.Table{"count": int64(1), "time": time.Unix(1600000000, 0).UTC()}},
+			"flag":               true,
+		},
+	}}
+	for _, m := range []*OutboxMessage{msg, {ID: 8, RoutingKey: "next"}} {
+		if err = o.Push(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = o.Push(&OutboxMessage{ID: 9}); err != ErrOutboxFull {
+		t.Fatalf("push to full outbox err: %v", err)
+	}
+
+	o, err = NewDiskOutbox(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Len() != 2 || o.LastID() != 8 {
+		t.Fatalf("reopened outbox len %d last id %d", o.Len(), o.LastID())
+	}
+	list := o.Peek(10)
+	if len(list) != 2 {
+		t.Fatalf("peek returned %d messages", len(list))
+	}
+	if !reflect.DeepEqual(list[0], msg) {
+		t.Errorf("restored message %+v, want %+v", list[0], msg)
+	}
+	if v, ok := list[0].Publishing.Headers[HeaderMessageVersion].(int32); !ok || v != 2 {
+		t.Errorf("version header %#v is not int32", list[0].Publishing.Headers[HeaderMessageVersion])
+	}
+	if err = o.Remove(7); err != nil {
+		t.Fatal(err)
+	}
+	if list = o.Peek(10); len(list) != 1 || list[0].ID != 8 {
+		t.Fatalf("messages after remove: %+v", list)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("%d files left in outbox dir", len(files))
+	}
+}
+
+func TestMemoryOutboxRemove(t *testing.T) {
+	o := NewMemoryOutbox(0)
+	for id := uint64(1); id <= 3; id++ {
+		o.Push(&OutboxMessage{ID: id})
+	}
+	o.Remove(2)
+	list := o.Peek(10)
+	if len(list) != 2 || list[0].ID != 1 || list[1].ID != 3 {
+		t.Fatalf("messages after remove: %+v", list)
+	}
+	if list = o.Peek(1); len(list) != 1 || list[0].ID != 1 {
+		t.Fatalf("peek 1 returned %+v", list)
+	}
+}
@@ -0,0 +1,449 @@
+package amqpconnector
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrPublishNack message is rejected by broker
+	ErrPublishNack = errors.New("message is rejected by broker")
+	// ErrPublishReturned mandatory message is returned by broker as unroutable
+	ErrPublishReturned = errors.New("message is returned by broker")
+	// ErrPublishTimeout broker did not confirm message in time
+	ErrPublishTimeout = errors.New("publish confirm timeout")
+	// ErrPublisherClosed publisher is closed
+	ErrPublisherClosed = errors.New("publisher is closed")
+)
+
+// PublishResult result of message publish
+type PublishResult struct {
+	ID         uint64
+	RoutingKey string
+	Err        error // nil if message is confirmed by broker
+}
+
+// PublisherConfig settings of reliable publisher
+type PublisherConfig struct {
+	Mandatory      bool          // unroutable messages are returned and reported with ErrPublishReturned
+	Outbox         Outbox        // storage of messages during outage, memory outbox of OutboxSize if nil
+	OutboxSize     int           // max count of messages in memory outbox, 0 is unlimited
+	MaxAttempts    int           // publish attempts of message, 0 is unlimited
+	RetryDelay     time.Duration // initial delay between attempts, doubled on every failure
+	MaxRetryDelay  time.Duration
+	ConfirmTimeout time.Duration
+	ConfirmWindow  int // max count of unconfirmed messages, messages are published one by one if 0
+	// OnResult is called with result of every message, including messages restored from disk outbox
+	OnResult func(result PublishResult)
+}
+
+// DefaultPublisherConfig default settings of reliable publisher
+var DefaultPublisherConfig = PublisherConfig{
+	Mandatory:      true,
+	OutboxSize:     10000,
+	RetryDelay:     time.Second,
+	MaxRetryDelay:  30 * time.Second,
+	ConfirmTimeout: 10 * time.Second,
+	ConfirmWindow:  100,
+}
+
+type publishWaiter struct {
+	ctx    context.Context
+	result chan PublishResult
+}
+
+// inflightMessage message published to channel and waiting for confirm
+type inflightMessage struct {
+	msg      *OutboxMessage
+	deadline time.Time // zero if confirm timeout is not set
+	returned bool
+}
+
+// ReliablePublisher publisher with broker confirms, messages are kept in outbox until confirmed
+type ReliablePublisher struct {
+	Config   PublisherConfig
+	uri      string
+	name     string
+	exchange Exchange
+	outbox   Outbox
+	seq      uint64
+	mu       sync.Mutex
+	waiters  map[uint64]*publishWaiter
+	closed   bool
+	notify   chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	// channel and publish state are used only by publish loop
+	channel  Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	tag      uint64                      // delivery tag of last message published to channel
+	inflight map[uint64]*inflightMessage // unconfirmed messages by delivery tag
+	tags     map[uint64]uint64           // delivery tags of unconfirmed messages by outbox id
+	attempts map[uint64]int              // failed attempts by outbox id
+	delay    time.Duration
+	retryAt  time.Time
+}
+
+// NewReliablePublisher create publisher with confirms, connection is established in background
+func NewReliablePublisher(amqpURI, name string, exchange Exchange, cfg PublisherConfig) *ReliablePublisher {
+	p := &ReliablePublisher{
+		Config:   cfg,
+		uri:      amqpURI,
+		name:     name,
+		exchange: exchange,
+		outbox:   cfg.Outbox,
+		waiters:  make(map[uint64]*publishWaiter),
+		notify:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		inflight: make(map[uint64]*inflightMessage),
+		tags:     make(map[uint64]uint64),
+		attempts: make(map[uint64]int),
+		delay:    cfg.RetryDelay,
+	}
+	if p.outbox == nil {
+		p.outbox = NewMemoryOutbox(cfg.OutboxSize)
+	}
+	if disk, ok := p.outbox.(*DiskOutbox); ok {
+		p.seq = disk.LastID()
+	}
+	go p.loop()
+	return p
+}
+
+func (p *ReliablePublisher) logInfo(log string) string {
+	return "[" + p.name + "]" + log
+}
+
+// Send puts message to outbox, result is sent to returned channel when message is confirmed or failed,
+// message is dropped with context error if context is done before publish
+func (p *ReliablePublisher) Send(ctx context.Context, routingKey string, msg amqp.Publishing) (<-chan PublishResult, error) {
+	msg.Body = append([]byte(nil), msg.Body...)
+	stampPublishing(ctx, &msg)
+	out := &OutboxMessage{RoutingKey: routingKey, Publishing: msg}
+	waiter := &publishWaiter{ctx: ctx, result: make(chan PublishResult, 1)}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPublisherClosed
+	}
+	out.ID = atomic.AddUint64(&p.seq, 1)
+	if err := p.outbox.Push(out); err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.waiters[out.ID] = waiter
+	p.mu.Unlock()
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+	return waiter.result, nil
+}
+
+// Publish sends message and waits for its result or context done
+func (p *ReliablePublisher) Publish(ctx context.Context, routingKey string, msg amqp.Publishing) error {
+	result, err := p.Send(ctx, routingKey, msg)
+	if err != nil {
+		return err
+	}
+	select {
+	case res := <-result:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pending returns count of messages in outbox
+func (p *ReliablePublisher) Pending() int {
+	return p.outbox.Len()
+}
+
+// Close stops publishing, messages of disk outbox are kept for next start
+func (p *ReliablePublisher) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+	close(p.stop)
+	<-p.done
+	p.mu.Lock()
+	for id, waiter := range p.waiters {
+		waiter.result <- PublishResult{ID: id, Err: ErrPublisherClosed}
+		delete(p.waiters, id)
+	}
+	p.mu.Unlock()
+	p.disconnect()
+	return nil
+}
+
+// finish removes message from outbox and reports result
+func (p *ReliablePublisher) finish(msg *OutboxMessage, err error) {
+	if errRemove := p.outbox.Remove(msg.ID); errRemove != nil {
+		logrus.Error(p.logInfo("outbox remove err: "), errRemove)
+	}
+	delete(p.attempts, msg.ID)
+	res := PublishResult{ID: msg.ID, RoutingKey: msg.RoutingKey, Err: err}
+	p.mu.Lock()
+	waiter := p.waiters[msg.ID]
+	delete(p.waiters, msg.ID)
+	p.mu.Unlock()
+	if waiter != nil {
+		waiter.result <- res
+	}
+	if p.Config.OnResult != nil {
+		p.Config.OnResult(res)
+	}
+}
+
+func (p *ReliablePublisher) window() int {
+	if p.Config.ConfirmWindow > 0 {
+		return p.Config.ConfirmWindow
+	}
+	return 1
+}
+
+// loop publishes outbox messages keeping up to confirm window of unconfirmed messages
+func (p *ReliablePublisher) loop() {
+	defer close(p.done)
+	for p.step() {
+	}
+}
+
+// step publishes messages and handles one event, returns false if publisher is stopped
+func (p *ReliablePublisher) step() bool {
+	ctxDone := p.fill()
+	var retry, timeout <-chan time.Time
+	if wait := time.Until(p.retryAt); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		retry = timer.C
+	}
+	if deadline, ok := p.deadline(); ok {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-p.notify:
+	case <-retry:
+	case <-ctxDone:
+	case ret, ok := <-p.returns:
+		if !ok {
+			p.returns = nil
+			break
+		}
+		p.returned(ret)
+	case confirm, ok := <-p.confirms:
+		if !ok {
+			p.fail(amqp.ErrClosed)
+			break
+		}
+		p.confirm(confirm)
+	case <-timeout:
+		p.fail(ErrPublishTimeout)
+	case <-p.stop:
+		return false
+	}
+	return true
+}
+
+// next returns first outbox message which is not published to channel
+func (p *ReliablePublisher) next() *OutboxMessage {
+	for _, msg := range p.outbox.Peek(len(p.inflight) + 1) {
+		if _, ok := p.tags[msg.ID]; !ok {
+			return msg
+		}
+	}
+	return nil
+}
+
+// fill publishes outbox messages until confirm window is full,
+// returns done channel of context of message waiting for retry
+func (p *ReliablePublisher) fill() <-chan struct{} {
+	for len(p.inflight) < p.window() {
+		msg := p.next()
+		if msg == nil {
+			return nil
+		}
+		p.mu.Lock()
+		waiter := p.waiters[msg.ID]
+		p.mu.Unlock()
+		var ctxDone <-chan struct{}
+		if waiter != nil && waiter.ctx != nil {
+			if err := waiter.ctx.Err(); err != nil {
+				p.finish(msg, err)
+				continue
+			}
+			ctxDone = waiter.ctx.Done()
+		}
+		if time.Now().Before(p.retryAt) {
+			return ctxDone
+		}
+		if err := p.connect(); err != nil {
+			p.retry(msg, err)
+			continue
+		}
+		if err := p.channel.Publish(p.exchange.Name, msg.RoutingKey, p.Config.Mandatory, false, msg.Publishing); err != nil {
+			p.fail(err)
+			p.retry(msg, err)
+			continue
+		}
+		p.tag++
+		item := &inflightMessage{msg: msg}
+		if p.Config.ConfirmTimeout > 0 {
+			item.deadline = time.Now().Add(p.Config.ConfirmTimeout)
+		}
+		p.inflight[p.tag] = item
+		p.tags[msg.ID] = p.tag
+	}
+	return nil
+}
+
+// deadline returns confirm deadline of oldest unconfirmed message
+func (p *ReliablePublisher) deadline() (time.Time, bool) {
+	var oldest time.Time
+	for _, item := range p.inflight {
+		if !item.deadline.IsZero() && (oldest.IsZero() || item.deadline.Before(oldest)) {
+			oldest = item.deadline
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// retry counts failed attempt of message and delays next publish,
+// message is finished with error if attempts are exhausted
+func (p *ReliablePublisher) retry(msg *OutboxMessage, err error) {
+	p.attempts[msg.ID]++
+	attempts := p.attempts[msg.ID]
+	if p.Config.MaxAttempts > 0 && attempts >= p.Config.MaxAttempts {
+		p.finish(msg, err)
+		return
+	}
+	if time.Now().Before(p.retryAt) {
+		return
+	}
+	logrus.Warn(p.logInfo("publish err: "), err, " attempt: ", attempts, " next try in ", p.delay)
+	p.retryAt = time.Now().Add(p.delay)
+	if p.delay *= 2; p.Config.MaxRetryDelay > 0 && p.delay > p.Config.MaxRetryDelay {
+		p.delay = p.Config.MaxRetryDelay
+	}
+}
+
+// returned marks unconfirmed message returned by broker, message is found by id set on send
+func (p *ReliablePublisher) returned(ret amqp.Return) {
+	var found *inflightMessage
+	var foundTag uint64
+	for tag, item := range p.inflight {
+		if !item.returned && item.msg.Publishing.MessageId == ret.MessageId && (found == nil || tag < foundTag) {
+			found, foundTag = item, tag
+		}
+	}
+	if found != nil {
+		found.returned = true
+	}
+}
+
+// confirm finishes message by broker confirm, nacked message is published again after delay
+func (p *ReliablePublisher) confirm(confirm amqp.Confirmation) {
+	item, ok := p.inflight[confirm.DeliveryTag]
+	if !ok {
+		return
+	}
+	delete(p.inflight, confirm.DeliveryTag)
+	delete(p.tags, item.msg.ID)
+	if !confirm.Ack {
+		p.retry(item.msg, ErrPublishNack)
+		return
+	}
+	// return of message is sent by broker before its ack
+	for drained := false; !drained; {
+		select {
+		case ret, ok := <-p.returns:
+			if !ok {
+				p.returns = nil
+				drained = true
+				break
+			}
+			p.returned(ret)
+		default:
+			drained = true
+		}
+	}
+	p.delay = p.Config.RetryDelay
+	if item.returned {
+		p.finish(item.msg, ErrPublishReturned)
+		return
+	}
+	p.finish(item.msg, nil)
+}
+
+// fail closes channel after error, unconfirmed messages are published again after delay
+func (p *ReliablePublisher) fail(err error) {
+	tags := make([]uint64, 0, len(p.inflight))
+	for tag := range p.inflight {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	items := make([]*inflightMessage, len(tags))
+	for i, tag := range tags {
+		items[i] = p.inflight[tag]
+	}
+	p.disconnect()
+	for _, item := range items {
+		p.retry(item.msg, err)
+	}
+}
+
+// connect opens channel of shared connection in confirm mode
+func (p *ReliablePublisher) connect() error {
+	if p.channel != nil {
+		return nil
+	}
+	connection, err := GetConnection(p.uri)
+	if err != nil {
+		return err
+	}
+	channel, err := connection.Channel()
+	if err != nil {
+		return err
+	}
+	if p.exchange.Name != "" {
+		declarer := &Consumer{channel: channel, exchange: &p.exchange, name: p.name}
+		_, err = declarer.ExchangeDeclare()
+	}
+	if err == nil {
+		err = channel.Confirm(false)
+	}
+	if err != nil {
+		channel.Close()
+		return err
+	}
+	p.channel = channel
+	p.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, p.window()))
+	p.returns = channel.NotifyReturn(make(chan amqp.Return, p.window()))
+	return nil
+}
+
+// disconnect closes channel after error, delivery tags of new channel start from one
+func (p *ReliablePublisher) disconnect() {
+	if p.channel != nil {
+		p.channel.Close()
+	}
+	p.channel, p.confirms, p.returns = nil, nil, nil
+	p.tag = 0
+	p.inflight = make(map[uint64]*inflightMessage)
+	p.tags = make(map[uint64]uint64)
+}
@@ -0,0 +1,70 @@
+package amqpconnector
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestReliablePublisherWindow(t *testing.T) {
+	broker, uri, channel := testBroker(t)
+	exchange := Exchange{Name: "events", Type: "direct", Durable: true}
+	if err := channel.ExchangeDeclare(exchange.Name, exchange.Type, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	declare(t, channel, "events.routed", exchange.Name, nil, "routed")
+
+	cfg := DefaultPublisherConfig
+	cfg.ConfirmWindow = 8
+	cfg.ConfirmTimeout = 5 * time.Second
+	p := NewReliablePublisher(uri, "window", exchange, cfg)
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var results []<-chan PublishResult
+	for i := 0; i < 50; i++ {
+		key := "routed"
+		if i%10 == 3 {
+			key = "unrouted"
+		}
+		result, err := p.Send(ctx, key, amqp.Publishing{Body: []byte(strconv.Itoa(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+	for i, result := range results {
+		select {
+		case res := <-result:
+			want := error(nil)
+			if i%10 == 3 {
+				want = ErrPublishReturned
+			}
+			if res.Err != want {
+				t.Errorf("message %d result %v, want %v", i, res.Err, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("message %d is not confirmed", i)
+		}
+	}
+	if p.Pending() != 0 {
+		t.Errorf("%d messages left in outbox", p.Pending())
+	}
+	msgs := broker.QueueMessages("events.routed")
+	if len(msgs) != 45 {
+		t.Fatalf("%d messages routed, want 45", len(msgs))
+	}
+	n := 0
+	for i := 0; i < 50; i++ {
+		if i%10 == 3 {
+			continue
+		}
+		if string(msgs[n].Body) != strconv.Itoa(i) {
+			t.Errorf("routed message %d is %s, want %d", n, msgs[n].Body, i)
+		}
+		n++
+	}
+}
@@ -0,0 +1,354 @@
+package amqpconnector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	strUtil "gitlab.com/battler/modules/strings"
+)
+
+// directReplyQueue pseudo queue of rabbitmq direct reply-to
+const directReplyQueue = "amq.rabbitmq.reply-to"
+
+// HeaderRPCError header of rpc reply with handler error
+const HeaderRPCError = "x-rpc-error"
+
+var (
+	// ErrRPCReplyLost connection is lost before reply
+	ErrRPCReplyLost = errors.New("rpc reply is lost")
+	// ErrRPCNotFound server has no handler for routing key
+	ErrRPCNotFound = errors.New("rpc method not found")
+)
+
+// RPCError error returned by rpc server handler
+type RPCError struct {
+	Method  string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return "rpc " + e.Method + ": " + e.Message
+}
+
+// RPCClientConfig settings of rpc client
+type RPCClientConfig struct {
+	CallbackQueue bool          // exclusive callback queue instead of direct reply-to
+	Timeout       time.Duration // timeout of calls with context without deadline, 0 is unlimited
+}
+
+// DefaultRPCClientConfig default settings of rpc client
+var DefaultRPCClientConfig = RPCClientConfig{
+	Timeout: 30 * time.Second,
+}
+
+// RPCClient sends requests with correlation id and waits for replies
+type RPCClient struct {
+	Config     RPCClientConfig
+	name       string
+	exchange   string
+	connection *Connection
+	mu         sync.Mutex
+	channel    Channel
+	replyTo    string
+	pending    map[string]chan *amqp.Delivery
+}
+
+// NewRPCClient create rpc client publishing requests to exchange
+func NewRPCClient(amqpURI, name, exchange string, cfg RPCClientConfig) (*RPCClient, error) {
+	r := &RPCClient{
+		Config:   cfg,
+		name:     name,
+		exchange: exchange,
+		pending:  make(map[string]chan *amqp.Delivery),
+	}
+	connection, err := GetConnection(amqpURI)
+	if err != nil {
+		return nil, err
+	}
+	r.connection = connection
+	if err = connection.register(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RPCClient) logInfo(log string) string {
+	return "[" + r.name + "]" + log
+}
+
+// setup starts consuming replies on new channel, calls of previous channel are failed
+func (r *RPCClient) setup(channel Channel) error {
+	queue := directReplyQueue
+	if r.Config.CallbackQueue {
+		q, err := channel.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			return err
+		}
+		queue = q.Name
+	}
+	// direct reply-to requires no ack mode
+	replies, err := channel.Consume(queue, "", true, r.Config.CallbackQueue, false, false, nil)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.channel, r.replyTo = channel, queue
+	for id, reply := range r.pending {
+		reply <- nil
+		delete(r.pending, id)
+	}
+	r.mu.Unlock()
+	go r.receive(replies)
+	return nil
+}
+
+// receive passes replies to waiting calls
+func (r *RPCClient) receive(replies <-chan amqp.Delivery) {
+	for d := range replies {
+		d := d
+		r.mu.Lock()
+		reply, ok := r.pending[d.CorrelationId]
+		delete(r.pending, d.CorrelationId)
+		r.mu.Unlock()
+		if !ok {
+			logrus.Warn(r.logInfo("rpc reply without call: "), d.CorrelationId)
+			continue
+		}
+		reply <- &d
+	}
+}
+
+// CallRaw publishes request to routing key and waits for reply body
+func (r *RPCClient) CallRaw(ctx context.Context, routingKey string, body []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && r.Config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Config.Timeout)
+		defer cancel()
+	}
+	id := *strUtil.NewId()
+	reply := make(chan *amqp.Delivery, 1)
+	r.mu.Lock()
+	channel, replyTo := r.channel, r.replyTo
+	if channel == nil {
+		r.mu.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	r.pending[id] = reply
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+	}()
+	msg := amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: id,
+		ReplyTo:       replyTo,
+		Body:          body,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// broker drops requests which can not be answered in time
+		ms := int64(time.Until(deadline) / time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+		msg.Expiration = strconv.FormatInt(ms, 10)
+	}
+	stampPublishing(ctx, &msg)
+	if err := channel.Publish(r.exchange, routingKey, false, false, msg); err != nil {
+		return nil, err
+	}
+	select {
+	case d := <-reply:
+		if d == nil {
+			return nil, ErrRPCReplyLost
+		}
+		if errMsg, ok := d.Headers[HeaderRPCError].(string); ok {
+			return nil, &RPCError{Method: routingKey, Message: errMsg}
+		}
+		return d.Body, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Call publishes request marshaled to json and unmarshals reply to result if it is not nil
+func (r *RPCClient) Call(ctx context.Context, routingKey string, request, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	res, err := r.CallRaw(ctx, routingKey, body)
+	if err != nil || result == nil {
+		return err
+	}
+	return json.Unmarshal(res, result)
+}
+
+// Close stops rpc client, waiting calls are failed
+func (r *RPCClient) Close() error {
+	r.connection.unregister(r)
+	r.mu.Lock()
+	channel := r.channel
+	r.channel = nil
+	for id, reply := range r.pending {
+		reply <- nil
+		delete(r.pending, id)
+	}
+	r.mu.Unlock()
+	if channel != nil {
+		if err := channel.Close(); err != nil && err != amqp.ErrClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+// RPCRequest request received by rpc server
+type RPCRequest struct {
+	*Delivery
+}
+
+// Decode unmarshals json request body
+func (req *RPCRequest) Decode(v interface{}) error {
+	return json.Unmarshal(req.Body, v)
+}
+
+// RPCHandler handles request, result is marshaled to json unless it is []byte
+type RPCHandler func(ctx context.Context, req *RPCRequest) (interface{}, error)
+
+// RPCServer consumer which replies to requests by handlers of routing keys
+type RPCServer struct {
+	consumer *Consumer
+	uri      string
+	name     string
+	exchange *Exchange
+	queue    *Queue
+	mu       sync.RWMutex
+	handlers map[string]RPCHandler
+}
+
+// NewRPCServer create rpc server of exchange, queue is generated if nil
+func NewRPCServer(amqpURI, name string, exchange *Exchange, queue *Queue) *RPCServer {
+	if queue == nil {
+		queueName := GenerateName("rpc." + name)
+		queue = &Queue{Name: queueName, ConsumerTag: queueName, AutoDelete: true}
+	}
+	return &RPCServer{
+		uri:      amqpURI,
+		name:     name,
+		exchange: exchange,
+		queue:    queue,
+		handlers: make(map[string]RPCHandler),
+	}
+}
+
+// Handle registers handler of routing key, key is bound if server is started
+func (s *RPCServer) Handle(routingKey string, handler RPCHandler) error {
+	s.mu.Lock()
+	s.handlers[routingKey] = handler
+	consumer := s.consumer
+	if consumer == nil {
+		s.queue.Keys = append(s.queue.Keys, routingKey)
+	}
+	s.mu.Unlock()
+	if consumer != nil {
+		return consumer.BindKeys([]string{routingKey})
+	}
+	return nil
+}
+
+// Start starts consuming requests
+func (s *RPCServer) Start() error {
+	// requests wait for lock until consumer is set
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	consumer := &Consumer{
+		exchange:       s.exchange,
+		queue:          s.queue,
+		uri:            s.uri,
+		name:           s.name,
+		resultHandlers: []ResultHandler{s.handle},
+	}
+	if err := consumer.connect(); err != nil {
+		return err
+	}
+	s.consumer = consumer
+	return nil
+}
+
+// Drain stops consuming and waits for handled requests
+func (s *RPCServer) Drain(timeout time.Duration) error {
+	s.mu.RLock()
+	consumer := s.consumer
+	s.mu.RUnlock()
+	if consumer == nil {
+		return nil
+	}
+	return consumer.Drain(timeout)
+}
+
+// call runs handler and converts panic to error
+func (s *RPCServer) call(ctx context.Context, handler RPCHandler, req *RPCRequest) (res interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Error("[", s.name, "] rpc handler panic: ", r, "\n", string(debug.Stack()))
+			err = fmt.Errorf("rpc handler panic: %v", r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// handle runs handler of delivery routing key and publishes reply
+func (s *RPCServer) handle(d *Delivery) HandleResult {
+	s.mu.RLock()
+	handler, ok := s.handlers[d.RoutingKey]
+	consumer := s.consumer
+	s.mu.RUnlock()
+	ctx := d.Context()
+	if ms, err := strconv.ParseInt(d.Expiration, 10, 64); err == nil && ms > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+		defer cancel()
+	}
+	var res interface{}
+	err := ErrRPCNotFound
+	if ok {
+		res, err = s.call(ctx, handler, &RPCRequest{d})
+	}
+	if d.ReplyTo == "" {
+		if err != nil {
+			logrus.Error("[", s.name, "] rpc ", d.RoutingKey, " err: ", err)
+		}
+		return Ack
+	}
+	msg := amqp.Publishing{ContentType: "application/json", CorrelationId: d.CorrelationId}
+	if err == nil {
+		if body, isBytes := res.([]byte); isBytes {
+			msg.Body = body
+		} else {
+			msg.Body, err = json.Marshal(res)
+		}
+	}
+	if err != nil {
+		msg.Body = nil
+		msg.Headers = amqp.Table{HeaderRPCError: err.Error()}
+	}
+	stampPublishing(ctx, &msg)
+	channel := consumer.getChannel()
+	if channel == nil {
+		return Requeue
+	}
+	if errPublish := channel.Publish("", d.ReplyTo, false, false, msg); errPublish != nil {
+		logrus.Error("[", s.name, "] rpc reply err: ", errPublish)
+	}
+	return Ack
+}
@@ -0,0 +1,246 @@
+package amqpconnector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"gopkg.in/yaml.v2"
+)
+
+// ExchangeConfig exchange of topology
+type ExchangeConfig struct {
+	Name       string                 `json:"name" yaml:"name"`
+	Type       string                 `json:"type" yaml:"type"`
+	Durable    bool                   `json:"durable,omitempty" yaml:"durable,omitempty"`
+	AutoDelete bool                   `json:"autoDelete,omitempty" yaml:"autoDelete,omitempty"`
+	Internal   bool                   `json:"internal,omitempty" yaml:"internal,omitempty"`
+	Args       map[string]interface{} `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+// QueueConfig queue of topology
+type QueueConfig struct {
+	Name               string                 `json:"name" yaml:"name"`
+	Durable            bool                   `json:"durable,omitempty" yaml:"durable,omitempty"`
+	AutoDelete         bool                   `json:"autoDelete,omitempty" yaml:"autoDelete,omitempty"`
+	Exclusive          bool                   `json:"exclusive,omitempty" yaml:"exclusive,omitempty"`
+	MessageTTL         int64                  `json:"messageTtl,omitempty" yaml:"messageTtl,omitempty"` // ms
+	Expires            int64                  `json:"expires,omitempty" yaml:"expires,omitempty"`       // ms of unused queue life
+	MaxLength          int64                  `json:"maxLength,omitempty" yaml:"maxLength,omitempty"`
+	DeadLetterExchange string                 `json:"deadLetterExchange,omitempty" yaml:"deadLetterExchange,omitempty"`
+	DeadLetterKey      string                 `json:"deadLetterKey,omitempty" yaml:"deadLetterKey,omitempty"`
+	Args               map[string]interface{} `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+// BindingConfig binding of queue or exchange to exchange
+type BindingConfig struct {
+	Exchange   string                 `json:"exchange" yaml:"exchange"`
+	Queue      string                 `json:"queue,omitempty" yaml:"queue,omitempty"`
+	ToExchange string                 `json:"toExchange,omitempty" yaml:"toExchange,omitempty"` // exchange to exchange binding
+	Keys       []string               `json:"keys,omitempty" yaml:"keys,omitempty"`
+	Args       map[string]interface{} `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+// Topology declarative set of exchanges, queues and bindings,
+// declaration is idempotent while settings of existing entities are not changed
+type Topology struct {
+	Exchanges []ExchangeConfig `json:"exchanges" yaml:"exchanges"`
+	Queues    []QueueConfig    `json:"queues" yaml:"queues"`
+	Bindings  []BindingConfig  `json:"bindings" yaml:"bindings"`
+}
+
+var exchangeTypes = map[string]bool{"direct": true, "fanout": true, "topic": true, "headers": true}
+
+// LoadTopologyJSON loads topology from JSON config
+func LoadTopologyJSON(data []byte) (*Topology, error) {
+	t := &Topology{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	return t, t.Validate()
+}
+
+// LoadTopologyYAML loads topology from YAML config
+func LoadTopologyYAML(data []byte) (*Topology, error) {
+	t := &Topology{}
+	if err := yaml.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	return t, t.Validate()
+}
+
+// LoadTopologyFile loads topology from JSON or YAML file by extension
+func LoadTopologyFile(path string) (*Topology, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return LoadTopologyYAML(data)
+	}
+	return LoadTopologyJSON(data)
+}
+
+// Validate checks names and types of topology
+func (t *Topology) Validate() error {
+	for _, e := range t.Exchanges {
+		if e.Name == "" {
+			return errors.New("topology exchange without name")
+		}
+		if !exchangeTypes[e.Type] {
+			return fmt.Errorf("topology exchange %s has unknown type %q", e.Name, e.Type)
+		}
+	}
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			return errors.New("topology queue without name")
+		}
+	}
+	for _, b := range t.Bindings {
+		if b.Exchange == "" {
+			return errors.New("topology binding without exchange")
+		}
+		if (b.Queue == "") == (b.ToExchange == "") {
+			return fmt.Errorf("topology binding of %s must have either queue or toExchange", b.Exchange)
+		}
+	}
+	return nil
+}
+
+// tableValue converts config value to amqp table value,
+// yaml maps get string keys and whole json numbers become integers
+func tableValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) < 1<<53 {
+			return int64(val)
+		}
+	case int:
+		return int64(val)
+	case map[interface{}]interface{}:
+		res := make(amqp.Table, len(val))
+		for k, item := range val {
+			res[fmt.Sprint(k)] = tableValue(item)
+		}
+		return res
+	case map[string]interface{}:
+		return table(val)
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			res[i] = tableValue(item)
+		}
+		return res
+	}
+	return v
+}
+
+// table converts config args to amqp table
+func table(args map[string]interface{}) amqp.Table {
+	if len(args) == 0 {
+		return nil
+	}
+	res := make(amqp.Table, len(args))
+	for k, v := range args {
+		res[k] = tableValue(v)
+	}
+	return res
+}
+
+// queueArgs returns queue args with ttl, length and dead letter settings
+func (q *QueueConfig) queueArgs() amqp.Table {
+	args := table(q.Args)
+	set := func(k string, v interface{}) {
+		if args == nil {
+			args = amqp.Table{}
+		}
+		args[k] = v
+	}
+	if q.MessageTTL > 0 {
+		set("x-message-ttl", q.MessageTTL)
+	}
+	if q.Expires > 0 {
+		set("x-expires", q.Expires)
+	}
+	if q.MaxLength > 0 {
+		set("x-max-length", q.MaxLength)
+	}
+	if q.DeadLetterExchange != "" {
+		set("x-dead-letter-exchange", q.DeadLetterExchange)
+	}
+	if q.DeadLetterKey != "" {
+		set("x-dead-letter-routing-key", q.DeadLetterKey)
+	}
+	return args
+}
+
+// Apply declares topology on channel
+func (t *Topology) Apply(channel Channel) error {
+	for _, e := range t.Exchanges {
+		if err := channel.ExchangeDeclare(e.Name, e.Type, e.Durable, e.AutoDelete, e.Internal, false, table(e.Args)); err != nil {
+			return fmt.Errorf("declare exchange %s: %v", e.Name, err)
+		}
+	}
+	for i := range t.Queues {
+		q := &t.Queues[i]
+		if _, err := channel.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.queueArgs()); err != nil {
+			return fmt.Errorf("declare queue %s: %v", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		keys := b.Keys
+		if len(keys) == 0 {
+			keys = []string{""}
+		}
+		for _, key := range keys {
+			var err error
+			if b.Queue != "" {
+				err = channel.QueueBind(b.Queue, key, b.Exchange, false, table(b.Args))
+			} else {
+				err = channel.ExchangeBind(b.ToExchange, key, b.Exchange, false, table(b.Args))
+			}
+			if err != nil {
+				return fmt.Errorf("bind %s%s to %s by %q: %v", b.Queue, b.ToExchange, b.Exchange, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// topologyClient declares topology on every connect of shared connection
+type topologyClient struct {
+	topology *Topology
+}
+
+func (c *topologyClient) logInfo(log string) string {
+	return "[topology]" + log
+}
+
+func (c *topologyClient) setup(channel Channel) error {
+	err := c.topology.Apply(channel)
+	if err == nil {
+		logrus.Info(c.logInfo("amqp topology declared"))
+		// closed by client, channel is not reopened
+		channel.Close()
+	}
+	return err
+}
+
+// Declare applies topology to shared connection of uri and after every reconnect
+func (t *Topology) Declare(amqpURI string) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	connection, err := GetConnection(amqpURI)
+	if err != nil {
+		return err
+	}
+	return connection.register(&topologyClient{topology: t})
+}
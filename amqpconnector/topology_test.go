@@ -0,0 +1,275 @@
+package amqpconnector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const topologyJSON = `{
+	"exchanges": [
+		{"name": "events", "type": "topic", "durable": true},
+		{"name": "events.dead", "type": "fanout", "durable": true},
+		{"name": "events.copy", "type": "fanout"}
+	],
+	"queues": [
+		{"name": "events.short", "messageTtl": 20, "deadLetterExchange": "events.dead", "deadLetterKey": "expired", "args": {"x-max-priority": 5}},
+		{"name": "events.dead"},
+		{"name": "events.copy"}
+	],
+	"bindings": [
+		{"exchange": "events", "queue": "events.short", "keys": ["car.*", "bus.#"]},
+		{"exchange": "events.dead", "queue": "events.dead"},
+		{"exchange": "events", "toExchange": "events.copy", "keys": ["car.*"]},
+		{"exchange": "events.copy", "queue": "events.copy"}
+	]
+}`
+
+const topologyYAML = `
+exchanges:
+  - name: events
+    type: topic
+    durable: true
+  - name: events.dead
+    type: fanout
+    durable: true
+  - name: events.copy
+    type: fanout
+queues:
+  - name: events.short
+    messageTtl: 20
+    deadLetterExchange: events.dead
+    deadLetterKey: expired
+    args:
+      x-max-priority: 5
+  - name: events.dead
+  - name: events.copy
+bindings:
+  - exchange: events
+    queue: events.short
+    keys: [car.*, bus.#]
+  - exchange: events.dead
+    queue: events.dead
+  - exchange: events
+    toExchange: events.copy
+    keys: [car.*]
+  - exchange: events.copy
+    queue: events.copy
+`
+
+func TestLoadTopology(t *testing.T) {
+	fromJSON, err := LoadTopologyJSON([]byte(topologyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromYAML, err := LoadTopologyYAML([]byte(topologyYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJSON.Exchanges, fromYAML.Exchanges) || !reflect.DeepEqual(fromJSON.Bindings, fromYAML.Bindings) {
+		t.Errorf("json topology %+v differs from yaml %+v", fromJSON, fromYAML)
+	}
+	// json numbers are float64 and yaml numbers are int, both are int64 in queue args
+	for i := range fromJSON.Queues {
+		if args, expected := fromYAML.Queues[i].queueArgs(), fromJSON.Queues[i].queueArgs(); !reflect.DeepEqual(args, expected) {
+			t.Errorf("queue %s: yaml args %#v, json args %#v", fromJSON.Queues[i].Name, args, expected)
+		}
+	}
+	dir, err := ioutil.TempDir("", "topology")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{"topology.json": topologyJSON, "topology.yml": topologyYAML, "topology.YAML": topologyYAML} {
+		path := filepath.Join(dir, name)
+		if err = ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fromFile, err := LoadTopologyFile(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(fromFile.Bindings, fromJSON.Bindings) {
+			t.Errorf("%s: bindings %+v", name, fromFile.Bindings)
+		}
+	}
+	if _, err = LoadTopologyFile(filepath.Join(dir, "none.json")); err == nil {
+		t.Error("missing file is loaded")
+	}
+	if _, err = LoadTopologyJSON([]byte(topologyYAML)); err == nil {
+		t.Error("yaml is loaded as json")
+	}
+}
+
+func TestTopologyValidate(t *testing.T) {
+	cases := []struct {
+		config string
+		err    string
+	}{
+		{`{"exchanges": [{"type": "topic"}]}`, "topology exchange without name"},
+		{`{"exchanges": [{"name": "a", "type": "x-delayed"}]}`, `topology exchange a has unknown type "x-delayed"`},
+		{`{"queues": [{"durable": true}]}`, "topology queue without name"},
+		{`{"bindings": [{"queue": "q"}]}`, "topology binding without exchange"},
+		{`{"bindings": [{"exchange": "a"}]}`, "topology binding of a must have either queue or toExchange"},
+		{`{"bindings": [{"exchange": "a", "queue": "q", "toExchange": "b"}]}`, "topology binding of a must have either queue or toExchange"},
+	}
+	for _, tc := range cases {
+		_, err := LoadTopologyJSON([]byte(tc.config))
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("%s: error %v, expected %q", tc.config, err, tc.err)
+		}
+	}
+	if err := (&Topology{Bindings: []BindingConfig{{Exchange: "a"}}}).Declare(memoryScheme + "invalid-topology"); err == nil {
+		t.Error("invalid topology is declared")
+	}
+}
+
+func TestTableValue(t *testing.T) {
+	cases := []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{float64(5), int64(5)},
+		{float64(-3), int64(-3)},
+		{1.5, 1.5},
+		{float64(1 << 53), float64(1 << 53)},
+		{7, int64(7)},
+		{int64(8), int64(8)},
+		{"s", "s"},
+		{true, true},
+		{nil, nil},
+		{[]interface{}{float64(1), "a", 2.5}, []interface{}{int64(1), "a", 2.5}},
+		{map[interface{}]interface{}{"a": 1, 2: "b"}, amqp.Table{"a": int64(1), "2": "b"}},
+		{map[string]interface{}{"a": float64(1), "b": map[interface{}]interface{}{"c": 2}}, amqp.Table{"a": int64(1), "b": amqp.Table{"c": int64(2)}}},
+		{[]interface{}{map[interface{}]interface{}{"x-match": "all"}}, []interface{}{amqp.Table{"x-match": "all"}}},
+	}
+	for _, tc := range cases {
+		if res := tableValue(tc.value); !reflect.DeepEqual(res, tc.expected) {
+			t.Errorf("%#v: %#v, expected %#v", tc.value, res, tc.expected)
+		}
+	}
+	if table(nil) != nil || table(map[string]interface{}{}) != nil {
+		t.Error("empty args are not nil table")
+	}
+	if err := (amqp.Table{"v": tableValue(map[interface{}]interface{}{"a": []interface{}{1}})}).Validate(); err != nil {
+		t.Errorf("converted value is not valid amqp table: %v", err)
+	}
+}
+
+func TestQueueArgs(t *testing.T) {
+	cases := []struct {
+		queue    QueueConfig
+		expected amqp.Table
+	}{
+		{QueueConfig{Name: "plain"}, nil},
+		{QueueConfig{Name: "args", Args: map[string]interface{}{"x-queue-mode": "lazy"}}, amqp.Table{"x-queue-mode": "lazy"}},
+		{
+			QueueConfig{Name: "all", MessageTTL: 1000, Expires: 60000, MaxLength: 10, DeadLetterExchange: "dead", DeadLetterKey: "expired"},
+			amqp.Table{"x-message-ttl": int64(1000), "x-expires": int64(60000), "x-max-length": int64(10), "x-dead-letter-exchange": "dead", "x-dead-letter-routing-key": "expired"},
+		},
+		{
+			// settings override the same args
+			QueueConfig{Name: "override", MessageTTL: 1000, Args: map[string]interface{}{"x-message-ttl": float64(5), "x-max-priority": float64(3)}},
+			amqp.Table{"x-message-ttl": int64(1000), "x-max-priority": int64(3)},
+		},
+	}
+	for _, tc := range cases {
+		if args := tc.queue.queueArgs(); !reflect.DeepEqual(args, tc.expected) {
+			t.Errorf("%s: %#v, expected %#v", tc.queue.Name, args, tc.expected)
+		}
+	}
+}
+
+func TestTopologyApply(t *testing.T) {
+	broker, _, channel := testBroker(t)
+	topology, err := LoadTopologyYAML([]byte(topologyYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = topology.Apply(channel); err != nil {
+			t.Fatalf("apply %d: %v", i+1, err)
+		}
+	}
+	channel.Publish("events", "car.1", false, false, amqp.Publishing{Body: []byte("car")})
+	channel.Publish("events", "bus.1.stop", false, false, amqp.Publishing{Body: []byte("bus")})
+	channel.Publish("events", "train.1", false, false, amqp.Publishing{Body: []byte("train")})
+	// bindings are not duplicated by second apply
+	if ready, _ := broker.QueueLen("events.copy"); ready != 1 {
+		t.Errorf("copy queue has %d messages, expected 1", ready)
+	}
+	ok := waitFor(t, time.Second, func() bool {
+		ready, _ := broker.QueueLen("events.dead")
+		return ready == 2
+	})
+	if !ok {
+		t.Fatal("expired messages are not dead-lettered by topology args")
+	}
+	if ready, _ := broker.QueueLen("events.short"); ready != 0 {
+		t.Errorf("short queue has %d messages after ttl", ready)
+	}
+	for _, msg := range broker.QueueMessages("events.dead") {
+		deaths, _ := msg.Headers["x-death"].([]interface{})
+		if len(deaths) != 1 || deaths[0].(amqp.Table)["reason"] != "expired" || deaths[0].(amqp.Table)["queue"] != "events.short" {
+			t.Errorf("message %s x-death %v", msg.Body, msg.Headers["x-death"])
+		}
+	}
+	// changed settings of existing queue are not equivalent
+	changed := *topology
+	changed.Queues = []QueueConfig{{Name: "events.short", MessageTTL: 30, DeadLetterExchange: "events.dead", DeadLetterKey: "expired"}}
+	changed.Bindings = nil
+	if err = changed.Apply(channel); err == nil || !strings.HasPrefix(err.Error(), "declare queue events.short: ") {
+		t.Errorf("redeclare of queue with other ttl: %v", err)
+	}
+	_, _, channel = testBroker(t)
+	unknown := &Topology{Bindings: []BindingConfig{{Exchange: "none", Queue: "q"}}}
+	unknown.Queues = []QueueConfig{{Name: "q"}}
+	if err = unknown.Apply(channel); err == nil || !strings.HasPrefix(err.Error(), `bind q to none by "": `) {
+		t.Errorf("binding to unknown exchange: %v", err)
+	}
+}
+
+func TestTopologyDeclare(t *testing.T) {
+	broker, uri, _ := testBroker(t)
+	topology, err := LoadTopologyJSON([]byte(topologyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = topology.Declare(uri); err != nil {
+			t.Fatalf("declare %d: %v", i+1, err)
+		}
+	}
+	channel, err := broker.Connect().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Publish("events", "car.2", false, false, amqp.Publishing{Body: []byte("car")})
+	if ready, _ := broker.QueueLen("events.copy"); ready != 1 {
+		t.Errorf("copy queue has %d messages, expected 1", ready)
+	}
+	// topology is declared again after reconnect of shared connection
+	broker.Disconnect()
+	if ready, _ := broker.QueueLen("events.copy"); ready != 0 {
+		t.Fatal("not durable queue is kept after broker restart")
+	}
+	channel, err = broker.Connect().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := waitFor(t, 5*time.Second, func() bool {
+		channel.Publish("events", "car.3", false, false, amqp.Publishing{Body: []byte("car")})
+		ready, _ := broker.QueueLen("events.copy")
+		return ready > 0
+	})
+	if !ok {
+		t.Error("topology is not declared after reconnect")
+	}
+}
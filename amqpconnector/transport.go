@@ -0,0 +1,58 @@
+package amqpconnector
+
+import (
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// Channel channel operations of broker transport, implemented by *amqp.Channel
+type Channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(returns chan amqp.Return) chan amqp.Return
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Transport connection of broker
+type Transport interface {
+	Channel() (Channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// amqpTransport amqp server connection
+type amqpTransport struct {
+	*amqp.Connection
+}
+
+// Channel opens amqp channel
+func (t amqpTransport) Channel() (Channel, error) {
+	channel, err := t.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// Dial connects to broker of uri, memory:// uri connects to in-process MemoryBroker
+func Dial(uri string) (Transport, error) {
+	if strings.HasPrefix(uri, memoryScheme) {
+		return GetMemoryBroker(strings.TrimPrefix(uri, memoryScheme)).Connect(), nil
+	}
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, err
+	}
+	return amqpTransport{conn}, nil
+}
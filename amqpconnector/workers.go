@@ -0,0 +1,129 @@
+package amqpconnector
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// ErrDrainTimeout in-flight deliveries are not handled in time
+var ErrDrainTimeout = errors.New("consumer drain timeout")
+
+// OrderKey returns ordering key of delivery,
+// deliveries with equal keys are handled sequentially by one worker
+type OrderKey func(*Delivery) string
+
+// OrderByRoutingKey keeps order of deliveries with equal routing key
+func OrderByRoutingKey(d *Delivery) string {
+	return d.RoutingKey
+}
+
+// OrderByUpdateID keeps order of Update messages of one object,
+// routing key is used for other messages
+func OrderByUpdateID(d *Delivery) string {
+	var update struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(d.Body, &update); err != nil || update.ID == "" {
+		return d.RoutingKey
+	}
+	return update.ID
+}
+
+// dispatch handles deliveries by worker pool of queue until deliveries channel is closed
+func (c *Consumer) dispatch(deliveries <-chan amqp.Delivery) {
+	defer c.running.Done()
+	workers := 1
+	var orderKey OrderKey
+	if c.queue != nil {
+		workers, orderKey = c.queue.Workers, c.queue.OrderKey
+	}
+	if workers <= 1 {
+		for d := range deliveries {
+			c.handleDelivery(d)
+		}
+		return
+	}
+	// unordered workers share one channel, ordered ones have own channel each
+	queues := make([]chan amqp.Delivery, 1)
+	if orderKey != nil {
+		queues = make([]chan amqp.Delivery, workers)
+	}
+	for i := range queues {
+		queues[i] = make(chan amqp.Delivery)
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(queue chan amqp.Delivery) {
+			defer wg.Done()
+			for d := range queue {
+				c.handleDelivery(d)
+			}
+		}(queues[i%len(queues)])
+	}
+	for d := range deliveries {
+		i := 0
+		if orderKey != nil {
+			dv := Delivery(d)
+			hash := fnv.New32a()
+			hash.Write([]byte(orderKey(&dv)))
+			i = int(hash.Sum32() % uint32(len(queues)))
+		}
+		queues[i] <- d
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+}
+
+// Drain stops consuming, waits for in-flight deliveries and closes consumer channel,
+// timeout 0 waits without limit
+func (c *Consumer) Drain(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	logrus.Warn(c.logInfo("[Drain] stop consuming"))
+	c.forget()
+	if c.connection != nil {
+		c.connection.unregister(c)
+	}
+	channel := c.getChannel()
+	if channel != nil && c.queue != nil {
+		// deliveries channel is closed after buffered deliveries
+		if err := channel.Cancel(c.tag, false); err != nil {
+			logrus.Error(c.logInfo("[Drain] consumer cancel err: "), err)
+		}
+	}
+	drained := make(chan struct{})
+	go func() {
+		c.running.Wait()
+		close(drained)
+	}()
+	var err error
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-drained:
+		case <-timer.C:
+			err = ErrDrainTimeout
+		}
+		timer.Stop()
+	} else {
+		<-drained
+	}
+	if channel != nil {
+		if errClose := channel.Close(); errClose != nil && errClose != amqp.ErrClosed && err == nil {
+			err = errClose
+		}
+	}
+	logrus.Warn(c.logInfo("[Drain] AMQP drain finished"))
+	return err
+}
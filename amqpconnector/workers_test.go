@@ -0,0 +1,237 @@
+package amqpconnector
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// orderRecorder records handled sequence numbers by order key and max count of concurrent handlers
+type orderRecorder struct {
+	sync.Mutex
+	handled   map[string][]int
+	count     int
+	active    int
+	maxActive int
+}
+
+func (r *orderRecorder) handle(key string, seq int) {
+	r.Lock()
+	r.active++
+	if r.active > r.maxActive {
+		r.maxActive = r.active
+	}
+	r.Unlock()
+	// even deliveries are slow, so parallel handling of one key breaks order
+	if seq%2 == 0 {
+		time.Sleep(3 * time.Millisecond)
+	}
+	r.Lock()
+	r.active--
+	r.handled[key] = append(r.handled[key], seq)
+	r.count++
+	r.Unlock()
+}
+
+func (r *orderRecorder) handledCount() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.count
+}
+
+// check verifies that every key is handled in publish order with concurrent workers
+func (r *orderRecorder) check(t *testing.T, keys, perKey int) {
+	t.Helper()
+	if !waitFor(t, 5*time.Second, func() bool { return r.handledCount() == keys*perKey }) {
+		t.Fatalf("%d deliveries handled, expected %d", r.handledCount(), keys*perKey)
+	}
+	r.Lock()
+	defer r.Unlock()
+	if len(r.handled) != keys {
+		t.Errorf("%d keys handled, expected %d", len(r.handled), keys)
+	}
+	for key, seqs := range r.handled {
+		for i, seq := range seqs {
+			if seq != i {
+				t.Errorf("key %s handled out of order: %v", key, seqs)
+				break
+			}
+		}
+	}
+	if r.maxActive < 2 {
+		t.Errorf("keys are handled by one worker, max concurrent handlers %d", r.maxActive)
+	}
+}
+
+func TestWorkersOrderByRoutingKey(t *testing.T) {
+	_, uri, channel := testBroker(t)
+	rec := &orderRecorder{handled: make(map[string][]int)}
+	queue := &Queue{Name: "ordered", Keys: []string{"#"}, Workers: 4, OrderKey: OrderByRoutingKey}
+	c, err := NewResultConsumer(uri, "ordered", &Exchange{Name: "events", Type: "topic"}, queue, func(d *Delivery) HandleResult {
+		seq, _ := strconv.Atoi(string(d.Body))
+		rec.handle(d.RoutingKey, seq)
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	keys := []string{"car.1", "car.2", "car.3", "car.4", "car.5", "car.6", "car.7", "car.8"}
+	for seq := 0; seq < 20; seq++ {
+		for _, key := range keys {
+			if err = channel.Publish("events", key, false, false, amqp.Publishing{Body: []byte(strconv.Itoa(seq))}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	rec.check(t, len(keys), 20)
+}
+
+func TestOrderByUpdateID(t *testing.T) {
+	cases := []struct {
+		body string
+		key  string
+	}{
+		{`{"id": "42", "cmd": "update", "collection": "users"}`, "42"},
+		{`{"cmd": "update", "collection": "users"}`, "users"},
+		{`{"id": 42}`, "users"},
+		{`not json`, "users"},
+	}
+	for _, tc := range cases {
+		if key := OrderByUpdateID(&Delivery{RoutingKey: "users", Body: []byte(tc.body)}); key != tc.key {
+			t.Errorf("%s: key %q, expected %q", tc.body, key, tc.key)
+		}
+	}
+}
+
+func TestWorkersOrderByUpdateID(t *testing.T) {
+	_, uri, channel := testBroker(t)
+	rec := &orderRecorder{handled: make(map[string][]int)}
+	queue := &Queue{Name: "updates", Keys: []string{"users"}, Workers: 4, OrderKey: OrderByUpdateID}
+	c, err := NewResultConsumer(uri, "updates", &Exchange{Name: "updates", Type: "direct"}, queue, func(d *Delivery) HandleResult {
+		var update Update
+		if err := json.Unmarshal(d.Body, &update); err != nil {
+			t.Error(err)
+			return Nack
+		}
+		seq, _ := strconv.Atoi(update.Data)
+		rec.handle(update.ID, seq)
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	// all updates have one routing key, objects are spread over workers by id
+	ids := []string{"1", "2", "3", "4", "5", "6", "7", "8"}
+	for seq := 0; seq < 20; seq++ {
+		for _, id := range ids {
+			body, _ := json.Marshal(Update{ID: id, Cmd: "update", Collection: "users", Data: strconv.Itoa(seq)})
+			if err = channel.Publish("updates", "users", false, false, amqp.Publishing{Body: body}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	rec.check(t, len(ids), 20)
+}
+
+// blockingConsumer returns consumer of queue with handlers blocked until release is closed
+func blockingConsumer(t *testing.T, uri string, channel Channel, workers int, started chan<- string, release <-chan struct{}, finished *counter) *Consumer {
+	t.Helper()
+	queue := &Queue{Name: "slow", Keys: []string{"job"}, Workers: workers}
+	c, err := NewResultConsumer(uri, "slow", &Exchange{Name: "jobs", Type: "direct"}, queue, func(d *Delivery) HandleResult {
+		started <- string(d.Body)
+		<-release
+		finished.add()
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = channel.Publish("jobs", "job", false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+type counter struct {
+	sync.Mutex
+	n int
+}
+
+func (c *counter) add() {
+	c.Lock()
+	c.n++
+	c.Unlock()
+}
+
+func (c *counter) get() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.n
+}
+
+func TestDrainWaitsInFlight(t *testing.T) {
+	for _, workers := range []int{1, 2} {
+		broker, uri, channel := testBroker(t)
+		started := make(chan string, 3)
+		release := make(chan struct{})
+		finished := &counter{}
+		c := blockingConsumer(t, uri, channel, workers, started, release, finished)
+		for i := 0; i < workers; i++ {
+			select {
+			case <-started:
+			case <-time.After(time.Second):
+				t.Fatalf("workers %d: delivery is not handled", workers)
+			}
+		}
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+		}()
+		begin := time.Now()
+		if err := c.Drain(5 * time.Second); err != nil {
+			t.Fatalf("workers %d: drain err %v", workers, err)
+		}
+		if time.Since(begin) < 40*time.Millisecond {
+			t.Errorf("workers %d: drain does not wait for in-flight handlers", workers)
+		}
+		handled := finished.get()
+		if handled < workers || handled != len(started)+workers {
+			t.Errorf("workers %d: %d deliveries finished, %d started", workers, handled, len(started)+workers)
+		}
+		// deliveries not handled before drain are returned to queue
+		if ready, unacked := broker.QueueLen("slow"); ready != 3-handled || unacked != 0 {
+			t.Errorf("workers %d: queue has %d ready and %d unacked, handled %d", workers, ready, unacked, handled)
+		}
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	_, uri, channel := testBroker(t)
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	defer close(release)
+	c := blockingConsumer(t, uri, channel, 2, started, release, &counter{})
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("delivery is not handled")
+	}
+	begin := time.Now()
+	if err := c.Drain(50 * time.Millisecond); err != ErrDrainTimeout {
+		t.Errorf("drain of blocked handlers err %v, expected %v", err, ErrDrainTimeout)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("drain timeout is not kept: %v", elapsed)
+	}
+	if err := c.Drain(50 * time.Millisecond); err != nil {
+		t.Errorf("second drain err %v", err)
+	}
+}
@@ -44,6 +44,64 @@ var (
 	PublisherInitWait = NewInitWait()
 )
 
+// Message contracts of notifications
+const (
+	ContractMail = "mail"
+	ContractSMS  = "sms"
+	ContractPush = "push"
+)
+
+// json schemas of notification contracts v1
+const (
+	mailSchema = `{
+	"type": "object",
+	"properties": {
+		"from": {"type": "string"},
+		"senderName": {"type": "string"},
+		"to": {"type": "string", "minLength": 1},
+		"subject": {"type": "string"},
+		"images": {"type": ["array", "null"], "items": {"type": "string"}},
+		"bucket": {"type": "string"},
+		"body": {"type": "string"},
+		"contentType": {"type": "string"},
+		"template": {"type": "string"},
+		"templateType": {"type": "string"},
+		"templateContext": {}
+	},
+	"required": ["to"],
+	"additionalProperties": false
+}`
+	smsSchema = `{
+	"type": "object",
+	"properties": {
+		"phone": {"type": "string", "minLength": 1},
+		"msg": {"type": "string", "minLength": 1},
+		"msgId": {"type": ["string", "null"]},
+		"type": {"type": "string"}
+	},
+	"required": ["phone", "msg"],
+	"additionalProperties": false
+}`
+	pushSchema = `{
+	"type": "object",
+	"properties": {
+		"msg": {"type": "string"},
+		"data": {},
+		"title": {"type": "string"},
+		"tokens": {"type": "array", "minItems": 1, "items": {"type": "string", "minLength": 1}},
+		"isTopic": {"type": "boolean"}
+	},
+	"required": ["tokens"],
+	"additionalProperties": false
+}`
+)
+
+func init() {
+	amqp.DefaultContracts.MustRegisterSchema(ContractMail, 1, []byte(mailSchema))
+	amqp.DefaultContracts.MustRegisterSchema(ContractSMS, 1, []byte(smsSchema))
+	amqp.DefaultContracts.MustRegisterSchema(ContractPush, 1, []byte(pushSchema))
+}
+
 // InitWait - wait initialize
 type InitWait struct {
 	sync.Mutex
@@ -210,11 +268,10 @@ func SendEmail(to, subject, mail string, contentType string, images *[]string, o
 	if newMail.Template != "" {
 		newMail.TemplateContext = data
 	}
-	m, err := json.Marshal(newMail)
-	if err != nil {
-		log.Warn("msgSender-sendEmail error json marshal: ", err)
+	if err := notificationPublisher.PublishContract(ContractMail, newMail, "email"); err != nil {
+		log.Error("[msgSender-SendEmail] ", "Error send notification to: "+to, err)
+		return
 	}
-	notificationPublisher.Publish(m, "email")
 	log.Info("[msgSender-SendEmail] ", "Success sended notification to: ", to)
 }
 
@@ -230,12 +287,10 @@ func SendSMS(phone, msg string, options ...string) {
 	if len(options) > 1 {
 		newSms.Type = options[1]
 	}
-	m, err := json.Marshal(newSms)
-	if err != nil {
+	if err := notificationPublisher.PublishContract(ContractSMS, newSms, "sms"); err != nil {
 		log.Error("[msgSender-SendSMS] ", "Error create sms for client: "+phone, err)
 		return
 	}
-	notificationPublisher.Publish(m, "sms")
 	log.Info("[msgSender-SendSMS] ", "Success sended notification to: ", phone)
 }
 
@@ -249,12 +304,10 @@ func SendPush(msg, title string, tokens []string, data interface{}, isTopic bool
 	newPush := Push{Msg: msg, Title: title, Tokens: tokens, Data: data}
 	newPush.IsTopic = isTopic
 
-	m, err := json.Marshal(newPush)
-	if err != nil {
+	if err := notificationPublisher.PublishContract(ContractPush, newPush, "push"); err != nil {
 		log.Error("[msgSender-SendPush] ", "Error create push: ", err)
 		return
 	}
-	notificationPublisher.Publish(m, "push")
 	log.Info("[msgSender-SendPush] ", "Success sended notification to: ", tokens)
 }
 
@@ -0,0 +1,36 @@
+package msgsender
+
+import (
+	"testing"
+
+	amqp "gitlab.com/battler/modules/amqpconnector"
+)
+
+func TestSendValidation(t *testing.T) {
+	amqpURI = "memory://msgsender-test"
+	initNotificationsPublisher()
+	defer func() {
+		amqpURI, notificationPublisher = "", nil
+	}()
+	broker := amqp.GetMemoryBroker("msgsender-test")
+	// invalid notifications are logged and not published
+	SendSMS("79000000000", "")
+	SendSMS("", "code 1234")
+	SendPush("msg", "title", nil, nil, false)
+	SendPush("msg", "title", []string{}, nil, false)
+	SendPush("msg", "title", []string{""}, nil, false)
+	if published := broker.Published(); len(published) != 0 {
+		t.Fatalf("invalid notifications are published: %+v", published)
+	}
+	SendSMS("79000000000", "code 1234")
+	SendPush("msg", "title", []string{"token"}, map[string]interface{}{"id": 1}, false)
+	published := broker.Published()
+	if len(published) != 2 {
+		t.Fatalf("%d notifications are published, expected 2", len(published))
+	}
+	for i, key := range []string{"sms", "push"} {
+		if pub := published[i]; pub.Exchange != mailingsExchange || pub.RoutingKey != key {
+			t.Errorf("notification %d is published to %s by %s", i, pub.Exchange, pub.RoutingKey)
+		}
+	}
+}
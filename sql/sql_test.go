@@ -0,0 +1,132 @@
+package sql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	amqp "gitlab.com/battler/modules/amqpconnector"
+)
+
+// recordDriver database driver recording executed statements, statements with "fail" return error
+type recordDriver struct {
+	sync.Mutex
+	queries []string
+}
+
+func (d *recordDriver) Open(name string) (driver.Conn, error) {
+	return &recordConn{d}, nil
+}
+
+func (d *recordDriver) executed() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.queries...)
+}
+
+type recordConn struct {
+	d *recordDriver
+}
+
+func (c *recordConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordStmt{c.d, query}, nil
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+func (c *recordConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *recordConn) Commit() error {
+	return nil
+}
+
+func (c *recordConn) Rollback() error {
+	return nil
+}
+
+type recordStmt struct {
+	d     *recordDriver
+	query string
+}
+
+func (s *recordStmt) Close() error {
+	return nil
+}
+
+func (s *recordStmt) NumInput() int {
+	return -1
+}
+
+func (s *recordStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.Contains(s.query, "fail") {
+		return nil, errors.New("exec failed")
+	}
+	s.d.Lock()
+	s.d.queries = append(s.d.queries, s.query)
+	s.d.Unlock()
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("query is not supported")
+}
+
+var testDriver = &recordDriver{}
+
+func init() {
+	sql.Register("record", testDriver)
+}
+
+func TestSchemaTableInsertUpdates(t *testing.T) {
+	type user struct {
+		ID   string `db:"id" json:"id" type:"uuid" key:"1"`
+		Name string `db:"name" json:"name" type:"text"`
+	}
+	db, err := sql.Open("record", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// updates of inserted rows are published to in-process broker of AMQP_URI=memory://
+	amqpURI = "memory://sql-test"
+	defer func() { amqpURI = "" }()
+	broker := amqp.GetMemoryBroker("sql-test")
+	users := NewSchemaTable("users", user{}, map[string]interface{}{"db": sqlx.NewDb(db, "postgres")})
+	if err = users.Insert(user{ID: "e2c1b0a8-3f2d-4b8e-9d0a-6c1f2e3d4b5a", Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if queries := testDriver.executed(); len(queries) != 1 || queries[0] != `INSERT INTO "users" ("id","name") VALUES ($1,$2)` {
+		t.Errorf("executed %q", queries)
+	}
+	// update is sent in background after insert
+	deadline := time.Now().Add(time.Second)
+	for len(broker.Updates()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	updates := broker.Updates()
+	if len(updates) != 1 {
+		t.Fatalf("updates %+v", updates)
+	}
+	if u := updates[0]; u.Cmd != "create" || u.Collection != "users" || u.ID != "e2c1b0a8-3f2d-4b8e-9d0a-6c1f2e3d4b5a" || u.Data != `{"id":"e2c1b0a8-3f2d-4b8e-9d0a-6c1f2e3d4b5a","name":"Ann"}` {
+		t.Errorf("update %+v", u)
+	}
+	// failed insert is not published
+	broker.ClearPublished()
+	failed := NewSchemaTable("fail_users", user{}, map[string]interface{}{"db": sqlx.NewDb(db, "postgres")})
+	if err = failed.Insert(user{ID: "0c9a6b1e-2d4f-4e3a-8b7c-5d6e7f8a9b0c", Name: "Bob"}); err == nil {
+		t.Fatal("failed insert returns no error")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if updates = broker.Updates(); len(updates) != 0 {
+		t.Errorf("update of failed insert %+v", updates)
+	}
+}
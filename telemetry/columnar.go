@@ -0,0 +1,640 @@
+package telemetry
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// BlockCompression compression of columnar block payload
+type BlockCompression uint8
+
+const (
+	// BlockRaw payload without compression
+	BlockRaw BlockCompression = iota
+	// BlockZstd payload compressed by zstd
+	BlockZstd
+	// BlockSnappy payload compressed by snappy
+	BlockSnappy
+)
+
+const (
+	// columnar block structure
+	// 2 byte sign + 1 byte version + 1 byte compression + payload
+	blockVersion = 1
+	// time column modes
+	blockTimeDelta   = 0 // zig-zag varint deltas of integer milliseconds
+	blockTimeFloat64 = 1 // raw float64 values
+	// column kinds
+	columnNumber = 0
+	columnString = 1
+	columnBytes  = 2
+	columnEvents = 3
+	// number column modes
+	columnModeScaled  = 0 // zig-zag varint deltas of values scaled by 10^exp
+	columnModeFloat32 = 1
+	columnModeFloat64 = 2
+	// max scale exponent of number column
+	columnMaxExp = 9
+)
+
+var (
+	blockID = []byte("bc")
+
+	// ErrBlockFormat columnar block is corrupted or has unknown format
+	ErrBlockFormat = errors.New("invalid columnar block")
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// blockBuf is a reader of block payload
+type blockBuf struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (b *blockBuf) uvarint() uint64 {
+	if b.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(b.buf[b.off:])
+	if n <= 0 {
+		b.err = ErrBlockFormat
+		return 0
+	}
+	b.off += n
+	return v
+}
+
+func (b *blockBuf) varint() int64 {
+	if b.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(b.buf[b.off:])
+	if n <= 0 {
+		b.err = ErrBlockFormat
+		return 0
+	}
+	b.off += n
+	return v
+}
+
+func (b *blockBuf) bytes(n int) []byte {
+	if b.err != nil {
+		return nil
+	}
+	if n < 0 || b.off+n > len(b.buf) {
+		b.err = ErrBlockFormat
+		return nil
+	}
+	v := b.buf[b.off : b.off+n]
+	b.off += n
+	return v
+}
+
+func (b *blockBuf) byte() byte {
+	v := b.bytes(1)
+	if v == nil {
+		return 0
+	}
+	return v[0]
+}
+
+// blockColumn column descriptor with rows values
+type blockColumn struct {
+	key  uint16
+	kind uint8
+	data []byte
+}
+
+// numberScale returns exponent for lossless integer scaling of values
+func numberScale(values []float64) (int, bool) {
+	for exp := 0; exp <= columnMaxExp; exp++ {
+		scale := math.Pow10(exp)
+		ok := true
+		for _, v := range values {
+			s := math.Round(v * scale)
+			if math.Abs(s) > 1<<53 || s/scale != v || (v == 0 && math.Signbit(v)) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return exp, true
+		}
+	}
+	return 0, false
+}
+
+func isFloat32Values(values []float64) bool {
+	for _, v := range values {
+		if float64(float32(v)) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func appendBitmap(buf []byte, present []bool) []byte {
+	bitmap := make([]byte, (len(present)+7)/8)
+	for i, ok := range present {
+		if ok {
+			bitmap[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return append(buf, bitmap...)
+}
+
+func encodeNumberColumn(key uint16, positions []FlatPosition) []byte {
+	present := make([]bool, len(positions))
+	values := make([]float64, 0, len(positions))
+	for i := range positions {
+		if v, ok := positions[i].P[key]; ok {
+			present[i] = true
+			values = append(values, v)
+		}
+	}
+	data := appendBitmap(nil, present)
+	if exp, ok := numberScale(values); ok {
+		scale := math.Pow10(exp)
+		data = append(data, columnModeScaled, byte(exp))
+		var prev int64
+		for _, v := range values {
+			s := int64(math.Round(v * scale))
+			data = appendVarint(data, s-prev)
+			prev = s
+		}
+	} else if isFloat32Values(values) {
+		data = append(data, columnModeFloat32)
+		for _, v := range values {
+			data = append(data, float32ToByte(float32(v))...)
+		}
+	} else {
+		data = append(data, columnModeFloat64)
+		for _, v := range values {
+			data = append(data, float64ToByte(v)...)
+		}
+	}
+	return data
+}
+
+func encodeBytesColumn(positions []FlatPosition, get func(pos *FlatPosition) ([]byte, bool)) []byte {
+	present := make([]bool, len(positions))
+	var values []byte
+	for i := range positions {
+		if v, ok := get(&positions[i]); ok {
+			present[i] = true
+			values = appendUvarint(values, uint64(len(v)))
+			values = append(values, v...)
+		}
+	}
+	return append(appendBitmap(nil, present), values...)
+}
+
+func encodeEventsColumn(positions []FlatPosition) []byte {
+	var data []byte
+	for i := range positions {
+		data = appendUvarint(data, uint64(len(positions[i].E)))
+		for _, e := range positions[i].E {
+			data = appendUvarint(data, uint64(e))
+		}
+	}
+	return data
+}
+
+// EncodeBlock writes positions to columnar block
+func EncodeBlock(positions []FlatPosition, compression BlockCompression) ([]byte, error) {
+	// payload structure
+	// count + time mode + times + dictionary (key delta, kind, column length) + columns
+	payload := appendUvarint(nil, uint64(len(positions)))
+	integral := true
+	for i := range positions {
+		t := positions[i].Time
+		if t != math.Trunc(t) || math.Abs(t) > 1<<53 {
+			integral = false
+			break
+		}
+	}
+	if integral {
+		payload = append(payload, blockTimeDelta)
+		var prev int64
+		for i := range positions {
+			t := int64(positions[i].Time)
+			payload = appendVarint(payload, t-prev)
+			prev = t
+		}
+	} else {
+		payload = append(payload, blockTimeFloat64)
+		for i := range positions {
+			payload = append(payload, float64ToByte(positions[i].Time)...)
+		}
+	}
+
+	numbers := map[uint16]bool{}
+	strs := map[uint16]bool{}
+	bytesKeys := map[uint16]bool{}
+	hasEvents, hasZones := false, false
+	for i := range positions {
+		for key := range positions[i].P {
+			numbers[key] = true
+		}
+		for key := range positions[i].S {
+			strs[key] = true
+		}
+		for key := range positions[i].B {
+			bytesKeys[key] = true
+		}
+		hasEvents = hasEvents || len(positions[i].E) > 0
+		hasZones = hasZones || len(positions[i].Zones) > 0
+	}
+	columns := make([]blockColumn, 0, len(numbers)+len(strs)+len(bytesKeys)+2)
+	for _, key := range sortKeys(mapKeys(numbers)) {
+		columns = append(columns, blockColumn{key, columnNumber, encodeNumberColumn(key, positions)})
+	}
+	for _, key := range sortKeys(mapKeys(strs)) {
+		k := key
+		columns = append(columns, blockColumn{key, columnString, encodeBytesColumn(positions, func(pos *FlatPosition) ([]byte, bool) {
+			v, ok := pos.S[k]
+			return []byte(v), ok
+		})})
+	}
+	for _, key := range sortKeys(mapKeys(bytesKeys)) {
+		k := key
+		columns = append(columns, blockColumn{key, columnBytes, encodeBytesColumn(positions, func(pos *FlatPosition) ([]byte, bool) {
+			v, ok := pos.B[k]
+			return v, ok
+		})})
+	}
+	if hasZones {
+		var zonesErr error
+		columns = append(columns, blockColumn{paramZones, columnBytes, encodeBytesColumn(positions, func(pos *FlatPosition) ([]byte, bool) {
+			if len(pos.Zones) == 0 {
+				return nil, false
+			}
+			data, err := json.Marshal(pos.Zones)
+			if err != nil {
+				zonesErr = err
+				return nil, false
+			}
+			return data, true
+		})})
+		if zonesErr != nil {
+			return nil, zonesErr
+		}
+	}
+	if hasEvents {
+		columns = append(columns, blockColumn{paramEvent, columnEvents, encodeEventsColumn(positions)})
+	}
+
+	payload = appendUvarint(payload, uint64(len(columns)))
+	var prevKey uint16
+	for _, col := range columns {
+		payload = appendVarint(payload, int64(col.key)-int64(prevKey))
+		payload = append(payload, col.kind)
+		payload = appendUvarint(payload, uint64(len(col.data)))
+		prevKey = col.key
+	}
+	for _, col := range columns {
+		payload = append(payload, col.data...)
+	}
+
+	res := append([]byte(nil), blockID...)
+	res = append(res, blockVersion, byte(compression))
+	switch compression {
+	case BlockRaw:
+		return append(res, payload...), nil
+	case BlockZstd:
+		initZstd()
+		if zstdErr != nil {
+			return nil, zstdErr
+		}
+		return zstdEncoder.EncodeAll(payload, res), nil
+	case BlockSnappy:
+		return append(res, snappy.Encode(nil, payload)...), nil
+	}
+	return nil, errors.New("unknown block compression")
+}
+
+func mapKeys(m map[uint16]bool) []uint16 {
+	keys := make([]uint16, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// IsBlock checks columnar block sign
+func IsBlock(data []byte) bool {
+	return len(data) >= 4 && data[0] == blockID[0] && data[1] == blockID[1]
+}
+
+// BlockReader reads positions from columnar block,
+// decodes only columns of requested params
+type BlockReader struct {
+	Params    map[uint16]bool
+	Events    map[uint16]bool
+	BeginTime time.Time
+	EndTime   time.Time
+}
+
+func blockPayload(block []byte) ([]byte, error) {
+	if !IsBlock(block) || block[2] != blockVersion {
+		return nil, ErrBlockFormat
+	}
+	data := block[4:]
+	switch BlockCompression(block[3]) {
+	case BlockRaw:
+		return data, nil
+	case BlockZstd:
+		initZstd()
+		if zstdErr != nil {
+			return nil, zstdErr
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	case BlockSnappy:
+		return snappy.Decode(nil, data)
+	}
+	return nil, ErrBlockFormat
+}
+
+func readBitmap(b *blockBuf, count int) []byte {
+	return b.bytes((count + 7) / 8)
+}
+
+func bitmapHas(bitmap []byte, i int) bool {
+	return bitmap[i/8]&(1<<uint(i%8)) != 0
+}
+
+func decodeNumberColumn(key uint16, data []byte, positions []FlatPosition) error {
+	b := &blockBuf{buf: data}
+	bitmap := readBitmap(b, len(positions))
+	mode := b.byte()
+	var scale float64
+	var prev int64
+	if mode == columnModeScaled {
+		exp := b.byte()
+		if exp > columnMaxExp {
+			return ErrBlockFormat
+		}
+		scale = math.Pow10(int(exp))
+	}
+	for i := range positions {
+		if b.err != nil {
+			return b.err
+		}
+		if !bitmapHas(bitmap, i) {
+			continue
+		}
+		var v float64
+		switch mode {
+		case columnModeScaled:
+			prev += b.varint()
+			v = float64(prev) / scale
+		case columnModeFloat32:
+			if buf := b.bytes(4); buf != nil {
+				v = float64(ReadFloat32(buf))
+			}
+		case columnModeFloat64:
+			if buf := b.bytes(8); buf != nil {
+				v = ReadFloat64(buf)
+			}
+		default:
+			return ErrBlockFormat
+		}
+		if positions[i].P != nil {
+			positions[i].P[key] = v
+		}
+	}
+	return b.err
+}
+
+func decodeBytesColumn(data []byte, positions []FlatPosition, set func(pos *FlatPosition, v []byte) error) error {
+	b := &blockBuf{buf: data}
+	bitmap := readBitmap(b, len(positions))
+	for i := range positions {
+		if b.err != nil {
+			return b.err
+		}
+		if !bitmapHas(bitmap, i) {
+			continue
+		}
+		v := b.bytes(int(b.uvarint()))
+		if b.err != nil {
+			return b.err
+		}
+		if err := set(&positions[i], v); err != nil {
+			return err
+		}
+	}
+	return b.err
+}
+
+func decodeEventsColumn(data []byte, positions []FlatPosition) error {
+	b := &blockBuf{buf: data}
+	for i := range positions {
+		count := b.uvarint()
+		if b.err != nil {
+			return b.err
+		}
+		if count == 0 {
+			continue
+		}
+		if count > uint64(len(data)) {
+			return ErrBlockFormat
+		}
+		positions[i].E = make([]uint16, count)
+		for j := range positions[i].E {
+			positions[i].E[j] = uint16(b.uvarint())
+		}
+	}
+	return b.err
+}
+
+// ReadFlatPositions decodes positions from columnar block
+func (r *BlockReader) ReadFlatPositions(block []byte) ([]FlatPosition, error) {
+	payload, err := blockPayload(block)
+	if err != nil {
+		return nil, err
+	}
+	b := &blockBuf{buf: payload}
+	count := int(b.uvarint())
+	if b.err != nil || count > len(payload) {
+		return nil, ErrBlockFormat
+	}
+	positions := make([]FlatPosition, count)
+	switch b.byte() {
+	case blockTimeDelta:
+		var prev int64
+		for i := range positions {
+			prev += b.varint()
+			positions[i].Time = float64(prev)
+		}
+	case blockTimeFloat64:
+		for i := range positions {
+			if buf := b.bytes(8); buf != nil {
+				positions[i].Time = ReadFloat64(buf)
+			}
+		}
+	default:
+		return nil, ErrBlockFormat
+	}
+	for i := range positions {
+		positions[i].P = make(map[uint16]float64)
+	}
+
+	colCount := int(b.uvarint())
+	if b.err != nil || colCount > len(payload) {
+		return nil, ErrBlockFormat
+	}
+	columns := make([]blockColumn, colCount)
+	lens := make([]int, colCount)
+	var key int64
+	for i := range columns {
+		key += b.varint()
+		columns[i].key = uint16(key)
+		columns[i].kind = b.byte()
+		lens[i] = int(b.uvarint())
+	}
+	for i := range columns {
+		// only slice column data, decode later if requested
+		columns[i].data = b.bytes(lens[i])
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	lenParams := len(r.Params)
+	for _, col := range columns {
+		if col.kind != columnEvents && lenParams > 0 && !r.Params[col.key] {
+			continue
+		}
+		key := col.key
+		switch col.kind {
+		case columnNumber:
+			err = decodeNumberColumn(key, col.data, positions)
+		case columnString:
+			err = decodeBytesColumn(col.data, positions, func(pos *FlatPosition, v []byte) error {
+				if pos.S == nil {
+					pos.S = make(map[uint16]string)
+				}
+				pos.S[key] = string(v)
+				return nil
+			})
+		case columnBytes:
+			err = decodeBytesColumn(col.data, positions, func(pos *FlatPosition, v []byte) error {
+				if key == paramZones {
+					return json.Unmarshal(v, &pos.Zones)
+				}
+				if pos.B == nil {
+					pos.B = make(map[uint16][]byte)
+				}
+				pos.B[key] = append([]byte(nil), v...)
+				return nil
+			})
+		case columnEvents:
+			err = decodeEventsColumn(col.data, positions)
+		default:
+			err = ErrBlockFormat
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.filter(positions), nil
+}
+
+// filter passes positions by time range and events
+func (r *BlockReader) filter(positions []FlatPosition) []FlatPosition {
+	checkTime := !(r.BeginTime.IsZero() && r.EndTime.IsZero())
+	if !checkTime && len(r.Events) == 0 {
+		return positions
+	}
+	beginUnix := r.BeginTime.Unix() * 1000
+	endUnix := r.EndTime.Unix() * 1000
+	res := positions[:0]
+	for _, pos := range positions {
+		if checkTime && (int64(pos.Time) < beginUnix || int64(pos.Time) > endUnix) {
+			continue
+		}
+		if len(r.Events) > 0 {
+			pass := false
+			for _, e := range pos.E {
+				if r.Events[e] {
+					pass = true
+					break
+				}
+			}
+			if !pass {
+				continue
+			}
+		}
+		res = append(res, pos)
+	}
+	return res
+}
+
+// FramesToBlock converts binary frames (BinaryData.Data) to columnar block
+func FramesToBlock(frames []byte, compression BlockCompression) ([]byte, error) {
+	reader := NewReader()
+	// stored values are converted as is, without registry scaling and rounding
+	reader.Registry = NewParamRegistry()
+	reader.Set(&frames)
+	code, positions := reader.ReadFlatPositions()
+	if code != 0 {
+		return nil, reader.Err()
+	}
+	return EncodeBlock(positions, compression)
+}
+
+// BlockToFrames converts columnar block to binary frames of protocol version
+func BlockToFrames(block []byte, version uint16) ([]byte, error) {
+	reader := BlockReader{}
+	positions, err := reader.ReadFlatPositions(block)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := NewEncoder(version)
+	if err != nil {
+		return nil, err
+	}
+	var res []byte
+	for i := range positions {
+		res, err = enc.AppendFlat(res, &positions[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
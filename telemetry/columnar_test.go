@@ -0,0 +1,49 @@
+package telemetry
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// storedPositions positions with values which registry precision would round
+func storedPositions(version uint16) []FlatPosition {
+	positions := []FlatPosition{
+		{Time: 1600000000000, P: map[uint16]float64{ParamLat: 55.1234567891234, ParamLon: 37.987654321, ParamSpeed: 61, 1021: 12.3456, 3400: 40.987, 3500: 7.123456}, E: []uint16{1}},
+		{Time: 1600000001000, P: map[uint16]float64{ParamLat: 55.1234567891239, ParamLon: 37.98765432, ParamSpeed: 0, 1021: 12.3, 3400: 40.9}},
+		{Time: 1600000002000, P: map[uint16]float64{ParamLat: 55.2, ParamSpeed: -1.5, 1201: 1234.56789, 3001: math.Copysign(0, -1), 2000: math.NaN()}},
+	}
+	if version >= protocolVersionCRC {
+		positions[0].S = map[uint16]string{500: "driver"}
+		positions[1].B = map[uint16][]byte{600: {1, 2, 3}}
+		positions[2].Zones = []ZoneInfo{{ID: "z1", Name: "Base"}}
+	}
+	return positions
+}
+
+func TestFramesBlockRoundTrip(t *testing.T) {
+	for _, version := range SupportedVersions {
+		enc, _ := NewEncoder(version)
+		var frames []byte
+		positions := storedPositions(version)
+		for i := range positions {
+			var err error
+			if frames, err = enc.AppendFlat(frames, &positions[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, compression := range []BlockCompression{BlockRaw, BlockZstd, BlockSnappy} {
+			block, err := FramesToBlock(frames, compression)
+			if err != nil {
+				t.Fatalf("version %d compression %d: %v", version, compression, err)
+			}
+			res, err := BlockToFrames(block, version)
+			if err != nil {
+				t.Fatalf("version %d compression %d: %v", version, compression, err)
+			}
+			if !bytes.Equal(res, frames) {
+				t.Errorf("version %d compression %d: frames are changed by block round trip", version, compression)
+			}
+		}
+	}
+}
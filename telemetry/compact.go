@@ -0,0 +1,256 @@
+package telemetry
+
+import (
+	"encoding/json"
+)
+
+// ParamKV param code and value
+type ParamKV struct {
+	K uint16
+	V float64
+}
+
+// CompactParams params sorted by code
+type CompactParams []ParamKV
+
+// index returns position of code or position for insert
+func (p CompactParams) index(code uint16) (int, bool) {
+	lo, hi := 0, len(p)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if p[m].K < code {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	return lo, lo < len(p) && p[lo].K == code
+}
+
+// Get returns param value by code
+func (p CompactParams) Get(code uint16) (float64, bool) {
+	if i, ok := p.index(code); ok {
+		return p[i].V, true
+	}
+	return 0, false
+}
+
+// Has checks param presence
+func (p CompactParams) Has(code uint16) bool {
+	_, ok := p.index(code)
+	return ok
+}
+
+// Set sets param value keeping params sorted
+func (p *CompactParams) Set(code uint16, v float64) {
+	params := *p
+	// frames are usually written with ascending codes, check tail first
+	n := len(params)
+	if n == 0 || params[n-1].K < code {
+		*p = append(params, ParamKV{code, v})
+		return
+	}
+	i, ok := params.index(code)
+	if ok {
+		params[i].V = v
+		return
+	}
+	params = append(params, ParamKV{})
+	copy(params[i+1:], params[i:])
+	params[i] = ParamKV{code, v}
+	*p = params
+}
+
+// Delete removes param
+func (p *CompactParams) Delete(code uint16) {
+	params := *p
+	if i, ok := params.index(code); ok {
+		*p = append(params[:i], params[i+1:]...)
+	}
+}
+
+// Map converts params to map
+func (p CompactParams) Map() map[uint16]float64 {
+	res := make(map[uint16]float64, len(p))
+	for _, kv := range p {
+		res[kv.K] = kv.V
+	}
+	return res
+}
+
+// CompactPosition position decoded into reused buffers,
+// string and bytes values reference reader buffer and are valid until buffer is changed
+type CompactPosition struct {
+	Time  float64
+	P     CompactParams
+	S     []ParamsBytes // string values
+	B     []ParamsBytes // bytes values
+	E     []uint16
+	zones []byte
+}
+
+// reset clears position keeping buffers
+func (pos *CompactPosition) reset(t float64) {
+	pos.Time = t
+	pos.P = pos.P[:0]
+	pos.S = pos.S[:0]
+	pos.B = pos.B[:0]
+	pos.E = pos.E[:0]
+	pos.zones = nil
+}
+
+// Zones decodes zones of position
+func (pos *CompactPosition) Zones() ([]ZoneInfo, error) {
+	if pos.zones == nil {
+		return nil, nil
+	}
+	var zones []ZoneInfo
+	err := json.Unmarshal(pos.zones, &zones)
+	return zones, err
+}
+
+// CopyTo copies position to flat position reusing its maps and slices
+func (pos *CompactPosition) CopyTo(dst *FlatPosition) *FlatPosition {
+	dst.Time = pos.Time
+	if dst.P == nil {
+		dst.P = make(map[uint16]float64, len(pos.P))
+	} else {
+		for k := range dst.P {
+			delete(dst.P, k)
+		}
+	}
+	for _, kv := range pos.P {
+		dst.P[kv.K] = kv.V
+	}
+	dst.S, dst.B = nil, nil
+	if len(pos.S) > 0 {
+		dst.S = make(map[uint16]string, len(pos.S))
+		for _, kv := range pos.S {
+			dst.S[kv.K] = string(kv.V)
+		}
+	}
+	if len(pos.B) > 0 {
+		dst.B = make(map[uint16][]byte, len(pos.B))
+		for _, kv := range pos.B {
+			dst.B[kv.K] = append([]byte(nil), kv.V...)
+		}
+	}
+	dst.E = append(dst.E[:0], pos.E...)
+	if len(dst.E) == 0 {
+		dst.E = nil
+	}
+	dst.Zones, _ = pos.Zones()
+	return dst
+}
+
+// Flat converts position to new flat position
+func (pos *CompactPosition) Flat() *FlatPosition {
+	return pos.CopyTo(&FlatPosition{})
+}
+
+// Binary converts position to struct position, params are stored as float64 values
+func (pos *CompactPosition) Binary() *BinaryPosition {
+	res := &BinaryPosition{Time: pos.Time, F64: make([]ParamsFloat64, len(pos.P))}
+	for i, kv := range pos.P {
+		res.F64[i] = ParamsFloat64{kv.K, kv.V}
+	}
+	for _, kv := range pos.S {
+		res.Str = append(res.Str, ParamsString{kv.K, string(kv.V)})
+	}
+	for _, kv := range pos.B {
+		res.Bytes = append(res.Bytes, ParamsBytes{kv.K, append([]byte(nil), kv.V...)})
+	}
+	res.E = append([]uint16(nil), pos.E...)
+	res.Zones, _ = pos.Zones()
+	return res
+}
+
+// DecodeCompactValue reads value to compact position
+func (reader *BinaryReader) DecodeCompactValue(kind uint8, key uint16) error {
+	if err := reader.checkValue(kind, key); err != nil {
+		return err
+	}
+	if kind != binaryArray && reader.lenParams > 0 && !reader.Params[key] && !reader.filterKeys[key] {
+		reader.Skip(kind, key)
+		return nil
+	}
+	pos := reader.compactPos
+	switch kind {
+	case binaryArray:
+		val := reader.ReadUint16()
+		pos.E = append(pos.E, val)
+		if reader.lenEvents > 0 && reader.Events[val] {
+			reader.pass = true
+		}
+	case binaryZero:
+		reader.setCompactValue(key, 0)
+	case binaryInt8:
+		reader.setCompactValue(key, float64(reader.ReadInt8()))
+	case binaryUint8:
+		reader.setCompactValue(key, float64(reader.ReadUint8()))
+	case binaryInt16:
+		reader.setCompactValue(key, float64(reader.ReadInt16()))
+	case binaryUint16:
+		reader.setCompactValue(key, float64(reader.ReadUint16()))
+	case binaryInt32:
+		reader.setCompactValue(key, float64(reader.ReadInt32()))
+	case binaryUint32:
+		reader.setCompactValue(key, float64(reader.ReadUint32()))
+	case binaryFloat64:
+		reader.setCompactValue(key, reader.readFloatValue(key, binaryFloat64))
+	case binaryFloat32:
+		reader.setCompactValue(key, reader.readFloatValue(key, binaryFloat32))
+	case binaryString:
+		pos.S = append(pos.S, ParamsBytes{key, reader.ReadBytes()})
+	case binaryBytes:
+		val := reader.ReadBytes()
+		if key == paramZones {
+			if !json.Valid(val) {
+				derr := reader.decodeError(ErrFrameKind, reader.frameStart, 0, 0)
+				derr.Key, derr.Kind = paramZones, kind
+				return derr
+			}
+			pos.zones = val
+			return nil
+		}
+		pos.B = append(pos.B, ParamsBytes{key, val})
+	}
+	return nil
+}
+
+// setCompactValue rounds value by reader registry and sets it to compact position
+func (reader *BinaryReader) setCompactValue(key uint16, raw float64) {
+	if v, ok := reader.roundValue(key, raw); ok {
+		reader.compactPos.P.Set(key, v)
+	}
+}
+
+// applyCompactFilter checks compact position by filter and removes params read only for filter
+func (reader *BinaryReader) applyCompactFilter() bool {
+	if reader.filterPos == nil {
+		reader.filterPos = &FlatPosition{}
+	}
+	if !reader.Filter.Match(reader.compactPos.CopyTo(reader.filterPos)) {
+		return false
+	}
+	for key := range reader.filterKeys {
+		reader.compactPos.P.Delete(key)
+		if key == paramZones {
+			reader.compactPos.zones = nil
+		}
+	}
+	return true
+}
+
+// ReadCompactPositionsFunc reads positions into one reused compact position without allocations,
+// position is valid only during callback
+func (reader *BinaryReader) ReadCompactPositionsFunc(cb func(pos *CompactPosition)) int16 {
+	reader.PositionFormat = "compact"
+	reader.Reset()
+	if reader.compactPos == nil {
+		reader.compactPos = &CompactPosition{}
+	}
+	return reader.readPositions(func() {
+		cb(reader.compactPos)
+	})
+}
@@ -0,0 +1,114 @@
+package telemetry
+
+import (
+	"reflect"
+	"testing"
+)
+
+// compactFrames encodes stored positions of every supported version
+func compactFrames(t testing.TB) []byte {
+	var frames []byte
+	for _, version := range SupportedVersions {
+		enc, _ := NewEncoder(version)
+		positions := storedPositions(version)
+		for i := range positions {
+			var err error
+			if frames, err = enc.AppendFlat(frames, &positions[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return frames
+}
+
+// sameFlat compares positions, NaN values are equal
+func sameFlat(a, b *FlatPosition) bool {
+	if a.Time != b.Time || len(a.P) != len(b.P) || !reflect.DeepEqual(a.S, b.S) || !reflect.DeepEqual(a.B, b.B) ||
+		!reflect.DeepEqual(a.E, b.E) || !reflect.DeepEqual(a.Zones, b.Zones) {
+		return false
+	}
+	for k, v := range a.P {
+		if w, ok := b.P[k]; !ok || !sameFloat(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// compactPositions reads frames by compact reader and converts positions by cb
+func compactPositions(reader *BinaryReader, frames []byte, cb func(pos *CompactPosition) *FlatPosition) (int16, []*FlatPosition) {
+	var res []*FlatPosition
+	reader.Set(&frames)
+	code := reader.ReadCompactPositionsFunc(func(pos *CompactPosition) {
+		res = append(res, cb(pos))
+	})
+	return code, res
+}
+
+func TestCompactFlatEquivalence(t *testing.T) {
+	frames := compactFrames(t)
+	for name, registry := range map[string]*ParamRegistry{"default": nil, "registry": DefaultRegistry} {
+		reader := NewReader()
+		reader.Registry = registry
+		reader.Set(&frames)
+		code, expected := reader.ReadFlatPositions()
+		if code != 0 || len(expected) == 0 {
+			t.Fatalf("%s: code %d positions %d", name, code, len(expected))
+		}
+		code, res := compactPositions(reader, frames, (*CompactPosition).Flat)
+		if code != 0 || len(res) != len(expected) {
+			t.Fatalf("%s: code %d compact positions %d, expected %d", name, code, len(res), len(expected))
+		}
+		for i := range res {
+			if !sameFlat(res[i], &expected[i]) {
+				t.Errorf("%s position %d: %+v, expected %+v", name, i, res[i], expected[i])
+			}
+		}
+	}
+}
+
+func TestCompactBinaryEquivalence(t *testing.T) {
+	frames := compactFrames(t)
+	// struct positions keep stored values, compact reader must not round them too
+	reader := rawReader(frames)
+	code, expected := reader.ReadStructPositions()
+	if code != 0 || len(expected) == 0 {
+		t.Fatalf("code %d positions %d", code, len(expected))
+	}
+	code, res := compactPositions(reader, frames, func(pos *CompactPosition) *FlatPosition {
+		return pos.Binary().Flat()
+	})
+	if code != 0 || len(res) != len(expected) {
+		t.Fatalf("code %d compact positions %d, expected %d", code, len(res), len(expected))
+	}
+	for i := range res {
+		if flat := expected[i].Flat(); !sameFlat(res[i], flat) {
+			t.Errorf("position %d: %+v, expected %+v", i, res[i], flat)
+		}
+	}
+}
+
+func BenchmarkReadFlatPositions(b *testing.B) {
+	frames := compactFrames(b)
+	reader := NewReader()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frames)))
+	for i := 0; i < b.N; i++ {
+		reader.Set(&frames)
+		reader.ReadFlatPositions()
+	}
+}
+
+func BenchmarkReadCompactPositionsFunc(b *testing.B) {
+	frames := compactFrames(b)
+	reader := NewReader()
+	var cnt int
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frames)))
+	for i := 0; i < b.N; i++ {
+		reader.Set(&frames)
+		reader.ReadCompactPositionsFunc(func(pos *CompactPosition) {
+			cnt += len(pos.P)
+		})
+	}
+}
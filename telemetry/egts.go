@@ -0,0 +1,386 @@
+package telemetry
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
+const (
+	egtsHeaderSize       = 11
+	egtsPacketResponse   = 0
+	egtsPacketAppData    = 1
+	egtsServiceAuth      = 1
+	egtsServiceTeledata  = 2
+	egtsSrRecordResponse = 0
+	egtsSrTermIdentity   = 1
+	egtsSrPosData        = 16
+	egtsSrExtPosData     = 17
+	egtsSrADSensors      = 18
+	egtsSrCounters       = 19
+	egtsSrLiquidLevel    = 27
+)
+
+// egtsEpoch EGTS time base 2010-01-01 UTC
+var egtsEpoch = time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+// EGTSMapping default mapping of EGTS teledata values, indexed values are named
+// "ain:<n>" for analog sensors, "dio:<n>" for additional inputs, "counter:<n>" and "lls:<n>"
+var EGTSMapping = ProtocolMapping{
+	"speed":    {Code: ParamSpeed, Scale: 0.1},
+	"course":   {Code: ParamAngle},
+	"alt":      {Code: ParamAlt},
+	"odometer": {Code: ParamOdometer, Scale: 0.1},
+	"sats":     {Code: 1024},
+	"din":      {Code: 1901},
+	"dout":     {Code: 1902},
+	"ain:1":    {Code: 2000},
+	"ain:2":    {Code: 2001},
+	"ain:3":    {Code: 2002},
+	"ain:4":    {Code: 2003},
+	"ain:5":    {Code: 2004},
+	"lls:1":    {Code: 2100},
+	"lls:2":    {Code: 2101},
+}
+
+// EGTSDecoder decodes EGTS transport packets with auth and teledata services
+type EGTSDecoder struct {
+	Mapping  ProtocolMapping
+	DeviceID string
+	pid      uint16
+	rn       uint16
+}
+
+// NewEGTSDecoder create EGTS decoder, EGTSMapping is used if mapping is nil
+func NewEGTSDecoder(mapping ProtocolMapping) *EGTSDecoder {
+	if mapping == nil {
+		mapping = EGTSMapping
+	}
+	return &EGTSDecoder{Mapping: mapping}
+}
+
+// crc8EGTS CRC-8 of EGTS transport header, poly 0x31, init 0xFF
+func crc8EGTS(data []byte) byte {
+	crc := byte(0xFF)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x31
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// crc16CCITT CRC-16/CCITT-FALSE of EGTS frame data
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// egtsRecordResult received record for response
+type egtsRecordResult struct {
+	rn      uint16
+	service byte
+}
+
+// Decode decodes complete transport packets and builds response packets
+func (d *EGTSDecoder) Decode(data []byte) (*ProtocolResult, error) {
+	res := &ProtocolResult{}
+	defer func() {
+		res.DeviceID = d.DeviceID
+	}()
+	for res.Consumed < len(data) {
+		buf := data[res.Consumed:]
+		if len(buf) < egtsHeaderSize {
+			return res, nil
+		}
+		if buf[0] != 0x01 {
+			return res, ErrProtocolData
+		}
+		hl := int(buf[3])
+		if hl != 11 && hl != 16 {
+			return res, ErrProtocolData
+		}
+		fdl := int(binary.LittleEndian.Uint16(buf[5:]))
+		size := hl + fdl
+		if fdl > 0 {
+			size += 2
+		}
+		if len(buf) < size {
+			return res, nil
+		}
+		if crc8EGTS(buf[:hl-1]) != buf[hl-1] {
+			return res, ErrProtocolCRC
+		}
+		pid := binary.LittleEndian.Uint16(buf[7:])
+		pt := buf[9]
+		sfrd := buf[hl : hl+fdl]
+		if fdl > 0 && crc16CCITT(sfrd) != binary.LittleEndian.Uint16(buf[hl+fdl:]) {
+			return res, ErrProtocolCRC
+		}
+		res.Consumed += size
+		if pt != egtsPacketAppData {
+			continue
+		}
+		records, err := d.decodeRecords(sfrd, res)
+		if err != nil {
+			return res, err
+		}
+		res.Ack = append(res.Ack, d.response(pid, records)...)
+	}
+	return res, nil
+}
+
+// decodeRecords decodes service data records of app data packet
+func (d *EGTSDecoder) decodeRecords(sfrd []byte, res *ProtocolResult) ([]egtsRecordResult, error) {
+	var records []egtsRecordResult
+	for off := 0; off < len(sfrd); {
+		if off+7 > len(sfrd) {
+			return nil, ErrProtocolData
+		}
+		rl := int(binary.LittleEndian.Uint16(sfrd[off:]))
+		rn := binary.LittleEndian.Uint16(sfrd[off+2:])
+		rfl := sfrd[off+4]
+		off += 5
+		var oid string
+		var tm uint32
+		if rfl&0x01 != 0 {
+			if off+4 > len(sfrd) {
+				return nil, ErrProtocolData
+			}
+			oid = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(sfrd[off:])), 10)
+			off += 4
+		}
+		if rfl&0x02 != 0 {
+			off += 4 // event id
+		}
+		if rfl&0x04 != 0 {
+			if off+4 > len(sfrd) {
+				return nil, ErrProtocolData
+			}
+			tm = binary.LittleEndian.Uint32(sfrd[off:])
+			off += 4
+		}
+		if off+2+rl > len(sfrd) {
+			return nil, ErrProtocolData
+		}
+		sst := sfrd[off]
+		off += 2
+		if oid != "" {
+			d.DeviceID = oid
+		}
+		if err := d.decodeSubrecords(sfrd[off:off+rl], sst, tm, res); err != nil {
+			return nil, err
+		}
+		records = append(records, egtsRecordResult{rn, sst})
+		off += rl
+	}
+	return records, nil
+}
+
+// decodeSubrecords decodes subrecords of one service record
+func (d *EGTSDecoder) decodeSubrecords(rd []byte, service byte, tm uint32, res *ProtocolResult) error {
+	var pos *FlatPosition
+	for off := 0; off < len(rd); {
+		if off+3 > len(rd) {
+			return ErrProtocolData
+		}
+		srt := rd[off]
+		srl := int(binary.LittleEndian.Uint16(rd[off+1:]))
+		off += 3
+		if off+srl > len(rd) {
+			return ErrProtocolData
+		}
+		srd := rd[off : off+srl]
+		off += srl
+		switch {
+		case service == egtsServiceAuth && srt == egtsSrTermIdentity:
+			d.termIdentity(srd)
+		case service != egtsServiceTeledata:
+		case srt == egtsSrPosData:
+			p, ok := d.posData(srd)
+			if !ok {
+				return ErrProtocolData
+			}
+			res.Positions = append(res.Positions, p)
+			pos = &res.Positions[len(res.Positions)-1]
+		case pos == nil:
+			// sensors data without position use record time
+			if tm == 0 {
+				continue
+			}
+			res.Positions = append(res.Positions, FlatPosition{Time: float64((egtsEpoch + int64(tm)) * 1000), P: make(map[uint16]float64)})
+			pos = &res.Positions[len(res.Positions)-1]
+			fallthrough
+		default:
+			d.sensorsData(pos, srt, srd)
+		}
+	}
+	return nil
+}
+
+// termIdentity reads terminal id and imei
+func (d *EGTSDecoder) termIdentity(srd []byte) {
+	if len(srd) < 5 {
+		return
+	}
+	d.DeviceID = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(srd)), 10)
+	flags := srd[4]
+	off := 5
+	if flags&0x01 != 0 {
+		off += 2 // home dispatcher id
+	}
+	if flags&0x02 != 0 && off+15 <= len(srd) {
+		d.DeviceID = string(srd[off : off+15])
+	}
+}
+
+// posData decodes EGTS_SR_POS_DATA subrecord
+func (d *EGTSDecoder) posData(srd []byte) (FlatPosition, bool) {
+	if len(srd) < 21 {
+		return FlatPosition{}, false
+	}
+	ntm := binary.LittleEndian.Uint32(srd)
+	lat := float64(binary.LittleEndian.Uint32(srd[4:])) * 90 / 0xFFFFFFFF
+	lon := float64(binary.LittleEndian.Uint32(srd[8:])) * 180 / 0xFFFFFFFF
+	flags := srd[12]
+	if flags&0x20 != 0 {
+		lat = -lat
+	}
+	if flags&0x40 != 0 {
+		lon = -lon
+	}
+	if flags&0x01 == 0 {
+		// coordinates are not valid
+		lat, lon = 0, 0
+	}
+	pos := newProtocolPosition(float64((egtsEpoch+int64(ntm))*1000), lat, lon)
+	spd := binary.LittleEndian.Uint16(srd[13:])
+	d.Mapping.set(&pos, "speed", float64(spd&0x3FFF))
+	course := uint16(srd[15])
+	if spd&0x8000 != 0 {
+		course |= 0x100
+	}
+	d.Mapping.set(&pos, "course", float64(course))
+	d.Mapping.set(&pos, "odometer", float64(uint32(srd[16])|uint32(srd[17])<<8|uint32(srd[18])<<16))
+	d.Mapping.set(&pos, "din", float64(srd[19]))
+	if flags&0x80 != 0 && len(srd) >= 24 {
+		alt := float64(uint32(srd[21]) | uint32(srd[22])<<8 | uint32(srd[23])<<16)
+		if spd&0x4000 != 0 {
+			alt = -alt
+		}
+		d.Mapping.set(&pos, "alt", alt)
+	}
+	return pos, true
+}
+
+func egtsUint24(b []byte) float64 {
+	return float64(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16)
+}
+
+// sensorsData decodes extended position, sensors, counters and liquid level subrecords
+func (d *EGTSDecoder) sensorsData(pos *FlatPosition, srt byte, srd []byte) {
+	switch srt {
+	case egtsSrExtPosData:
+		if len(srd) < 1 {
+			return
+		}
+		flags, off := srd[0], 1
+		for i, name := range []string{"vdop", "hdop", "pdop"} {
+			if flags&(1<<uint(i)) != 0 && off+2 <= len(srd) {
+				d.Mapping.set(pos, name, float64(binary.LittleEndian.Uint16(srd[off:])))
+				off += 2
+			}
+		}
+		if flags&0x08 != 0 && off < len(srd) {
+			d.Mapping.set(pos, "sats", float64(srd[off]))
+			off++
+		}
+		if flags&0x10 != 0 && off+2 <= len(srd) {
+			d.Mapping.set(pos, "ns", float64(binary.LittleEndian.Uint16(srd[off:])))
+		}
+	case egtsSrADSensors:
+		if len(srd) < 3 {
+			return
+		}
+		dioe, asfe, off := srd[0], srd[2], 3
+		d.Mapping.set(pos, "dout", float64(srd[1]))
+		for i := 0; i < 8; i++ {
+			if dioe&(1<<uint(i)) != 0 && off < len(srd) {
+				d.Mapping.set(pos, "dio:"+strconv.Itoa(i+1), float64(srd[off]))
+				off++
+			}
+		}
+		for i := 0; i < 8; i++ {
+			if asfe&(1<<uint(i)) != 0 && off+3 <= len(srd) {
+				d.Mapping.set(pos, "ain:"+strconv.Itoa(i+1), egtsUint24(srd[off:]))
+				off += 3
+			}
+		}
+	case egtsSrCounters:
+		if len(srd) < 1 {
+			return
+		}
+		cfe, off := srd[0], 1
+		for i := 0; i < 8; i++ {
+			if cfe&(1<<uint(i)) != 0 && off+3 <= len(srd) {
+				d.Mapping.set(pos, "counter:"+strconv.Itoa(i+1), egtsUint24(srd[off:]))
+				off += 3
+			}
+		}
+	case egtsSrLiquidLevel:
+		// flags + 2 bytes module address + 4 bytes level if raw data flag is not set
+		if len(srd) < 7 || srd[0]&0x08 != 0 || srd[0]&0x40 != 0 {
+			return
+		}
+		n := int(srd[0]&0x07) + 1
+		d.Mapping.set(pos, "lls:"+strconv.Itoa(n), float64(binary.LittleEndian.Uint32(srd[3:])))
+	}
+}
+
+// response builds response packet with record responses
+func (d *EGTSDecoder) response(pid uint16, records []egtsRecordResult) []byte {
+	sfrd := make([]byte, 3, 3+len(records)*13)
+	binary.LittleEndian.PutUint16(sfrd, pid)
+	sfrd[2] = 0 // processing result ok
+	for _, rec := range records {
+		d.rn++
+		// record header + EGTS_SR_RECORD_RESPONSE subrecord
+		r := make([]byte, 13)
+		binary.LittleEndian.PutUint16(r, 6)
+		binary.LittleEndian.PutUint16(r[2:], d.rn)
+		r[4] = 0
+		r[5], r[6] = rec.service, rec.service
+		r[7] = egtsSrRecordResponse
+		binary.LittleEndian.PutUint16(r[8:], 3)
+		binary.LittleEndian.PutUint16(r[10:], rec.rn)
+		r[12] = 0
+		sfrd = append(sfrd, r...)
+	}
+	d.pid++
+	packet := make([]byte, egtsHeaderSize, egtsHeaderSize+len(sfrd)+2)
+	packet[0] = 0x01
+	packet[3] = egtsHeaderSize
+	binary.LittleEndian.PutUint16(packet[5:], uint16(len(sfrd)))
+	binary.LittleEndian.PutUint16(packet[7:], d.pid)
+	packet[9] = egtsPacketResponse
+	packet[10] = crc8EGTS(packet[:10])
+	packet = append(packet, sfrd...)
+	crc := make([]byte, 2)
+	binary.LittleEndian.PutUint16(crc, crc16CCITT(sfrd))
+	return append(packet, crc...)
+}
@@ -0,0 +1,261 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"math"
+	"sort"
+)
+
+// SupportedVersions binary protocol versions supported by reader and encoder
+var SupportedVersions = []uint16{protocolVersion, protocolVersionCRC}
+
+// ErrEncodeVersion value can not be written by encoder protocol version
+var ErrEncodeVersion = errors.New("value kind not supported by protocol version")
+
+// NegotiateVersion returns the highest protocol version supported by both sides,
+// returns base version if peer versions are not set
+func NegotiateVersion(peer ...uint16) uint16 {
+	var res uint16 = protocolVersion
+	for _, v := range peer {
+		if v > res && isSupportedVersion(v) {
+			res = v
+		}
+	}
+	return res
+}
+
+func isSupportedVersion(version uint16) bool {
+	for _, v := range SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Encoder writes positions to binary frames
+type Encoder struct {
+	Version uint16
+	data    []byte
+}
+
+// NewEncoder create encoder for protocol version
+func NewEncoder(version uint16) (*Encoder, error) {
+	if !isSupportedVersion(version) {
+		return nil, errors.New("unsupported protocol version")
+	}
+	return &Encoder{Version: version}, nil
+}
+
+// losslessKind returns smallest kind that keeps value without loss,
+// negative zero is written as float to keep its sign
+func losslessKind(value float64) uint8 {
+	if value == math.Trunc(value) && !math.IsInf(value, 0) && !(value == 0 && math.Signbit(value)) {
+		switch {
+		case value == 0:
+			return binaryZero
+		case value >= 0 && value <= math.MaxUint8:
+			return binaryUint8
+		case value >= math.MinInt8 && value < 0:
+			return binaryInt8
+		case value >= 0 && value <= math.MaxUint16:
+			return binaryUint16
+		case value >= math.MinInt16 && value < 0:
+			return binaryInt16
+		case value >= 0 && value <= math.MaxUint32:
+			return binaryUint32
+		case value >= math.MinInt32 && value < 0:
+			return binaryInt32
+		}
+	}
+	if float64(float32(value)) == value {
+		return binaryFloat32
+	}
+	return binaryFloat64
+}
+
+// writeValue appends key, kind and value
+func (e *Encoder) writeValue(key uint16, kind uint8, value float64) {
+	e.data = append(e.data, uint16ToByte(key)...)
+	e.data = append(e.data, kind)
+	switch kind {
+	case binaryInt8:
+		e.data = append(e.data, byte(int8(value)))
+	case binaryUint8:
+		e.data = append(e.data, byte(uint8(value)))
+	case binaryInt16:
+		e.data = append(e.data, int16ToByte(int16(value))...)
+	case binaryUint16:
+		e.data = append(e.data, uint16ToByte(uint16(value))...)
+	case binaryInt32:
+		e.data = append(e.data, int32ToByte(int32(value))...)
+	case binaryUint32:
+		e.data = append(e.data, uint32ToByte(uint32(value))...)
+	case binaryFloat32:
+		e.data = append(e.data, float32ToByte(float32(value))...)
+	case binaryFloat64:
+		e.data = append(e.data, float64ToByte(value)...)
+	}
+}
+
+// writeBytes appends string or bytes array value
+func (e *Encoder) writeBytes(key uint16, kind uint8, value []byte) error {
+	if e.Version < protocolVersionCRC {
+		return ErrEncodeVersion
+	}
+	if len(value) > math.MaxUint16 {
+		return errors.New("value too long")
+	}
+	e.data = append(e.data, uint16ToByte(key)...)
+	e.data = append(e.data, kind)
+	e.data = append(e.data, uint16ToByte(uint16(len(value)))...)
+	e.data = append(e.data, value...)
+	return nil
+}
+
+func (e *Encoder) writeEvents(events []uint16) {
+	if len(events) == 0 {
+		return
+	}
+	e.data = append(e.data, uint16ToByte(paramEvent)...)
+	e.data = append(e.data, byte(binaryArray|binaryUint16))
+	e.data = append(e.data, uint16ToByte(uint16(len(events)))...)
+	for _, ev := range events {
+		e.data = append(e.data, uint16ToByte(ev)...)
+	}
+}
+
+func (e *Encoder) writeZones(zones []ZoneInfo) error {
+	if len(zones) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(zones)
+	if err != nil {
+		return err
+	}
+	return e.writeBytes(paramZones, binaryBytes, data)
+}
+
+// frame appends frame header, time, collected params and crc to dst
+func (e *Encoder) frame(dst []byte, t float64) []byte {
+	// 2 byte sign + 2 byte version + 4 bytes length + 8 bytes time + params and events [+ 4 bytes crc]
+	start := len(dst)
+	dst = append(dst, byte(binaryID[0]), byte(binaryID[1]))
+	dst = append(dst, uint16ToByte(e.Version)...)
+	length := len(e.data) + 8
+	if e.Version >= protocolVersionCRC {
+		length += 4
+	}
+	dst = append(dst, uint32ToByte(uint32(length))...)
+	dst = append(dst, float64ToByte(t)...)
+	dst = append(dst, e.data...)
+	if e.Version >= protocolVersionCRC {
+		dst = append(dst, uint32ToByte(crc32.ChecksumIEEE(dst[start:]))...)
+	}
+	e.data = e.data[:0]
+	return dst
+}
+
+func sortKeys(keys []uint16) []uint16 {
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func sortedKeys(m map[uint16]float64) []uint16 {
+	keys := make([]uint16, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return sortKeys(keys)
+}
+
+// AppendFlat appends flat position frame to dst
+func (e *Encoder) AppendFlat(dst []byte, pos *FlatPosition) ([]byte, error) {
+	e.data = e.data[:0]
+	for _, key := range sortedKeys(pos.P) {
+		val := pos.P[key]
+		e.writeValue(key, losslessKind(val), val)
+	}
+	if len(pos.S) > 0 {
+		keys := make([]uint16, 0, len(pos.S))
+		for key := range pos.S {
+			keys = append(keys, key)
+		}
+		for _, key := range sortKeys(keys) {
+			if err := e.writeBytes(key, binaryString, []byte(pos.S[key])); err != nil {
+				return dst, err
+			}
+		}
+	}
+	if len(pos.B) > 0 {
+		keys := make([]uint16, 0, len(pos.B))
+		for key := range pos.B {
+			keys = append(keys, key)
+		}
+		for _, key := range sortKeys(keys) {
+			if err := e.writeBytes(key, binaryBytes, pos.B[key]); err != nil {
+				return dst, err
+			}
+		}
+	}
+	e.writeEvents(pos.E)
+	if err := e.writeZones(pos.Zones); err != nil {
+		return dst, err
+	}
+	return e.frame(dst, pos.Time), nil
+}
+
+// AppendBinary appends struct position frame to dst, keeps kinds of values
+func (e *Encoder) AppendBinary(dst []byte, pos *BinaryPosition) ([]byte, error) {
+	e.data = e.data[:0]
+	for _, p := range pos.I16 {
+		kind := losslessKind(float64(p.V))
+		if kind != binaryZero && kind != binaryInt8 {
+			kind = binaryInt16
+		}
+		e.writeValue(p.K, kind, float64(p.V))
+	}
+	for _, p := range pos.I32 {
+		e.writeValue(p.K, binaryInt32, float64(p.V))
+	}
+	for _, p := range pos.UI32 {
+		kind := uint8(binaryUint32)
+		if p.V <= math.MaxUint16 {
+			kind = binaryUint16
+		}
+		e.writeValue(p.K, kind, float64(p.V))
+	}
+	for _, p := range pos.F32 {
+		e.writeValue(p.K, binaryFloat32, float64(p.V))
+	}
+	for _, p := range pos.F64 {
+		e.writeValue(p.K, binaryFloat64, p.V)
+	}
+	for _, p := range pos.Str {
+		if err := e.writeBytes(p.K, binaryString, []byte(p.V)); err != nil {
+			return dst, err
+		}
+	}
+	for _, p := range pos.Bytes {
+		if err := e.writeBytes(p.K, binaryBytes, p.V); err != nil {
+			return dst, err
+		}
+	}
+	e.writeEvents(pos.E)
+	if err := e.writeZones(pos.Zones); err != nil {
+		return dst, err
+	}
+	return e.frame(dst, pos.Time), nil
+}
+
+// EncodeFlat returns flat position frame
+func (e *Encoder) EncodeFlat(pos *FlatPosition) ([]byte, error) {
+	return e.AppendFlat(nil, pos)
+}
+
+// EncodeBinary returns struct position frame
+func (e *Encoder) EncodeBinary(pos *BinaryPosition) ([]byte, error) {
+	return e.AppendBinary(nil, pos)
+}
@@ -0,0 +1,160 @@
+package telemetry
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// kindValues values covering every numeric kind, key is value index + 100
+var kindValues = []struct {
+	value float64
+	kind  uint8
+}{
+	{0, binaryZero},
+	{math.Copysign(0, -1), binaryFloat32},
+	{200, binaryUint8},
+	{-100, binaryInt8},
+	{60000, binaryUint16},
+	{-30000, binaryInt16},
+	{4000000000, binaryUint32},
+	{-2000000000, binaryInt32},
+	{1.5, binaryFloat32},
+	{0.1, binaryFloat64},
+	{1 << 40, binaryFloat32},
+	{math.Inf(1), binaryFloat32},
+	{math.Inf(-1), binaryFloat32},
+	{math.NaN(), binaryFloat64},
+}
+
+// sameFloat compares values by bits, any NaN is equal to NaN
+func sameFloat(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Float64bits(a) == math.Float64bits(b)
+}
+
+// rawReader returns reader which does not round or scale values
+func rawReader(buf []byte) *BinaryReader {
+	reader := NewReader()
+	reader.Registry = NewParamRegistry()
+	reader.Set(&buf)
+	return reader
+}
+
+func TestLosslessKind(t *testing.T) {
+	for _, tc := range kindValues {
+		if kind := losslessKind(tc.value); kind != tc.kind {
+			t.Errorf("value %v: kind 0x%02x, expected 0x%02x", tc.value, kind, tc.kind)
+		}
+	}
+}
+
+func TestEncodeFlatRoundTrip(t *testing.T) {
+	for _, version := range SupportedVersions {
+		pos := &FlatPosition{Time: 1600000000123, P: map[uint16]float64{}, E: []uint16{1, 65535}}
+		for i, tc := range kindValues {
+			pos.P[uint16(100+i)] = tc.value
+		}
+		if version >= protocolVersionCRC {
+			distance := 12.5
+			pos.S = map[uint16]string{500: "driver", 501: ""}
+			pos.B = map[uint16][]byte{600: {0, 1, 255}}
+			pos.Zones = []ZoneInfo{{ID: "z1", Name: "Base", Type: "polygon", Distance: &distance}}
+		}
+		enc, err := NewEncoder(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, err := enc.EncodeFlat(pos)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		code, res := rawReader(frame).ReadFlatPositions()
+		if code != 0 || len(res) != 1 {
+			t.Fatalf("version %d: code %d, positions %d", version, code, len(res))
+		}
+		got := res[0]
+		if got.Time != pos.Time || !reflect.DeepEqual(got.E, pos.E) {
+			t.Errorf("version %d: time %v events %v", version, got.Time, got.E)
+		}
+		if len(got.P) != len(pos.P) {
+			t.Errorf("version %d: %d params, expected %d", version, len(got.P), len(pos.P))
+		}
+		for key, v := range pos.P {
+			if !sameFloat(got.P[key], v) {
+				t.Errorf("version %d key %d: %v, expected %v", version, key, got.P[key], v)
+			}
+		}
+		if version >= protocolVersionCRC {
+			if !reflect.DeepEqual(got.S, pos.S) || !reflect.DeepEqual(got.B, pos.B) || !reflect.DeepEqual(got.Zones, pos.Zones) {
+				t.Errorf("version %d: strings %v bytes %v zones %v", version, got.S, got.B, got.Zones)
+			}
+		}
+		// encoded again from decoded position gives the same frame
+		again, err := enc.EncodeFlat(&got)
+		if err != nil || !bytes.Equal(again, frame) {
+			t.Errorf("version %d: frame is changed after round trip", version)
+		}
+	}
+}
+
+func TestEncodeBytesVersion0(t *testing.T) {
+	enc, _ := NewEncoder(protocolVersion)
+	cases := []*FlatPosition{
+		{Time: 1, S: map[uint16]string{500: "a"}},
+		{Time: 1, B: map[uint16][]byte{600: {1}}},
+		{Time: 1, Zones: []ZoneInfo{{ID: "z"}}},
+	}
+	for i, pos := range cases {
+		if _, err := enc.EncodeFlat(pos); err != ErrEncodeVersion {
+			t.Errorf("case %d: err %v, expected ErrEncodeVersion", i, err)
+		}
+	}
+}
+
+func TestEncodeBinaryRoundTrip(t *testing.T) {
+	for _, version := range SupportedVersions {
+		pos := &BinaryPosition{
+			Time: 1600000000000,
+			I16:  []ParamsInt16{{1, 0}, {2, -5}, {3, -30000}},
+			I32:  []ParamsInt32{{4, -2000000000}},
+			UI32: []ParamsUint32{{5, 60000}, {6, 4000000000}},
+			F32:  []ParamsFloat32{{7, float32(math.Copysign(0, -1))}, {8, float32(math.Inf(-1))}},
+			F64:  []ParamsFloat64{{9, 0.1}, {10, math.NaN()}},
+			E:    []uint16{7},
+		}
+		if version >= protocolVersionCRC {
+			pos.Str = []ParamsString{{11, "text"}}
+			pos.Bytes = []ParamsBytes{{12, []byte{9, 8}}}
+			pos.Zones = []ZoneInfo{{ID: "z2"}}
+		}
+		enc, _ := NewEncoder(version)
+		frame, err := enc.EncodeBinary(pos)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		code, res := rawReader(frame).ReadStructPositions()
+		if code != 0 || len(res) != 1 {
+			t.Fatalf("version %d: code %d, positions %d", version, code, len(res))
+		}
+		got := res[0]
+		if !reflect.DeepEqual(got.I16, pos.I16) || !reflect.DeepEqual(got.I32, pos.I32) || !reflect.DeepEqual(got.UI32, pos.UI32) {
+			t.Errorf("version %d: integers %v %v %v", version, got.I16, got.I32, got.UI32)
+		}
+		if len(got.F32) != 2 || !math.Signbit(float64(got.F32[0].V)) || !math.IsInf(float64(got.F32[1].V), -1) {
+			t.Errorf("version %d: float32 %v", version, got.F32)
+		}
+		if len(got.F64) != 2 || got.F64[0].V != 0.1 || !math.IsNaN(got.F64[1].V) {
+			t.Errorf("version %d: float64 %v", version, got.F64)
+		}
+		if version >= protocolVersionCRC && (!reflect.DeepEqual(got.Str, pos.Str) || !reflect.DeepEqual(got.Bytes, pos.Bytes) || !reflect.DeepEqual(got.Zones, pos.Zones)) {
+			t.Errorf("version %d: strings %v bytes %v zones %v", version, got.Str, got.Bytes, got.Zones)
+		}
+		if again, _ := enc.EncodeBinary(&got); !bytes.Equal(again, frame) {
+			t.Errorf("version %d: frame is changed after round trip", version)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package telemetry
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DecodePolicy defines BinaryReader behaviour on corrupted frames
+type DecodePolicy int
+
+const (
+	// DecodeStrict stops reading on the first corrupted frame
+	DecodeStrict DecodePolicy = iota
+	// DecodeSkipFrame skips corrupted frame by declared length,
+	// stops if frame header is broken
+	DecodeSkipFrame
+	// DecodeResync scans buffer for the next "bt" signature after corrupted frame
+	DecodeResync
+)
+
+// maxSummaryErrors limits count of errors saved in decode summary
+const maxSummaryErrors = 100
+
+var (
+	// ErrFrameSize frame header or time does not fit in buffer
+	ErrFrameSize = errors.New("frame size too small")
+	// ErrFrameSign frame does not start with "bt" signature
+	ErrFrameSign = errors.New("invalid frame sign")
+	// ErrFrameLength declared frame or value length exceeds available data
+	ErrFrameLength = errors.New("invalid frame length")
+	// ErrFrameTime frame time is not valid
+	ErrFrameTime = errors.New("invalid frame time")
+	// ErrFrameKind param value kind is unknown
+	ErrFrameKind = errors.New("unknown value kind")
+	// ErrFrameVersion frame protocol version is not supported
+	ErrFrameVersion = errors.New("unsupported protocol version")
+	// ErrFrameCRC frame checksum mismatch
+	ErrFrameCRC = errors.New("frame checksum mismatch")
+)
+
+// DecodeError describes binary frame decoding error
+type DecodeError struct {
+	Err      error  // one of ErrFrame* errors
+	Offset   uint32 // frame start offset in buffer
+	At       uint32 // offset of failed read
+	Expected uint32 // expected bytes count
+	Actual   uint32 // available bytes count
+	Key      uint16 // param key if error occurred while reading value
+	Kind     uint8  // param value kind if error occurred while reading value
+	frameLen uint32 // declared frame length if frame header is valid
+}
+
+func (e *DecodeError) Error() string {
+	msg := fmt.Sprintf("telemetry: %s at frame %d (offset %d)", e.Err, e.Offset, e.At)
+	if e.Key != 0 || e.Kind != 0 {
+		msg += fmt.Sprintf(" key %d kind 0x%02x", e.Key, e.Kind)
+	}
+	if e.Expected != 0 || e.Actual != 0 {
+		msg += fmt.Sprintf(": expected %d bytes, got %d", e.Expected, e.Actual)
+	}
+	return msg
+}
+
+// Unwrap returns base error for errors.Is checks
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Code returns legacy numeric error code
+func (e *DecodeError) Code() int16 {
+	switch e.Err {
+	case ErrFrameLength:
+		return errorBinaryLen
+	case ErrFrameTime:
+		return errorProtoTime
+	case ErrFrameKind, ErrFrameVersion, ErrFrameCRC:
+		return errorBinaryRead
+	}
+	return errorBinarySize
+}
+
+// DecodeSummary contains statistics of last read
+type DecodeSummary struct {
+	Good     int            // decoded frames
+	Skipped  int            // frames passed by time or events filter
+	Corrupt  int            // corrupted frames
+	Resynced uint32         // bytes dropped while searching next frame
+	Errors   []*DecodeError // first corrupted frames errors
+}
+
+// errorCode returns legacy numeric code of decode error, 0 for nil
+func errorCode(err error) int16 {
+	if err == nil {
+		return 0
+	}
+	if derr, ok := err.(*DecodeError); ok {
+		return derr.Code()
+	}
+	return errorBinaryRead
+}
+
+// Summary returns statistics of last read
+func (r *BinaryReader) Summary() DecodeSummary {
+	return r.summary
+}
+
+// Err returns last decode error or nil
+func (r *BinaryReader) Err() error {
+	if r.err == nil {
+		return nil
+	}
+	return r.err
+}
+
+func (r *BinaryReader) decodeError(err error, frame, expected, actual uint32) *DecodeError {
+	return &DecodeError{
+		Err:      err,
+		Offset:   frame,
+		At:       r.offset,
+		Expected: expected,
+		Actual:   actual,
+		frameLen: r.frameLen,
+	}
+}
+
+// need checks that n bytes are available in current frame
+func (r *BinaryReader) need(n uint32) error {
+	limit := r.Size
+	if r.frameEnd > 0 {
+		limit = r.frameEnd
+	}
+	if r.offset+n > limit {
+		var actual uint32
+		if limit > r.offset {
+			actual = limit - r.offset
+		}
+		return r.decodeError(ErrFrameLength, r.frameStart, n, actual)
+	}
+	return nil
+}
+
+// recoverFrame registers decode error and moves offset by reader policy,
+// returns false if reading must be stopped
+func (r *BinaryReader) recoverFrame(err *DecodeError) bool {
+	r.err = err
+	r.summary.Corrupt++
+	if len(r.summary.Errors) < maxSummaryErrors {
+		r.summary.Errors = append(r.summary.Errors, err)
+	}
+	r.frameEnd = 0
+	switch r.Policy {
+	case DecodeSkipFrame:
+		if err.frameLen == 0 {
+			return false
+		}
+		// frame length is checked by readHeader, wide sum guards against wrap to frame start
+		next := uint64(err.Offset) + 8 + uint64(err.frameLen)
+		if next > uint64(r.Size) {
+			next = uint64(r.Size)
+		}
+		r.offset = uint32(next)
+		return true
+	case DecodeResync:
+		r.offset = err.Offset + 1
+		for r.offset+1 < r.Size && !r.CheckSign() {
+			r.offset++
+		}
+		if r.offset+1 >= r.Size {
+			r.offset = r.Size
+		}
+		r.summary.Resynced += r.offset - err.Offset
+		return true
+	}
+	return false
+}
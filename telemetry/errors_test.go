@@ -0,0 +1,76 @@
+package telemetry
+
+import (
+	"testing"
+	"time"
+)
+
+// overflowFrame declares length 0xFFFFFFF8 so that frame start + 8 + length wraps to frame start
+func overflowFrame() []byte {
+	return []byte{'b', 't', 0, 0, 0xFF, 0xFF, 0xFF, 0xF8, 0, 0, 0, 0, 0, 0, 0, 0}
+}
+
+func TestOverflowFrameLength(t *testing.T) {
+	policies := []DecodePolicy{DecodeStrict, DecodeSkipFrame, DecodeResync}
+	for _, policy := range policies {
+		done := make(chan struct{})
+		var code int16
+		var res []FlatPosition
+		reader := NewReader()
+		reader.Policy = policy
+		buf := overflowFrame()
+		reader.Set(&buf)
+		go func() {
+			code, res = reader.ReadFlatPositions()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("policy %d: read does not finish", policy)
+		}
+		if len(res) != 0 {
+			t.Errorf("policy %d: %d positions decoded from corrupted frame", policy, len(res))
+		}
+		summary := reader.Summary()
+		if summary.Corrupt != 1 || len(summary.Errors) != 1 || summary.Errors[0].Err != ErrFrameLength {
+			t.Errorf("policy %d: unexpected summary %+v", policy, summary)
+		}
+		if policy == DecodeStrict && code != errorBinaryLen {
+			t.Errorf("policy %d: code %d, expected %d", policy, code, errorBinaryLen)
+		}
+	}
+}
+
+func TestOverflowFrameBinaryPositions(t *testing.T) {
+	policies := []DecodePolicy{DecodeStrict, DecodeSkipFrame, DecodeResync}
+	for _, policy := range policies {
+		done := make(chan struct{})
+		reader := NewReader()
+		reader.Policy = policy
+		buf := overflowFrame()
+		reader.Set(&buf)
+		go func() {
+			reader.ReadBinaryPositions()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("policy %d: read does not finish", policy)
+		}
+	}
+}
+
+func TestRecoverFrameOffset(t *testing.T) {
+	reader := NewReader()
+	reader.Policy = DecodeSkipFrame
+	reader.Size = 32
+	err := &DecodeError{Err: ErrFrameKind, Offset: 16, frameLen: 0xFFFFFFF8}
+	if !reader.recoverFrame(err) {
+		t.Fatal("skip frame policy must continue")
+	}
+	if reader.offset != reader.Size {
+		t.Fatalf("offset %d, expected end of buffer %d", reader.offset, reader.Size)
+	}
+}
@@ -0,0 +1,462 @@
+package telemetry
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrackWriter writes positions stream to export format
+type TrackWriter interface {
+	WritePosition(pos *FlatPosition) error
+	// Close writes format footer, does not close underlying writer
+	Close() error
+}
+
+// ExportOptions settings of track exporters
+type ExportOptions struct {
+	Name     string         // track name
+	Params   []uint16       // exported params, all params for GPX if empty, DefaultCSVColumns for CSV
+	Registry *ParamRegistry // param titles and precision, DefaultRegistry if nil
+	Location *time.Location // time zone of CSV time column, UTC if nil
+	Points   bool           // GeoJSON exports positions as Point features instead of LineString
+	Segments SegmentConfig  // KML trip segmentation
+}
+
+// DefaultCSVColumns default CSV param columns
+var DefaultCSVColumns = []uint16{ParamLat, ParamLon, ParamSpeed, ParamAngle, ParamOdometer}
+
+func (o *ExportOptions) registry() *ParamRegistry {
+	if o.Registry != nil {
+		return o.Registry
+	}
+	return DefaultRegistry
+}
+
+// formatValue formats param value with registry precision
+func (o *ExportOptions) formatValue(code uint16, v float64) string {
+	return strconv.FormatFloat(o.registry().Round(code, v), 'f', -1, 64)
+}
+
+// exportParams returns exported params of position in ascending order
+func (o *ExportOptions) exportParams(pos *FlatPosition) []uint16 {
+	if len(o.Params) > 0 {
+		return o.Params
+	}
+	return sortedKeys(pos.P)
+}
+
+func formatTime(t float64, loc *time.Location) string {
+	sec := int64(t / 1000)
+	nsec := int64((t - float64(sec)*1000) * float64(time.Millisecond))
+	tm := time.Unix(sec, nsec).UTC()
+	if loc != nil {
+		tm = tm.In(loc)
+	}
+	return tm.Format(time.RFC3339Nano)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// exportWriter buffered writer which keeps first error
+type exportWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func newExportWriter(w io.Writer) *exportWriter {
+	return &exportWriter{w: bufio.NewWriter(w)}
+}
+
+func (w *exportWriter) print(args ...string) {
+	for _, s := range args {
+		if w.err != nil {
+			return
+		}
+		_, w.err = w.w.WriteString(s)
+	}
+}
+
+func (w *exportWriter) flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+// GPXWriter writes GPX 1.1 track, params are written to trkpt extensions
+type GPXWriter struct {
+	Options ExportOptions
+	w       *exportWriter
+	started bool
+}
+
+// NewGPXWriter create GPX track writer
+func NewGPXWriter(w io.Writer, opts ExportOptions) *GPXWriter {
+	return &GPXWriter{Options: opts, w: newExportWriter(w)}
+}
+
+func (g *GPXWriter) start() {
+	if g.started {
+		return
+	}
+	g.started = true
+	g.w.print(xml.Header,
+		`<gpx version="1.1" creator="battler telemetry" xmlns="http://www.topografix.com/GPX/1/1" xmlns:tm="https://gitlab.com/battler/modules/telemetry">`, "\n",
+		"<trk><name>", xmlEscape(g.Options.Name), "</name><trkseg>\n")
+}
+
+// WritePosition writes track point, positions without coordinates are skipped
+func (g *GPXWriter) WritePosition(pos *FlatPosition) error {
+	g.start()
+	lat, lon, ok := pos.LatLon()
+	if !ok {
+		return g.w.err
+	}
+	opts := &g.Options
+	g.w.print(`<trkpt lat="`, opts.formatValue(ParamLat, lat), `" lon="`, opts.formatValue(ParamLon, lon), `">`)
+	if alt, ok := pos.P[ParamAlt]; ok {
+		g.w.print("<ele>", opts.formatValue(ParamAlt, alt), "</ele>")
+	}
+	g.w.print("<time>", formatTime(pos.Time, nil), "</time><extensions>")
+	reg := opts.registry()
+	for _, code := range opts.exportParams(pos) {
+		v, ok := pos.P[code]
+		if !ok || code == ParamLat || code == ParamLon || code == ParamAlt {
+			continue
+		}
+		g.w.print(`<tm:p code="`, strconv.Itoa(int(code)), `" name="`, xmlEscape(reg.Title(code)), `">`, opts.formatValue(code, v), "</tm:p>")
+	}
+	for _, e := range pos.E {
+		g.w.print("<tm:e>", strconv.Itoa(int(e)), "</tm:e>")
+	}
+	g.w.print("</extensions></trkpt>\n")
+	return g.w.err
+}
+
+// Close writes GPX footer
+func (g *GPXWriter) Close() error {
+	g.start()
+	g.w.print("</trkseg></trk>\n</gpx>\n")
+	return g.w.flush()
+}
+
+// kmlStyles colors are aabbggrr
+const kmlStyles = `<Style id="trip"><LineStyle><color>ffff6400</color><width>4</width></LineStyle></Style>
+<Style id="stop"><IconStyle><color>ff00c8ff</color><Icon><href>http://maps.google.com/mapfiles/kml/paddle/ylw-blank.png</href></Icon></IconStyle></Style>
+<Style id="parking"><IconStyle><color>ff0000ff</color><Icon><href>http://maps.google.com/mapfiles/kml/paddle/P.png</href></Icon></IconStyle></Style>
+`
+
+// kmlPoint buffered coordinate of open segment
+type kmlPoint struct {
+	t, lat, lon float64
+}
+
+// KMLWriter writes KML document with styled trip lines and stop points,
+// only coordinates of open segment are kept in memory
+type KMLWriter struct {
+	Options   ExportOptions
+	w         *exportWriter
+	started   bool
+	segmenter *Segmenter
+	points    []kmlPoint
+	trips     int
+}
+
+// NewKMLWriter create KML track writer
+func NewKMLWriter(w io.Writer, opts ExportOptions) *KMLWriter {
+	cfg := opts.Segments
+	if cfg == (SegmentConfig{}) {
+		cfg = DefaultSegmentConfig
+	}
+	return &KMLWriter{Options: opts, w: newExportWriter(w), segmenter: NewSegmenter(cfg)}
+}
+
+func (k *KMLWriter) start() {
+	if k.started {
+		return
+	}
+	k.started = true
+	k.w.print(xml.Header, `<kml xmlns="http://www.opengis.net/kml/2.2"><Document>`, "\n",
+		"<name>", xmlEscape(k.Options.Name), "</name>\n", kmlStyles)
+}
+
+// WritePosition adds position to segmentation and writes closed segments
+func (k *KMLWriter) WritePosition(pos *FlatPosition) error {
+	k.start()
+	lat, lon, ok := pos.LatLon()
+	if !ok {
+		return k.w.err
+	}
+	k.points = append(k.points, kmlPoint{pos.Time, lat, lon})
+	for _, seg := range k.segmenter.Push(pos) {
+		k.writeSegment(&seg)
+	}
+	return k.w.err
+}
+
+// writeSegment writes placemark of segment and drops its coordinates,
+// end point stays as start of next segment
+func (k *KMLWriter) writeSegment(seg *Segment) {
+	n := 0
+	for n < len(k.points) && k.points[n].t <= seg.End.Time {
+		n++
+	}
+	k.w.print("<Placemark>")
+	if seg.Kind == SegmentTrip {
+		k.trips++
+		k.w.print("<name>Trip ", strconv.Itoa(k.trips), "</name><description>",
+			fmt.Sprintf("distance %.3f km, duration %s, max speed %.0f km/h", seg.Distance, seg.Duration, seg.MaxSpeed),
+			"</description>")
+	} else {
+		k.w.print("<name>", seg.Kind.String(), "</name><description>duration ", seg.Duration.String(), "</description>")
+	}
+	k.w.print("<TimeSpan><begin>", formatTime(seg.Start.Time, nil), "</begin><end>", formatTime(seg.End.Time, nil), "</end></TimeSpan>",
+		"<styleUrl>#", seg.Kind.String(), "</styleUrl>")
+	if seg.Kind == SegmentTrip {
+		k.w.print("<LineString><tessellate>1</tessellate><coordinates>")
+		for i, p := range k.points[:n] {
+			if i > 0 {
+				k.w.print(" ")
+			}
+			k.w.print(k.coordinates(p.lat, p.lon))
+		}
+		k.w.print("</coordinates></LineString>")
+	} else {
+		lat, lon, _ := seg.Start.LatLon()
+		k.w.print("<Point><coordinates>", k.coordinates(lat, lon), "</coordinates></Point>")
+	}
+	k.w.print("</Placemark>\n")
+	if n > 0 {
+		n--
+	}
+	k.points = append(k.points[:0], k.points[n:]...)
+}
+
+func (k *KMLWriter) coordinates(lat, lon float64) string {
+	return k.Options.formatValue(ParamLon, lon) + "," + k.Options.formatValue(ParamLat, lat)
+}
+
+// Close writes open segments and KML footer
+func (k *KMLWriter) Close() error {
+	k.start()
+	for _, seg := range k.segmenter.Flush() {
+		k.writeSegment(&seg)
+	}
+	k.points = nil
+	k.w.print("</Document></kml>\n")
+	return k.w.flush()
+}
+
+// GeoJSONWriter writes FeatureCollection with track LineString or position Points,
+// track of one position is written as Point, empty track has no features
+type GeoJSONWriter struct {
+	Options    ExportOptions
+	w          *exportWriter
+	started    bool
+	count      int
+	first      float64
+	last       float64
+	firstCoord string // line is started by the second position
+}
+
+// NewGeoJSONWriter create GeoJSON track writer
+func NewGeoJSONWriter(w io.Writer, opts ExportOptions) *GeoJSONWriter {
+	return &GeoJSONWriter{Options: opts, w: newExportWriter(w)}
+}
+
+func (g *GeoJSONWriter) start() {
+	if g.started {
+		return
+	}
+	g.started = true
+	g.w.print(`{"type":"FeatureCollection","features":[`)
+}
+
+func (g *GeoJSONWriter) coordinates(lat, lon float64) string {
+	return "[" + g.Options.formatValue(ParamLon, lon) + "," + g.Options.formatValue(ParamLat, lat) + "]"
+}
+
+// WritePosition writes position coordinates or Point feature
+func (g *GeoJSONWriter) WritePosition(pos *FlatPosition) error {
+	g.start()
+	lat, lon, ok := pos.LatLon()
+	if !ok {
+		return g.w.err
+	}
+	if g.count == 0 {
+		g.first = pos.Time
+	}
+	g.count++
+	g.last = pos.Time
+	if !g.Options.Points {
+		coord := g.coordinates(lat, lon)
+		switch g.count {
+		case 1:
+			g.firstCoord = coord
+		case 2:
+			g.w.print(`{"type":"Feature","geometry":{"type":"LineString","coordinates":[`, g.firstCoord, ",", coord)
+		default:
+			g.w.print(",", coord)
+		}
+		return g.w.err
+	}
+	if g.count > 1 {
+		g.w.print(",")
+	}
+	reg := g.Options.registry()
+	props := map[string]interface{}{"time": formatTime(pos.Time, nil)}
+	for _, code := range g.Options.exportParams(pos) {
+		if v, ok := pos.P[code]; ok && code != ParamLat && code != ParamLon {
+			props[reg.Title(code)] = reg.Round(code, v)
+		}
+	}
+	if len(pos.E) > 0 {
+		props["events"] = pos.E
+	}
+	data, err := json.Marshal(props)
+	if err != nil {
+		return err
+	}
+	g.w.print(`{"type":"Feature","geometry":{"type":"Point","coordinates":`, g.coordinates(lat, lon), `},"properties":`, string(data), "}")
+	return g.w.err
+}
+
+// Close writes GeoJSON footer
+func (g *GeoJSONWriter) Close() error {
+	g.start()
+	if !g.Options.Points && g.count > 0 {
+		props := map[string]interface{}{"name": g.Options.Name, "points": g.count,
+			"begin": formatTime(g.first, nil), "end": formatTime(g.last, nil)}
+		data, err := json.Marshal(props)
+		if err != nil {
+			return err
+		}
+		if g.count == 1 {
+			g.w.print(`{"type":"Feature","geometry":{"type":"Point","coordinates":`, g.firstCoord, `},"properties":`, string(data), "}")
+		} else {
+			g.w.print(`]},"properties":`, string(data), "}")
+		}
+	}
+	g.w.print("]}\n")
+	return g.w.flush()
+}
+
+// CSVWriter writes positions as CSV rows with time, param and events columns
+type CSVWriter struct {
+	Options ExportOptions
+	w       *csv.Writer
+	started bool
+	row     []string
+}
+
+// NewCSVWriter create CSV track writer
+func NewCSVWriter(w io.Writer, opts ExportOptions) *CSVWriter {
+	if len(opts.Params) == 0 {
+		opts.Params = DefaultCSVColumns
+	}
+	return &CSVWriter{Options: opts, w: csv.NewWriter(w)}
+}
+
+func (c *CSVWriter) start() error {
+	if c.started {
+		return nil
+	}
+	c.started = true
+	reg := c.Options.registry()
+	header := make([]string, 0, len(c.Options.Params)+2)
+	header = append(header, "time")
+	for _, code := range c.Options.Params {
+		header = append(header, reg.Title(code))
+	}
+	header = append(header, "events")
+	return c.w.Write(header)
+}
+
+// WritePosition writes position row, missing params are empty
+func (c *CSVWriter) WritePosition(pos *FlatPosition) error {
+	if err := c.start(); err != nil {
+		return err
+	}
+	c.row = append(c.row[:0], formatTime(pos.Time, c.Options.Location))
+	for _, code := range c.Options.Params {
+		if v, ok := pos.P[code]; ok {
+			c.row = append(c.row, c.Options.formatValue(code, v))
+		} else if s, ok := pos.S[code]; ok {
+			c.row = append(c.row, s)
+		} else {
+			c.row = append(c.row, "")
+		}
+	}
+	events := make([]string, len(pos.E))
+	for i, e := range pos.E {
+		events[i] = strconv.Itoa(int(e))
+	}
+	c.row = append(c.row, strings.Join(events, " "))
+	return c.w.Write(c.row)
+}
+
+// Close flushes CSV rows
+func (c *CSVWriter) Close() error {
+	if err := c.start(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// NewTrackWriter create track writer by format name: gpx, kml, geojson or csv
+func NewTrackWriter(format string, w io.Writer, opts ExportOptions) (TrackWriter, error) {
+	switch strings.ToLower(format) {
+	case "gpx":
+		return NewGPXWriter(w, opts), nil
+	case "kml":
+		return NewKMLWriter(w, opts), nil
+	case "geojson", "json":
+		return NewGeoJSONWriter(w, opts), nil
+	case "csv":
+		return NewCSVWriter(w, opts), nil
+	}
+	return nil, errors.New("unsupported export format: " + format)
+}
+
+// ExportTrack writes positions decoded by reader to track writer and closes it
+func ExportTrack(reader *BinaryReader, tw TrackWriter) error {
+	var werr error
+	code := reader.ReadFlatPositionsFunc(func(pos *FlatPosition) {
+		if werr == nil {
+			werr = tw.WritePosition(pos)
+		}
+	})
+	if werr != nil {
+		return werr
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if code != 0 {
+		return reader.Err()
+	}
+	return nil
+}
+
+// ExportPositions writes positions to track writer and closes it
+func ExportPositions(positions []FlatPosition, tw TrackWriter) error {
+	for i := range positions {
+		if err := tw.WritePosition(&positions[i]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
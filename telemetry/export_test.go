@@ -0,0 +1,137 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// exportTrack trip, stop and trip with altitude, event and position without coordinates
+func exportTrack() []FlatPosition {
+	track := segmentTrack(trackPhase{40 * time.Second, 60, 1}, trackPhase{40 * time.Second, 0, 1}, trackPhase{30 * time.Second, 60, 1})
+	for i := range track {
+		track[i].Time += 1600000000000
+	}
+	track[0].P[ParamAlt] = 150.25
+	track[5].E = []uint16{12}
+	noCoords := FlatPosition{Time: track[2].Time + 5000, P: map[uint16]float64{ParamSpeed: 60, 1021: 12.345}}
+	return append(track[:3], append([]FlatPosition{noCoords}, track[3:]...)...)
+}
+
+func exportOptions() ExportOptions {
+	return ExportOptions{
+		Name:     "Car <1>",
+		Segments: SegmentConfig{MinSpeed: 3, MinStopDuration: 30 * time.Second},
+		Location: time.FixedZone("UTC+3", 3*3600),
+	}
+}
+
+func TestExportGolden(t *testing.T) {
+	points := exportOptions()
+	points.Points = true
+	points.Params = []uint16{ParamSpeed, ParamAlt}
+	cases := []struct {
+		format string
+		opts   ExportOptions
+		golden string
+	}{
+		{"gpx", exportOptions(), "track.golden.gpx"},
+		{"kml", exportOptions(), "track.golden.kml"},
+		{"geojson", exportOptions(), "track.golden.geojson"},
+		{"geojson", points, "track_points.golden.geojson"},
+		{"csv", exportOptions(), "track.golden.csv"},
+	}
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		tw, err := NewTrackWriter(tc.format, &buf, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ExportPositions(exportTrack(), tw); err != nil {
+			t.Errorf("%s: %v", tc.golden, err)
+			continue
+		}
+		golden, err := ioutil.ReadFile(filepath.Join("testdata", tc.golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), golden) {
+			t.Errorf("%s differs from golden:\n%s", tc.golden, buf.Bytes())
+		}
+		if tc.format == "geojson" && !json.Valid(buf.Bytes()) {
+			t.Errorf("%s: invalid json", tc.golden)
+		}
+	}
+}
+
+func TestGeoJSONShortTrack(t *testing.T) {
+	track := exportTrack()
+	cases := []struct {
+		positions []FlatPosition
+		features  []string
+	}{
+		{nil, nil},
+		{track[3:4], nil},
+		{track[:1], []string{"Point"}},
+		{track[2:4], []string{"Point"}},
+		{track[:2], []string{"LineString"}},
+	}
+	for i, tc := range cases {
+		var buf bytes.Buffer
+		if err := ExportPositions(tc.positions, NewGeoJSONWriter(&buf, ExportOptions{Name: "short"})); err != nil {
+			t.Fatal(err)
+		}
+		var res struct {
+			Features []struct {
+				Geometry struct {
+					Type        string          `json:"type"`
+					Coordinates json.RawMessage `json:"coordinates"`
+				} `json:"geometry"`
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"features"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+			t.Errorf("case %d: %v\n%s", i, err, buf.Bytes())
+			continue
+		}
+		if len(res.Features) != len(tc.features) {
+			t.Errorf("case %d: %s", i, buf.Bytes())
+			continue
+		}
+		for j, f := range res.Features {
+			if f.Geometry.Type != tc.features[j] || f.Properties["name"] != "short" {
+				t.Errorf("case %d feature %d: %s", i, j, buf.Bytes())
+			}
+		}
+	}
+}
+
+func TestExportTrackReader(t *testing.T) {
+	enc, _ := NewEncoder(protocolVersion)
+	var frames []byte
+	track := exportTrack()
+	for i := range track {
+		var err error
+		if frames, err = enc.AppendFlat(frames, &track[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var expected, res bytes.Buffer
+	if err := ExportPositions(track, NewCSVWriter(&expected, exportOptions())); err != nil {
+		t.Fatal(err)
+	}
+	reader := NewReader()
+	reader.Set(&frames)
+	if err := ExportTrack(reader, NewCSVWriter(&res, exportOptions())); err != nil {
+		t.Fatal(err)
+	}
+	if res.String() != expected.String() {
+		t.Errorf("reader export:\n%s\nexpected\n%s", res.String(), expected.String())
+	}
+	if _, err := NewTrackWriter("shp", &res, exportOptions()); err == nil {
+		t.Error("unsupported format is created")
+	}
+}
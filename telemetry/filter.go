@@ -0,0 +1,770 @@
+package telemetry
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter compiled position filter expression.
+//
+// Expression syntax:
+//
+//	p.1105 > 60 and not (p.paramGPS < 4 or event(12))
+//	p.1020 & 0x4                   bitmask test, true if any bit is set
+//	p.1020 & 0x6 == 0x6            masked comparison
+//	p.1105 in 10..60               inclusive range
+//	tod in 22:00..06:00            time of day range, wraps over midnight
+//	hour >= 8, weekday in 1..5     time of position in filter location
+//	t >= 1577836800000             position time in ms
+//	has(p.1101)                    param exists
+//	event(12, 14)                  position has any of events
+//	zone("id1", "id2")             position is in any of zones
+//	zonetype("parking")            position is in zone of type
+//	zones > 0, events > 0          count of zones and events
+//
+// Comparisons of missing params are false
+type Filter struct {
+	// Location is used by time of day operands, UTC if nil
+	Location *time.Location
+	src      string
+	root     filterNode
+	params   []uint16
+}
+
+// filter three-valued result of time only evaluation
+type triBool int8
+
+const (
+	triFalse triBool = iota
+	triTrue
+	triUnknown
+)
+
+func toTri(v bool) triBool {
+	if v {
+		return triTrue
+	}
+	return triFalse
+}
+
+type filterNode interface {
+	match(f *Filter, pos *FlatPosition) bool
+	matchTime(f *Filter, t float64) triBool
+}
+
+type andNode []filterNode
+
+func (n andNode) match(f *Filter, pos *FlatPosition) bool {
+	for _, sub := range n {
+		if !sub.match(f, pos) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n andNode) matchTime(f *Filter, t float64) triBool {
+	res := triTrue
+	for _, sub := range n {
+		switch sub.matchTime(f, t) {
+		case triFalse:
+			return triFalse
+		case triUnknown:
+			res = triUnknown
+		}
+	}
+	return res
+}
+
+type orNode []filterNode
+
+func (n orNode) match(f *Filter, pos *FlatPosition) bool {
+	for _, sub := range n {
+		if sub.match(f, pos) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n orNode) matchTime(f *Filter, t float64) triBool {
+	res := triFalse
+	for _, sub := range n {
+		switch sub.matchTime(f, t) {
+		case triTrue:
+			return triTrue
+		case triUnknown:
+			res = triUnknown
+		}
+	}
+	return res
+}
+
+type notNode struct {
+	sub filterNode
+}
+
+func (n notNode) match(f *Filter, pos *FlatPosition) bool {
+	return !n.sub.match(f, pos)
+}
+
+func (n notNode) matchTime(f *Filter, t float64) triBool {
+	switch v := n.sub.matchTime(f, t); v {
+	case triTrue:
+		return triFalse
+	case triFalse:
+		return triTrue
+	default:
+		return v
+	}
+}
+
+type constNode bool
+
+func (n constNode) match(f *Filter, pos *FlatPosition) bool {
+	return bool(n)
+}
+
+func (n constNode) matchTime(f *Filter, t float64) triBool {
+	return toTri(bool(n))
+}
+
+// operandKind source of compared value
+type operandKind int
+
+const (
+	operandParam operandKind = iota
+	operandTime
+	operandTimeOfDay
+	operandHour
+	operandWeekday
+	operandZones
+	operandEvents
+)
+
+type filterOperand struct {
+	kind operandKind
+	code uint16
+	mask int64
+}
+
+func (op *filterOperand) timeOnly() bool {
+	switch op.kind {
+	case operandTime, operandTimeOfDay, operandHour, operandWeekday:
+		return true
+	}
+	return false
+}
+
+// value returns operand value of position time and params
+func (op *filterOperand) value(f *Filter, t float64, pos *FlatPosition) (float64, bool) {
+	var v float64
+	switch op.kind {
+	case operandParam:
+		var ok bool
+		if v, ok = pos.P[op.code]; !ok {
+			return 0, false
+		}
+	case operandZones:
+		v = float64(len(pos.Zones))
+	case operandEvents:
+		v = float64(len(pos.E))
+	case operandTime:
+		v = t
+	default:
+		loc := f.Location
+		if loc == nil {
+			loc = time.UTC
+		}
+		tm := time.Unix(0, int64(t*float64(time.Millisecond))).In(loc)
+		switch op.kind {
+		case operandTimeOfDay:
+			v = float64(tm.Hour()*60 + tm.Minute())
+		case operandHour:
+			v = float64(tm.Hour())
+		case operandWeekday:
+			v = float64(tm.Weekday())
+		}
+	}
+	if op.mask != 0 {
+		v = float64(int64(v) & op.mask)
+	}
+	return v, true
+}
+
+type compareNode struct {
+	op    filterOperand
+	cmp   string
+	value float64
+	to    float64   // upper bound of range
+	list  []float64 // values of "in" list
+}
+
+func (n *compareNode) test(v float64) bool {
+	switch n.cmp {
+	case "":
+		return v != 0
+	case "==":
+		return v == n.value
+	case "!=":
+		return v != n.value
+	case "<":
+		return v < n.value
+	case "<=":
+		return v <= n.value
+	case ">":
+		return v > n.value
+	case ">=":
+		return v >= n.value
+	case "..":
+		if n.value > n.to {
+			// range wraps, e.g. time of day over midnight
+			return v >= n.value || v <= n.to
+		}
+		return v >= n.value && v <= n.to
+	case "in":
+		for _, item := range n.list {
+			if v == item {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n *compareNode) match(f *Filter, pos *FlatPosition) bool {
+	v, ok := n.op.value(f, pos.Time, pos)
+	return ok && n.test(v)
+}
+
+func (n *compareNode) matchTime(f *Filter, t float64) triBool {
+	if !n.op.timeOnly() {
+		return triUnknown
+	}
+	v, _ := n.op.value(f, t, nil)
+	return toTri(n.test(v))
+}
+
+type hasNode uint16
+
+func (n hasNode) match(f *Filter, pos *FlatPosition) bool {
+	_, ok := pos.P[uint16(n)]
+	return ok
+}
+
+func (n hasNode) matchTime(f *Filter, t float64) triBool {
+	return triUnknown
+}
+
+type eventNode []uint16
+
+func (n eventNode) match(f *Filter, pos *FlatPosition) bool {
+	for _, e := range pos.E {
+		for _, code := range n {
+			if e == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n eventNode) matchTime(f *Filter, t float64) triBool {
+	return triUnknown
+}
+
+type zoneNode struct {
+	byType bool
+	values []string
+}
+
+func (n *zoneNode) match(f *Filter, pos *FlatPosition) bool {
+	for _, z := range pos.Zones {
+		v := z.ID
+		if n.byType {
+			v = z.Type
+		}
+		for _, item := range n.values {
+			if v == item {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n *zoneNode) matchTime(f *Filter, t float64) triBool {
+	return triUnknown
+}
+
+// CompileFilter parses filter expression
+func CompileFilter(expr string) (*Filter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens, params: make(map[uint16]bool)}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	f := &Filter{src: expr, root: root}
+	for code := range p.params {
+		f.params = append(f.params, code)
+	}
+	sortKeys(f.params)
+	return f, nil
+}
+
+// MustCompileFilter parses filter expression and panics on error
+func MustCompileFilter(expr string) *Filter {
+	f, err := CompileFilter(expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// String returns source expression
+func (f *Filter) String() string {
+	return f.src
+}
+
+// Params returns param codes used by filter
+func (f *Filter) Params() []uint16 {
+	return f.params
+}
+
+// Match checks position by filter
+func (f *Filter) Match(pos *FlatPosition) bool {
+	return f.root.match(f, pos)
+}
+
+// MatchTime checks position time by filter, returns false only
+// if filter can not match any position with this time
+func (f *Filter) MatchTime(t float64) bool {
+	return f.root.matchTime(f, t) != triFalse
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+type filterToken struct {
+	kind  tokenKind
+	text  string
+	value float64
+	pos   int
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// lexFilter splits expression to tokens
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case unicode.IsDigit(r) || r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			i++
+			for i < len(runes) && (isIdentRune(runes[i]) || runes[i] == ':') {
+				if runes[i] == '.' && i+1 < len(runes) && runes[i+1] == '.' {
+					break
+				}
+				i++
+			}
+			text := string(runes[start:i])
+			v, err := parseFilterNumber(text)
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid number %q at %d", text, start)
+			}
+			tokens = append(tokens, filterToken{kind: tokenNumber, text: text, value: v, pos: start})
+			continue
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && isIdentRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: tokenIdent, text: string(runes[start:i]), pos: start})
+			continue
+		case r == '"' || r == '\'':
+			i++
+			for i < len(runes) && runes[i] != r {
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("filter: unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, filterToken{kind: tokenString, text: string(runes[start+1 : i-1]), pos: start})
+			continue
+		}
+		op := ""
+		if i+1 < len(runes) {
+			switch two := string(runes[i : i+2]); two {
+			case "==", "!=", "<=", ">=", "&&", "||", "..":
+				op = two
+			}
+		}
+		if op == "" {
+			switch r {
+			case '(', ')', '[', ']', ',', '<', '>', '!', '&', '=':
+				op = string(r)
+			default:
+				return nil, fmt.Errorf("filter: unexpected %q at %d", r, start)
+			}
+		}
+		i += len(op)
+		if op == "=" {
+			op = "=="
+		}
+		tokens = append(tokens, filterToken{kind: tokenOp, text: op, pos: start})
+	}
+	return append(tokens, filterToken{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+// parseFilterNumber parses decimal, hex or hh:mm time of day value
+func parseFilterNumber(text string) (float64, error) {
+	if hm := strings.Split(text, ":"); len(hm) == 2 {
+		h, err := strconv.Atoi(hm[0])
+		if err != nil {
+			return 0, err
+		}
+		m, err := strconv.Atoi(hm[1])
+		if err != nil || h > 24 || m > 59 {
+			return 0, errors.New("invalid time of day")
+		}
+		return float64(h*60 + m), nil
+	}
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		v, err := strconv.ParseUint(text[2:], 16, 64)
+		return float64(v), err
+	}
+	v, err := strconv.ParseFloat(text, 64)
+	if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		err = errors.New("invalid number")
+	}
+	return v, err
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	params map[uint16]bool
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) errorf(tok filterToken, format string, args ...interface{}) error {
+	return fmt.Errorf("filter: "+format+" at %d", append(args, tok.pos)...)
+}
+
+// accept consumes operator or keyword token
+func (p *filterParser) accept(texts ...string) bool {
+	tok := p.peek()
+	if tok.kind != tokenOp && tok.kind != tokenIdent {
+		return false
+	}
+	for _, text := range texts {
+		if strings.EqualFold(tok.text, text) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *filterParser) expect(text string) error {
+	if !p.accept(text) {
+		tok := p.peek()
+		return p.errorf(tok, "expected %q, got %q", text, tok.text)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	res := orNode{node}
+	for p.accept("or", "||") {
+		if node, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		res = append(res, node)
+	}
+	if len(res) == 1 {
+		return res[0], nil
+	}
+	return res, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	node, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	res := andNode{node}
+	for p.accept("and", "&&") {
+		if node, err = p.parseUnary(); err != nil {
+			return nil, err
+		}
+		res = append(res, node)
+	}
+	if len(res) == 1 {
+		return res[0], nil
+	}
+	return res, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.accept("not", "!") {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	}
+	if p.accept("(") {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	}
+	return p.parsePredicate()
+}
+
+func (p *filterParser) parsePredicate() (filterNode, error) {
+	tok := p.next()
+	if tok.kind != tokenIdent {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	name := strings.ToLower(tok.text)
+	switch name {
+	case "true", "false":
+		return constNode(name == "true"), nil
+	case "has", "event", "zone", "zonetype":
+		if p.peek().text == "(" {
+			return p.parseFunc(tok, name)
+		}
+	}
+	op, err := p.parseOperand(tok)
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("&") {
+		mask := p.next()
+		if mask.kind != tokenNumber {
+			return nil, p.errorf(mask, "expected mask number, got %q", mask.text)
+		}
+		op.mask = int64(mask.value)
+	}
+	node := &compareNode{op: op}
+	cmp := p.peek()
+	switch {
+	case cmp.kind == tokenOp && (cmp.text == "==" || cmp.text == "!=" || cmp.text[0] == '<' || cmp.text[0] == '>'):
+		p.next()
+		node.cmp = cmp.text
+		if node.value, err = p.parseNumber(); err != nil {
+			return nil, err
+		}
+	case cmp.kind == tokenIdent && strings.EqualFold(cmp.text, "in"):
+		p.next()
+		if p.accept("[") {
+			return node, p.parseList(node)
+		}
+		node.cmp = ".."
+		if node.value, err = p.parseNumber(); err != nil {
+			return nil, err
+		}
+		if err = p.expect(".."); err != nil {
+			return nil, err
+		}
+		if node.to, err = p.parseNumber(); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func (p *filterParser) parseNumber() (float64, error) {
+	tok := p.next()
+	if tok.kind != tokenNumber {
+		return 0, p.errorf(tok, "expected number, got %q", tok.text)
+	}
+	return tok.value, nil
+}
+
+func (p *filterParser) parseList(node *compareNode) error {
+	node.cmp = "in"
+	for {
+		v, err := p.parseNumber()
+		if err != nil {
+			return err
+		}
+		node.list = append(node.list, v)
+		if !p.accept(",") {
+			return p.expect("]")
+		}
+	}
+}
+
+// parseOperand parses p.<code or name>, t, tod, hour, weekday, zones and events operands
+func (p *filterParser) parseOperand(tok filterToken) (filterOperand, error) {
+	name := strings.ToLower(tok.text)
+	switch name {
+	case "t", "time":
+		return filterOperand{kind: operandTime}, nil
+	case "tod":
+		return filterOperand{kind: operandTimeOfDay}, nil
+	case "hour":
+		return filterOperand{kind: operandHour}, nil
+	case "weekday":
+		return filterOperand{kind: operandWeekday}, nil
+	case "zones":
+		p.params[paramZones] = true
+		return filterOperand{kind: operandZones}, nil
+	case "events":
+		return filterOperand{kind: operandEvents}, nil
+	}
+	code, err := p.paramCode(tok)
+	if err != nil {
+		return filterOperand{}, err
+	}
+	return filterOperand{kind: operandParam, code: code}, nil
+}
+
+// paramCode resolves p.<code> or p.<registry name> param reference
+func (p *filterParser) paramCode(tok filterToken) (uint16, error) {
+	if !strings.HasPrefix(strings.ToLower(tok.text), "p.") {
+		return 0, p.errorf(tok, "unknown operand %q", tok.text)
+	}
+	ref := tok.text[2:]
+	code, err := strconv.ParseUint(ref, 10, 16)
+	if err != nil {
+		info, ok := DefaultRegistry.ParamByName(ref)
+		if !ok {
+			return 0, p.errorf(tok, "unknown param %q", ref)
+		}
+		code = uint64(info.Code)
+	}
+	p.params[uint16(code)] = true
+	return uint16(code), nil
+}
+
+func (p *filterParser) parseFunc(tok filterToken, name string) (filterNode, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var res filterNode
+	switch name {
+	case "has":
+		code, err := p.paramCode(p.next())
+		if err != nil {
+			return nil, err
+		}
+		res = hasNode(code)
+	case "event":
+		var events eventNode
+		for {
+			v, err := p.parseNumber()
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, uint16(v))
+			if !p.accept(",") {
+				break
+			}
+		}
+		res = events
+	default:
+		p.params[paramZones] = true
+		node := &zoneNode{byType: name == "zonetype"}
+		for {
+			arg := p.next()
+			if arg.kind != tokenString && arg.kind != tokenIdent && arg.kind != tokenNumber {
+				return nil, p.errorf(arg, "expected zone, got %q", arg.text)
+			}
+			node.values = append(node.values, arg.text)
+			if !p.accept(",") {
+				break
+			}
+		}
+		res = node
+	}
+	return res, p.expect(")")
+}
+
+// removeKeys removes params with keys from struct position
+func (pos *BinaryPosition) removeKeys(keys map[uint16]bool) {
+	i16 := pos.I16[:0]
+	for _, p := range pos.I16 {
+		if !keys[p.K] {
+			i16 = append(i16, p)
+		}
+	}
+	pos.I16 = i16
+	i32 := pos.I32[:0]
+	for _, p := range pos.I32 {
+		if !keys[p.K] {
+			i32 = append(i32, p)
+		}
+	}
+	pos.I32 = i32
+	ui32 := pos.UI32[:0]
+	for _, p := range pos.UI32 {
+		if !keys[p.K] {
+			ui32 = append(ui32, p)
+		}
+	}
+	pos.UI32 = ui32
+	f32 := pos.F32[:0]
+	for _, p := range pos.F32 {
+		if !keys[p.K] {
+			f32 = append(f32, p)
+		}
+	}
+	pos.F32 = f32
+	f64 := pos.F64[:0]
+	for _, p := range pos.F64 {
+		if !keys[p.K] {
+			f64 = append(f64, p)
+		}
+	}
+	pos.F64 = f64
+	if keys[paramZones] {
+		pos.Zones = nil
+	}
+}
@@ -0,0 +1,279 @@
+package telemetry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// monday 2020-01-06 00:00 UTC in ms
+const filterDay = 1578268800000
+
+// todTime returns position time of hh:mm of filterDay
+func todTime(h, m int) float64 {
+	return filterDay + float64((h*60+m)*60000)
+}
+
+func TestFilterMatch(t *testing.T) {
+	pos := &FlatPosition{
+		Time:  todTime(23, 30),
+		P:     map[uint16]float64{ParamSpeed: 70, ParamStatus: 5, 1024: 3},
+		E:     []uint16{12},
+		Zones: []ZoneInfo{{ID: "a1", Type: "parking"}},
+	}
+	cases := []struct {
+		expr  string
+		match bool
+	}{
+		// precedence and parentheses
+		{"true or false and false", true},
+		{"(true or false) and false", false},
+		{"false and false or true", true},
+		{"false and (false or true)", false},
+		{"not true or true", true},
+		{"not (true or true)", false},
+		{"!false && true || false", true},
+		{"p.1105 > 60 and not (p.paramGPS < 4 or event(12))", false},
+		{"p.1105 > 60 and not (p.paramGPS < 2 or event(13))", true},
+		// comparisons, ranges and in lists
+		{"p.1105 == 70", true},
+		{"p.1105 = 70", true},
+		{"p.1105 != 70", false},
+		{"p.1105 >= 70 and p.1105 <= 70", true},
+		{"p.1105 < 70", false},
+		{"p.1105 in 60..80", true},
+		{"p.1105 in 71..80", false},
+		{"p.1105 in 70..70", true},
+		{"p.1105 in [10, 70]", true},
+		{"p.1105 in [10, 20]", false},
+		{"p.1105", true},
+		// bit masks
+		{"p.1020 & 0x4", true},
+		{"p.1020 & 0x2", false},
+		{"p.1020 & 0x5 == 0x5", true},
+		{"p.1020 & 0x6 == 0x6", false},
+		{"p.paramStatus & 6 in [4, 6]", true},
+		// missing params
+		{"p.999 < 1", false},
+		{"p.999 != 1", false},
+		{"not has(p.999)", true},
+		{"has(p.paramStatus)", true},
+		// events and zones
+		{"event(1, 12)", true},
+		{"event(1)", false},
+		{"events > 0", true},
+		{`zone("b", "a1")`, true},
+		{"zone('b')", false},
+		{"zone(a1)", true},
+		{"zonetype(parking)", true},
+		{`zonetype("a1")`, false},
+		{"zones == 1", true},
+		// time
+		{"tod in 22:00..06:00", true},
+		{"tod in 08:00..18:00", false},
+		{"tod >= 23:30", true},
+		{"hour == 23", true},
+		{"weekday in 1..5", true},
+		{"weekday in [0, 6]", false},
+		{"t >= 1578268800000 and time < 1578355200000", true},
+	}
+	for _, tc := range cases {
+		f, err := CompileFilter(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if res := f.Match(pos); res != tc.match {
+			t.Errorf("%s: %v, expected %v", tc.expr, res, tc.match)
+		}
+		if f.String() != tc.expr {
+			t.Errorf("%s: source %q", tc.expr, f.String())
+		}
+	}
+}
+
+func TestFilterTimeOfDay(t *testing.T) {
+	f := MustCompileFilter("tod in 22:00..06:00")
+	cases := []struct {
+		h, m  int
+		match bool
+	}{
+		{21, 59, false},
+		{22, 0, true},
+		{23, 59, true},
+		{0, 0, true},
+		{3, 0, true},
+		{6, 0, true},
+		{6, 1, false},
+		{12, 0, false},
+	}
+	for _, tc := range cases {
+		tm := todTime(tc.h, tc.m)
+		if res := f.Match(&FlatPosition{Time: tm}); res != tc.match {
+			t.Errorf("%02d:%02d: %v, expected %v", tc.h, tc.m, res, tc.match)
+		}
+		if res := f.MatchTime(tm); res != tc.match {
+			t.Errorf("%02d:%02d time only: %v, expected %v", tc.h, tc.m, res, tc.match)
+		}
+	}
+	// 20:00 UTC is 23:00 in UTC+3
+	f.Location = time.FixedZone("UTC+3", 3*3600)
+	if !f.MatchTime(todTime(20, 0)) || f.MatchTime(todTime(3, 30)) {
+		t.Error("time of day is not checked in filter location")
+	}
+}
+
+func TestFilterMatchTime(t *testing.T) {
+	cases := []struct {
+		expr  string
+		tm    float64
+		match bool
+	}{
+		{"tod in 22:00..06:00 and p.1105 > 60", todTime(12, 0), false},
+		{"tod in 22:00..06:00 and p.1105 > 60", todTime(23, 0), true},
+		{"tod in 08:00..09:00 or p.1105 > 60", todTime(12, 0), true},
+		{"tod in 08:00..09:00 or hour == 13", todTime(12, 0), false},
+		{"not (hour == 12)", todTime(12, 0), false},
+		{"not (hour == 12 and p.1105 > 60)", todTime(12, 0), true},
+		{"not has(p.1105)", todTime(12, 0), true},
+		{"weekday == 0 and event(12)", todTime(12, 0), false},
+		{"false or zone(a1)", todTime(12, 0), true},
+		{"t > 1578268800000", filterDay, false},
+	}
+	for _, tc := range cases {
+		if res := MustCompileFilter(tc.expr).MatchTime(tc.tm); res != tc.match {
+			t.Errorf("%s: %v, expected %v", tc.expr, res, tc.match)
+		}
+	}
+}
+
+func TestFilterParams(t *testing.T) {
+	f := MustCompileFilter("p.1105 > 1 and has(p.paramGPS) or zone(a) or p.paramStatus & 1 or tod > 1:00")
+	if expected := []uint16{paramZones, ParamStatus, 1024, ParamSpeed}; !reflect.DeepEqual(f.Params(), expected) {
+		t.Errorf("params %v, expected %v", f.Params(), expected)
+	}
+	if f := MustCompileFilter("event(1) and hour > 1"); len(f.Params()) != 0 {
+		t.Errorf("params %v, expected none", f.Params())
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		err  string
+	}{
+		{"p.1105 >", `filter: expected number, got "" at 8`},
+		{"p.1105 > 1 and", `filter: unexpected "" at 14`},
+		{"(p.1 > 1", `filter: expected ")", got "" at 8`},
+		{"true false", `filter: unexpected "false" at 5`},
+		{"speed > 1", `filter: unknown operand "speed" at 0`},
+		{"p.1 > 1 and p.nope > 1", `filter: unknown param "nope" at 12`},
+		{"p.1 > 1x", `filter: invalid number "1x" at 6`},
+		{"tod in 25:00..06:00", `filter: invalid number "25:00" at 7`},
+		{`zone("a) or true`, `filter: unterminated string at 5`},
+		{"p.1 > 1 # 2", `filter: unexpected '#' at 8`},
+		{"p.1 & x", `filter: expected mask number, got "x" at 6`},
+		{"p.1 in 1 2", `filter: expected "..", got "2" at 9`},
+		{"p.1 in [1, 2", `filter: expected "]", got "" at 12`},
+		{"event(a)", `filter: expected number, got "a" at 6`},
+		{"zone()", `filter: expected zone, got ")" at 5`},
+		{"has(1)", `filter: unknown operand "1" at 4`},
+		{"zone(\"зона\") and p.x", `filter: unknown param "x" at 17`},
+	}
+	for _, tc := range cases {
+		f, err := CompileFilter(tc.expr)
+		if err == nil {
+			t.Errorf("%s: compiled to %v", tc.expr, f)
+			continue
+		}
+		if err.Error() != tc.err {
+			t.Errorf("%s: error %q, expected %q", tc.expr, err, tc.err)
+		}
+	}
+}
+
+const filterPower = 1021
+
+// filterFrames returns frames of positions at 21:00, 23:00, 01:00 and 07:00 with speed 20, 70, 30, 90
+func filterFrames(t *testing.T) []byte {
+	enc, _ := NewEncoder(protocolVersion)
+	var frames []byte
+	for i, h := range []int{21, 23, 1, 7} {
+		pos := &FlatPosition{Time: todTime(h, 0), P: map[uint16]float64{ParamSpeed: float64(20 + i*10 + i%2*40), filterPower: 12}}
+		var err error
+		if frames, err = enc.AppendFlat(frames, pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return frames
+}
+
+func TestReaderFilter(t *testing.T) {
+	frames := filterFrames(t)
+	filter := MustCompileFilter("tod in 22:00..06:00 and p.1105 > 25")
+	expected := []float64{todTime(23, 0), todTime(1, 0)}
+	for _, format := range []string{"flat", "struct", "compact"} {
+		for _, requested := range [][]uint16{nil, {filterPower}} {
+			reader := NewReader()
+			reader.Filter = filter
+			reader.Params = make(map[uint16]bool)
+			for _, key := range requested {
+				reader.Params[key] = true
+			}
+			var res []*FlatPosition
+			var code int16
+			switch format {
+			case "flat":
+				reader.Set(&frames)
+				var positions []FlatPosition
+				code, positions = reader.ReadFlatPositions()
+				for i := range positions {
+					res = append(res, &positions[i])
+				}
+			case "struct":
+				reader.Set(&frames)
+				var positions []BinaryPosition
+				code, positions = reader.ReadStructPositions()
+				for i := range positions {
+					res = append(res, positions[i].Flat())
+				}
+			default:
+				code, res = compactPositions(reader, frames, (*CompactPosition).Flat)
+			}
+			if code != 0 || len(res) != len(expected) {
+				t.Fatalf("%s %v: code %d positions %d, expected %d", format, requested, code, len(res), len(expected))
+			}
+			for i, pos := range res {
+				if pos.Time != expected[i] {
+					t.Errorf("%s %v position %d: time %v, expected %v", format, requested, i, pos.Time, expected[i])
+				}
+				if _, ok := pos.P[ParamSpeed]; ok != (requested == nil) {
+					t.Errorf("%s %v position %d: filter param is returned %v", format, requested, i, ok)
+				}
+				if _, ok := pos.P[filterPower]; !ok {
+					t.Errorf("%s %v position %d: requested param is not decoded", format, requested, i)
+				}
+			}
+		}
+	}
+}
+
+func TestReaderFilterSkipsByTime(t *testing.T) {
+	frames := filterFrames(t)
+	// break value kind of first param of frames out of time filter, frame length is fixed
+	frameLen := len(frames) / 4
+	for _, i := range []int{0, 3} {
+		frames[i*frameLen+18] = 0xff
+	}
+	reader := NewReader()
+	reader.Filter = MustCompileFilter("tod in 22:00..06:00 and p.1105 > 25")
+	reader.Set(&frames)
+	if code, res := reader.ReadFlatPositions(); code != 0 || len(res) != 2 {
+		t.Errorf("code %d positions %d, broken frames are decoded", code, len(res))
+	}
+	reader.Filter = MustCompileFilter("tod in 20:00..06:00 and p.1105 > 25")
+	reader.Set(&frames)
+	if code, _ := reader.ReadFlatPositions(); code == 0 {
+		t.Error("broken frame matched by time is not decoded")
+	}
+}
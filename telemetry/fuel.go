@@ -0,0 +1,320 @@
+package telemetry
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// EventRefuel position event of detected refuel
+	EventRefuel = 3410
+	// EventDrain position event of detected fuel drain
+	EventDrain = 3411
+)
+
+// CalibrationPoint sensor value and fuel volume pair
+type CalibrationPoint struct {
+	Raw    float64 `json:"raw" yaml:"raw"`
+	Litres float64 `json:"litres" yaml:"litres"`
+}
+
+// CalibrationTable converts fuel sensor values to litres by linear interpolation
+type CalibrationTable []CalibrationPoint
+
+// NewCalibrationTable create calibration table sorted by sensor value
+func NewCalibrationTable(points []CalibrationPoint) (CalibrationTable, error) {
+	if len(points) < 2 {
+		return nil, errors.New("calibration table needs at least two points")
+	}
+	table := append(CalibrationTable(nil), points...)
+	sort.Slice(table, func(i, j int) bool { return table[i].Raw < table[j].Raw })
+	for i := 1; i < len(table); i++ {
+		if table[i].Raw == table[i-1].Raw {
+			return nil, errors.New("calibration table has duplicate sensor values")
+		}
+	}
+	return table, nil
+}
+
+// Litres returns fuel volume of sensor value, values out of table are clamped
+func (table CalibrationTable) Litres(raw float64) float64 {
+	n := len(table)
+	if n == 0 {
+		return raw
+	}
+	if raw <= table[0].Raw {
+		return table[0].Litres
+	}
+	if raw >= table[n-1].Raw {
+		return table[n-1].Litres
+	}
+	i := sort.Search(n, func(i int) bool { return table[i].Raw >= raw })
+	a, b := table[i-1], table[i]
+	return a.Litres + (raw-a.Raw)*(b.Litres-a.Litres)/(b.Raw-a.Raw)
+}
+
+// FuelEventKind kind of fuel level change
+type FuelEventKind int
+
+const (
+	// FuelRefuel fuel level increase
+	FuelRefuel FuelEventKind = iota
+	// FuelDrain fuel level drop
+	FuelDrain
+)
+
+func (kind FuelEventKind) String() string {
+	switch kind {
+	case FuelRefuel:
+		return "refuel"
+	case FuelDrain:
+		return "drain"
+	}
+	return "unknown"
+}
+
+// FuelEvent detected refuel or drain
+type FuelEvent struct {
+	Kind   FuelEventKind `json:"kind"`
+	Start  float64       `json:"start"` // ms
+	End    float64       `json:"end"`   // ms
+	Before float64       `json:"before"`
+	After  float64       `json:"after"`
+	Volume float64       `json:"volume"`
+	Lat    float64       `json:"lat"`
+	Lon    float64       `json:"lon"`
+}
+
+// FuelConfig settings of fuel level analytics
+type FuelConfig struct {
+	Source          uint16           // sensor param code
+	Target          uint16           // calculated fuel level param code
+	TimeTarget      uint16           // fuel level time param code, zero disables
+	AvgTarget       uint16           // average consumption param code, zero disables
+	Calibration     CalibrationTable // sensor value to litres, nil if sensor measures litres
+	Window          int              // points of median smoothing, 0 or 1 disables smoothing
+	Noise           float64          // l, smaller level changes are consumption or sensor noise
+	RefuelThreshold float64          // l, minimal refuel volume
+	DrainThreshold  float64          // l, minimal drain volume
+	SettleTime      time.Duration    // level is stable if not changed for settle time
+	DrainMaxSpeed   float64          // km/h, drains are detected only on lower speed, zero disables check
+	MinDistance     float64          // km, minimal distance for average consumption
+	Registry        *ParamRegistry   // precision of params, DefaultRegistry if nil
+}
+
+// DefaultFuelConfig default settings of fuel level analytics
+var DefaultFuelConfig = FuelConfig{
+	Source:          ParamCanFuelLevel,
+	Target:          ParamFuel,
+	TimeTarget:      ParamTimeFuel,
+	AvgTarget:       ParamAvgFuel,
+	Window:          7,
+	Noise:           2,
+	RefuelThreshold: 10,
+	DrainThreshold:  8,
+	SettleTime:      2 * time.Minute,
+	DrainMaxSpeed:   5,
+	MinDistance:     1,
+}
+
+// FuelReport fuel usage summary
+type FuelReport struct {
+	Consumed float64     `json:"consumed"` // l, without drains
+	Distance float64     `json:"distance"` // km
+	Avg      float64     `json:"avg"`      // l/100km
+	Refueled float64     `json:"refueled"`
+	Drained  float64     `json:"drained"`
+	Events   []FuelEvent `json:"events"`
+}
+
+// fuelEpisode level change in progress
+type fuelEpisode struct {
+	rising  bool
+	start   float64
+	before  float64
+	extreme float64
+	changed float64 // ms, last extreme update
+	lat     float64
+	lon     float64
+	moving  bool
+}
+
+// FuelAnalyzer smooths fuel sensor of one vehicle, calculates consumption
+// and detects refuels and drains in time ordered positions
+type FuelAnalyzer struct {
+	Config   FuelConfig
+	window   []float64
+	started  bool
+	last     float64 // ms
+	baseline float64
+	basePos  geoPoint
+	episode  *fuelEpisode
+	odo      odoCounter
+	report   FuelReport
+}
+
+// NewFuelAnalyzer create fuel analyzer
+func NewFuelAnalyzer(cfg FuelConfig) *FuelAnalyzer {
+	return &FuelAnalyzer{Config: cfg}
+}
+
+func (f *FuelAnalyzer) registry() *ParamRegistry {
+	if f.Config.Registry != nil {
+		return f.Config.Registry
+	}
+	return DefaultRegistry
+}
+
+// smooth adds level to median window and returns smoothed level
+func (f *FuelAnalyzer) smooth(level float64) float64 {
+	if f.Config.Window <= 1 {
+		return level
+	}
+	f.window = append(f.window, level)
+	if len(f.window) > f.Config.Window {
+		f.window = f.window[len(f.window)-f.Config.Window:]
+	}
+	return median(f.window)
+}
+
+// distance updates travelled distance by calculated or device odometer
+func (f *FuelAnalyzer) distance(pos *FlatPosition) {
+	code := uint16(ParamCalcOdo)
+	if _, ok := pos.P[code]; !ok {
+		code = ParamOdometer
+	}
+	before := f.odo.total
+	if f.odo.push(pos, code) {
+		f.report.Distance += f.odo.total - before
+	}
+}
+
+// Push adds next position, writes smoothed fuel level and average consumption,
+// appends refuel and drain events to position and returns them
+func (f *FuelAnalyzer) Push(pos *FlatPosition) []FuelEvent {
+	if f.started && pos.Time < f.last {
+		// skip unordered position
+		return nil
+	}
+	f.distance(pos)
+	raw, ok := pos.P[f.Config.Source]
+	if !ok {
+		return nil
+	}
+	reg := f.registry()
+	level := f.smooth(f.Config.Calibration.Litres(raw))
+	pos.P[f.Config.Target] = reg.Round(f.Config.Target, level)
+	if f.Config.TimeTarget != 0 {
+		pos.P[f.Config.TimeTarget] = pos.Time
+	}
+	lat, lon, _ := pos.LatLon()
+	if !f.started {
+		f.started = true
+		f.baseline, f.basePos = level, geoPoint{lat, lon}
+	}
+	f.last = pos.Time
+	var events []FuelEvent
+	if ev := f.detect(pos, level, geoPoint{lat, lon}); ev != nil {
+		events = append(events, *ev)
+		code := uint16(EventRefuel)
+		if ev.Kind == FuelDrain {
+			code = EventDrain
+		}
+		pos.E = append(pos.E, code)
+	}
+	if f.Config.AvgTarget != 0 && f.report.Distance >= f.Config.MinDistance && f.report.Distance > 0 {
+		f.report.Avg = f.report.Consumed * 100 / f.report.Distance
+		pos.P[f.Config.AvgTarget] = reg.Round(f.Config.AvgTarget, f.report.Avg)
+	}
+	return events
+}
+
+// detect tracks level changes and returns confirmed refuel or drain
+func (f *FuelAnalyzer) detect(pos *FlatPosition, level float64, p geoPoint) *FuelEvent {
+	speed, _ := pos.P[ParamSpeed]
+	moving := f.Config.DrainMaxSpeed > 0 && speed > f.Config.DrainMaxSpeed
+	ep := f.episode
+	if ep == nil {
+		delta := level - f.baseline
+		if math.Abs(delta) <= f.Config.Noise {
+			if delta < 0 {
+				// slow decrease is consumption
+				f.report.Consumed -= delta
+				f.baseline = level
+			}
+			f.basePos = p
+			return nil
+		}
+		f.episode = &fuelEpisode{
+			rising:  delta > 0,
+			start:   pos.Time,
+			before:  f.baseline,
+			extreme: level,
+			changed: pos.Time,
+			lat:     f.basePos.Lat,
+			lon:     f.basePos.Lon,
+			moving:  moving,
+		}
+		return nil
+	}
+	ep.moving = ep.moving || moving
+	if (ep.rising && level > ep.extreme) || (!ep.rising && level < ep.extreme) {
+		ep.extreme, ep.changed = level, pos.Time
+	}
+	if pos.Time-ep.changed < float64(f.Config.SettleTime/time.Millisecond) {
+		return nil
+	}
+	// level is settled, volume is counted by settled level so short spikes revert to baseline
+	f.episode = nil
+	f.baseline, f.basePos = level, p
+	volume := level - ep.before
+	if !ep.rising {
+		volume = -volume
+	}
+	ev := &FuelEvent{
+		Start:  ep.start,
+		End:    ep.changed,
+		Before: ep.before,
+		After:  level,
+		Volume: volume,
+		Lat:    ep.lat,
+		Lon:    ep.lon,
+	}
+	switch {
+	case ep.rising && volume >= f.Config.RefuelThreshold:
+		ev.Kind = FuelRefuel
+		f.report.Refueled += volume
+	case !ep.rising && !ep.moving && volume >= f.Config.DrainThreshold:
+		ev.Kind = FuelDrain
+		f.report.Drained += volume
+	default:
+		if level < ep.before {
+			// fast consumption or sensor jump while moving
+			f.report.Consumed += ep.before - level
+		}
+		return nil
+	}
+	f.report.Events = append(f.report.Events, *ev)
+	return ev
+}
+
+// Report returns fuel usage summary
+func (f *FuelAnalyzer) Report() FuelReport {
+	res := f.report
+	res.Events = append([]FuelEvent(nil), f.report.Events...)
+	if res.Distance > 0 {
+		res.Avg = res.Consumed * 100 / res.Distance
+	}
+	return res
+}
+
+// AnalyzeFuel processes fuel level of track and returns fuel usage summary
+func AnalyzeFuel(positions []FlatPosition, cfg FuelConfig) FuelReport {
+	f := NewFuelAnalyzer(cfg)
+	for i := range positions {
+		f.Push(&positions[i])
+	}
+	return f.Report()
+}
@@ -0,0 +1,123 @@
+package telemetry
+
+import (
+	"math"
+	"testing"
+)
+
+// fuelTrack generates positions each 30 s with fuel sensor levels and speed
+func fuelTrack(speed float64, levels ...float64) []FlatPosition {
+	res := make([]FlatPosition, len(levels))
+	for i, level := range levels {
+		res[i] = FlatPosition{Time: float64(i) * 30000, P: map[uint16]float64{
+			ParamCanFuelLevel: level, ParamSpeed: speed, ParamLat: 55, ParamLon: 37,
+		}}
+	}
+	return res
+}
+
+// repeat returns n copies of level
+func repeat(level float64, n int) []float64 {
+	res := make([]float64, n)
+	for i := range res {
+		res[i] = level
+	}
+	return res
+}
+
+func join(parts ...[]float64) []float64 {
+	var res []float64
+	for _, part := range parts {
+		res = append(res, part...)
+	}
+	return res
+}
+
+func TestFuelEvents(t *testing.T) {
+	cases := []struct {
+		name     string
+		speed    float64
+		window   int
+		levels   []float64
+		kind     FuelEventKind
+		events   int
+		volume   float64
+		consumed float64
+	}{
+		{"spike", 0, 1, join(repeat(50, 10), repeat(65, 3), repeat(50, 10)), FuelRefuel, 0, 0, 0},
+		{"refuel", 0, 7, join(repeat(50, 10), []float64{55, 60, 65, 70}, repeat(70, 12)), FuelRefuel, 1, 20, 0},
+		{"drain parked", 0, 1, join(repeat(50, 10), []float64{45, 40, 35}, repeat(35, 10)), FuelDrain, 1, 15, 0},
+		{"drain moving", 60, 1, join(repeat(50, 10), []float64{45, 40, 35}, repeat(35, 10)), FuelDrain, 0, 0, 15},
+	}
+	for _, tc := range cases {
+		cfg := DefaultFuelConfig
+		cfg.Window = tc.window
+		report := AnalyzeFuel(fuelTrack(tc.speed, tc.levels...), cfg)
+		if len(report.Events) != tc.events || math.Abs(report.Consumed-tc.consumed) > 1e-9 {
+			t.Errorf("%s: events %+v consumed %v, want %d events consumed %v", tc.name, report.Events, report.Consumed, tc.events, tc.consumed)
+			continue
+		}
+		if tc.events == 0 {
+			if report.Refueled != 0 || report.Drained != 0 {
+				t.Errorf("%s: refueled %v drained %v", tc.name, report.Refueled, report.Drained)
+			}
+			continue
+		}
+		ev := report.Events[0]
+		if ev.Kind != tc.kind || math.Abs(ev.Volume-tc.volume) > 1e-9 || math.Abs(math.Abs(ev.After-ev.Before)-tc.volume) > 1e-9 {
+			t.Errorf("%s: event %+v, want %v of %v l", tc.name, ev, tc.kind, tc.volume)
+		}
+		total := report.Refueled + report.Drained
+		if math.Abs(total-tc.volume) > 1e-9 {
+			t.Errorf("%s: refueled %v drained %v, want %v", tc.name, report.Refueled, report.Drained, tc.volume)
+		}
+	}
+}
+
+func TestFuelEventPosition(t *testing.T) {
+	cfg := DefaultFuelConfig
+	cfg.Window = 1
+	track := fuelTrack(0, join(repeat(50, 5), repeat(70, 6))...)
+	f := NewFuelAnalyzer(cfg)
+	var events []FuelEvent
+	for i := range track {
+		events = append(events, f.Push(&track[i])...)
+	}
+	if len(events) != 1 {
+		t.Fatalf("events %+v", events)
+	}
+	// event is set to position where level is settled
+	last := track[9]
+	if len(last.E) != 1 || last.E[0] != EventRefuel || len(track[8].E) != 0 {
+		t.Errorf("position events %v", last.E)
+	}
+	if last.P[ParamFuel] != 70 || last.P[ParamTimeFuel] != last.Time {
+		t.Errorf("fuel level %v time %v", last.P[ParamFuel], last.P[ParamTimeFuel])
+	}
+}
+
+func TestCalibrationTable(t *testing.T) {
+	table, err := NewCalibrationTable([]CalibrationPoint{{200, 80}, {0, 0}, {100, 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for raw, want := range map[float64]float64{-5: 0, 0: 0, 50: 25, 100: 50, 150: 65, 200: 80, 300: 80} {
+		if v := table.Litres(raw); math.Abs(v-want) > 1e-9 {
+			t.Errorf("litres of %v: %v, want %v", raw, v, want)
+		}
+	}
+	if _, err = NewCalibrationTable([]CalibrationPoint{{0, 0}}); err == nil {
+		t.Error("table of one point is created")
+	}
+	if _, err = NewCalibrationTable([]CalibrationPoint{{0, 0}, {0, 10}}); err == nil {
+		t.Error("table with duplicate values is created")
+	}
+	cfg := DefaultFuelConfig
+	cfg.Window = 1
+	cfg.Calibration = table
+	track := fuelTrack(0, 150)
+	AnalyzeFuel(track, cfg)
+	if track[0].P[ParamFuel] != 65 {
+		t.Errorf("calibrated level %v, want 65", track[0].P[ParamFuel])
+	}
+}
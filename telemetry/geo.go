@@ -0,0 +1,37 @@
+package telemetry
+
+import "math"
+
+// earthRadius mean earth radius in meters
+const earthRadius = 6371008.8
+
+func toRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// GeoDistance returns great-circle distance in meters between two points
+func GeoDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// LatLon returns position coordinates
+func (pos *FlatPosition) LatLon() (lat, lon float64, ok bool) {
+	lat, okLat := pos.P[ParamLat]
+	lon, okLon := pos.P[ParamLon]
+	return lat, lon, okLat && okLon
+}
+
+// DistanceTo returns great-circle distance in meters to other position,
+// returns false if any position has no coordinates
+func (pos *FlatPosition) DistanceTo(other *FlatPosition) (float64, bool) {
+	lat1, lon1, ok1 := pos.LatLon()
+	lat2, lon2, ok2 := other.LatLon()
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	return GeoDistance(lat1, lon1, lat2, lon2), true
+}
@@ -0,0 +1,385 @@
+package telemetry
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ZoneEventKind kind of geofence event
+type ZoneEventKind int
+
+const (
+	// ZoneEnter object entered zone
+	ZoneEnter ZoneEventKind = iota
+	// ZoneExit object left zone
+	ZoneExit
+	// ZoneDwell object stays in zone longer than dwell time
+	ZoneDwell
+)
+
+func (kind ZoneEventKind) String() string {
+	switch kind {
+	case ZoneEnter:
+		return "enter"
+	case ZoneExit:
+		return "exit"
+	case ZoneDwell:
+		return "dwell"
+	}
+	return "unknown"
+}
+
+// ZoneEvent geofence event of object
+type ZoneEvent struct {
+	Kind     ZoneEventKind `json:"kind"`
+	Object   string        `json:"object"`
+	Zone     ZoneInfo      `json:"zone"`
+	Time     float64       `json:"t"`     // event time in ms
+	Enter    float64       `json:"enter"` // zone enter time in ms
+	Duration time.Duration `json:"duration"`
+}
+
+// GeofenceConfig geofence engine settings
+type GeofenceConfig struct {
+	CellSize  float64       // grid cell size in degrees
+	MaxCells  int           // zones covering more cells are checked without index
+	DwellTime time.Duration // zero disables dwell events
+}
+
+// DefaultGeofenceConfig default geofence engine settings
+var DefaultGeofenceConfig = GeofenceConfig{
+	CellSize:  0.05,
+	MaxCells:  4096,
+	DwellTime: 10 * time.Minute,
+}
+
+type gridCell struct {
+	X, Y int32
+}
+
+// geoZone zone with parsed geometry
+type geoZone struct {
+	info   ZoneInfo
+	shapes []geoShape
+	bounds geoBounds
+}
+
+func (z *geoZone) contains(lat, lon float64) bool {
+	if !z.bounds.contains(lat, lon) {
+		return false
+	}
+	for i := range z.shapes {
+		if z.shapes[i].contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneVisit object stay in zone
+type zoneVisit struct {
+	enter float64
+	dwell bool
+}
+
+// objectZones geofence state of object
+type objectZones struct {
+	last   float64
+	visits map[string]*zoneVisit
+}
+
+// Geofence computes zone membership of positions by grid index
+// and tracks enter, exit and dwell events of objects
+type Geofence struct {
+	Config  GeofenceConfig
+	mu      sync.RWMutex
+	zones   map[string]*geoZone
+	grid    map[gridCell][]*geoZone
+	large   []*geoZone
+	objects map[string]*objectZones
+}
+
+// NewGeofence create geofence engine
+func NewGeofence(cfg GeofenceConfig) *Geofence {
+	if cfg.CellSize <= 0 {
+		cfg.CellSize = DefaultGeofenceConfig.CellSize
+	}
+	if cfg.MaxCells <= 0 {
+		cfg.MaxCells = DefaultGeofenceConfig.MaxCells
+	}
+	return &Geofence{
+		Config:  cfg,
+		zones:   make(map[string]*geoZone),
+		grid:    make(map[gridCell][]*geoZone),
+		objects: make(map[string]*objectZones),
+	}
+}
+
+func (g *Geofence) cell(lat, lon float64) gridCell {
+	return gridCell{X: int32(math.Floor(lon / g.Config.CellSize)), Y: int32(math.Floor(lat / g.Config.CellSize))}
+}
+
+// cells returns grid cells covering bounds, returns false if bounds are too large
+func (g *Geofence) cells(b geoBounds) (gridCell, gridCell, bool) {
+	min, max := g.cell(b.MinLat, b.MinLon), g.cell(b.MaxLat, b.MaxLon)
+	count := (float64(max.X) - float64(min.X) + 1) * (float64(max.Y) - float64(min.Y) + 1)
+	return min, max, count <= float64(g.Config.MaxCells)
+}
+
+// AddZone parses zone GeoJSON path and adds zone to index, replaces zone with same id.
+// Buffer is used as circle radius for points and as buffer for lines and polygons
+func (g *Geofence) AddZone(zone ZoneInfo) error {
+	if zone.ID == "" {
+		return errors.New("zone id is empty")
+	}
+	buffer := 0.0
+	if zone.Buffer != nil {
+		buffer = *zone.Buffer
+	}
+	shapes, err := parseGeoJSON([]byte(zone.Path), buffer)
+	if err != nil {
+		return err
+	}
+	if len(shapes) == 0 {
+		return errors.New("zone geometry is empty")
+	}
+	z := &geoZone{info: zone, shapes: shapes, bounds: emptyBounds()}
+	for i := range shapes {
+		b := shapes[i].bounds()
+		z.bounds.extend(geoPoint{b.MinLat, b.MinLon})
+		z.bounds.extend(geoPoint{b.MaxLat, b.MaxLon})
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.removeZone(zone.ID)
+	g.zones[zone.ID] = z
+	min, max, ok := g.cells(z.bounds)
+	if !ok {
+		g.large = append(g.large, z)
+		return nil
+	}
+	for x := min.X; x <= max.X; x++ {
+		for y := min.Y; y <= max.Y; y++ {
+			c := gridCell{x, y}
+			g.grid[c] = append(g.grid[c], z)
+		}
+	}
+	return nil
+}
+
+// RemoveZone removes zone from index
+func (g *Geofence) RemoveZone(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.removeZone(id)
+}
+
+func removeGeoZone(list []*geoZone, z *geoZone) []*geoZone {
+	for i := range list {
+		if list[i] == z {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func (g *Geofence) removeZone(id string) {
+	z, ok := g.zones[id]
+	if !ok {
+		return
+	}
+	delete(g.zones, id)
+	min, max, ok := g.cells(z.bounds)
+	if !ok {
+		g.large = removeGeoZone(g.large, z)
+		return
+	}
+	for x := min.X; x <= max.X; x++ {
+		for y := min.Y; y <= max.Y; y++ {
+			c := gridCell{x, y}
+			if list := removeGeoZone(g.grid[c], z); len(list) > 0 {
+				g.grid[c] = list
+			} else {
+				delete(g.grid, c)
+			}
+		}
+	}
+}
+
+// Zones returns all indexed zones
+func (g *Geofence) Zones() []ZoneInfo {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	res := make([]ZoneInfo, 0, len(g.zones))
+	for _, z := range g.zones {
+		res = append(res, z.info)
+	}
+	return res
+}
+
+// Lookup returns zones containing point
+func (g *Geofence) Lookup(lat, lon float64) []ZoneInfo {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var res []ZoneInfo
+	for _, z := range g.grid[g.cell(lat, lon)] {
+		if z.contains(lat, lon) {
+			res = append(res, z.info)
+		}
+	}
+	for _, z := range g.large {
+		if z.contains(lat, lon) {
+			res = append(res, z.info)
+		}
+	}
+	return res
+}
+
+// Locate returns zones containing position, returns false if position has no coordinates
+func (g *Geofence) Locate(pos *FlatPosition) ([]ZoneInfo, bool) {
+	lat, lon, ok := pos.LatLon()
+	if !ok {
+		return nil, false
+	}
+	return g.Lookup(lat, lon), true
+}
+
+// Evaluate sets position zones and returns enter, exit and dwell events of object.
+// Positions without coordinates and unordered positions do not change object state
+func (g *Geofence) Evaluate(object string, pos *FlatPosition) []ZoneEvent {
+	zones, ok := g.Locate(pos)
+	if !ok {
+		return nil
+	}
+	pos.Zones = zones
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state, ok := g.objects[object]
+	if !ok {
+		state = &objectZones{last: pos.Time, visits: make(map[string]*zoneVisit)}
+		g.objects[object] = state
+	}
+	if pos.Time < state.last {
+		return nil
+	}
+	state.last = pos.Time
+	var events []ZoneEvent
+	event := func(kind ZoneEventKind, zone ZoneInfo, visit *zoneVisit) {
+		events = append(events, ZoneEvent{
+			Kind:     kind,
+			Object:   object,
+			Zone:     zone,
+			Time:     pos.Time,
+			Enter:    visit.enter,
+			Duration: time.Duration((pos.Time - visit.enter) * float64(time.Millisecond)),
+		})
+	}
+	inside := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		inside[zone.ID] = true
+		visit, ok := state.visits[zone.ID]
+		if !ok {
+			visit = &zoneVisit{enter: pos.Time}
+			state.visits[zone.ID] = visit
+			event(ZoneEnter, zone, visit)
+		}
+		dwell := g.Config.DwellTime
+		if !visit.dwell && dwell > 0 && pos.Time-visit.enter >= float64(dwell/time.Millisecond) {
+			visit.dwell = true
+			event(ZoneDwell, zone, visit)
+		}
+	}
+	for id, visit := range state.visits {
+		if inside[id] {
+			continue
+		}
+		delete(state.visits, id)
+		zone := ZoneInfo{ID: id}
+		if z, ok := g.zones[id]; ok {
+			zone = z.info
+		}
+		event(ZoneExit, zone, visit)
+	}
+	return events
+}
+
+// Inside returns ids of zones where object is now
+func (g *Geofence) Inside(object string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	state, ok := g.objects[object]
+	if !ok {
+		return nil
+	}
+	res := make([]string, 0, len(state.visits))
+	for id := range state.visits {
+		res = append(res, id)
+	}
+	return res
+}
+
+// Reset clears object state
+func (g *Geofence) Reset(object string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.objects, object)
+}
+
+// ZoneRecord stored zone, record of zonestore table, nullable columns are pointers
+type ZoneRecord struct {
+	ID       string   `db:"id" json:"id"`
+	Name     *string  `db:"name" json:"name"`
+	Type     *string  `db:"tid" json:"tid"`
+	Path     *string  `db:"path" json:"path"` // GeoJSON geometry
+	Additive *float64 `db:"additive" json:"additive"`
+	Distance *float64 `db:"distance" json:"distance"`
+	Buffer   *float64 `db:"buffer" json:"buffer"`
+}
+
+// Zone converts record to zone info
+func (rec *ZoneRecord) Zone() ZoneInfo {
+	zone := ZoneInfo{ID: rec.ID, Additive: rec.Additive, Distance: rec.Distance, Buffer: rec.Buffer}
+	if rec.Name != nil {
+		zone.Name = *rec.Name
+	}
+	if rec.Type != nil {
+		zone.Type = *rec.Type
+	}
+	if rec.Path != nil {
+		zone.Path = *rec.Path
+	}
+	return zone
+}
+
+// AddZones adds zones records to index, returns count of added zones.
+// Zones with invalid geometry are skipped and reported in error
+func (g *Geofence) AddZones(recs []ZoneRecord) (int, error) {
+	cnt := 0
+	var failed []string
+	for i := range recs {
+		if err := g.AddZone(recs[i].Zone()); err != nil {
+			failed = append(failed, recs[i].ID+": "+err.Error())
+			continue
+		}
+		cnt++
+	}
+	if len(failed) > 0 {
+		return cnt, errors.New("invalid zones: " + strings.Join(failed, "; "))
+	}
+	return cnt, nil
+}
+
+// LoadZones loads zones records by loader (zonestore.Loader of SchemaTable) and adds them to index, returns count of loaded zones
+func (g *Geofence) LoadZones(load func() ([]ZoneRecord, error)) (int, error) {
+	if load == nil {
+		return 0, errors.New("zones loader is not set")
+	}
+	recs, err := load()
+	if err != nil {
+		return 0, err
+	}
+	return g.AddZones(recs)
+}
@@ -0,0 +1,34 @@
+package telemetry
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLoadZones(t *testing.T) {
+	point := `{"type":"Point","coordinates":[37.6,55.7]}`
+	invalid := `{"type":"Point"`
+	buffer, small, distance := 200.0, 50.0, 5000.0
+	g := NewGeofence(DefaultGeofenceConfig)
+	cnt, err := g.LoadZones(func() ([]ZoneRecord, error) {
+		return []ZoneRecord{
+			{ID: "circle", Path: &point, Buffer: &buffer},
+			{ID: "distance", Path: &point, Buffer: &small, Distance: &distance},
+			{ID: "broken", Path: &invalid},
+		}, nil
+	})
+	if cnt != 2 || err == nil {
+		t.Fatalf("count %d, err %v, expected 2 zones and invalid zone error", cnt, err)
+	}
+	// 0.001 deg of latitude is about 111 m
+	zones := g.Lookup(55.701, 37.6)
+	if len(zones) != 1 || zones[0].ID != "circle" {
+		t.Errorf("zones %v, expected only circle zone, distance must not be used as buffer", zones)
+	}
+	if len(g.Lookup(55.703, 37.6)) != 0 {
+		t.Error("point outside of buffer is found in zone")
+	}
+	if _, err := g.LoadZones(func() ([]ZoneRecord, error) { return nil, errors.New("db error") }); err == nil {
+		t.Error("loader error is not returned")
+	}
+}
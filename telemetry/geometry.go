@@ -0,0 +1,306 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+// metersPerDegree length of latitude degree in meters
+const metersPerDegree = earthRadius * math.Pi / 180
+
+type shapeKind int
+
+const (
+	shapeCircle shapeKind = iota
+	shapePolygon
+	shapeLine
+)
+
+type geoPoint struct {
+	Lat, Lon float64
+}
+
+// geoBounds bounding box in degrees
+type geoBounds struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+func (b *geoBounds) extend(p geoPoint) {
+	b.MinLat = math.Min(b.MinLat, p.Lat)
+	b.MaxLat = math.Max(b.MaxLat, p.Lat)
+	b.MinLon = math.Min(b.MinLon, p.Lon)
+	b.MaxLon = math.Max(b.MaxLon, p.Lon)
+}
+
+// grow expands bounds by distance in meters
+func (b *geoBounds) grow(meters float64) {
+	if meters <= 0 {
+		return
+	}
+	dLat := meters / metersPerDegree
+	lat := math.Max(math.Abs(b.MinLat), math.Abs(b.MaxLat))
+	dLon := 180.0
+	if cos := math.Cos(toRad(math.Min(lat+dLat, 89.9))); cos > 0 {
+		dLon = math.Min(180, dLat/cos)
+	}
+	b.MinLat, b.MaxLat = b.MinLat-dLat, b.MaxLat+dLat
+	b.MinLon, b.MaxLon = b.MinLon-dLon, b.MaxLon+dLon
+}
+
+func (b *geoBounds) contains(lat, lon float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat && lon >= b.MinLon && lon <= b.MaxLon
+}
+
+func emptyBounds() geoBounds {
+	return geoBounds{MinLat: math.Inf(1), MinLon: math.Inf(1), MaxLat: math.Inf(-1), MaxLon: math.Inf(-1)}
+}
+
+// geoShape circle, polygon with holes or polyline
+type geoShape struct {
+	kind   shapeKind
+	rings  [][]geoPoint // polygon rings (first is outer) or polyline parts
+	center geoPoint
+	radius float64 // meters, circle radius or buffer distance
+}
+
+func (s *geoShape) bounds() geoBounds {
+	b := emptyBounds()
+	if s.kind == shapeCircle {
+		b.extend(s.center)
+	}
+	for _, ring := range s.rings {
+		for _, p := range ring {
+			b.extend(p)
+		}
+	}
+	b.grow(s.radius)
+	return b
+}
+
+// contains checks point is inside shape or buffer around it
+func (s *geoShape) contains(lat, lon float64) bool {
+	switch s.kind {
+	case shapeCircle:
+		return GeoDistance(lat, lon, s.center.Lat, s.center.Lon) <= s.radius
+	case shapePolygon:
+		if len(s.rings) > 0 && inRing(s.rings[0], lat, lon) {
+			inside := true
+			for _, hole := range s.rings[1:] {
+				if inRing(hole, lat, lon) {
+					inside = false
+					break
+				}
+			}
+			if inside {
+				return true
+			}
+		}
+	}
+	return s.radius > 0 && s.edgeDistance(lat, lon) <= s.radius
+}
+
+// edgeDistance returns distance in meters from point to the nearest shape edge
+func (s *geoShape) edgeDistance(lat, lon float64) float64 {
+	res := math.Inf(1)
+	for _, ring := range s.rings {
+		if len(ring) == 1 {
+			res = math.Min(res, GeoDistance(lat, lon, ring[0].Lat, ring[0].Lon))
+		}
+		for i := 1; i < len(ring); i++ {
+			res = math.Min(res, segmentDistance(lat, lon, ring[i-1], ring[i]))
+		}
+	}
+	return res
+}
+
+// inRing checks point is inside ring by ray casting
+func inRing(ring []geoPoint, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > lat) != (b.Lat > lat) &&
+			lon < (b.Lon-a.Lon)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// segmentDistance returns distance in meters from point to segment,
+// segment is projected to local plane around point
+func segmentDistance(lat, lon float64, a, b geoPoint) float64 {
+	kx := metersPerDegree * math.Cos(toRad(lat))
+	ax, ay := (a.Lon-lon)*kx, (a.Lat-lat)*metersPerDegree
+	bx, by := (b.Lon-lon)*kx, (b.Lat-lat)*metersPerDegree
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l))
+	}
+	x, y := ax+t*dx, ay+t*dy
+	return math.Sqrt(x*x + y*y)
+}
+
+// geoJSON generic GeoJSON object
+type geoJSON struct {
+	Type        string                 `json:"type"`
+	Coordinates json.RawMessage        `json:"coordinates"`
+	Geometry    *geoJSON               `json:"geometry"`
+	Geometries  []*geoJSON             `json:"geometries"`
+	Features    []*geoJSON             `json:"features"`
+	Properties  map[string]interface{} `json:"properties"`
+}
+
+func toGeoPoint(c []float64) (geoPoint, error) {
+	if len(c) < 2 {
+		return geoPoint{}, errors.New("invalid geojson position")
+	}
+	return geoPoint{Lat: c[1], Lon: c[0]}, nil
+}
+
+func toGeoPoints(coords [][]float64) ([]geoPoint, error) {
+	res := make([]geoPoint, len(coords))
+	for i, c := range coords {
+		p, err := toGeoPoint(c)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = p
+	}
+	return res, nil
+}
+
+func toGeoRings(coords [][][]float64) ([][]geoPoint, error) {
+	res := make([][]geoPoint, len(coords))
+	for i, c := range coords {
+		ring, err := toGeoPoints(c)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = ring
+	}
+	return res, nil
+}
+
+// parseGeoJSON parses GeoJSON geometry, feature or collection to shapes,
+// buffer is used as circle radius for points and as buffer distance for lines and polygons,
+// "radius" feature property overrides buffer
+func parseGeoJSON(data []byte, buffer float64) ([]geoShape, error) {
+	obj := geoJSON{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	return obj.shapes(buffer)
+}
+
+func (obj *geoJSON) shapes(buffer float64) ([]geoShape, error) {
+	var res []geoShape
+	var err error
+	switch obj.Type {
+	case "Feature":
+		if r, ok := obj.Properties["radius"].(float64); ok {
+			buffer = r
+		}
+		if obj.Geometry == nil {
+			return nil, errors.New("geojson feature without geometry")
+		}
+		return obj.Geometry.shapes(buffer)
+	case "FeatureCollection":
+		for _, f := range obj.Features {
+			shapes, err := f.shapes(buffer)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, shapes...)
+		}
+	case "GeometryCollection":
+		for _, g := range obj.Geometries {
+			shapes, err := g.shapes(buffer)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, shapes...)
+		}
+	case "Point":
+		var c []float64
+		if err = json.Unmarshal(obj.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		res, err = pointShapes([][]float64{c}, buffer)
+	case "MultiPoint":
+		var c [][]float64
+		if err = json.Unmarshal(obj.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		res, err = pointShapes(c, buffer)
+	case "LineString":
+		var c [][]float64
+		if err = json.Unmarshal(obj.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		res, err = lineShapes([][][]float64{c}, buffer)
+	case "MultiLineString":
+		var c [][][]float64
+		if err = json.Unmarshal(obj.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		res, err = lineShapes(c, buffer)
+	case "Polygon":
+		var c [][][]float64
+		if err = json.Unmarshal(obj.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		res, err = polygonShapes([][][][]float64{c}, buffer)
+	case "MultiPolygon":
+		var c [][][][]float64
+		if err = json.Unmarshal(obj.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		res, err = polygonShapes(c, buffer)
+	default:
+		return nil, errors.New("unsupported geojson type: " + obj.Type)
+	}
+	return res, err
+}
+
+func pointShapes(coords [][]float64, radius float64) ([]geoShape, error) {
+	if radius <= 0 {
+		return nil, errors.New("circle zone without radius")
+	}
+	res := make([]geoShape, 0, len(coords))
+	for _, c := range coords {
+		p, err := toGeoPoint(c)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, geoShape{kind: shapeCircle, center: p, radius: radius})
+	}
+	return res, nil
+}
+
+func lineShapes(coords [][][]float64, buffer float64) ([]geoShape, error) {
+	if buffer <= 0 {
+		return nil, errors.New("line zone without buffer distance")
+	}
+	rings, err := toGeoRings(coords)
+	if err != nil {
+		return nil, err
+	}
+	return []geoShape{{kind: shapeLine, rings: rings, radius: buffer}}, nil
+}
+
+func polygonShapes(coords [][][][]float64, buffer float64) ([]geoShape, error) {
+	res := make([]geoShape, 0, len(coords))
+	for _, c := range coords {
+		rings, err := toGeoRings(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(rings) == 0 || len(rings[0]) < 3 {
+			return nil, errors.New("invalid geojson polygon")
+		}
+		res = append(res, geoShape{kind: shapePolygon, rings: rings, radius: buffer})
+	}
+	return res, nil
+}
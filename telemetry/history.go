@@ -0,0 +1,211 @@
+package telemetry
+
+import (
+	"sort"
+	"time"
+)
+
+// DayLoader loads binary telemetry block of object for day in "20060102" format,
+// nil data without error means that object has no data for day
+type DayLoader func(object, day string) ([]byte, error)
+
+// HistoryConfig settings of param history lookup
+type HistoryConfig struct {
+	MaxDays  int           // days loaded before requested day for params with history flag
+	MaxAge   time.Duration // older values are treated as missing, zero is unlimited
+	MaxGap   time.Duration // max gap between points of interpolation, zero is unlimited
+	Registry *ParamRegistry
+}
+
+// DefaultHistoryConfig default settings of param history lookup
+var DefaultHistoryConfig = HistoryConfig{
+	MaxDays: 7,
+	MaxGap:  10 * time.Minute,
+}
+
+// HistoryValue param value at requested time
+type HistoryValue struct {
+	Value        float64       `json:"v"`
+	Time         float64       `json:"t"`   // value time in ms, linked time if param has it
+	Age          time.Duration `json:"age"` // requested time minus value time, minus older point time if interpolated
+	Interpolated bool          `json:"i,omitempty"`
+}
+
+// HistorySample param values at requested time
+type HistorySample struct {
+	Time   float64                 `json:"t"`
+	Values map[uint16]HistoryValue `json:"values"`
+}
+
+// historyPoint value of param at time
+type historyPoint struct {
+	t float64
+	v float64
+}
+
+// History time-aligned param lookup over positions of object,
+// day blocks are loaded on demand
+type History struct {
+	Config    HistoryConfig
+	Object    string
+	Load      DayLoader
+	positions []FlatPosition
+	days      map[string]bool
+	series    map[uint16][]historyPoint
+}
+
+// NewHistory create history of object, load may be nil if positions are added by Add
+func NewHistory(object string, load DayLoader, cfg HistoryConfig) *History {
+	if cfg.Registry == nil {
+		cfg.Registry = DefaultRegistry
+	}
+	return &History{Config: cfg, Object: object, Load: load, days: make(map[string]bool)}
+}
+
+// Add adds positions of object
+func (h *History) Add(positions ...FlatPosition) {
+	h.positions = append(h.positions, positions...)
+	sort.SliceStable(h.positions, func(i, j int) bool { return h.positions[i].Time < h.positions[j].Time })
+	h.series = nil
+}
+
+// historyDay day of time in format of binary blocks
+func historyDay(t time.Time) string {
+	return t.Format("20060102")
+}
+
+// loadDay loads day block once, returns true if positions were added
+func (h *History) loadDay(day string) (bool, error) {
+	if h.Load == nil || h.days[day] {
+		return false, nil
+	}
+	h.days[day] = true
+	data, err := h.Load(h.Object, day)
+	if err != nil || len(data) == 0 {
+		return false, err
+	}
+	reader := NewReader()
+	reader.Set(&data)
+	reader.Registry = h.Config.Registry
+	reader.Policy = DecodeResync
+	code, positions := reader.ReadFlatPositions()
+	if code != 0 {
+		return false, reader.Err()
+	}
+	h.Add(positions...)
+	return len(positions) > 0, nil
+}
+
+// points returns sorted values of param, linked time is used as value time
+func (h *History) points(code uint16) []historyPoint {
+	if h.series == nil {
+		h.series = make(map[uint16][]historyPoint)
+	}
+	if points, ok := h.series[code]; ok {
+		return points
+	}
+	var linked uint16
+	if info, ok := h.Config.Registry.Param(code); ok {
+		linked = info.LinkedTime
+	}
+	var points []historyPoint
+	for i := range h.positions {
+		pos := &h.positions[i]
+		v, ok := pos.P[code]
+		if !ok {
+			continue
+		}
+		t := pos.Time
+		if linked != 0 {
+			if lt, ok := pos.P[linked]; ok && lt > 0 {
+				t = lt
+			}
+		}
+		points = append(points, historyPoint{t, v})
+	}
+	if linked != 0 {
+		sort.SliceStable(points, func(i, j int) bool { return points[i].t < points[j].t })
+	}
+	h.series[code] = points
+	return points
+}
+
+// value finds last known or interpolated value of param at time
+func (h *History) value(code uint16, t float64, continuous bool) (HistoryValue, bool) {
+	points := h.points(code)
+	i := sort.Search(len(points), func(i int) bool { return points[i].t > t })
+	if i == 0 {
+		return HistoryValue{}, false
+	}
+	prev := points[i-1]
+	res := HistoryValue{Value: prev.v, Time: prev.t, Age: time.Duration((t - prev.t) * float64(time.Millisecond))}
+	// age of interpolated value is age of older point
+	if h.Config.MaxAge > 0 && res.Age > h.Config.MaxAge {
+		return HistoryValue{}, false
+	}
+	if continuous && prev.t < t && i < len(points) {
+		next := points[i]
+		if h.Config.MaxGap == 0 || next.t-prev.t <= float64(h.Config.MaxGap/time.Millisecond) {
+			v := prev.v + (next.v-prev.v)*(t-prev.t)/(next.t-prev.t)
+			return HistoryValue{Value: h.Config.Registry.Round(code, v), Time: t, Age: res.Age, Interpolated: true}, true
+		}
+	}
+	return res, true
+}
+
+// Lookup returns values of params at time in ms
+func (h *History) Lookup(t float64, params ...uint16) (map[uint16]HistoryValue, error) {
+	samples, err := h.Series([]float64{t}, params...)
+	if err != nil {
+		return nil, err
+	}
+	return samples[0].Values, nil
+}
+
+// Series returns values of params at every time in ms,
+// missing values of params with history flag are backfilled from earlier days
+func (h *History) Series(times []float64, params ...uint16) ([]HistorySample, error) {
+	samples := make([]HistorySample, len(times))
+	for i, t := range times {
+		if _, err := h.loadDay(historyDay(time.Unix(0, int64(t)*int64(time.Millisecond)))); err != nil {
+			return nil, err
+		}
+		samples[i] = HistorySample{Time: t, Values: make(map[uint16]HistoryValue, len(params))}
+	}
+	for _, code := range params {
+		info, _ := h.Config.Registry.Param(code)
+		continuous := info != nil && info.Continuous
+		for i, t := range times {
+			v, ok := h.value(code, t, continuous)
+			if !ok && info != nil && info.History {
+				var err error
+				if v, ok, err = h.backfill(code, t, continuous); err != nil {
+					return nil, err
+				}
+			}
+			if ok {
+				samples[i].Values[code] = v
+			}
+		}
+	}
+	return samples, nil
+}
+
+// backfill loads previous days until value of param is found
+func (h *History) backfill(code uint16, t float64, continuous bool) (HistoryValue, bool, error) {
+	day := time.Unix(0, int64(t)*int64(time.Millisecond))
+	for i := 0; i < h.Config.MaxDays; i++ {
+		day = day.AddDate(0, 0, -1)
+		added, err := h.loadDay(historyDay(day))
+		if err != nil {
+			return HistoryValue{}, false, err
+		}
+		if !added {
+			continue
+		}
+		if v, ok := h.value(code, t, continuous); ok {
+			return v, true, nil
+		}
+	}
+	return HistoryValue{}, false, nil
+}
@@ -0,0 +1,67 @@
+package telemetry
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHistoryInterpolationAge(t *testing.T) {
+	minute := float64(time.Minute / time.Millisecond)
+	positions := []FlatPosition{
+		{Time: 0, P: map[uint16]float64{ParamOdometer: 100}},
+		{Time: 20 * minute, P: map[uint16]float64{ParamOdometer: 120}},
+	}
+	cases := []struct {
+		maxAge time.Duration
+		ok     bool
+	}{
+		{0, true},
+		{15 * time.Minute, true},
+		{5 * time.Minute, false},
+	}
+	for _, tc := range cases {
+		h := NewHistory("1", nil, HistoryConfig{MaxAge: tc.maxAge})
+		h.Add(positions...)
+		values, err := h.Lookup(10*minute, ParamOdometer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, ok := values[ParamOdometer]
+		if ok != tc.ok {
+			t.Errorf("max age %s: found %v, expected %v", tc.maxAge, ok, tc.ok)
+			continue
+		}
+		if ok && (!v.Interpolated || v.Value != 110 || v.Age != 10*time.Minute) {
+			t.Errorf("max age %s: value %+v, expected interpolated 110 with age 10m", tc.maxAge, v)
+		}
+	}
+}
+
+func TestHistoryLoadErrors(t *testing.T) {
+	garbage := []byte("not a telemetry block")
+	h := NewHistory("1", func(object, day string) ([]byte, error) { return garbage, nil }, DefaultHistoryConfig)
+	if _, err := h.Lookup(1600000000000, ParamOdometer); err != nil {
+		t.Errorf("corrupted block error %v, expected resync without error", err)
+	}
+	loadErr := errors.New("storage is not available")
+	h = NewHistory("1", func(object, day string) ([]byte, error) { return nil, loadErr }, DefaultHistoryConfig)
+	if _, err := h.Lookup(1600000000000, ParamOdometer); err != loadErr {
+		t.Errorf("error %v, expected loader error", err)
+	}
+}
+
+func TestReaderErr(t *testing.T) {
+	buf := overflowFrame()
+	reader := NewReader()
+	reader.Set(&buf)
+	if code, _ := reader.ReadFlatPositions(); code == 0 || reader.Err() == nil {
+		t.Errorf("code %d err %v, expected decode error", code, reader.Err())
+	}
+	enc, _ := NewEncoder(protocolVersion)
+	frame, _ := enc.EncodeFlat(&FlatPosition{Time: 1, P: map[uint16]float64{ParamSpeed: 1}})
+	reader.Set(&frame)
+	if code, _ := reader.ReadFlatPositions(); code != 0 || reader.Err() != nil {
+		t.Errorf("code %d err %v, expected nil error", code, reader.Err())
+	}
+}
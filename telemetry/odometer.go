@@ -0,0 +1,281 @@
+package telemetry
+
+import (
+	"math"
+	"sort"
+)
+
+// OdometerSource source of distance increments
+type OdometerSource int
+
+const (
+	// OdometerGPS distance is calculated by filtered coordinates
+	OdometerGPS OdometerSource = iota
+	// OdometerDevice distance is taken from device odometer 1201, gps is used until first odometer value
+	OdometerDevice
+	// OdometerCan distance is taken from can odometer 2203, gps is used until first odometer value
+	OdometerCan
+)
+
+// OdometerConfig thresholds of distance recomputation
+type OdometerConfig struct {
+	MaxSpeed     float64        // km/h, faster jumps are gps outliers
+	MaxAccel     float64        // m/s², larger speed changes are gps outliers
+	MedianWindow int            // points of median coordinates filter, 0 or 1 disables filter
+	MinSpeed     float64        // km/h, lower speed is stationary and counted as drift
+	MaxRejects   int            // consecutive outliers after which the track is restarted from new point
+	Source       OdometerSource // preferred source of distance
+	Registry     *ParamRegistry // precision of written params, DefaultRegistry if nil
+}
+
+// DefaultOdometerConfig default thresholds of distance recomputation
+var DefaultOdometerConfig = OdometerConfig{
+	MaxSpeed:     250,
+	MaxAccel:     8,
+	MedianWindow: 5,
+	MinSpeed:     3,
+	MaxRejects:   5,
+}
+
+// odoCounter accumulates deltas of external odometer with reset detection
+type odoCounter struct {
+	last  float64
+	delta float64 // km since last position
+	total float64 // km
+	ok    bool
+}
+
+func (c *odoCounter) push(pos *FlatPosition, code uint16) bool {
+	c.delta = 0
+	v, ok := pos.P[code]
+	if !ok {
+		return false
+	}
+	if c.ok && v >= c.last {
+		// counter resets are skipped
+		c.delta = v - c.last
+		c.total += c.delta
+	}
+	c.last, c.ok = v, true
+	return true
+}
+
+// OdometerReport comparison of calculated distance with device odometers in km
+type OdometerReport struct {
+	Distance   float64 `json:"distance"`
+	Device     float64 `json:"device"`
+	Can        float64 `json:"can"`
+	DeviceDiff float64 `json:"deviceDiff"` // relative difference of device odometer to calculated distance
+	CanDiff    float64 `json:"canDiff"`    // relative difference of can odometer to calculated distance
+	Drift      float64 `json:"drift"`      // km, rejected movements while stationary
+	Outliers   int     `json:"outliers"`
+}
+
+// Odometer recomputes distance of time ordered positions,
+// writes ParamCalcOdo and ParamDriftLevel to positions
+type Odometer struct {
+	Config   OdometerConfig
+	Value    float64 // km
+	distance float64 // km since start
+	drift    float64 // meters
+	outliers int
+	rejects  int
+	window   []geoPoint
+	started  bool
+	lastTime float64  // ms, last accepted position
+	lastRaw  geoPoint // last accepted coordinates
+	filtered geoPoint
+	speed    float64 // m/s, last accepted speed
+	hasSpeed bool
+	anchor   *geoPoint // stop point
+	device   odoCounter
+	can      odoCounter
+}
+
+// NewOdometer create odometer with start value in km
+func NewOdometer(start float64, cfg OdometerConfig) *Odometer {
+	return &Odometer{Config: cfg, Value: start}
+}
+
+func (o *Odometer) registry() *ParamRegistry {
+	if o.Config.Registry != nil {
+		return o.Config.Registry
+	}
+	return DefaultRegistry
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// filter adds point to median window and returns filtered point
+func (o *Odometer) filter(p geoPoint) geoPoint {
+	size := o.Config.MedianWindow
+	if size <= 1 {
+		return p
+	}
+	o.window = append(o.window, p)
+	if len(o.window) > size {
+		o.window = o.window[len(o.window)-size:]
+	}
+	lats := make([]float64, len(o.window))
+	lons := make([]float64, len(o.window))
+	for i, w := range o.window {
+		lats[i], lons[i] = w.Lat, w.Lon
+	}
+	return geoPoint{Lat: median(lats), Lon: median(lons)}
+}
+
+// outlier checks implied speed and acceleration from last accepted position
+func (o *Odometer) outlier(dist, dt float64) (float64, bool) {
+	if dt <= 0 {
+		return 0, dist > 0
+	}
+	speed := dist / dt
+	if o.Config.MaxSpeed > 0 && speed*3.6 > o.Config.MaxSpeed {
+		return speed, true
+	}
+	if o.hasSpeed && o.Config.MaxAccel > 0 && math.Abs(speed-o.speed)/dt > o.Config.MaxAccel {
+		return speed, true
+	}
+	return speed, false
+}
+
+func (o *Odometer) stationary(pos *FlatPosition, speed float64) bool {
+	if v, ok := pos.P[ParamSpeed]; ok {
+		return v < o.Config.MinSpeed
+	}
+	return speed*3.6 < o.Config.MinSpeed
+}
+
+// restart starts track from position without distance
+func (o *Odometer) restart(pos *FlatPosition, p geoPoint) {
+	o.window = o.window[:0]
+	o.filtered = o.filter(p)
+	o.started = true
+	o.lastTime, o.lastRaw = pos.Time, p
+	o.hasSpeed = false
+	o.rejects = 0
+	o.anchor = nil
+}
+
+// Push adds next position, writes calculated params and returns false for gps outlier
+func (o *Odometer) Push(pos *FlatPosition) bool {
+	if o.started && pos.Time < o.lastTime {
+		// skip unordered position
+		return false
+	}
+	if pos.P == nil {
+		pos.P = make(map[uint16]float64)
+	}
+	var counter *odoCounter
+	switch o.Config.Source {
+	case OdometerDevice:
+		counter = &o.device
+	case OdometerCan:
+		counter = &o.can
+	}
+	// after first external reading legs are counted by odometer deltas only,
+	// positions without external odometer do not add gps distance
+	external := counter != nil && counter.ok
+	o.device.push(pos, ParamOdometer)
+	o.can.push(pos, ParamCanOdometer)
+	accepted := true
+	if lat, lon, ok := pos.LatLon(); ok {
+		accepted = o.pushPoint(pos, geoPoint{lat, lon}, !external)
+	}
+	if external {
+		o.Value += counter.delta
+		o.distance += counter.delta
+	}
+	reg := o.registry()
+	pos.P[ParamCalcOdo] = reg.Round(ParamCalcOdo, o.Value)
+	pos.P[ParamDriftLevel] = reg.Round(ParamDriftLevel, o.driftLevel(pos))
+	return accepted
+}
+
+// pushPoint filters coordinates and adds gps distance if count is set
+func (o *Odometer) pushPoint(pos *FlatPosition, p geoPoint, count bool) bool {
+	if !o.started {
+		o.restart(pos, p)
+		return true
+	}
+	dt := (pos.Time - o.lastTime) / 1000
+	speed, bad := o.outlier(GeoDistance(o.lastRaw.Lat, o.lastRaw.Lon, p.Lat, p.Lon), dt)
+	if bad {
+		o.outliers++
+		o.rejects++
+		if o.Config.MaxRejects > 0 && o.rejects >= o.Config.MaxRejects {
+			// position jump is real, e.g. after gps loss
+			o.restart(pos, p)
+		}
+		return false
+	}
+	o.rejects = 0
+	filtered := o.filter(p)
+	dist := GeoDistance(o.filtered.Lat, o.filtered.Lon, filtered.Lat, filtered.Lon)
+	if o.stationary(pos, speed) {
+		if o.anchor == nil {
+			o.anchor = &geoPoint{filtered.Lat, filtered.Lon}
+		}
+		o.drift += dist
+	} else {
+		o.anchor = nil
+		if count {
+			o.Value += dist / 1000
+			o.distance += dist / 1000
+		}
+	}
+	o.filtered = filtered
+	o.lastTime, o.lastRaw = pos.Time, p
+	o.speed, o.hasSpeed = speed, dt > 0
+	return true
+}
+
+// driftLevel returns distance in meters from stop point while stationary
+func (o *Odometer) driftLevel(pos *FlatPosition) float64 {
+	if o.anchor == nil {
+		return 0
+	}
+	lat, lon, ok := pos.LatLon()
+	if !ok {
+		return 0
+	}
+	return GeoDistance(o.anchor.Lat, o.anchor.Lon, lat, lon)
+}
+
+// relativeDiff returns relative difference of external odometer, zero if odometer is not present
+func relativeDiff(c *odoCounter, base float64) float64 {
+	if !c.ok || base == 0 {
+		return 0
+	}
+	return (c.total - base) / base
+}
+
+// Report returns calculated distance reconciled with device and can odometers
+func (o *Odometer) Report() OdometerReport {
+	return OdometerReport{
+		Distance:   o.distance,
+		Device:     o.device.total,
+		Can:        o.can.total,
+		DeviceDiff: relativeDiff(&o.device, o.distance),
+		CanDiff:    relativeDiff(&o.can, o.distance),
+		Drift:      o.drift / 1000,
+		Outliers:   o.outliers,
+	}
+}
+
+// RecalcOdometer recomputes distance params of track from start value
+func RecalcOdometer(positions []FlatPosition, start float64, cfg OdometerConfig) OdometerReport {
+	o := NewOdometer(start, cfg)
+	for i := range positions {
+		o.Push(&positions[i])
+	}
+	return o.Report()
+}
@@ -0,0 +1,52 @@
+package telemetry
+
+import (
+	"math"
+	"testing"
+)
+
+// odometerTrack moves north about 167 m each 10 s, external odometer is sent with every second position
+func odometerTrack(code uint16) []FlatPosition {
+	var res []FlatPosition
+	for i := 0; i < 7; i++ {
+		pos := FlatPosition{Time: float64(i) * 10000, P: map[uint16]float64{ParamLat: 55 + float64(i)*0.0015, ParamLon: 37, ParamSpeed: 60}}
+		if i%2 == 0 {
+			pos.P[code] = 100 + float64(i)*0.2
+		}
+		res = append(res, pos)
+	}
+	return res
+}
+
+func TestOdometerExternalSource(t *testing.T) {
+	cases := []struct {
+		source OdometerSource
+		code   uint16
+	}{
+		{OdometerDevice, ParamOdometer},
+		{OdometerCan, ParamCanOdometer},
+	}
+	for _, tc := range cases {
+		cfg := DefaultOdometerConfig
+		cfg.Source = tc.source
+		report := RecalcOdometer(odometerTrack(tc.code), 0, cfg)
+		// only odometer deltas are counted, gps legs between readings are not added
+		if math.Abs(report.Distance-1.2) > 1e-9 {
+			t.Errorf("source %d: distance %v, expected 1.2", tc.source, report.Distance)
+		}
+	}
+}
+
+func TestOdometerGPSBeforeExternal(t *testing.T) {
+	positions := odometerTrack(ParamOdometer)
+	delete(positions[0].P, ParamOdometer)
+	cfg := DefaultOdometerConfig
+	cfg.Source = OdometerDevice
+	cfg.MedianWindow = 0
+	report := RecalcOdometer(positions, 0, cfg)
+	// legs up to first device reading are counted by gps
+	gps := GeoDistance(55, 37, 55.003, 37) / 1000
+	if math.Abs(report.Distance-(gps+0.8)) > 1e-6 {
+		t.Errorf("distance %v, expected %v", report.Distance, gps+0.8)
+	}
+}
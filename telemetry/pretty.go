@@ -0,0 +1,245 @@
+package telemetry
+
+import "math"
+
+// prettyTags tags of single value fields, index is bit in PrettyPosition.has
+var prettyTags = [...]string{"st", "v", "bv", "sl", "sc", "x", "y", "z", "s", "a", "d", "sm", "rm"}
+
+// prettyKnown bit of PrettyPosition.has which is set if fields presence is known
+const prettyKnown = 1 << 15
+
+func prettyBit(tag string) uint16 {
+	for i, t := range prettyTags {
+		if t == tag {
+			return 1 << uint(i)
+		}
+	}
+	return 0
+}
+
+// prettyInt converts value of integer field, fractional and out of range values are not converted
+func prettyInt(v float64) (int16, bool) {
+	if v != math.Trunc(v) || v < math.MinInt16 || v > math.MaxInt16 {
+		return 0, false
+	}
+	return int16(v), true
+}
+
+// setPrettyField sets single value field by registry tag
+func (p *PrettyPosition) setPrettyField(tag string, v float64) bool {
+	switch tag {
+	case "st":
+		p.Status = v
+	case "v":
+		p.Power = v
+	case "bv":
+		p.Battery = v
+	case "sl", "sc", "a":
+		i, ok := prettyInt(v)
+		if !ok {
+			return false
+		}
+		switch tag {
+		case "sl":
+			p.Gsm = i
+		case "sc":
+			p.Gps = i
+		default:
+			p.Angle = i
+		}
+	case "x":
+		p.Lon = v
+	case "y":
+		p.Lat = v
+	case "z":
+		p.Alt = v
+	case "s":
+		p.Speed = v
+	case "d":
+		p.Odo = v
+	case "sm":
+		p.Sensor = v
+	case "rm":
+		p.Relay = v
+	default:
+		return false
+	}
+	p.has |= prettyBit(tag) | prettyKnown
+	return true
+}
+
+// prettyField returns single value field by registry tag, returns false if field is absent.
+// Presence of fields is known for positions converted by ToPretty,
+// zero values of other positions (e.g. decoded from json) are treated as absent
+func (p *PrettyPosition) prettyField(tag string) (float64, bool) {
+	var v float64
+	switch tag {
+	case "st":
+		v = p.Status
+	case "v":
+		v = p.Power
+	case "bv":
+		v = p.Battery
+	case "sl":
+		v = float64(p.Gsm)
+	case "sc":
+		v = float64(p.Gps)
+	case "x":
+		v = p.Lon
+	case "y":
+		v = p.Lat
+	case "z":
+		v = p.Alt
+	case "s":
+		v = p.Speed
+	case "a":
+		v = float64(p.Angle)
+	case "d":
+		v = p.Odo
+	case "sm":
+		v = p.Sensor
+	case "rm":
+		v = p.Relay
+	default:
+		return 0, false
+	}
+	if p.has&prettyKnown != 0 {
+		return v, p.has&prettyBit(tag) != 0
+	}
+	return v, v != 0
+}
+
+// prettyGroup returns pointer to indexed group field by registry group tag
+func (p *PrettyPosition) prettyGroup(tag string) *map[uint16]float64 {
+	switch tag {
+	case "an":
+		return &p.Analog
+	case "dg":
+		return &p.Digit
+	case "m":
+		return &p.Moto
+	case "tp":
+		return &p.Tempr
+	case "c":
+		return &p.Can
+	case "w":
+		return &p.Tire
+	}
+	return nil
+}
+
+func setGroupValue(group *map[uint16]float64, index uint16, v float64) {
+	if *group == nil {
+		*group = make(map[uint16]float64)
+	}
+	(*group)[index] = v
+}
+
+// ToPretty converts flat position to pretty position by registry tags,
+// params of indexed groups are stored by index in group, unknown params in P
+func (reg *ParamRegistry) ToPretty(pos *FlatPosition) *PrettyPosition {
+	res := &PrettyPosition{Time: pos.Time, has: prettyKnown}
+	if len(pos.E) > 0 {
+		res.Events = make([]uint16, len(pos.E))
+		copy(res.Events, pos.E)
+	}
+	for code, v := range pos.P {
+		if info, ok := reg.Param(code); ok && res.setPrettyField(info.Tag, v) {
+			continue
+		}
+		if group, index, ok := reg.Group(code); ok {
+			if field := res.prettyGroup(group.Tag); field != nil {
+				setGroupValue(field, index, v)
+				continue
+			}
+		}
+		setGroupValue(&res.P, code, v)
+	}
+	return res
+}
+
+// ToPrettyExt converts flat position to pretty position with string, bytes and zones values
+func (reg *ParamRegistry) ToPrettyExt(pos *FlatPosition) *PrettyPositionExt {
+	res := &PrettyPositionExt{PrettyPosition: *reg.ToPretty(pos)}
+	if len(pos.S) > 0 {
+		res.Str = make(map[uint16]string, len(pos.S))
+		for code, v := range pos.S {
+			res.Str[code] = v
+		}
+	}
+	if len(pos.B) > 0 {
+		res.Bytes = make(map[uint16][]byte, len(pos.B))
+		for code, v := range pos.B {
+			res.Bytes[code] = append([]byte(nil), v...)
+		}
+	}
+	res.Zones = pos.Zones
+	return res
+}
+
+// FromPretty converts pretty position to flat position by registry tags,
+// only single value fields present in source position are converted
+func (reg *ParamRegistry) FromPretty(pretty *PrettyPosition) *FlatPosition {
+	res := &FlatPosition{Time: pretty.Time, P: make(map[uint16]float64)}
+	if len(pretty.Events) > 0 {
+		res.E = make([]uint16, len(pretty.Events))
+		copy(res.E, pretty.Events)
+	}
+	for _, info := range reg.Params() {
+		if v, ok := pretty.prettyField(info.Tag); ok {
+			res.P[info.Code] = v
+		}
+	}
+	for _, group := range reg.Groups() {
+		field := pretty.prettyGroup(group.Tag)
+		if field == nil {
+			continue
+		}
+		for index, v := range *field {
+			res.P[group.Base+index] = v
+		}
+	}
+	for code, v := range pretty.P {
+		res.P[code] = v
+	}
+	return res
+}
+
+// FromPrettyExt converts pretty position with string, bytes and zones values to flat position
+func (reg *ParamRegistry) FromPrettyExt(pretty *PrettyPositionExt) *FlatPosition {
+	res := reg.FromPretty(&pretty.PrettyPosition)
+	if len(pretty.Str) > 0 {
+		res.S = make(map[uint16]string, len(pretty.Str))
+		for code, v := range pretty.Str {
+			res.S[code] = v
+		}
+	}
+	if len(pretty.Bytes) > 0 {
+		res.B = make(map[uint16][]byte, len(pretty.Bytes))
+		for code, v := range pretty.Bytes {
+			res.B[code] = append([]byte(nil), v...)
+		}
+	}
+	res.Zones = pretty.Zones
+	return res
+}
+
+// Pretty converts position to user friendly format by DefaultRegistry
+func (pos *FlatPosition) Pretty() *PrettyPosition {
+	return DefaultRegistry.ToPretty(pos)
+}
+
+// PrettyExt converts position to user friendly format with string, bytes and zones values by DefaultRegistry
+func (pos *FlatPosition) PrettyExt() *PrettyPositionExt {
+	return DefaultRegistry.ToPrettyExt(pos)
+}
+
+// Flat converts user friendly position to compact format by DefaultRegistry
+func (p *PrettyPosition) Flat() *FlatPosition {
+	return DefaultRegistry.FromPretty(p)
+}
+
+// Flat converts user friendly position to compact format by DefaultRegistry
+func (p *PrettyPositionExt) Flat() *FlatPosition {
+	return DefaultRegistry.FromPrettyExt(p)
+}
@@ -0,0 +1,84 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// prettyFlat position with values of single fields, groups and other params
+func prettyFlat() *FlatPosition {
+	return &FlatPosition{Time: 1600000000000, E: []uint16{1, 5}, P: map[uint16]float64{
+		1020: 1, 1021: 12.45, 1023: 25, 1024: 11, ParamLon: 37.6173, ParamLat: 55.755826,
+		ParamSpeed: 61.5, 1104: 90, ParamOdometer: 1234.567, 2001: 3.3, 2200: 150, ParamFuel: 40.5,
+	}}
+}
+
+func TestPrettyGolden(t *testing.T) {
+	golden, err := ioutil.ReadFile("testdata/pretty_position.golden.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.MarshalIndent(prettyFlat().Pretty(), "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(data, '\n'), golden) {
+		t.Errorf("pretty json differs from golden:\n%s", data)
+	}
+}
+
+func TestPrettyExt(t *testing.T) {
+	pos := prettyFlat()
+	pos.S = map[uint16]string{500: "driver"}
+	pos.B = map[uint16][]byte{600: {1, 2}}
+	pos.Zones = []ZoneInfo{{ID: "z1", Name: "Base"}}
+	data, err := json.Marshal(pos.PrettyExt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ext PrettyPositionExt
+	if err := json.Unmarshal(data, &ext); err != nil {
+		t.Fatal(err)
+	}
+	res := ext.Flat()
+	if !reflect.DeepEqual(res.S, pos.S) || !reflect.DeepEqual(res.B, pos.B) || !reflect.DeepEqual(res.Zones, pos.Zones) {
+		t.Errorf("strings %v bytes %v zones %v", res.S, res.B, res.Zones)
+	}
+	for code, v := range pos.P {
+		if res.P[code] != v {
+			t.Errorf("key %d: %v, expected %v", code, res.P[code], v)
+		}
+	}
+}
+
+func TestPrettyRoundTrip(t *testing.T) {
+	for _, p := range []map[uint16]float64{
+		{ParamLat: 55.75, ParamSpeed: 0, 1104: 270},
+		{1104: 359, 1023: 31, 1024: 200},
+		{1104: 45.5, 1023: -40000},
+		{ParamOdometer: 10, 2001: 3.3, 7000: 1},
+		{},
+	} {
+		pos := &FlatPosition{Time: 1600000000000, P: p}
+		res := pos.Pretty().Flat()
+		if !reflect.DeepEqual(res.P, p) {
+			t.Errorf("round trip of %v returned %v", p, res.P)
+		}
+	}
+	pretty := (&FlatPosition{P: map[uint16]float64{1104: 270}}).Pretty()
+	if pretty.Angle != 270 {
+		t.Errorf("angle %d, want 270", pretty.Angle)
+	}
+	data, _ := json.Marshal(pretty)
+	var decoded PrettyPosition
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	// zero fields of decoded json are absent
+	if res := decoded.Flat(); !reflect.DeepEqual(res.P, map[uint16]float64{1104: 270}) {
+		t.Errorf("decoded json converted to %v", res.P)
+	}
+}
@@ -0,0 +1,114 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+)
+
+// ErrProtocolData malformed tracker protocol data
+var ErrProtocolData = errors.New("malformed protocol data")
+
+// ErrProtocolCRC tracker protocol checksum mismatch
+var ErrProtocolCRC = errors.New("protocol checksum mismatch")
+
+// ProtocolResult result of tracker protocol data decoding
+type ProtocolResult struct {
+	DeviceID  string         // device identifier from login or record header
+	Positions []FlatPosition // decoded records
+	Ack       []byte         // response for device, nil if not needed
+	Consumed  int            // bytes of complete packets, rest of data must be decoded with next chunk
+}
+
+// ProtocolDecoder decodes tracker protocol stream of one connection
+type ProtocolDecoder interface {
+	Decode(data []byte) (*ProtocolResult, error)
+}
+
+// ParamMapping target param of protocol value
+type ParamMapping struct {
+	Code  uint16  `json:"code" yaml:"code"`
+	Scale float64 `json:"scale,omitempty" yaml:"scale,omitempty"` // value multiplier, 0 - without scaling
+}
+
+// ProtocolMapping maps protocol value names to param codes,
+// names are protocol specific, e.g. "speed", "io:66" or "adc1"
+type ProtocolMapping map[string]ParamMapping
+
+// set writes mapped value normalized by DefaultRegistry to position,
+// values out of param range are dropped, returns false if name is not mapped
+func (m ProtocolMapping) set(pos *FlatPosition, name string, v float64) bool {
+	target, ok := m[name]
+	if !ok {
+		return false
+	}
+	if target.Scale != 0 {
+		v *= target.Scale
+	}
+	if v, ok = DefaultRegistry.Normalize(target.Code, v); ok {
+		pos.P[target.Code] = v
+	}
+	return true
+}
+
+// setIndexed writes mapped value by name with index suffix
+func (m ProtocolMapping) setIndexed(pos *FlatPosition, prefix string, index int, v float64) bool {
+	return m.set(pos, prefix+strconv.Itoa(index), v)
+}
+
+// Merge returns copy of mapping with overridden names
+func (m ProtocolMapping) Merge(other ProtocolMapping) ProtocolMapping {
+	res := make(ProtocolMapping, len(m)+len(other))
+	for k, v := range m {
+		res[k] = v
+	}
+	for k, v := range other {
+		res[k] = v
+	}
+	return res
+}
+
+// LoadProtocolMapping loads mapping from json file and merges it with base mapping
+func LoadProtocolMapping(path string, base ProtocolMapping) (ProtocolMapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := ProtocolMapping{}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return base.Merge(m), nil
+}
+
+// crc16ARC CRC-16/ARC (IBM) checksum used by Wialon IPS and Teltonika
+func crc16ARC(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// newProtocolPosition create position with coordinates, zero and out of range coordinates are not set
+func newProtocolPosition(t float64, lat, lon float64) FlatPosition {
+	pos := FlatPosition{Time: t, P: make(map[uint16]float64)}
+	if lat == 0 && lon == 0 {
+		return pos
+	}
+	lat, latOk := DefaultRegistry.Normalize(ParamLat, lat)
+	lon, lonOk := DefaultRegistry.Normalize(ParamLon, lon)
+	if latOk && lonOk {
+		pos.P[ParamLat] = lat
+		pos.P[ParamLon] = lon
+	}
+	return pos
+}
@@ -0,0 +1,151 @@
+package telemetry
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readCapture reads captured packets from testdata, .hex files contain hex dump with # comment lines
+func readCapture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Ext(name) != ".hex" {
+		return data
+	}
+	var dump strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			dump.WriteString(strings.TrimSpace(line))
+		}
+	}
+	res, err := hex.DecodeString(dump.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// samePositions compares decoded positions, nil and empty maps are equal
+func samePositions(t *testing.T, name string, got, expected []FlatPosition) {
+	if len(got) != len(expected) {
+		t.Errorf("%s: %d positions, expected %d", name, len(got), len(expected))
+		return
+	}
+	for i := range expected {
+		g, e := got[i], expected[i]
+		if g.Time != e.Time || !reflect.DeepEqual(g.P, e.P) || len(g.E)+len(e.E) > 0 && !reflect.DeepEqual(g.E, e.E) ||
+			len(g.S)+len(e.S) > 0 && !reflect.DeepEqual(g.S, e.S) || len(g.B)+len(e.B) > 0 && !reflect.DeepEqual(g.B, e.B) {
+			t.Errorf("%s position %d:\n%+v\nexpected\n%+v", name, i, g, e)
+		}
+	}
+}
+
+func TestProtocolCaptures(t *testing.T) {
+	cases := []struct {
+		file      string
+		decoder   ProtocolDecoder
+		deviceID  string
+		consumed  int
+		ack       string
+		positions []FlatPosition
+	}{
+		{
+			file: "wialon_ips11.txt", decoder: NewWialonDecoder(nil), deviceID: "354330030000001",
+			// last packet is incomplete, record without time is rejected
+			consumed: 335, ack: hex.EncodeToString([]byte("#AL#1\r\n#ASD#1\r\n#AD#1\r\n#AP#\r\n#ASD#0\r\n#AB#2\r\n")),
+			positions: []FlatPosition{
+				{Time: 1613640600000, P: map[uint16]float64{1024: 8, ParamLat: 55.743375, ParamLon: 37.66139, ParamAlt: 150, ParamAngle: 90, ParamSpeed: 60}},
+				{Time: 1613640610000, P: map[uint16]float64{1021: 12.8, 1024: 9, ParamLat: 55.744166667, ParamLon: 37.661666667, ParamAlt: 151, ParamAngle: 92, ParamSpeed: 62, 1901: 3, 1902: 1, 2000: 12.5, 2001: 3.3, 2400: 21}},
+				{Time: 1613640620000, P: map[uint16]float64{1024: 7, ParamLat: 55.745, ParamLon: 37.663333333, ParamAlt: 150, ParamAngle: 80, ParamSpeed: 55}},
+				{Time: 1613640630000, P: map[uint16]float64{1024: 7, ParamLat: -55.745833333, ParamLon: -37.664166667, ParamAlt: 150, ParamAngle: 80, ParamSpeed: 50}},
+			},
+		},
+		{
+			file: "wialon_ips20.txt", decoder: NewWialonDecoder(nil), deviceID: "354330030000002",
+			// short packet has wrong crc
+			consumed: 306, ack: hex.EncodeToString([]byte("#AL#1\r\n#AD#1\r\n#ASD#13\r\n#AB#2\r\n")),
+			positions: []FlatPosition{
+				{Time: 1613640610000, P: map[uint16]float64{1021: 12.8, 1024: 9, ParamLat: 55.744166667, ParamLon: 37.661666667, ParamAlt: 151, ParamAngle: 92, ParamSpeed: 62, 1901: 3, 1902: 1, 2000: 12.5, 2400: 21}},
+				{Time: 1613640620000, P: map[uint16]float64{1024: 7, ParamLat: 55.745, ParamLon: 37.663333333, ParamAlt: 150, ParamAngle: 80, ParamSpeed: 55}},
+				{Time: 1613640630000, P: map[uint16]float64{1024: 7, ParamLat: 55.745833333, ParamLon: 37.664166667, ParamAlt: 150, ParamAngle: 80, ParamSpeed: 50}},
+			},
+		},
+		{
+			file: "teltonika_codec8.hex", decoder: NewTeltonikaDecoder(nil), deviceID: "356307042441013",
+			// last packet is incomplete
+			consumed: 182, ack: "010000000200000001",
+			positions: []FlatPosition{
+				{Time: 1613640600000, P: map[uint16]float64{1021: 12.8, 1023: 4, 1024: 8, ParamLat: 55.743375, ParamLon: 37.66139, ParamAlt: 150, ParamAngle: 90, ParamSpeed: 60, ParamOdometer: 1234.567, 1901: 1}},
+				{Time: 1613640610000, P: map[uint16]float64{1021: 12.8, 1023: 4, 1024: 9, ParamLat: 55.7441667, ParamLon: 37.6616667, ParamAlt: 151, ParamAngle: 92, ParamSpeed: 62, ParamOdometer: 1234.567, 1901: 0}},
+				{Time: 1560161086000, P: map[uint16]float64{1021: 24.08, 1023: 3, 1024: 0, ParamAlt: 0, ParamAngle: 0, ParamSpeed: 0, 2010: 1}},
+			},
+		},
+		{
+			file: "teltonika_codec8e.hex", decoder: NewTeltonikaDecoder(nil), deviceID: "356307042441013",
+			consumed: 103, ack: "0100000001",
+			positions: []FlatPosition{
+				{Time: 1560166592000, P: map[uint16]float64{1024: 0, ParamAlt: 0, ParamAngle: 0, ParamSpeed: 0, ParamOdometer: 22949, 2010: 1}},
+			},
+		},
+		{
+			file: "egts.hex", decoder: NewEGTSDecoder(nil), deviceID: "1001",
+			// response packets with record responses to auth and teledata packets
+			consumed: 117, ack: "0100000b0010000100002e010000060001000001010003000100005cb30100000b001000020000e4020000060002000002020003000200004c6a",
+			// course 456 is out of param range and is dropped
+			positions: []FlatPosition{
+				{Time: 1613640600000, P: map[uint16]float64{ParamLat: 55.743374987, ParamLon: 37.661389978, ParamAlt: 150, ParamSpeed: 60.5, ParamOdometer: 1234.5, 1901: 5, 1902: 1, 2000: 3226, 2100: 10000}},
+			},
+		},
+	}
+	for _, tc := range cases {
+		res, err := tc.decoder.Decode(readCapture(t, tc.file))
+		if err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+			continue
+		}
+		if res.DeviceID != tc.deviceID || res.Consumed != tc.consumed {
+			t.Errorf("%s: device %q consumed %d, expected %q %d", tc.file, res.DeviceID, res.Consumed, tc.deviceID, tc.consumed)
+		}
+		if ack := hex.EncodeToString(res.Ack); ack != tc.ack {
+			t.Errorf("%s: ack %s, expected %s", tc.file, ack, tc.ack)
+		}
+		samePositions(t, tc.file, res.Positions, tc.positions)
+	}
+}
+
+func TestWialonReceivedTime(t *testing.T) {
+	packet := []byte("#L#354330030000001;NA\r\n#SD#NA;NA;5544.6025;N;03739.6834;E;0;0;0;0\r\n")
+	d := NewWialonDecoder(nil)
+	d.Received = time.Date(2021, 2, 18, 9, 30, 0, 0, time.UTC)
+	res, err := d.Decode(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Ack) != "#AL#1\r\n#ASD#1\r\n" || len(res.Positions) != 1 || res.Positions[0].Time != 1613640600000 {
+		t.Errorf("ack %q positions %+v", res.Ack, res.Positions)
+	}
+}
+
+func TestProtocolMappingNormalize(t *testing.T) {
+	m := ProtocolMapping{"power": {Code: 1021, Scale: 0.001}, "course": {Code: ParamAngle}, "raw": {Code: 5000}}
+	pos := newProtocolPosition(1, 55.12345678912345, 200)
+	for name, v := range map[string]float64{"power": 12345.6, "course": 400, "raw": 1.23456789, "unknown": 1} {
+		if m.set(&pos, name, v) != (name != "unknown") {
+			t.Errorf("%s: mapped %v", name, name == "unknown")
+		}
+	}
+	expected := map[uint16]float64{1021: 12.35, 5000: 1.23456789}
+	if !reflect.DeepEqual(pos.P, expected) {
+		t.Errorf("params %v, expected %v", pos.P, expected)
+	}
+	if pos = newProtocolPosition(1, 55.12345678912345, 37.5); pos.P[ParamLat] != 55.123456789 || pos.P[ParamLon] != 37.5 {
+		t.Errorf("coordinates %v", pos.P)
+	}
+}
@@ -0,0 +1,460 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ParamGroup group of indexed parameters, codes from Base to Base+Count-1
+type ParamGroup struct {
+	Name  string `json:"name" yaml:"name"`
+	Base  uint16 `json:"base" yaml:"base"`
+	Count uint16 `json:"count" yaml:"count"`
+	Tag   string `json:"tag,omitempty" yaml:"tag,omitempty"` // PrettyPosition json field
+}
+
+// Has checks code membership in group
+func (g *ParamGroup) Has(code uint16) bool {
+	return code >= g.Base && code < g.Base+g.Count
+}
+
+// ParamInfo telemetry parameter metadata
+type ParamInfo struct {
+	Code       uint16   `json:"code" yaml:"code"`
+	Name       string   `json:"name" yaml:"name"`                               // code name, used by ParamCode
+	Title      string   `json:"title,omitempty" yaml:"title,omitempty"`         // name for TranslatePos
+	Group      string   `json:"group,omitempty" yaml:"group,omitempty"`         // group name
+	Unit       string   `json:"unit,omitempty" yaml:"unit,omitempty"`           // measure unit
+	Precision  int      `json:"precision,omitempty" yaml:"precision,omitempty"` // decimal digits, 0 - without rounding
+	Scale      float64  `json:"scale,omitempty" yaml:"scale,omitempty"`         // raw value multiplier, 0 - without scaling
+	Min        *float64 `json:"min,omitempty" yaml:"min,omitempty"`
+	Max        *float64 `json:"max,omitempty" yaml:"max,omitempty"`
+	LinkedTime uint16   `json:"linkedTime,omitempty" yaml:"linkedTime,omitempty"` // linked time param code
+	History    bool     `json:"history,omitempty" yaml:"history,omitempty"`       // need load history if parameter not exists
+	Continuous bool     `json:"continuous,omitempty" yaml:"continuous,omitempty"` // value can be linearly interpolated
+	Legacy     bool     `json:"legacy,omitempty" yaml:"legacy,omitempty"`         // rounded by precision on decoding without registry
+	Tag        string   `json:"tag,omitempty" yaml:"tag,omitempty"`               // PrettyPosition json field
+	multiplier float64
+}
+
+// Round rounds value by parameter precision
+func (p *ParamInfo) Round(v float64) float64 {
+	if p.multiplier > 0 {
+		return math.Round(v*p.multiplier) / p.multiplier
+	}
+	return v
+}
+
+// Valid checks value range
+func (p *ParamInfo) Valid(v float64) bool {
+	if math.IsNaN(v) {
+		return false
+	}
+	if p.Min != nil && v < *p.Min {
+		return false
+	}
+	if p.Max != nil && v > *p.Max {
+		return false
+	}
+	return true
+}
+
+// registryState immutable registry snapshot
+type registryState struct {
+	params map[uint16]*ParamInfo
+	names  map[string]*ParamInfo
+	groups []*ParamGroup
+}
+
+// ParamRegistry registry of telemetry parameters
+type ParamRegistry struct {
+	mu    sync.Mutex
+	state atomic.Value
+}
+
+// registryConfig format of registry JSON or YAML file
+type registryConfig struct {
+	Groups []ParamGroup `json:"groups" yaml:"groups"`
+	Params []ParamInfo  `json:"params" yaml:"params"`
+}
+
+// NewParamRegistry create empty registry
+func NewParamRegistry() *ParamRegistry {
+	reg := &ParamRegistry{}
+	reg.state.Store(&registryState{
+		params: map[uint16]*ParamInfo{},
+		names:  map[string]*ParamInfo{},
+	})
+	return reg
+}
+
+func (reg *ParamRegistry) load() *registryState {
+	return reg.state.Load().(*registryState)
+}
+
+// update copies current state, applies changes and stores new state
+func (reg *ParamRegistry) update(cb func(state *registryState) error) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	old := reg.load()
+	state := &registryState{
+		params: make(map[uint16]*ParamInfo, len(old.params)),
+		names:  make(map[string]*ParamInfo, len(old.names)),
+		groups: append([]*ParamGroup(nil), old.groups...),
+	}
+	for code, info := range old.params {
+		state.params[code] = info
+	}
+	for name, info := range old.names {
+		state.names[name] = info
+	}
+	if err := cb(state); err != nil {
+		return err
+	}
+	reg.state.Store(state)
+	return nil
+}
+
+func (state *registryState) register(info ParamInfo) error {
+	if info.Code == 0 {
+		return errors.New("param code is empty")
+	}
+	if info.Name == "" {
+		return errors.New("param name is empty: " + strconv.Itoa(int(info.Code)))
+	}
+	if info.Min != nil && info.Max != nil && *info.Min > *info.Max {
+		return errors.New("param min greater than max: " + info.Name)
+	}
+	if info.Precision > 0 {
+		info.multiplier = math.Pow10(info.Precision)
+	}
+	if old, ok := state.params[info.Code]; ok {
+		for _, name := range []string{old.Name, old.Title} {
+			if state.names[name] == old {
+				delete(state.names, name)
+			}
+		}
+	}
+	if other, ok := state.names[info.Name]; ok && other.Code != info.Code {
+		return errors.New("param name already registered: " + info.Name)
+	}
+	p := &info
+	state.params[info.Code] = p
+	state.names[info.Name] = p
+	if info.Title != "" {
+		if _, ok := state.names[info.Title]; !ok {
+			state.names[info.Title] = p
+		}
+	}
+	return nil
+}
+
+func (state *registryState) registerGroup(group ParamGroup) error {
+	if group.Name == "" || group.Count == 0 {
+		return errors.New("invalid param group")
+	}
+	for i, g := range state.groups {
+		if g.Name == group.Name {
+			state.groups[i] = &group
+			return nil
+		}
+	}
+	state.groups = append(state.groups, &group)
+	return nil
+}
+
+// Register adds or replaces parameter
+func (reg *ParamRegistry) Register(info ParamInfo) error {
+	return reg.update(func(state *registryState) error {
+		return state.register(info)
+	})
+}
+
+// RegisterGroup adds or replaces group of indexed parameters
+func (reg *ParamRegistry) RegisterGroup(group ParamGroup) error {
+	return reg.update(func(state *registryState) error {
+		return state.registerGroup(group)
+	})
+}
+
+func (reg *ParamRegistry) loadConfig(cfg *registryConfig) error {
+	return reg.update(func(state *registryState) error {
+		for _, group := range cfg.Groups {
+			if err := state.registerGroup(group); err != nil {
+				return err
+			}
+		}
+		for _, info := range cfg.Params {
+			if err := state.register(info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadJSON adds groups and params from JSON config
+func (reg *ParamRegistry) LoadJSON(data []byte) error {
+	cfg := registryConfig{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	return reg.loadConfig(&cfg)
+}
+
+// LoadYAML adds groups and params from YAML config
+func (reg *ParamRegistry) LoadYAML(data []byte) error {
+	cfg := registryConfig{}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	return reg.loadConfig(&cfg)
+}
+
+// LoadFile adds groups and params from JSON or YAML file by extension
+func (reg *ParamRegistry) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return reg.LoadYAML(data)
+	}
+	return reg.LoadJSON(data)
+}
+
+// Param get param info by code
+func (reg *ParamRegistry) Param(code uint16) (*ParamInfo, bool) {
+	info, ok := reg.load().params[code]
+	return info, ok
+}
+
+// ParamByName get param info by name or title
+func (reg *ParamRegistry) ParamByName(name string) (*ParamInfo, bool) {
+	info, ok := reg.load().names[name]
+	return info, ok
+}
+
+// Params returns all registered params
+func (reg *ParamRegistry) Params() []*ParamInfo {
+	state := reg.load()
+	res := make([]*ParamInfo, 0, len(state.params))
+	for _, info := range state.params {
+		res = append(res, info)
+	}
+	return res
+}
+
+// Code get param code by name or title, returns zero if not found
+func (reg *ParamRegistry) Code(name string) uint16 {
+	if info, ok := reg.ParamByName(name); ok {
+		return info.Code
+	}
+	return 0
+}
+
+// Title get param title for translate, returns code string if not found
+func (reg *ParamRegistry) Title(code uint16) string {
+	if info, ok := reg.Param(code); ok {
+		if info.Title != "" {
+			return info.Title
+		}
+		return info.Name
+	}
+	return strconv.Itoa(int(code))
+}
+
+// Group get group and index in group by param code
+func (reg *ParamRegistry) Group(code uint16) (*ParamGroup, uint16, bool) {
+	for _, group := range reg.load().groups {
+		if group.Has(code) {
+			return group, code - group.Base, true
+		}
+	}
+	return nil, 0, false
+}
+
+// GroupByName get group by name
+func (reg *ParamRegistry) GroupByName(name string) (*ParamGroup, bool) {
+	for _, group := range reg.load().groups {
+		if group.Name == name {
+			return group, true
+		}
+	}
+	return nil, false
+}
+
+// Groups returns all registered groups
+func (reg *ParamRegistry) Groups() []*ParamGroup {
+	return reg.load().groups
+}
+
+// Round rounds value by param precision
+func (reg *ParamRegistry) Round(code uint16, v float64) float64 {
+	if info, ok := reg.Param(code); ok {
+		return info.Round(v)
+	}
+	return v
+}
+
+// legacyRound rounds value of legacy param, other values are returned as is
+func (reg *ParamRegistry) legacyRound(code uint16, v float64) float64 {
+	if info, ok := reg.Param(code); ok && info.Legacy {
+		return info.Round(v)
+	}
+	return v
+}
+
+// Normalize scales and rounds raw device value, checks value range,
+// must not be used for stored values which are already scaled
+func (reg *ParamRegistry) Normalize(code uint16, raw float64) (float64, bool) {
+	info, ok := reg.Param(code)
+	if !ok {
+		return raw, true
+	}
+	if info.Scale != 0 {
+		raw *= info.Scale
+	}
+	v := info.Round(raw)
+	return v, info.Valid(v)
+}
+
+// Validate returns codes of position params out of range
+func (reg *ParamRegistry) Validate(pos *FlatPosition) (invalid []uint16) {
+	state := reg.load()
+	for code, v := range pos.P {
+		if info, ok := state.params[code]; ok && !info.Valid(v) {
+			invalid = append(invalid, code)
+		}
+	}
+	return sortKeys(invalid)
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// newDefaultRegistry create registry with built-in params
+func newDefaultRegistry() *ParamRegistry {
+	reg := NewParamRegistry()
+	cfg := registryConfig{
+		Groups: []ParamGroup{
+			{Name: "analog", Base: 2000, Count: 5, Tag: "an"},
+			{Name: "digit", Base: 2010, Count: 5, Tag: "dg"},
+			{Name: "moto", Base: 2020, Count: 5, Tag: "m"},
+			{Name: "params", Base: 2100, Count: 5},
+			{Name: "can", Base: 2200, Count: 10, Tag: "c"},
+			{Name: "tire", Base: 2300, Count: 4, Tag: "w"},
+			{Name: "tempr", Base: 2400, Count: 3, Tag: "tp"},
+		},
+		Params: []ParamInfo{
+			{Code: 1, Name: "paramTime", Title: "ParamTime", Unit: "ms", Tag: "t"},
+			{Code: 2, Name: "paramEvent", Title: "ParamEvent", Tag: "e"},
+			{Code: 8, Name: "paramTimeCan", Unit: "ms"},
+			{Code: 9, Name: "paramTimeReceive", Unit: "ms"},
+			{Code: 10, Name: "paramTimeFuel", Title: "FuelTime1", Unit: "ms"},
+			{Code: 11, Name: "paramTimeFuel2", Title: "FuelTime2", Unit: "ms"},
+
+			// System parameters
+			{Code: 1020, Name: "paramStatus", Title: "ParamDataStatus", Group: "system", Tag: "st"},
+			{Code: 1021, Name: "paramPower", Title: "ParamDataPower", Group: "system", Unit: "V", Precision: 2, Legacy: true, Tag: "v"},
+			{Code: 1022, Name: "paramBatteryV", Title: "ParamDataBattery", Group: "system", Unit: "V", Precision: 2, Legacy: true, Tag: "bv"},
+			{Code: 1023, Name: "paramGSM", Title: "ParamDataGSM", Group: "system", Tag: "sl"},
+			{Code: 1024, Name: "paramGPS", Title: "ParamDataGPS", Group: "system", Tag: "sc"},
+
+			// GPS parameters
+			{Code: 1101, Name: "paramLat", Title: "ParamDataLat", Group: "gps", Unit: "deg", Precision: 9, Min: floatPtr(-90), Max: floatPtr(90), History: true, Continuous: true, Legacy: true, Tag: "y"},
+			{Code: 1102, Name: "paramLon", Title: "ParamDataLon", Group: "gps", Unit: "deg", Precision: 9, Min: floatPtr(-180), Max: floatPtr(180), History: true, Continuous: true, Legacy: true, Tag: "x"},
+			{Code: 1103, Name: "paramAlt", Title: "ParamDataAlt", Group: "gps", Unit: "m", Tag: "z"},
+			{Code: 1104, Name: "paramAngle", Title: "ParamDataHead", Group: "gps", Unit: "deg", Min: floatPtr(0), Max: floatPtr(360), Tag: "a"},
+			{Code: 1105, Name: "paramSpeed", Title: "ParamDataSpeed", Group: "gps", Unit: "km/h", Tag: "s"},
+
+			// Drive parameters
+			{Code: 1201, Name: "paramOdometer", Title: "ParamDataOdo", Group: "drive", Unit: "km", Precision: 3, History: true, Continuous: true, Legacy: true, Tag: "d"},
+			{Code: 1203, Name: "paramMileageReserve", Group: "drive", Unit: "km"},
+			{Code: 1221, Name: "paramDriver", Title: "ParamDataDriver", Group: "drive"},
+			{Code: 1222, Name: "paramZone", Title: "ParamDataZone", Group: "drive"},
+
+			// Binary sensor parameters
+			{Code: 1901, Name: "paramInput", Title: "ParamDataInput", Group: "sensor", Tag: "sm"},
+			{Code: 1902, Name: "paramOutput", Title: "ParamDataOutput", Group: "sensor", Tag: "rm"},
+
+			// Other parameter groups (with index)
+			{Code: 2000, Name: "paramAdc0", Title: "ParamDataAnalog1", Group: "analog"},
+			{Code: 2001, Name: "paramAdc1", Title: "ParamDataAnalog2", Group: "analog"},
+			{Code: 2002, Name: "paramAdc2", Title: "ParamDataAnalog3", Group: "analog"},
+			{Code: 2003, Name: "paramAdc3", Title: "ParamDataAnalog4", Group: "analog"},
+			{Code: 2004, Name: "paramAdc4", Title: "ParamDataAnalog5", Group: "analog"},
+			{Code: 2010, Name: "paramDigit0", Title: "ParamDataDigit1", Group: "digit"},
+			{Code: 2011, Name: "paramDigit1", Title: "ParamDataDigit2", Group: "digit"},
+			{Code: 2012, Name: "paramDigit2", Title: "ParamDataDigit3", Group: "digit"},
+			{Code: 2013, Name: "paramDigit3", Title: "ParamDataDigit4", Group: "digit"},
+			{Code: 2014, Name: "paramDigit4", Title: "ParamDataDigit5", Group: "digit"},
+			{Code: 2020, Name: "paramMoto0", Title: "ParamDataMoto1", Group: "moto", Unit: "h"},
+			{Code: 2021, Name: "paramMoto1", Title: "ParamDataMoto2", Group: "moto", Unit: "h"},
+			{Code: 2022, Name: "paramMoto2", Title: "ParamDataMoto3", Group: "moto", Unit: "h"},
+			{Code: 2023, Name: "paramMoto3", Title: "ParamDataMoto4", Group: "moto", Unit: "h"},
+			{Code: 2024, Name: "paramMoto4", Title: "ParamDataMoto5", Group: "moto", Unit: "h"},
+			{Code: 2100, Name: "paramParams0", Title: "ParamDataParams1", Group: "params"},
+			{Code: 2101, Name: "paramParams1", Title: "ParamDataParams2", Group: "params"},
+			{Code: 2102, Name: "paramParams2", Title: "ParamDataParams3", Group: "params"},
+			{Code: 2103, Name: "paramParams3", Title: "ParamDataParams4", Group: "params"},
+			{Code: 2104, Name: "paramParams4", Title: "ParamDataParams5", Group: "params"},
+			{Code: 2300, Name: "paramTire0", Title: "ParamDataTire1", Group: "tire"},
+			{Code: 2301, Name: "paramTire1", Title: "ParamDataTire2", Group: "tire"},
+			{Code: 2302, Name: "paramTire2", Title: "ParamDataTire3", Group: "tire"},
+			{Code: 2303, Name: "paramTire3", Title: "ParamDataTire4", Group: "tire"},
+			{Code: 2400, Name: "paramTempr0", Title: "ParamDataTempr1", Group: "tempr", Unit: "C"},
+			{Code: 2401, Name: "paramTempr1", Title: "ParamDataTempr2", Group: "tempr", Unit: "C"},
+			{Code: 2402, Name: "paramTempr2", Title: "ParamDataTempr3", Group: "tempr", Unit: "C"},
+
+			// CAN parameters, status is the first param of can group
+			{Code: 2200, Name: "paramCanStatus", Title: "ParamDataCan", Group: "can"},
+			{Code: 2201, Name: "paramCanTempr", Title: "ParamCanTempr", Group: "can", Unit: "C"},
+			{Code: 2202, Name: "paramCanSpeed", Title: "ParamCanSpeed", Group: "can", Unit: "km/h"},
+			{Code: 2203, Name: "paramCanOdometer", Title: "ParamCanOdometer", Group: "can", Unit: "km"},
+			{Code: 2204, Name: "paramCanFuelTotal", Title: "ParamCanFuelTotal", Group: "can", Unit: "l"},
+			{Code: 2205, Name: "paramCanMotoTotal", Title: "ParamCanMotoTotal", Group: "can", Unit: "h"},
+			{Code: 2206, Name: "paramCanFuelLevel", Title: "ParamCanFuelLevel", Group: "can", Unit: "l"},
+			{Code: 2207, Name: "paramCanAccel", Title: "ParamCanAccel", Group: "can"},
+			{Code: 2208, Name: "paramCanTacho", Title: "ParamCanTacho", Group: "can", Unit: "rpm"},
+			{Code: 2209, Name: "paramCanBrake", Title: "ParamCanBrake", Group: "can"},
+			{Code: 2250, Name: "paramPosNum", Title: "ParamDataPosNum"},
+
+			// Calculated parameters
+			{Code: 3001, Name: "paramCalcOdo", Unit: "km", Precision: 3, Continuous: true},
+			{Code: 3004, Name: "paramDriftLevel", Unit: "m", Precision: 1},
+			{Code: 3005, Name: "paramSpeedAvg", Unit: "km/h"},
+			{Code: 3400, Name: "paramFuel", Unit: "l", Precision: 1, History: true},
+			{Code: 3401, Name: "paramFuel2", Unit: "l", Precision: 1},
+			{Code: 3500, Name: "paramAvgFuel", Unit: "l/100km", Precision: 2, History: true},
+			{Code: 3501, Name: "paramAvgFuel2", Unit: "l/100km", Precision: 2},
+		},
+	}
+	if err := reg.loadConfig(&cfg); err != nil {
+		panic(err)
+	}
+	return reg
+}
+
+// DefaultRegistry registry with built-in telemetry params
+var DefaultRegistry = newDefaultRegistry()
+
+// legacyParams builds Params map from registry
+func (reg *ParamRegistry) legacyParams() map[string]param {
+	res := map[string]param{}
+	for _, info := range reg.Params() {
+		res[info.Name] = param{info.Code, info.LinkedTime, info.History}
+	}
+	return res
+}
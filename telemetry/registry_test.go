@@ -0,0 +1,49 @@
+package telemetry
+
+import (
+	"testing"
+)
+
+func decodeFlat(t *testing.T, reader *BinaryReader, pos *FlatPosition) FlatPosition {
+	enc, _ := NewEncoder(protocolVersion)
+	frame, err := enc.EncodeFlat(pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Set(&frame)
+	code, res := reader.ReadFlatPositions()
+	if code != 0 || len(res) != 1 {
+		t.Fatalf("code %d, positions %d", code, len(res))
+	}
+	return res[0]
+}
+
+func TestDefaultDecodeRounding(t *testing.T) {
+	pos := &FlatPosition{Time: 1600000000000, P: map[uint16]float64{1101: 55.12345678912345, 1201: 1234.56789, ParamFuel: 40.987, 3500: 7.123456, 3001: 200}}
+	got := decodeFlat(t, NewReader(), pos)
+	expected := map[uint16]float64{1101: 55.123456789, 1201: 1234.568, ParamFuel: 40.987, 3500: 7.123456, 3001: 200}
+	for key, v := range expected {
+		if got.P[key] != v {
+			t.Errorf("key %d: %v, expected %v", key, got.P[key], v)
+		}
+	}
+}
+
+func TestRegistryDecodeWithoutScale(t *testing.T) {
+	reg := NewParamRegistry()
+	if err := reg.Register(ParamInfo{Code: 3400, Name: "paramFuel", Precision: 1, Scale: 0.1}); err != nil {
+		t.Fatal(err)
+	}
+	reader := NewReader()
+	reader.Registry = reg
+	got := decodeFlat(t, reader, &FlatPosition{Time: 1, P: map[uint16]float64{3400: 40.987, 3401: 12.345}})
+	if got.P[3400] != 41 || got.P[3401] != 12.345 {
+		t.Errorf("values %v, expected rounded without scale", got.P)
+	}
+}
+
+func TestLegacyFuelLinkedTime(t *testing.T) {
+	if p := Params["paramFuel"]; p.T != 0 {
+		t.Errorf("paramFuel linked time %d, expected 0", p.T)
+	}
+}
@@ -0,0 +1,315 @@
+package telemetry
+
+import (
+	"sync"
+	"time"
+)
+
+// RuleKind kind of rule condition
+type RuleKind int
+
+const (
+	// RuleAbove param is above threshold
+	RuleAbove RuleKind = iota
+	// RuleBelow param is below threshold
+	RuleBelow
+	// RuleEvent position has event with param code
+	RuleEvent
+	// RuleZoneEnter object is inside zone
+	RuleZoneEnter
+	// RuleZoneExit object left zone
+	RuleZoneExit
+	// RuleExpr compiled filter expression matches
+	RuleExpr
+)
+
+func (kind RuleKind) String() string {
+	switch kind {
+	case RuleAbove:
+		return "above"
+	case RuleBelow:
+		return "below"
+	case RuleEvent:
+		return "event"
+	case RuleZoneEnter:
+		return "enter"
+	case RuleZoneExit:
+		return "exit"
+	case RuleExpr:
+		return "expr"
+	}
+	return "unknown"
+}
+
+// Rule telemetry rule, alert is raised when condition holds for Duration
+// and cleared when it stops holding, threshold rules are cleared with Hysteresis margin
+type Rule struct {
+	ID         string
+	Name       string
+	Kind       RuleKind
+	Param      uint16        // param code of threshold rules, event code of event rules
+	Threshold  float64       // threshold of above and below rules
+	Hysteresis float64       // clear margin of threshold
+	Missing    bool          // missing param satisfies condition, e.g. lost signal
+	Zone       string        // zone id or type of zone rules, empty for any zone
+	Filter     *Filter       // condition of expression rules, additional condition for others
+	Duration   time.Duration // condition must hold for duration before alert
+	Cooldown   time.Duration // min interval between alerts of one object
+}
+
+// SpeedingRule speed is above limit in km/h for duration
+func SpeedingRule(id string, limit float64, duration time.Duration) *Rule {
+	return &Rule{ID: id, Name: "speeding", Kind: RuleAbove, Param: ParamSpeed, Threshold: limit, Hysteresis: 5, Duration: duration}
+}
+
+// LowBatteryRule battery voltage is below volts
+func LowBatteryRule(id string, volts float64) *Rule {
+	return &Rule{ID: id, Name: "battery", Kind: RuleBelow, Param: 1022, Threshold: volts, Hysteresis: 0.2, Duration: time.Minute}
+}
+
+// GSMLossRule gsm level is below level or missing for duration
+func GSMLossRule(id string, level float64, duration time.Duration) *Rule {
+	return &Rule{ID: id, Name: "gsm", Kind: RuleBelow, Param: 1023, Threshold: level, Missing: true, Duration: duration}
+}
+
+// GPSLossRule count of satellites is below sats or missing for duration
+func GPSLossRule(id string, sats float64, duration time.Duration) *Rule {
+	return &Rule{ID: id, Name: "gps", Kind: RuleBelow, Param: 1024, Threshold: sats, Missing: true, Duration: duration}
+}
+
+// ZoneRule object enters or leaves zone with id or type, empty zone matches any zone
+func ZoneRule(id, zone string, enter bool) *Rule {
+	rule := &Rule{ID: id, Name: "zone", Kind: RuleZoneExit, Zone: zone}
+	if enter {
+		rule.Kind = RuleZoneEnter
+	}
+	return rule
+}
+
+// ThresholdRule param crosses threshold, e.g. CAN coolant temperature
+func ThresholdRule(id string, code uint16, threshold float64, above bool) *Rule {
+	rule := &Rule{ID: id, Name: "threshold", Kind: RuleBelow, Param: code, Threshold: threshold}
+	if above {
+		rule.Kind = RuleAbove
+	}
+	return rule
+}
+
+// inZone checks that position is in zone of rule
+func (rule *Rule) inZone(pos *FlatPosition) (*ZoneInfo, bool) {
+	for i := range pos.Zones {
+		if rule.Zone == "" || pos.Zones[i].ID == rule.Zone || pos.Zones[i].Type == rule.Zone {
+			return &pos.Zones[i], true
+		}
+	}
+	return nil, false
+}
+
+// condition evaluates rule, known is false if position has no data for rule
+func (rule *Rule) condition(pos *FlatPosition, active bool) (match, known bool, value float64) {
+	if rule.Filter != nil && !rule.Filter.Match(pos) {
+		return false, true, 0
+	}
+	switch rule.Kind {
+	case RuleAbove, RuleBelow:
+		v, ok := pos.P[rule.Param]
+		if !ok {
+			return rule.Missing, rule.Missing, 0
+		}
+		threshold := rule.Threshold
+		if rule.Kind == RuleAbove {
+			if active {
+				threshold -= rule.Hysteresis
+			}
+			return v > threshold, true, v
+		}
+		if active {
+			threshold += rule.Hysteresis
+		}
+		return v < threshold, true, v
+	case RuleEvent:
+		return pos.IfEvent(rule.Param), true, 0
+	case RuleZoneEnter:
+		_, ok := rule.inZone(pos)
+		return ok, true, 0
+	case RuleZoneExit:
+		_, ok := rule.inZone(pos)
+		return !ok, true, 0
+	}
+	return true, true, 0
+}
+
+// RuleAlert raised or cleared alert of object
+type RuleAlert struct {
+	Rule     *Rule
+	Object   string
+	Time     float64 // alert time in ms
+	Since    float64 // condition start time in ms
+	Value    float64 // param value of threshold rules
+	Cleared  bool
+	Zone     *ZoneInfo
+	Position *FlatPosition
+}
+
+// Data returns alert values for message templates
+func (alert *RuleAlert) Data() map[string]interface{} {
+	data := map[string]interface{}{
+		"Object":   alert.Object,
+		"Rule":     alert.Rule.ID,
+		"Name":     alert.Rule.Name,
+		"Kind":     alert.Rule.Kind.String(),
+		"Time":     time.Unix(0, int64(alert.Time)*int64(time.Millisecond)).UTC(),
+		"Duration": time.Duration((alert.Time - alert.Since) * float64(time.Millisecond)),
+		"Value":    alert.Value,
+		"Limit":    alert.Rule.Threshold,
+		"Cleared":  alert.Cleared,
+	}
+	if alert.Zone != nil {
+		data["Zone"] = alert.Zone.Name
+		data["ZoneID"] = alert.Zone.ID
+	}
+	if alert.Position != nil {
+		data["Lat"] = alert.Position.P[ParamLat]
+		data["Lon"] = alert.Position.P[ParamLon]
+		data["Speed"] = alert.Position.P[ParamSpeed]
+	}
+	return data
+}
+
+// ruleState state of rule for object
+type ruleState struct {
+	since  float64 // condition start time, 0 - condition does not hold
+	active bool    // condition held for duration
+	raised bool    // alert is sent, only sent alerts are cleared
+	fired  float64 // last alert time
+	zone   *ZoneInfo
+}
+
+// ruleObject rules state of object
+type ruleObject struct {
+	last   float64
+	states map[*Rule]*ruleState
+}
+
+// RuleEngine evaluates rules against positions of objects
+type RuleEngine struct {
+	// Notify is called for every alert, nil - alerts are only returned
+	Notify  func(alert *RuleAlert)
+	mu      sync.Mutex
+	rules   []*Rule
+	objects map[string]*ruleObject
+}
+
+// NewRuleEngine create rule engine
+func NewRuleEngine(rules ...*Rule) *RuleEngine {
+	return &RuleEngine{rules: rules, objects: make(map[string]*ruleObject)}
+}
+
+// AddRule adds rule or replaces rule with same id
+func (e *RuleEngine) AddRule(rule *Rule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.removeRule(rule.ID)
+	e.rules = append(e.rules, rule)
+}
+
+// RemoveRule removes rule by id
+func (e *RuleEngine) RemoveRule(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.removeRule(id)
+}
+
+func (e *RuleEngine) removeRule(id string) {
+	for i, rule := range e.rules {
+		if rule.ID != id {
+			continue
+		}
+		e.rules = append(e.rules[:i], e.rules[i+1:]...)
+		for _, obj := range e.objects {
+			delete(obj.states, rule)
+		}
+		return
+	}
+}
+
+// Rules returns list of rules
+func (e *RuleEngine) Rules() []*Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Rule(nil), e.rules...)
+}
+
+// Reset clears state of object
+func (e *RuleEngine) Reset(object string) {
+	e.mu.Lock()
+	delete(e.objects, object)
+	e.mu.Unlock()
+}
+
+// Evaluate evaluates rules for next position of object and notifies alerts,
+// positions older than last evaluated position of object are ignored
+func (e *RuleEngine) Evaluate(object string, pos *FlatPosition) []RuleAlert {
+	e.mu.Lock()
+	obj, ok := e.objects[object]
+	if !ok {
+		obj = &ruleObject{last: pos.Time, states: make(map[*Rule]*ruleState)}
+		e.objects[object] = obj
+	}
+	if pos.Time < obj.last {
+		e.mu.Unlock()
+		return nil
+	}
+	obj.last = pos.Time
+	var alerts []RuleAlert
+	for _, rule := range e.rules {
+		state, ok := obj.states[rule]
+		if !ok {
+			state = &ruleState{}
+			obj.states[rule] = state
+		}
+		match, known, value := rule.condition(pos, state.active)
+		if !known {
+			continue
+		}
+		if !ok && match && rule.Kind == RuleZoneExit {
+			// object outside zone from start has not left it, its first entry is not cleared
+			state.active = true
+			continue
+		}
+		if !match {
+			if state.raised {
+				alerts = append(alerts, RuleAlert{Rule: rule, Object: object, Time: pos.Time, Since: state.since, Value: value, Cleared: true, Zone: state.zone, Position: pos})
+			}
+			state.since, state.active, state.raised, state.zone = 0, false, false, nil
+			if rule.Kind == RuleZoneExit {
+				// remember zone to report it on exit
+				state.zone, _ = rule.inZone(pos)
+			}
+			continue
+		}
+		if state.since == 0 {
+			state.since = pos.Time
+			if rule.Kind == RuleZoneEnter {
+				state.zone, _ = rule.inZone(pos)
+			}
+		}
+		if state.active || pos.Time-state.since < float64(rule.Duration/time.Millisecond) {
+			continue
+		}
+		state.active = true
+		if state.fired > 0 && pos.Time-state.fired < float64(rule.Cooldown/time.Millisecond) {
+			// suppressed alert is not raised and not cleared
+			continue
+		}
+		state.fired, state.raised = pos.Time, true
+		alerts = append(alerts, RuleAlert{Rule: rule, Object: object, Time: pos.Time, Since: state.since, Value: value, Zone: state.zone, Position: pos})
+	}
+	e.mu.Unlock()
+	if e.Notify != nil {
+		for i := range alerts {
+			e.Notify(&alerts[i])
+		}
+	}
+	return alerts
+}
@@ -0,0 +1,100 @@
+package telemetry
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// ruleStep position of object at second
+type ruleStep struct {
+	sec   float64
+	value float64
+	zone  string
+}
+
+// runRule evaluates rule on steps and returns alerts as "raise@sec" and "clear@sec"
+func runRule(rule *Rule, steps []ruleStep) []string {
+	var res []string
+	e := NewRuleEngine(rule)
+	for _, step := range steps {
+		pos := &FlatPosition{Time: step.sec * 1000, P: map[uint16]float64{rule.Param: step.value}}
+		if step.zone != "" {
+			pos.Zones = []ZoneInfo{{ID: step.zone}}
+		}
+		for _, alert := range e.Evaluate("car", pos) {
+			kind := "raise"
+			if alert.Cleared {
+				kind = "clear"
+			}
+			res = append(res, fmt.Sprintf("%s@%v", kind, alert.Time/1000))
+		}
+	}
+	return res
+}
+
+func TestRuleEngine(t *testing.T) {
+	cases := []struct {
+		name  string
+		rule  *Rule
+		steps []ruleStep
+		want  []string
+	}{
+		{
+			name:  "duration debounce",
+			rule:  SpeedingRule("speed", 90, 30*time.Second),
+			steps: []ruleStep{{0, 100, ""}, {10, 80, ""}, {20, 100, ""}, {40, 100, ""}, {50, 100, ""}, {60, 80, ""}},
+			want:  []string{"raise@50", "clear@60"},
+		},
+		{
+			name:  "hysteresis",
+			rule:  SpeedingRule("speed", 90, 0),
+			steps: []ruleStep{{0, 95, ""}, {10, 88, ""}, {20, 86, ""}, {30, 84, ""}, {40, 91, ""}},
+			want:  []string{"raise@0", "clear@30", "raise@40"},
+		},
+		{
+			name: "cooldown",
+			rule: &Rule{ID: "temp", Kind: RuleAbove, Param: 2400, Threshold: 100, Cooldown: time.Minute},
+			steps: []ruleStep{
+				{100, 110, ""}, {110, 90, ""}, // raised and cleared
+				{120, 110, ""}, {130, 90, ""}, // suppressed by cooldown, not cleared
+				{170, 110, ""}, {180, 90, ""},
+			},
+			want: []string{"raise@100", "clear@110", "raise@170", "clear@180"},
+		},
+		{
+			name:  "zone enter",
+			rule:  ZoneRule("base", "z1", true),
+			steps: []ruleStep{{0, 0, ""}, {10, 0, "z1"}, {20, 0, "z1"}, {30, 0, "z2"}},
+			want:  []string{"raise@10", "clear@30"},
+		},
+		{
+			name:  "zone exit outside from start",
+			rule:  ZoneRule("base", "z1", false),
+			steps: []ruleStep{{0, 0, ""}, {10, 0, "z1"}, {20, 0, ""}, {30, 0, "z1"}},
+			want:  []string{"raise@20", "clear@30"},
+		},
+	}
+	for _, tc := range cases {
+		if got := runRule(tc.rule, tc.steps); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: alerts %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRuleEngineNotify(t *testing.T) {
+	var notified []RuleAlert
+	e := NewRuleEngine(ZoneRule("base", "z1", false))
+	e.Notify = func(alert *RuleAlert) {
+		notified = append(notified, *alert)
+	}
+	e.Evaluate("car", &FlatPosition{Time: 1000, Zones: []ZoneInfo{{ID: "z1", Name: "Base"}}})
+	e.Evaluate("car", &FlatPosition{Time: 2000})
+	if old := e.Evaluate("car", &FlatPosition{Time: 1500}); old != nil {
+		t.Errorf("old position alerts %v", old)
+	}
+	if len(notified) != 1 || notified[0].Zone == nil || notified[0].Zone.Name != "Base" || notified[0].Since != 2000 {
+		t.Fatalf("notified alerts %+v", notified)
+	}
+}
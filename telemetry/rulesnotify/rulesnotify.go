@@ -0,0 +1,70 @@
+package rulesnotify
+
+import (
+	"sync"
+
+	msgsender "gitlab.com/battler/modules/msgSender"
+	"gitlab.com/battler/modules/telemetry"
+)
+
+// Messages messages of rule alerts, nil message is not sent
+type Messages struct {
+	Message *msgsender.Message
+	Clear   *msgsender.Message // sent when alert is cleared
+}
+
+// Notifier sends alerts of rule engine with msgSender messages of rules
+type Notifier struct {
+	mu       sync.RWMutex
+	messages map[string]Messages
+}
+
+// New create notifier
+func New() *Notifier {
+	return &Notifier{messages: make(map[string]Messages)}
+}
+
+// Set sets messages of rule by rule id
+func (n *Notifier) Set(ruleID string, messages Messages) {
+	n.mu.Lock()
+	n.messages[ruleID] = messages
+	n.mu.Unlock()
+}
+
+// Remove removes messages of rule
+func (n *Notifier) Remove(ruleID string) {
+	n.mu.Lock()
+	delete(n.messages, ruleID)
+	n.mu.Unlock()
+}
+
+// message returns message of alert, nil if rule has no message
+func (n *Notifier) message(alert *telemetry.RuleAlert) *msgsender.Message {
+	n.mu.RLock()
+	messages := n.messages[alert.Rule.ID]
+	n.mu.RUnlock()
+	if alert.Cleared {
+		return messages.Clear
+	}
+	return messages.Message
+}
+
+// Notify sends rule message or clear message of alert with alert data,
+// can be used as RuleEngine.Notify
+func (n *Notifier) Notify(alert *telemetry.RuleAlert) {
+	msg := n.message(alert)
+	if msg == nil {
+		return
+	}
+	m := *msg
+	data := alert.Data()
+	if m.Payload == nil {
+		m.Payload = data
+	}
+	m.Send(data)
+}
+
+// Bind sets notifier as notify callback of rule engine
+func (n *Notifier) Bind(engine *telemetry.RuleEngine) {
+	engine.Notify = n.Notify
+}
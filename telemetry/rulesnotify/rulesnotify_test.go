@@ -0,0 +1,34 @@
+package rulesnotify
+
+import (
+	"testing"
+
+	msgsender "gitlab.com/battler/modules/msgSender"
+	"gitlab.com/battler/modules/telemetry"
+)
+
+func TestMessage(t *testing.T) {
+	raised, cleared := &msgsender.Message{Msg: "raised"}, &msgsender.Message{Msg: "cleared"}
+	n := New()
+	n.Set("speed", Messages{Message: raised, Clear: cleared})
+	n.Set("gps", Messages{Message: raised})
+	rule, gps := telemetry.SpeedingRule("speed", 90, 0), telemetry.GPSLossRule("gps", 3, 0)
+	cases := []struct {
+		alert    telemetry.RuleAlert
+		expected *msgsender.Message
+	}{
+		{telemetry.RuleAlert{Rule: rule}, raised},
+		{telemetry.RuleAlert{Rule: rule, Cleared: true}, cleared},
+		{telemetry.RuleAlert{Rule: gps, Cleared: true}, nil},
+		{telemetry.RuleAlert{Rule: telemetry.LowBatteryRule("battery", 11)}, nil},
+	}
+	for i, tc := range cases {
+		if msg := n.message(&tc.alert); msg != tc.expected {
+			t.Errorf("case %d: message %v, expected %v", i, msg, tc.expected)
+		}
+	}
+	n.Remove("speed")
+	if msg := n.message(&telemetry.RuleAlert{Rule: rule}); msg != nil {
+		t.Errorf("message %v of removed rule", msg)
+	}
+}
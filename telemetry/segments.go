@@ -0,0 +1,300 @@
+package telemetry
+
+import (
+	"time"
+)
+
+// SegmentKind kind of track segment
+type SegmentKind int
+
+const (
+	// SegmentTrip object is moving
+	SegmentTrip SegmentKind = iota
+	// SegmentStop object is stopped with ignition on
+	SegmentStop
+	// SegmentParking object is stopped with ignition off
+	SegmentParking
+)
+
+func (kind SegmentKind) String() string {
+	switch kind {
+	case SegmentTrip:
+		return "trip"
+	case SegmentStop:
+		return "stop"
+	case SegmentParking:
+		return "parking"
+	}
+	return "unknown"
+}
+
+// SegmentConfig thresholds of track segmentation
+type SegmentConfig struct {
+	MinSpeed        float64       // km/h, lower speed is a stop
+	MinStopDuration time.Duration // shorter stops are merged to trip
+	IgnitionMask    uint32        // ignition bits of ParamStatus, zero if ignition is not used
+	JitterRadius    float64       // meters, moving inside radius of stop point is ignored
+}
+
+// DefaultSegmentConfig default segmentation thresholds
+var DefaultSegmentConfig = SegmentConfig{
+	MinSpeed:        3,
+	MinStopDuration: 3 * time.Minute,
+	JitterRadius:    50,
+}
+
+// Segment trip or stop on track
+type Segment struct {
+	Kind     SegmentKind   `json:"kind"`
+	Start    FlatPosition  `json:"start"`
+	End      FlatPosition  `json:"end"`
+	Distance float64       `json:"distance"` // km
+	Duration time.Duration `json:"duration"`
+	MaxSpeed float64       `json:"maxSpeed"` // km/h
+	AvgSpeed float64       `json:"avgSpeed"` // km/h
+	FuelUsed float64       `json:"fuelUsed"` // l
+	Points   int           `json:"points"`
+}
+
+// segmentState accumulator of open segment
+type segmentState struct {
+	kind     SegmentKind
+	start    *FlatPosition
+	last     *FlatPosition
+	geoDist  float64 // meters
+	maxSpeed float64
+	points   int
+}
+
+func newSegmentState(kind SegmentKind, pos *FlatPosition) *segmentState {
+	st := &segmentState{kind: kind, start: pos, last: pos}
+	st.maxSpeed, _ = pos.P[ParamSpeed]
+	st.points = 1
+	return st
+}
+
+func (st *segmentState) add(pos *FlatPosition) {
+	if d, ok := st.last.DistanceTo(pos); ok {
+		st.geoDist += d
+	}
+	if speed, ok := pos.P[ParamSpeed]; ok && speed > st.maxSpeed {
+		st.maxSpeed = speed
+	}
+	st.last = pos
+	st.points++
+}
+
+// closeAt sets segment end point without counting it
+func (st *segmentState) closeAt(pos *FlatPosition) {
+	if d, ok := st.last.DistanceTo(pos); ok {
+		st.geoDist += d
+	}
+	st.last = pos
+}
+
+// merge appends other state points
+func (st *segmentState) merge(other *segmentState) {
+	if d, ok := st.last.DistanceTo(other.start); ok {
+		st.geoDist += d
+	}
+	st.geoDist += other.geoDist
+	if other.maxSpeed > st.maxSpeed {
+		st.maxSpeed = other.maxSpeed
+	}
+	st.last = other.last
+	st.points += other.points
+}
+
+func (st *segmentState) duration() time.Duration {
+	return time.Duration((st.last.Time - st.start.Time) * float64(time.Millisecond))
+}
+
+// odoDistance returns distance by odometer params in km
+func odoDistance(start, end *FlatPosition) (float64, bool) {
+	for _, code := range []uint16{ParamCalcOdo, ParamOdometer} {
+		v1, ok1 := start.P[code]
+		v2, ok2 := end.P[code]
+		if ok1 && ok2 && v2 >= v1 {
+			return v2 - v1, true
+		}
+	}
+	return 0, false
+}
+
+// fuelUsed returns fuel consumption by fuel level or average consumption
+func fuelUsed(start, end *FlatPosition, distance float64) float64 {
+	v1, ok1 := start.P[ParamFuel]
+	v2, ok2 := end.P[ParamFuel]
+	if ok1 && ok2 {
+		if v1 > v2 {
+			return v1 - v2
+		}
+		return 0
+	}
+	if avg, ok := end.P[ParamAvgFuel]; ok && avg > 0 {
+		return avg * distance / 100
+	}
+	return 0
+}
+
+func (st *segmentState) segment() Segment {
+	seg := Segment{
+		Kind:     st.kind,
+		Duration: st.duration(),
+		MaxSpeed: st.maxSpeed,
+		Points:   st.points,
+	}
+	st.start.CopyTo(&seg.Start, false)
+	st.last.CopyTo(&seg.End, false)
+	if seg.Kind != SegmentTrip {
+		// movements on stops are gps jitter
+		seg.MaxSpeed = 0
+		return seg
+	}
+	if dist, ok := odoDistance(st.start, st.last); ok {
+		seg.Distance = dist
+	} else {
+		seg.Distance = st.geoDist / 1000
+	}
+	if hours := seg.Duration.Hours(); hours > 0 {
+		seg.AvgSpeed = seg.Distance / hours
+	}
+	seg.FuelUsed = fuelUsed(st.start, st.last, seg.Distance)
+	return seg
+}
+
+// Segmenter splits time ordered position stream to trips and stops,
+// works incrementally and can be used on live data
+type Segmenter struct {
+	Config  SegmentConfig
+	cur     *segmentState
+	pending *segmentState
+	anchor  *FlatPosition // stop point for jitter filter
+}
+
+// NewSegmenter create segmenter with thresholds
+func NewSegmenter(cfg SegmentConfig) *Segmenter {
+	return &Segmenter{Config: cfg}
+}
+
+// kind detects segment kind of position
+func (s *Segmenter) kind(pos *FlatPosition) SegmentKind {
+	if s.Config.IgnitionMask != 0 {
+		if status, ok := pos.P[ParamStatus]; ok && uint32(status)&s.Config.IgnitionMask == 0 {
+			return SegmentParking
+		}
+	}
+	speed, _ := pos.P[ParamSpeed]
+	if speed < s.Config.MinSpeed {
+		return SegmentStop
+	}
+	// moving inside stop point radius is gps jitter
+	if s.anchor != nil && s.Config.JitterRadius > 0 {
+		if d, ok := s.anchor.DistanceTo(pos); ok && d < s.Config.JitterRadius {
+			return SegmentStop
+		}
+	}
+	return SegmentTrip
+}
+
+func (s *Segmenter) confirmed(st *segmentState) bool {
+	if st.kind == SegmentTrip {
+		return true
+	}
+	return st.duration() >= s.Config.MinStopDuration
+}
+
+// Push adds next position and returns closed segments
+func (s *Segmenter) Push(pos *FlatPosition) []Segment {
+	if s.cur != nil && pos.Time < s.last().Time {
+		// skip unordered position
+		return nil
+	}
+	p := pos.Copy(false)
+	kind := s.kind(p)
+	if kind == SegmentTrip {
+		s.anchor = nil
+	} else if s.anchor == nil {
+		s.anchor = p
+	}
+	switch {
+	case s.cur == nil:
+		s.cur = newSegmentState(kind, p)
+	case s.pending == nil && kind == s.cur.kind:
+		s.cur.add(p)
+	case s.pending == nil:
+		s.pending = newSegmentState(kind, p)
+	case kind == s.cur.kind:
+		// pending segment is not confirmed, return it back to current
+		s.cur.merge(s.pending)
+		s.cur.add(p)
+		s.pending = nil
+	case kind == SegmentTrip:
+		// unconfirmed stop before moving is part of current stop or parking
+		s.cur.merge(s.pending)
+		s.pending = newSegmentState(kind, p)
+	default:
+		// stop turns to parking if ignition is off
+		if kind == SegmentParking {
+			s.pending.kind = kind
+		}
+		s.pending.add(p)
+	}
+	return s.confirm()
+}
+
+func (s *Segmenter) last() *FlatPosition {
+	if s.pending != nil {
+		return s.pending.last
+	}
+	return s.cur.last
+}
+
+// confirm closes current segment if pending segment is confirmed
+func (s *Segmenter) confirm() []Segment {
+	if s.pending == nil || !s.confirmed(s.pending) {
+		return nil
+	}
+	// current segment ends at the start of the next one
+	s.cur.closeAt(s.pending.start)
+	closed := []Segment{s.cur.segment()}
+	s.cur = s.pending
+	s.pending = nil
+	return closed
+}
+
+// Current returns open segment or nil
+func (s *Segmenter) Current() *Segment {
+	if s.cur == nil {
+		return nil
+	}
+	seg := s.cur.segment()
+	return &seg
+}
+
+// Flush closes and returns open segments
+func (s *Segmenter) Flush() []Segment {
+	if s.cur == nil {
+		return nil
+	}
+	closed := s.confirm()
+	if s.pending != nil {
+		// short stop at the end of track
+		s.cur.merge(s.pending)
+		s.pending = nil
+	}
+	closed = append(closed, s.cur.segment())
+	s.cur = nil
+	s.anchor = nil
+	return closed
+}
+
+// SplitSegments splits position track to trips and stops
+func SplitSegments(positions []FlatPosition, cfg SegmentConfig) []Segment {
+	s := NewSegmenter(cfg)
+	var res []Segment
+	for i := range positions {
+		res = append(res, s.Push(&positions[i])...)
+	}
+	return append(res, s.Flush()...)
+}
@@ -0,0 +1,92 @@
+package telemetry
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// trackPhase part of generated track with constant speed and status
+type trackPhase struct {
+	duration time.Duration
+	speed    float64 // km/h
+	status   float64
+}
+
+// segmentTrack generates positions each 10 s moving north with phase speed
+func segmentTrack(phases ...trackPhase) []FlatPosition {
+	var res []FlatPosition
+	t, lat := 0.0, 55.0
+	for _, phase := range phases {
+		for elapsed := time.Duration(0); elapsed < phase.duration; elapsed += 10 * time.Second {
+			lat += phase.speed / 3.6 * 10 / 111195
+			res = append(res, FlatPosition{Time: t, P: map[uint16]float64{
+				ParamLat: lat, ParamLon: 37, ParamSpeed: phase.speed, ParamStatus: phase.status,
+			}})
+			t += 10000
+		}
+	}
+	return res
+}
+
+func TestSegmenter(t *testing.T) {
+	const on, off = 1, 0
+	type want struct {
+		kind     SegmentKind
+		duration time.Duration
+		distance float64 // km
+	}
+	cases := []struct {
+		name   string
+		phases []trackPhase
+		want   []want
+	}{
+		{
+			name:   "short idle after parking",
+			phases: []trackPhase{{10 * time.Minute, 0, off}, {30 * time.Second, 0, on}, {10 * time.Minute, 60, on}, {5 * time.Minute, 0, off}},
+			want:   []want{{SegmentParking, 630 * time.Second, 0}, {SegmentTrip, 10 * time.Minute, 10}, {SegmentParking, 290 * time.Second, 0}},
+		},
+		{
+			name:   "short stop in trip",
+			phases: []trackPhase{{5 * time.Minute, 60, on}, {time.Minute, 0, on}, {5 * time.Minute, 60, on}},
+			want:   []want{{SegmentTrip, 650 * time.Second, 10}},
+		},
+		{
+			name:   "long stop",
+			phases: []trackPhase{{5 * time.Minute, 60, on}, {5 * time.Minute, 0, on}, {5 * time.Minute, 60, on}},
+			want:   []want{{SegmentTrip, 5 * time.Minute, 5}, {SegmentStop, 5 * time.Minute, 0}, {SegmentTrip, 290 * time.Second, 5}},
+		},
+		{
+			name:   "stop turns to parking",
+			phases: []trackPhase{{5 * time.Minute, 60, on}, {time.Minute, 0, on}, {5 * time.Minute, 0, off}, {5 * time.Minute, 60, on}},
+			want:   []want{{SegmentTrip, 5 * time.Minute, 5}, {SegmentParking, 6 * time.Minute, 0}, {SegmentTrip, 290 * time.Second, 5}},
+		},
+	}
+	cfg := DefaultSegmentConfig
+	cfg.IgnitionMask = 1
+	for _, tc := range cases {
+		segments := SplitSegments(segmentTrack(tc.phases...), cfg)
+		if len(segments) != len(tc.want) {
+			t.Errorf("%s: %d segments %v, want %d", tc.name, len(segments), segments, len(tc.want))
+			continue
+		}
+		for i, seg := range segments {
+			w := tc.want[i]
+			if seg.Kind != w.kind || seg.Duration != w.duration || math.Abs(seg.Distance-w.distance) > 0.2 {
+				t.Errorf("%s: segment %d is %v %v %.2f km, want %v %v %.2f km", tc.name, i, seg.Kind, seg.Duration, seg.Distance, w.kind, w.duration, w.distance)
+			}
+		}
+	}
+}
+
+func TestSegmenterUnordered(t *testing.T) {
+	s := NewSegmenter(DefaultSegmentConfig)
+	track := segmentTrack(trackPhase{time.Minute, 60, 1})
+	for i := range track {
+		s.Push(&track[i])
+	}
+	old := track[0]
+	if s.Push(&old) != nil || s.Current().Points != len(track) {
+		t.Errorf("unordered position is added to %+v", s.Current())
+	}
+}
@@ -0,0 +1,419 @@
+package telemetry
+
+import (
+	"container/heap"
+	"math"
+	"time"
+)
+
+// AggFunc aggregation of param values in time bucket
+type AggFunc int
+
+const (
+	// AggAvg average value
+	AggAvg AggFunc = iota
+	// AggMin minimal value
+	AggMin
+	// AggMax maximal value
+	AggMax
+	// AggSum sum of values
+	AggSum
+	// AggFirst first value in bucket
+	AggFirst
+	// AggLast last value in bucket
+	AggLast
+)
+
+// SimplifyConfig settings of track simplification
+type SimplifyConfig struct {
+	Tolerance  float64            // meters, Douglas-Peucker tolerance, zero disables
+	Budget     int                // maximal count of points, zero is unlimited
+	Bucket     time.Duration      // time bucket of downsampling, zero disables
+	Aggregate  map[uint16]AggFunc // aggregation of params in bucket, Default for others
+	Default    AggFunc            // default aggregation of params
+	KeepEvents bool               // positions with events are never removed
+	StopSpeed  float64            // km/h, first positions of stops are never removed, zero disables
+	ChunkSize  int                // points simplified at once by streaming simplifier
+}
+
+// DefaultSimplifyConfig default settings of track simplification
+var DefaultSimplifyConfig = SimplifyConfig{
+	Tolerance:  5,
+	Budget:     5000,
+	Default:    AggLast,
+	Aggregate:  map[uint16]AggFunc{ParamSpeed: AggMax},
+	KeepEvents: true,
+	StopSpeed:  3,
+	ChunkSize:  1000,
+}
+
+// trackPoints returns coordinates of positions, positions without coordinates
+// get coordinates of previous position
+func trackPoints(positions []FlatPosition) []geoPoint {
+	pts := make([]geoPoint, len(positions))
+	var last geoPoint
+	for i := range positions {
+		if lat, lon, ok := positions[i].LatLon(); ok {
+			last = geoPoint{lat, lon}
+		}
+		pts[i] = last
+	}
+	return pts
+}
+
+// keepRule positions which can not be removed by simplification
+type keepRule struct {
+	events    bool
+	stopSpeed float64
+}
+
+func (cfg *SimplifyConfig) keepRule() keepRule {
+	return keepRule{events: cfg.KeepEvents, stopSpeed: cfg.StopSpeed}
+}
+
+// locked checks position with events can not be removed
+func (r keepRule) locked(pos *FlatPosition) bool {
+	return r.events && len(pos.E) > 0
+}
+
+// stopStart checks position is the first stopped position after moving one
+func (r keepRule) stopStart(prev, pos *FlatPosition) bool {
+	if r.stopSpeed <= 0 {
+		return false
+	}
+	v1, ok1 := prev.P[ParamSpeed]
+	v2, ok2 := pos.P[ParamSpeed]
+	return ok1 && ok2 && v1 >= r.stopSpeed && v2 < r.stopSpeed
+}
+
+// trackable checks position has coordinates or must be kept
+func (r keepRule) trackable(pos *FlatPosition) bool {
+	_, _, ok := pos.LatLon()
+	return ok || r.locked(pos)
+}
+
+// track returns trackable positions and marks of positions which must be kept,
+// first and last positions are always kept
+func (r keepRule) track(positions []FlatPosition) ([]FlatPosition, []bool) {
+	track := make([]FlatPosition, 0, len(positions))
+	for i := range positions {
+		if r.trackable(&positions[i]) {
+			track = append(track, positions[i])
+		}
+	}
+	keep := make([]bool, len(track))
+	for i := range track {
+		keep[i] = i == 0 || i == len(track)-1 || r.locked(&track[i]) || r.stopStart(&track[i-1], &track[i])
+	}
+	return track, keep
+}
+
+// DouglasPeucker simplifies track with tolerance in meters,
+// positions without coordinates are removed
+func DouglasPeucker(positions []FlatPosition, tolerance float64, keepEvents bool) []FlatPosition {
+	return keepRule{events: keepEvents}.douglasPeucker(positions, tolerance)
+}
+
+func (r keepRule) douglasPeucker(positions []FlatPosition, tolerance float64) []FlatPosition {
+	track, keep := r.track(positions)
+	if len(track) < 3 || tolerance <= 0 {
+		return track
+	}
+	pts := trackPoints(track)
+	type span struct{ from, to int }
+	stack := []span{{0, len(track) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		maxDist, index := 0.0, -1
+		for i := s.from + 1; i < s.to; i++ {
+			if keep[i] {
+				// locked point splits span
+				maxDist, index = math.Inf(1), i
+				break
+			}
+			if d := segmentDistance(pts[i].Lat, pts[i].Lon, pts[s.from], pts[s.to]); d > maxDist {
+				maxDist, index = d, i
+			}
+		}
+		if index < 0 || maxDist <= tolerance {
+			continue
+		}
+		keep[index] = true
+		stack = append(stack, span{s.from, index}, span{index, s.to})
+	}
+	res := track[:0]
+	for i := range track {
+		if keep[i] {
+			res = append(res, track[i])
+		}
+	}
+	return res
+}
+
+// triangleArea returns area of triangle in m² by local projection
+func triangleArea(a, b, c geoPoint) float64 {
+	kx := metersPerDegree * math.Cos(toRad(b.Lat))
+	ax, ay := (a.Lon-b.Lon)*kx, (a.Lat-b.Lat)*metersPerDegree
+	cx, cy := (c.Lon-b.Lon)*kx, (c.Lat-b.Lat)*metersPerDegree
+	return math.Abs(ax*cy-ay*cx) / 2
+}
+
+// vwPoint point of Visvalingam heap
+type vwPoint struct {
+	index      int
+	area       float64
+	prev, next int
+	heapIndex  int
+}
+
+type vwHeap []*vwPoint
+
+func (h vwHeap) Len() int            { return len(h) }
+func (h vwHeap) Less(i, j int) bool  { return h[i].area < h[j].area }
+func (h vwHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i]; h[i].heapIndex = i; h[j].heapIndex = j }
+func (h *vwHeap) Push(x interface{}) { p := x.(*vwPoint); p.heapIndex = len(*h); *h = append(*h, p) }
+func (h *vwHeap) Pop() interface{} {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	p.heapIndex = -1
+	return p
+}
+
+// Visvalingam simplifies track to point budget by removing points with the smallest effective area,
+// first, last and locked positions are kept even if budget is exceeded
+func Visvalingam(positions []FlatPosition, budget int, keepEvents bool) []FlatPosition {
+	return keepRule{events: keepEvents}.visvalingam(positions, budget)
+}
+
+func (r keepRule) visvalingam(positions []FlatPosition, budget int) []FlatPosition {
+	track, keep := r.track(positions)
+	if budget <= 0 || len(track) <= budget || len(track) < 3 {
+		return track
+	}
+	pts := trackPoints(track)
+	points := make([]*vwPoint, len(track))
+	h := make(vwHeap, 0, len(track))
+	for i := range track {
+		points[i] = &vwPoint{index: i, prev: i - 1, next: i + 1, heapIndex: -1}
+		if keep[i] {
+			continue
+		}
+		points[i].area = triangleArea(pts[i-1], pts[i], pts[i+1])
+		h = append(h, points[i])
+		points[i].heapIndex = len(h) - 1
+	}
+	heap.Init(&h)
+	removed := make([]bool, len(track))
+	count := len(track)
+	update := func(i int) {
+		p := points[i]
+		if p.heapIndex < 0 {
+			return
+		}
+		p.area = triangleArea(pts[p.prev], pts[i], pts[p.next])
+		heap.Fix(&h, p.heapIndex)
+	}
+	for count > budget && h.Len() > 0 {
+		p := heap.Pop(&h).(*vwPoint)
+		removed[p.index] = true
+		count--
+		points[p.prev].next = p.next
+		points[p.next].prev = p.prev
+		update(p.prev)
+		update(p.next)
+	}
+	res := track[:0]
+	for i := range track {
+		if !removed[i] {
+			res = append(res, track[i])
+		}
+	}
+	return res
+}
+
+// bucketAgg aggregation state of one param
+type bucketAgg struct {
+	value float64
+	sum   float64
+	count int
+}
+
+// Downsampler aggregates time ordered positions by time buckets
+type Downsampler struct {
+	Config  SimplifyConfig
+	bucket  int64
+	last    float64 // ms
+	zones   []ZoneInfo
+	params  map[uint16]*bucketAgg
+	events  []uint16
+	hasData bool
+	moving  bool // previous position with speed is moving
+}
+
+// NewDownsampler create time bucket downsampler
+func NewDownsampler(cfg SimplifyConfig) *Downsampler {
+	return &Downsampler{Config: cfg}
+}
+
+func (d *Downsampler) agg(code uint16) AggFunc {
+	if code == ParamLat || code == ParamLon {
+		// coordinates are never averaged to keep points on track
+		return AggLast
+	}
+	if f, ok := d.Config.Aggregate[code]; ok {
+		return f
+	}
+	return d.Config.Default
+}
+
+func (d *Downsampler) add(pos *FlatPosition) {
+	if d.params == nil {
+		d.params = make(map[uint16]*bucketAgg)
+	}
+	for code, v := range pos.P {
+		a, ok := d.params[code]
+		if !ok {
+			d.params[code] = &bucketAgg{value: v, sum: v, count: 1}
+			continue
+		}
+		a.sum += v
+		a.count++
+		switch d.agg(code) {
+		case AggMin:
+			a.value = math.Min(a.value, v)
+		case AggMax:
+			a.value = math.Max(a.value, v)
+		case AggLast:
+			a.value = v
+		}
+	}
+	d.events = append(d.events, pos.E...)
+	d.last, d.zones = pos.Time, pos.Zones
+	d.hasData = true
+}
+
+// close returns aggregated position of current bucket
+func (d *Downsampler) close() []FlatPosition {
+	if !d.hasData {
+		return nil
+	}
+	res := FlatPosition{Time: d.last, P: make(map[uint16]float64, len(d.params)), Zones: d.zones}
+	for code, a := range d.params {
+		switch d.agg(code) {
+		case AggAvg:
+			res.P[code] = a.sum / float64(a.count)
+		case AggSum:
+			res.P[code] = a.sum
+		default:
+			res.P[code] = a.value
+		}
+	}
+	if len(d.events) > 0 {
+		res.E = d.events
+	}
+	d.params = nil
+	d.events = nil
+	d.zones = nil
+	d.hasData = false
+	return []FlatPosition{res}
+}
+
+// Push adds next position and returns closed buckets and kept positions
+func (d *Downsampler) Push(pos *FlatPosition) []FlatPosition {
+	bucketMs := int64(d.Config.Bucket / time.Millisecond)
+	if bucketMs <= 0 {
+		return []FlatPosition{*pos.Copy(true)}
+	}
+	rule := d.Config.keepRule()
+	stopStart := false
+	if speed, ok := pos.P[ParamSpeed]; ok && rule.stopSpeed > 0 {
+		stopStart = d.moving && speed < rule.stopSpeed
+		d.moving = speed >= rule.stopSpeed
+	}
+	if rule.locked(pos) || stopStart {
+		return append(d.close(), *pos.Copy(true))
+	}
+	var res []FlatPosition
+	bucket := int64(math.Floor(pos.Time / float64(bucketMs)))
+	if d.hasData && bucket != d.bucket {
+		res = d.close()
+	}
+	d.bucket = bucket
+	d.add(pos)
+	return res
+}
+
+// Flush returns aggregated position of open bucket
+func (d *Downsampler) Flush() []FlatPosition {
+	return d.close()
+}
+
+// TrackSimplifier simplifies time ordered position stream with bounded memory:
+// positions are downsampled by time buckets, simplified by Douglas-Peucker in chunks
+// and reduced by Visvalingam when point budget is exceeded
+type TrackSimplifier struct {
+	Config SimplifyConfig
+	down   *Downsampler
+	chunk  []FlatPosition
+	out    []FlatPosition
+}
+
+// NewTrackSimplifier create streaming track simplifier
+func NewTrackSimplifier(cfg SimplifyConfig) *TrackSimplifier {
+	if cfg.ChunkSize < 3 {
+		cfg.ChunkSize = DefaultSimplifyConfig.ChunkSize
+	}
+	return &TrackSimplifier{Config: cfg, down: NewDownsampler(cfg)}
+}
+
+// Push adds next position
+func (s *TrackSimplifier) Push(pos *FlatPosition) {
+	s.chunk = append(s.chunk, s.down.Push(pos)...)
+	if len(s.chunk) >= s.Config.ChunkSize {
+		s.simplifyChunk(false)
+	}
+}
+
+// simplifyChunk moves simplified chunk to output, last point stays in chunk
+// as start of next one if it is not the final chunk
+func (s *TrackSimplifier) simplifyChunk(final bool) {
+	chunk := s.Config.keepRule().douglasPeucker(s.chunk, s.Config.Tolerance)
+	if final || len(chunk) == 0 {
+		s.out = append(s.out, chunk...)
+		s.chunk = s.chunk[:0]
+	} else {
+		s.out = append(s.out, chunk[:len(chunk)-1]...)
+		tail := chunk[len(chunk)-1]
+		s.chunk = append(s.chunk[:0], tail)
+	}
+	if budget := s.Config.Budget; budget > 0 && len(s.out) > 2*budget {
+		s.out = s.Config.keepRule().visvalingam(s.out, budget)
+	}
+}
+
+// Flush returns simplified track and resets simplifier
+func (s *TrackSimplifier) Flush() []FlatPosition {
+	s.chunk = append(s.chunk, s.down.Flush()...)
+	s.simplifyChunk(true)
+	res := s.Config.keepRule().visvalingam(s.out, s.Config.Budget)
+	s.out = nil
+	return res
+}
+
+// SimplifyTrack simplifies track by config
+func SimplifyTrack(positions []FlatPosition, cfg SimplifyConfig) []FlatPosition {
+	s := NewTrackSimplifier(cfg)
+	for i := range positions {
+		s.Push(&positions[i])
+	}
+	return s.Flush()
+}
+
+// SimplifyReader simplifies positions decoded by reader without holding full track
+func SimplifyReader(reader *BinaryReader, cfg SimplifyConfig) (int16, []FlatPosition) {
+	s := NewTrackSimplifier(cfg)
+	code := reader.ReadFlatPositionsFunc(s.Push)
+	return code, s.Flush()
+}
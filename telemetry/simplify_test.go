@@ -0,0 +1,202 @@
+package telemetry
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// lineTrack generates positions each 10 s going east, lat returns offset of point from line in degrees
+func lineTrack(n int, lat func(i int) float64) []FlatPosition {
+	res := make([]FlatPosition, n)
+	for i := range res {
+		res[i] = FlatPosition{Time: float64(i) * 10000, P: map[uint16]float64{
+			ParamLat: 55 + lat(i), ParamLon: 37 + float64(i)*0.001, ParamSpeed: 60,
+		}}
+	}
+	return res
+}
+
+// trackTimes returns indexes of positions in generated track by time
+func trackTimes(positions []FlatPosition) []int {
+	res := make([]int, len(positions))
+	for i := range positions {
+		res[i] = int(positions[i].Time / 10000)
+	}
+	return res
+}
+
+func sameIndexes(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDouglasPeucker(t *testing.T) {
+	// triangle with top at 5, ~22 m from base at each step
+	triangle := lineTrack(11, func(i int) float64 { return 0.0002 * math.Min(float64(i), float64(10-i)) })
+	noCoords := lineTrack(5, func(i int) float64 { return 0 })
+	delete(noCoords[2].P, ParamLat)
+	withEvent := lineTrack(5, func(i int) float64 { return 0 })
+	withEvent[2].E = []uint16{12}
+	delete(withEvent[3].P, ParamLat)
+	withEvent[3].E = []uint16{13}
+	cases := []struct {
+		name       string
+		track      []FlatPosition
+		tolerance  float64
+		keepEvents bool
+		want       []int
+	}{
+		{"triangle", triangle, 5, false, []int{0, 5, 10}},
+		{"triangle under tolerance", triangle, 200, false, []int{0, 10}},
+		{"zero tolerance", triangle, 0, false, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"without coordinates", noCoords, 5, false, []int{0, 4}},
+		{"without coordinates zero tolerance", noCoords, 0, false, []int{0, 1, 3, 4}},
+		{"events", withEvent, 5, true, []int{0, 2, 3, 4}},
+		{"events not kept", withEvent, 5, false, []int{0, 4}},
+	}
+	for _, tc := range cases {
+		if got := trackTimes(DouglasPeucker(tc.track, tc.tolerance, tc.keepEvents)); !sameIndexes(got, tc.want) {
+			t.Errorf("%s: %v, expected %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestVisvalingam(t *testing.T) {
+	// broken line with corners at 5, 10 and 15, other points are on straight parts
+	corners := []struct{ i, lat float64 }{{0, 0}, {5, 0.003}, {10, 0}, {15, 0.001}, {19, 0}}
+	line := func(i int) float64 {
+		for k := 1; k < len(corners); k++ {
+			a, b := corners[k-1], corners[k]
+			if float64(i) <= b.i {
+				return a.lat + (b.lat-a.lat)*(float64(i)-a.i)/(b.i-a.i)
+			}
+		}
+		return 0
+	}
+	broken := lineTrack(20, line)
+	withEvents := lineTrack(20, line)
+	for _, i := range []int{1, 2, 3, 16, 17} {
+		withEvents[i].E = []uint16{12}
+	}
+	cases := []struct {
+		name       string
+		track      []FlatPosition
+		budget     int
+		keepEvents bool
+		want       []int
+	}{
+		{"budget", broken, 5, false, []int{0, 5, 10, 15, 19}},
+		{"budget without the smallest corner", broken, 4, false, []int{0, 5, 10, 19}},
+		{"budget of track length", broken, 20, false, trackTimes(broken)},
+		{"no budget", broken, 0, false, trackTimes(broken)},
+		{"events in budget", withEvents, 8, true, []int{0, 1, 2, 3, 10, 16, 17, 19}},
+		{"events over budget", withEvents, 3, true, []int{0, 1, 2, 3, 16, 17, 19}},
+	}
+	for _, tc := range cases {
+		got := trackTimes(Visvalingam(tc.track, tc.budget, tc.keepEvents))
+		if !sameIndexes(got, tc.want) {
+			t.Errorf("%s: %v, expected %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSimplifyKeepsStops(t *testing.T) {
+	// straight line is simplified to its ends, stop starts are kept
+	track := segmentTrack(trackPhase{time.Minute, 60, 1}, trackPhase{time.Minute, 0, 1}, trackPhase{time.Minute, 60, 1}, trackPhase{30 * time.Second, 1, 1})
+	cfg := SimplifyConfig{Tolerance: 5, StopSpeed: 3}
+	if got := trackTimes(SimplifyTrack(track, cfg)); !sameIndexes(got, []int{0, 6, 18, 20}) {
+		t.Errorf("stops: %v", got)
+	}
+	cfg.StopSpeed = 0
+	if got := trackTimes(SimplifyTrack(track, cfg)); !sameIndexes(got, []int{0, 20}) {
+		t.Errorf("stops are not kept: %v", got)
+	}
+	// stop start is not aggregated in time bucket
+	cfg = SimplifyConfig{Bucket: time.Minute, StopSpeed: 3, Aggregate: map[uint16]AggFunc{ParamSpeed: AggMax}}
+	got := SimplifyTrack(track, cfg)
+	if times := trackTimes(got); !sameIndexes(times, []int{5, 6, 11, 17, 18, 20}) {
+		t.Errorf("buckets: %v", times)
+	}
+}
+
+func TestDownsampler(t *testing.T) {
+	d := NewDownsampler(SimplifyConfig{
+		Bucket:     time.Minute,
+		Default:    AggLast,
+		Aggregate:  map[uint16]AggFunc{ParamSpeed: AggMax, ParamLat: AggAvg, 2000: AggMin, 2001: AggAvg, 2002: AggSum, 2003: AggFirst},
+		KeepEvents: true,
+	})
+	var res []FlatPosition
+	for i := 0; i < 15; i++ {
+		pos := FlatPosition{Time: float64(i) * 10000, P: map[uint16]float64{
+			ParamLat: 55 + float64(i), ParamSpeed: float64(i % 4), 2000: float64(10 - i), 2001: float64(i), 2002: 1, 2003: float64(i), 2004: float64(i),
+		}}
+		if i == 8 {
+			pos.E = []uint16{12}
+		}
+		res = append(res, d.Push(&pos)...)
+	}
+	res = append(res, d.Flush()...)
+	expected := []FlatPosition{
+		{Time: 50000, P: map[uint16]float64{ParamLat: 60, ParamSpeed: 3, 2000: 5, 2001: 2.5, 2002: 6, 2003: 0, 2004: 5}},
+		{Time: 70000, P: map[uint16]float64{ParamLat: 62, ParamSpeed: 3, 2000: 3, 2001: 6.5, 2002: 2, 2003: 6, 2004: 7}},
+		{Time: 80000, P: map[uint16]float64{ParamLat: 63, ParamSpeed: 0, 2000: 2, 2001: 8, 2002: 1, 2003: 8, 2004: 8}, E: []uint16{12}},
+		{Time: 110000, P: map[uint16]float64{ParamLat: 66, ParamSpeed: 3, 2000: -1, 2001: 10, 2002: 3, 2003: 9, 2004: 11}},
+		{Time: 140000, P: map[uint16]float64{ParamLat: 69, ParamSpeed: 2, 2000: -4, 2001: 13, 2002: 3, 2003: 12, 2004: 14}},
+	}
+	if len(res) != len(expected) {
+		t.Fatalf("%d positions %+v, expected %d", len(res), res, len(expected))
+	}
+	for i := range expected {
+		if !sameFlat(&res[i], &expected[i]) {
+			t.Errorf("bucket %d: %+v, expected %+v", i, res[i], expected[i])
+		}
+	}
+}
+
+func TestTrackSimplifierBudget(t *testing.T) {
+	track := lineTrack(5000, func(i int) float64 { return float64(i%7) * 0.0003 })
+	track[1234].E = []uint16{12}
+	cfg := SimplifyConfig{Tolerance: 5, Budget: 100, KeepEvents: true, ChunkSize: 300}
+	res := SimplifyTrack(track, cfg)
+	if len(res) == 0 || len(res) > cfg.Budget {
+		t.Fatalf("%d positions, budget %d", len(res), cfg.Budget)
+	}
+	times := trackTimes(res)
+	if times[0] != 0 || times[len(times)-1] != 4999 {
+		t.Errorf("track ends are not kept: %d..%d", times[0], times[len(times)-1])
+	}
+	found := false
+	for _, i := range times {
+		found = found || i == 1234
+	}
+	if !found {
+		t.Error("event position is removed")
+	}
+	enc, _ := NewEncoder(protocolVersion)
+	var frames []byte
+	for i := range track {
+		var err error
+		if frames, err = enc.AppendFlat(frames, &track[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// streaming simplification of reader is the same as simplification of decoded track
+	reader := NewReader()
+	reader.Set(&frames)
+	_, decoded := reader.ReadFlatPositions()
+	expected := trackTimes(SimplifyTrack(decoded, cfg))
+	reader.Set(&frames)
+	code, res := SimplifyReader(reader, cfg)
+	if code != 0 || !sameIndexes(trackTimes(res), expected) {
+		t.Errorf("code %d, reader track %v, expected %v", code, trackTimes(res), expected)
+	}
+}
@@ -0,0 +1,400 @@
+package telemetry
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StatsPeriod rollup period
+type StatsPeriod string
+
+const (
+	// StatsHour hourly rollups
+	StatsHour StatsPeriod = "hour"
+	// StatsDay daily rollups
+	StatsDay StatsPeriod = "day"
+)
+
+// start returns start of period containing time
+func (p StatsPeriod) start(t time.Time) time.Time {
+	if p == StatsDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+// end returns end of period started at start
+func (p StatsPeriod) end(start time.Time) time.Time {
+	if p == StatsDay {
+		return start.AddDate(0, 0, 1)
+	}
+	return start.Add(time.Hour)
+}
+
+// StatsKind kind of rollup
+type StatsKind string
+
+const (
+	// StatsValue min, max and time weighted average of param
+	StatsValue StatsKind = "value"
+	// StatsCounter increase of counter param, resets are skipped
+	StatsCounter StatsKind = "counter"
+	// StatsBit duration of set bit of bitmask param
+	StatsBit StatsKind = "bit"
+)
+
+// StatsConfig settings of telemetry rollups
+type StatsConfig struct {
+	Periods  []StatsPeriod
+	Location *time.Location // location of period boundaries, UTC if nil
+	Params   []uint16       // value params, nil - measured params of registry, see StatsParams
+	Counters []uint16
+	Bitmasks []uint16
+	MaxGap   time.Duration // longer intervals between positions are not accounted, zero is unlimited
+	Registry *ParamRegistry
+}
+
+// DefaultStatsConfig hourly and daily rollups with engine hours and status bits
+var DefaultStatsConfig = StatsConfig{
+	Periods:  []StatsPeriod{StatsHour, StatsDay},
+	Counters: []uint16{2020, 2021, 2022, 2023, 2024},
+	Bitmasks: []uint16{ParamStatus},
+	MaxGap:   30 * time.Minute,
+}
+
+// StatsRecord rollup of param in period, record of statsstore table
+type StatsRecord struct {
+	Object   string    `db:"object" json:"object" len:"50" key:"1"`
+	Period   string    `db:"period" json:"period" len:"10" key:"1"`
+	Start    time.Time `db:"start" json:"start" type:"timestamptz" key:"1"`
+	Param    int       `db:"param" json:"param" type:"int4" key:"1"`
+	Kind     string    `db:"kind" json:"kind" len:"10" key:"1"`
+	Bit      int       `db:"bit" json:"bit" type:"int2" key:"1"` // bit number of bit rollups
+	Count    int       `db:"count" json:"count" type:"int4"`     // count of values
+	Min      float64   `db:"min" json:"min" type:"float8"`
+	Max      float64   `db:"max" json:"max" type:"float8"`
+	Avg      float64   `db:"avg" json:"avg" type:"float8"`           // time weighted average
+	Sum      float64   `db:"sum" json:"sum" type:"float8"`           // sum of values, counter increase or seconds of set bit
+	Duration float64   `db:"duration" json:"duration" type:"float8"` // seconds covered by values
+}
+
+// EngineHours returns engine hours of moto counters in records of period
+func EngineHours(records []StatsRecord, period StatsPeriod) float64 {
+	var hours float64
+	for i := range records {
+		if records[i].Period == string(period) && records[i].Kind == string(StatsCounter) && records[i].Param >= 2020 && records[i].Param <= 2024 {
+			hours += records[i].Sum
+		}
+	}
+	return hours
+}
+
+type statsKey struct {
+	param uint16
+	kind  StatsKind
+	bit   int
+}
+
+type statsAcc struct {
+	count    int
+	min      float64
+	max      float64
+	sum      float64
+	weighted float64
+	duration float64 // seconds
+}
+
+type statsBucket struct {
+	period StatsPeriod
+	start  time.Time
+	end    float64 // ms
+	acc    map[statsKey]*statsAcc
+}
+
+func (b *statsBucket) get(key statsKey) *statsAcc {
+	acc, ok := b.acc[key]
+	if !ok {
+		acc = &statsAcc{min: math.Inf(1), max: math.Inf(-1)}
+		b.acc[key] = acc
+	}
+	return acc
+}
+
+type statsObject struct {
+	last     float64
+	values   map[uint16]float64 // values of last position
+	counters map[uint16]*odoCounter
+	buckets  map[StatsPeriod][]*statsBucket
+}
+
+// StatsAggregator builds rollups of position streams per object
+type StatsAggregator struct {
+	Config   StatsConfig
+	mu       sync.Mutex
+	objects  map[string]*statsObject
+	counters map[uint16]bool
+	bitmasks map[uint16]bool
+	params   map[uint16]bool
+}
+
+// NewStatsAggregator create rollups aggregator
+func NewStatsAggregator(cfg StatsConfig) *StatsAggregator {
+	if cfg.Registry == nil {
+		cfg.Registry = DefaultRegistry
+	}
+	if cfg.Location == nil {
+		cfg.Location = time.UTC
+	}
+	a := &StatsAggregator{Config: cfg, objects: make(map[string]*statsObject)}
+	a.counters = codeSet(cfg.Counters)
+	a.bitmasks = codeSet(cfg.Bitmasks)
+	if cfg.Params != nil {
+		a.params = codeSet(cfg.Params)
+	} else {
+		a.params = make(map[uint16]bool)
+		for _, code := range StatsParams(cfg.Registry) {
+			if !a.counters[code] && !a.bitmasks[code] {
+				a.params[code] = true
+			}
+		}
+	}
+	return a
+}
+
+// StatsParams returns registry params with measure unit except time and coordinates,
+// default value params of rollups
+func StatsParams(reg *ParamRegistry) []uint16 {
+	var codes []uint16
+	for _, info := range reg.Params() {
+		switch info.Unit {
+		case "", "ms", "deg":
+			continue
+		}
+		codes = append(codes, info.Code)
+	}
+	return sortKeys(codes)
+}
+
+func codeSet(codes []uint16) map[uint16]bool {
+	set := make(map[uint16]bool, len(codes))
+	for _, code := range codes {
+		set[code] = true
+	}
+	return set
+}
+
+// isValue checks that param is aggregated as value
+func (a *StatsAggregator) isValue(code uint16) bool {
+	return a.params[code]
+}
+
+// bucket returns open bucket of period containing time
+func (a *StatsAggregator) bucket(obj *statsObject, period StatsPeriod, t float64) *statsBucket {
+	list := obj.buckets[period]
+	for _, b := range list {
+		if t < b.end && t >= float64(b.start.UnixNano()/int64(time.Millisecond)) {
+			return b
+		}
+	}
+	start := period.start(time.Unix(0, int64(t)*int64(time.Millisecond)).In(a.Config.Location))
+	b := &statsBucket{
+		period: period,
+		start:  start,
+		end:    float64(period.end(start).UnixNano() / int64(time.Millisecond)),
+		acc:    make(map[statsKey]*statsAcc),
+	}
+	list = append(list, b)
+	sort.Slice(list, func(i, j int) bool { return list[i].end < list[j].end })
+	obj.buckets[period] = list
+	return b
+}
+
+// interval splits interval between buckets of every period and calls cb with share of interval
+func (a *StatsAggregator) interval(obj *statsObject, from, to float64, cb func(b *statsBucket, seconds, share float64)) {
+	if to <= from {
+		return
+	}
+	for _, period := range a.Config.Periods {
+		for t := from; t < to; {
+			b := a.bucket(obj, period, t)
+			end := math.Min(b.end, to)
+			cb(b, (end-t)/1000, (end-t)/(to-from))
+			t = end
+		}
+	}
+}
+
+// Push accounts position of object and returns rollups of completed periods,
+// positions older than last position of object are ignored
+func (a *StatsAggregator) Push(object string, pos *FlatPosition) []StatsRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	obj, ok := a.objects[object]
+	if !ok {
+		obj = &statsObject{
+			counters: make(map[uint16]*odoCounter),
+			buckets:  make(map[StatsPeriod][]*statsBucket),
+		}
+		a.objects[object] = obj
+	}
+	// interval since previous position, increase of counters after long gap
+	// is accounted in period of position
+	from := pos.Time - 1
+	if obj.values != nil {
+		if pos.Time < obj.last {
+			return nil
+		}
+		if a.Config.MaxGap == 0 || pos.Time-obj.last <= float64(a.Config.MaxGap/time.Millisecond) {
+			from = obj.last
+			a.interval(obj, from, pos.Time, func(b *statsBucket, seconds, share float64) {
+				a.accountInterval(b, obj.values, seconds)
+			})
+		}
+	}
+	a.pushCounters(obj, pos, from)
+	for _, period := range a.Config.Periods {
+		b := a.bucket(obj, period, pos.Time)
+		for code, v := range pos.P {
+			if !a.isValue(code) {
+				continue
+			}
+			acc := b.get(statsKey{code, StatsValue, 0})
+			acc.count++
+			acc.sum += v
+			acc.min = math.Min(acc.min, v)
+			acc.max = math.Max(acc.max, v)
+		}
+	}
+	values := make(map[uint16]float64, len(pos.P))
+	for code, v := range pos.P {
+		if a.isValue(code) || a.bitmasks[code] {
+			values[code] = v
+		}
+	}
+	obj.last, obj.values = pos.Time, values
+	return a.completed(object, obj, pos.Time)
+}
+
+// accountInterval accounts values held during interval
+func (a *StatsAggregator) accountInterval(b *statsBucket, values map[uint16]float64, seconds float64) {
+	for code, v := range values {
+		if !a.bitmasks[code] {
+			acc := b.get(statsKey{code, StatsValue, 0})
+			acc.weighted += v * seconds
+			acc.duration += seconds
+			continue
+		}
+		mask := uint64(v)
+		for bit := 0; mask != 0; bit, mask = bit+1, mask>>1 {
+			if mask&1 == 0 {
+				continue
+			}
+			acc := b.get(statsKey{code, StatsBit, bit})
+			acc.sum += seconds
+			acc.duration += seconds
+		}
+	}
+}
+
+// pushCounters accounts counter increase since previous reading over interval from time
+func (a *StatsAggregator) pushCounters(obj *statsObject, pos *FlatPosition, from float64) {
+	for code := range a.counters {
+		c, ok := obj.counters[code]
+		if !ok {
+			c = &odoCounter{}
+			obj.counters[code] = c
+		}
+		if !c.push(pos, code) || c.delta <= 0 {
+			continue
+		}
+		delta := c.delta
+		a.interval(obj, from, pos.Time, func(b *statsBucket, seconds, share float64) {
+			acc := b.get(statsKey{code, StatsCounter, 0})
+			acc.sum += delta * share
+			acc.duration += seconds
+		})
+	}
+}
+
+// completed removes buckets ended before time and returns their rollups
+func (a *StatsAggregator) completed(object string, obj *statsObject, t float64) []StatsRecord {
+	var records []StatsRecord
+	for _, period := range a.Config.Periods {
+		list := obj.buckets[period]
+		n := 0
+		for n < len(list) && list[n].end <= t {
+			records = append(records, a.records(object, list[n])...)
+			n++
+		}
+		obj.buckets[period] = list[n:]
+	}
+	return records
+}
+
+// Flush returns rollups of open periods of object and clears its state, all objects if object is empty
+func (a *StatsAggregator) Flush(object string) []StatsRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var records []StatsRecord
+	for id, obj := range a.objects {
+		if object != "" && id != object {
+			continue
+		}
+		records = append(records, a.completed(id, obj, math.Inf(1))...)
+		delete(a.objects, id)
+	}
+	return records
+}
+
+// records converts bucket accumulators to records
+func (a *StatsAggregator) records(object string, b *statsBucket) []StatsRecord {
+	reg := a.Config.Registry
+	records := make([]StatsRecord, 0, len(b.acc))
+	for key, acc := range b.acc {
+		rec := StatsRecord{
+			Object:   object,
+			Period:   string(b.period),
+			Start:    b.start,
+			Param:    int(key.param),
+			Kind:     string(key.kind),
+			Bit:      key.bit,
+			Count:    acc.count,
+			Sum:      acc.sum,
+			Duration: acc.duration,
+		}
+		if key.kind == StatsValue {
+			if acc.count > 0 {
+				rec.Min, rec.Max = acc.min, acc.max
+			}
+			if acc.duration > 0 {
+				rec.Avg = reg.Round(key.param, acc.weighted/acc.duration)
+			} else if acc.count > 0 {
+				rec.Avg = reg.Round(key.param, acc.sum/float64(acc.count))
+			}
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		x, y := &records[i], &records[j]
+		if x.Param != y.Param {
+			return x.Param < y.Param
+		}
+		if x.Kind != y.Kind {
+			return x.Kind < y.Kind
+		}
+		return x.Bit < y.Bit
+	})
+	return records
+}
+
+// AggregateStats builds rollups of time ordered positions of object
+func AggregateStats(object string, positions []FlatPosition, cfg StatsConfig) []StatsRecord {
+	a := NewStatsAggregator(cfg)
+	var records []StatsRecord
+	for i := range positions {
+		records = append(records, a.Push(object, &positions[i])...)
+	}
+	return append(records, a.Flush(object)...)
+}
@@ -0,0 +1,216 @@
+package telemetry
+
+import (
+	"testing"
+	"time"
+)
+
+// statsTime returns time of 2021-03-01 hh:mm UTC
+func statsTime(h, m int) time.Time {
+	return time.Date(2021, 3, 1, h, m, 0, 0, time.UTC)
+}
+
+func statsPos(h, m int, p map[uint16]float64) FlatPosition {
+	return FlatPosition{Time: float64(statsTime(h, m).UnixNano() / int64(time.Millisecond)), P: p}
+}
+
+// findRecord returns record of period started at start, nil if not found
+func findRecord(records []StatsRecord, period StatsPeriod, start time.Time, param uint16, kind StatsKind, bit int) *StatsRecord {
+	for i := range records {
+		r := &records[i]
+		if r.Period == string(period) && r.Start.Equal(start) && r.Param == int(param) && r.Kind == string(kind) && r.Bit == bit {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestStatsAggregate(t *testing.T) {
+	type want struct {
+		period StatsPeriod
+		start  time.Time
+		param  uint16
+		kind   StatsKind
+		bit    int
+		count  int
+		min    float64
+		max    float64
+		avg    float64
+		sum    float64
+		dur    float64
+	}
+	day := statsTime(0, 0)
+	cases := []struct {
+		name      string
+		cfg       StatsConfig
+		positions []FlatPosition
+		want      []want
+		records   int
+	}{
+		{
+			name: "time weighted average",
+			cfg:  StatsConfig{Periods: []StatsPeriod{StatsHour, StatsDay}, Params: []uint16{ParamSpeed}},
+			positions: []FlatPosition{
+				statsPos(10, 0, map[uint16]float64{ParamSpeed: 10}),
+				statsPos(10, 10, map[uint16]float64{ParamSpeed: 40}),
+				statsPos(10, 40, map[uint16]float64{ParamSpeed: 40}),
+				statsPos(11, 0, map[uint16]float64{ParamSpeed: 0}),
+			},
+			want: []want{
+				{StatsHour, statsTime(10, 0), ParamSpeed, StatsValue, 0, 3, 10, 40, 35, 90, 3600},
+				{StatsHour, statsTime(11, 0), ParamSpeed, StatsValue, 0, 1, 0, 0, 0, 0, 0},
+				{StatsDay, day, ParamSpeed, StatsValue, 0, 4, 0, 40, 35, 90, 3600},
+			},
+			records: 3,
+		},
+		{
+			name: "counter reset and split over hours",
+			cfg:  StatsConfig{Periods: []StatsPeriod{StatsHour, StatsDay}, Params: []uint16{}, Counters: []uint16{2020}},
+			positions: []FlatPosition{
+				statsPos(10, 50, map[uint16]float64{2020: 100}),
+				statsPos(11, 10, map[uint16]float64{2020: 102}),
+				statsPos(11, 20, map[uint16]float64{2020: 0.5}),
+				statsPos(11, 30, map[uint16]float64{2020: 1}),
+			},
+			want: []want{
+				{StatsHour, statsTime(10, 0), 2020, StatsCounter, 0, 0, 0, 0, 0, 1, 600},
+				{StatsHour, statsTime(11, 0), 2020, StatsCounter, 0, 0, 0, 0, 0, 1.5, 1200},
+				{StatsDay, day, 2020, StatsCounter, 0, 0, 0, 0, 0, 2.5, 1800},
+			},
+			records: 3,
+		},
+		{
+			name: "value split over days in location",
+			cfg:  StatsConfig{Periods: []StatsPeriod{StatsDay}, Params: []uint16{1021}, Location: time.FixedZone("UTC+3", 3*3600)},
+			positions: []FlatPosition{
+				statsPos(20, 50, map[uint16]float64{1021: 12}),
+				statsPos(21, 10, map[uint16]float64{1021: 14}),
+				statsPos(21, 20, map[uint16]float64{1021: 12}),
+			},
+			want: []want{
+				{StatsDay, statsTime(-3, 0), 1021, StatsValue, 0, 1, 12, 12, 12, 12, 600},
+				{StatsDay, statsTime(21, 0), 1021, StatsValue, 0, 2, 12, 14, 13, 26, 1200},
+			},
+			records: 2,
+		},
+		{
+			name: "bitmask durations",
+			cfg:  StatsConfig{Periods: []StatsPeriod{StatsHour}, Params: []uint16{}, Bitmasks: []uint16{ParamStatus}},
+			positions: []FlatPosition{
+				statsPos(10, 0, map[uint16]float64{ParamStatus: 5}),
+				statsPos(10, 10, map[uint16]float64{ParamStatus: 1}),
+				statsPos(10, 30, map[uint16]float64{ParamStatus: 0}),
+				statsPos(11, 0, map[uint16]float64{ParamStatus: 2}),
+				statsPos(11, 15, map[uint16]float64{ParamStatus: 2}),
+			},
+			want: []want{
+				{StatsHour, statsTime(10, 0), ParamStatus, StatsBit, 0, 0, 0, 0, 0, 1800, 1800},
+				{StatsHour, statsTime(10, 0), ParamStatus, StatsBit, 2, 0, 0, 0, 0, 600, 600},
+				{StatsHour, statsTime(11, 0), ParamStatus, StatsBit, 1, 0, 0, 0, 0, 900, 900},
+			},
+			records: 3,
+		},
+		{
+			name: "max gap",
+			cfg:  StatsConfig{Periods: []StatsPeriod{StatsHour}, Params: []uint16{ParamSpeed}, Counters: []uint16{2021}, MaxGap: 30 * time.Minute},
+			positions: []FlatPosition{
+				statsPos(10, 0, map[uint16]float64{ParamSpeed: 10, 2021: 1}),
+				statsPos(10, 50, map[uint16]float64{ParamSpeed: 20}),
+				statsPos(12, 30, map[uint16]float64{2021: 3}),
+			},
+			want: []want{
+				{StatsHour, statsTime(10, 0), ParamSpeed, StatsValue, 0, 2, 10, 20, 15, 30, 0},
+				{StatsHour, statsTime(12, 0), 2021, StatsCounter, 0, 0, 0, 0, 0, 2, 0.001},
+			},
+			records: 2,
+		},
+	}
+	for _, tc := range cases {
+		records := AggregateStats("car", tc.positions, tc.cfg)
+		if len(records) != tc.records {
+			t.Errorf("%s: %d records, expected %d: %+v", tc.name, len(records), tc.records, records)
+		}
+		for _, w := range tc.want {
+			r := findRecord(records, w.period, w.start, w.param, w.kind, w.bit)
+			if r == nil {
+				t.Errorf("%s: no record %+v", tc.name, w)
+				continue
+			}
+			if r.Object != "car" || r.Count != w.count || r.Min != w.min || r.Max != w.max || !near(r.Avg, w.avg) || !near(r.Sum, w.sum) || !near(r.Duration, w.dur) {
+				t.Errorf("%s: %+v, expected %+v", tc.name, *r, w)
+			}
+		}
+	}
+}
+
+func near(a, b float64) bool {
+	return a-b < 1e-9 && b-a < 1e-9
+}
+
+func TestStatsPushCompleted(t *testing.T) {
+	a := NewStatsAggregator(StatsConfig{Periods: []StatsPeriod{StatsHour, StatsDay}, Params: []uint16{ParamSpeed}})
+	for _, pos := range []FlatPosition{
+		statsPos(10, 0, map[uint16]float64{ParamSpeed: 10}),
+		statsPos(10, 30, map[uint16]float64{ParamSpeed: 10}),
+	} {
+		if records := a.Push("car", &pos); len(records) != 0 {
+			t.Errorf("records of open periods: %+v", records)
+		}
+	}
+	old := statsPos(9, 0, map[uint16]float64{ParamSpeed: 100})
+	if records := a.Push("car", &old); records != nil {
+		t.Errorf("old position is accounted: %+v", records)
+	}
+	next := statsPos(11, 0, map[uint16]float64{ParamSpeed: 10})
+	if records := a.Push("car", &next); len(records) != 1 || records[0].Period != string(StatsHour) || records[0].Max != 10 {
+		t.Errorf("completed hour: %+v", records)
+	}
+	other := statsPos(12, 0, map[uint16]float64{ParamSpeed: 50})
+	a.Push("bus", &other)
+	if records := a.Flush("car"); len(records) != 2 {
+		t.Errorf("flushed car records: %+v", records)
+	}
+	if records := a.Flush(""); len(records) != 2 || records[0].Object != "bus" {
+		t.Errorf("flushed records: %+v", records)
+	}
+}
+
+func TestStatsDefaultParams(t *testing.T) {
+	params := codeSet(StatsParams(DefaultRegistry))
+	for _, code := range []uint16{ParamSpeed, 1021, ParamOdometer, 2400, ParamFuel} {
+		if !params[code] {
+			t.Errorf("param %d is not in default params", code)
+		}
+	}
+	for _, code := range []uint16{1, 9, ParamTimeFuel, ParamLat, ParamLon, ParamAngle, ParamStatus} {
+		if params[code] {
+			t.Errorf("param %d is in default params", code)
+		}
+	}
+	positions := []FlatPosition{
+		statsPos(10, 0, map[uint16]float64{ParamLat: 55, ParamLon: 37, 9: 1614592800000, ParamSpeed: 30, ParamStatus: 1, 2020: 10, 5000: 1}),
+		statsPos(10, 30, map[uint16]float64{ParamLat: 55.1, ParamLon: 37.1, 9: 1614594600000, ParamSpeed: 50, ParamStatus: 1, 2020: 10.5, 5000: 1}),
+	}
+	records := AggregateStats("car", positions, DefaultStatsConfig)
+	kinds := map[uint16]StatsKind{}
+	for _, r := range records {
+		if r.Period == string(StatsHour) {
+			kinds[uint16(r.Param)] = StatsKind(r.Kind)
+		}
+	}
+	expected := map[uint16]StatsKind{ParamSpeed: StatsValue, ParamStatus: StatsBit, 2020: StatsCounter}
+	if len(kinds) != len(expected) {
+		t.Errorf("rolled up params %v, expected %v", kinds, expected)
+	}
+	for code, kind := range expected {
+		if kinds[code] != kind {
+			t.Errorf("param %d: %q, expected %q", code, kinds[code], kind)
+		}
+	}
+	if hours := EngineHours(records, StatsHour); !near(hours, 0.5) {
+		t.Errorf("engine hours %v", hours)
+	}
+	if hours := EngineHours(records, StatsDay); !near(hours, 0.5) {
+		t.Errorf("daily engine hours %v", hours)
+	}
+}
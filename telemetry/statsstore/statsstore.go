@@ -0,0 +1,46 @@
+package statsstore
+
+import (
+	"time"
+
+	dbc "gitlab.com/battler/modules/sql"
+	"gitlab.com/battler/modules/telemetry"
+)
+
+// NewSchema create schema table of rollups
+func NewSchema(name string) *dbc.SchemaTable {
+	return dbc.NewSchemaTable(name, telemetry.StatsRecord{}, nil)
+}
+
+// Save replaces rollups of records periods in table
+func Save(table *dbc.SchemaTable, records []telemetry.StatsRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	query, err := table.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	type bucket struct {
+		object, period string
+		start          time.Time
+	}
+	deleted := map[bucket]bool{}
+	for i := range records {
+		rec := &records[i]
+		b := bucket{rec.Object, rec.Period, rec.Start}
+		if !deleted[b] {
+			deleted[b] = true
+			_, err = query.Exec(`DELETE FROM "`+table.Name+`" WHERE "object" = $1 AND "period" = $2 AND "start" = $3`, rec.Object, rec.Period, rec.Start)
+			if err != nil {
+				query.Rollback()
+				return err
+			}
+		}
+		if err = table.TransactInsert(*rec, query); err != nil {
+			query.Rollback()
+			return err
+		}
+	}
+	return query.Commit()
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"hash/crc32"
 	"math"
 	"strconv"
 	"strings"
@@ -14,101 +15,32 @@ import (
 
 const (
 	// base
+	ParamStatus   = 1020
 	ParamLat      = 1101
 	ParamLon      = 1102
+	ParamAlt      = 1103
 	ParamAngle    = 1104
+	ParamSpeed    = 1105
 	ParamOdometer = 1201
 	// can
-	ParamCanStatus = 2200
-	ParamCanSpeed  = 2202
+	ParamCanStatus    = 2200 // the first param of can group
+	ParamCanSpeed     = 2202
+	ParamCanOdometer  = 2203
+	ParamCanFuelLevel = 2206
 	// calculated
-	ParamCalcOdo  = 3001
-	ParamSpeedAvg = 3005
+	ParamCalcOdo    = 3001
+	ParamDriftLevel = 3004
+	ParamSpeedAvg   = 3005
+	ParamFuel       = 3400
+	ParamAvgFuel    = 3500
+	// ParamTimeFuel time of calculated fuel level
+	ParamTimeFuel = 10
 )
 
-var mapParamsPrecision = map[uint16]float64{
-	1021: 100,
-	1022: 100,
-	1101: 1000000000,
-	1102: 1000000000,
-	1201: 1000,
-}
-
-var telemetryParams = map[uint16]string{
-	1:  "ParamTime",
-	10: "FuelTime1",
-	11: "FuelTime2",
-	2:  "ParamEvent",
-
-	// System parameters
-	1020: "ParamDataStatus",
-	1021: "ParamDataPower",
-	1022: "ParamDataBattery",
-	1023: "ParamDataGSM",
-	1024: "ParamDataGPS",
-
-	// GPS parameters
-	1101: "ParamDataLat",
-	1102: "ParamDataLon",
-	1103: "ParamDataAlt",
-	1104: "ParamDataHead",
-	1105: "ParamDataSpeed",
-
-	// Drive parameters
-	1201: "ParamDataOdo",
-	1221: "ParamDataDriver",
-	1222: "ParamDataZone",
-
-	// Binary sensor parameters
-	1901: "ParamDataInput",
-	1902: "ParamDataOutput",
-
-	// Other parameter groups (with index)
-	2000: "ParamDataAnalog1",
-	2001: "ParamDataAnalog2",
-	2002: "ParamDataAnalog3",
-	2003: "ParamDataAnalog4",
-	2004: "ParamDataAnalog5",
-	2010: "ParamDataDigit1",
-	2011: "ParamDataDigit2",
-	2012: "ParamDataDigit3",
-	2013: "ParamDataDigit4",
-	2014: "ParamDataDigit5",
-	2020: "ParamDataMoto1",
-	2021: "ParamDataMoto2",
-	2022: "ParamDataMoto3",
-	2023: "ParamDataMoto4",
-	2024: "ParamDataMoto5",
-	2100: "ParamDataParams1",
-	2101: "ParamDataParams2",
-	2102: "ParamDataParams3",
-	2103: "ParamDataParams4",
-	2104: "ParamDataParams5",
-	2200: "ParamDataCan",
-	2300: "ParamDataTire1",
-	2301: "ParamDataTire2",
-	2302: "ParamDataTire3",
-	2303: "ParamDataTire4",
-	2400: "ParamDataTempr1",
-	2401: "ParamDataTempr2",
-	2402: "ParamDataTempr3",
-
-	// Single parameters codes
-	// 2200: "ParamCanStatus",
-	2201: "ParamCanTempr",
-	2202: "ParamCanSpeed",
-	2203: "ParamCanOdometer",
-	2204: "ParamCanFuelTotal",
-	2205: "ParamCanMotoTotal",
-	2206: "ParamCanFuelLevel",
-	2207: "ParamCanAccel",
-	2208: "ParamCanTacho",
-	2209: "ParamCanBrake",
-	2250: "ParamDataPosNum"}
-
 const (
 	//binary protocol constants
 	protocolVersion    = 0
+	protocolVersionCRC = 1 // adds frame crc, string and bytes kinds
 	protocolTypeBinary = 0
 	protocolTypeJSON   = 1
 	baseSign           = 16
@@ -123,7 +55,10 @@ const (
 	binaryFloat32      = 0x24
 	binaryFloat64      = 0x28
 	binaryArray        = 0x40
+	binaryString       = 0x81 // uint16 length + utf8 bytes, since version 1
+	binaryBytes        = 0x82 // uint16 length + bytes, since version 1
 	paramEvent         = 2
+	paramZones         = 3 // json encoded zones as bytes value
 	//struct type
 	structInt16     = 0
 	structUint32    = 1
@@ -178,13 +113,32 @@ type ParamsUint32 struct {
 	V uint32
 }
 
+type ParamsInt32 struct {
+	K uint16
+	V int32
+}
+
+type ParamsString struct {
+	K uint16
+	V string
+}
+
+type ParamsBytes struct {
+	K uint16
+	V []byte
+}
+
 type BinaryPosition struct {
-	Time float64
-	F32  []ParamsFloat32
-	F64  []ParamsFloat64
-	I16  []ParamsInt16
-	UI32 []ParamsUint32
-	E    []uint16
+	Time  float64
+	F32   []ParamsFloat32
+	F64   []ParamsFloat64
+	I16   []ParamsInt16
+	I32   []ParamsInt32
+	UI32  []ParamsUint32
+	Str   []ParamsString
+	Bytes []ParamsBytes
+	E     []uint16
+	Zones []ZoneInfo
 }
 
 // ZoneInfo zone information
@@ -195,12 +149,15 @@ type ZoneInfo struct {
 	Type     string   `json:"tid"`
 	Additive *float64 `json:"additive,omitempty"`
 	Distance *float64 `json:"distance,omitempty"`
+	Buffer   *float64 `json:"buffer,omitempty"` // circle radius of point zone or buffer of line and polygon zone, meters
 }
 
 // FlatPosition compact position format
 type FlatPosition struct {
 	Time  float64            `json:"t"`
 	P     map[uint16]float64 `json:"p,omitempty"`
+	S     map[uint16]string  `json:"s,omitempty"`
+	B     map[uint16][]byte  `json:"b,omitempty"`
 	E     []uint16           `json:"e,omitempty"`
 	Zones []ZoneInfo         `json:"zones,omitempty"`
 }
@@ -212,13 +169,13 @@ type PrettyPosition struct {
 	Status  float64  `json:"st"` //[PARAMS.status, 'st'],
 	Power   float64  `json:"v"`  //[PARAMS.power, 'v'],
 	Battery float64  `json:"bv"` //[PARAMS.battery, 'bv'],
-	Gsm     int8     `json:"sl"` //[PARAMS.gsm, 'sl'],
-	Gps     int8     `json:"sc"` //[PARAMS.gps, 'sc'],
+	Gsm     int16    `json:"sl"` //[PARAMS.gsm, 'sl'],
+	Gps     int16    `json:"sc"` //[PARAMS.gps, 'sc'],
 	Lon     float64  `json:"x"`  //[PARAMS.lon, 'x'],
 	Lat     float64  `json:"y"`  //[PARAMS.lat, 'y'],
 	Alt     float64  `json:"z"`  //[PARAMS.alt, 'z'],
 	Speed   float64  `json:"s"`  //[PARAMS.speed, 's'],
-	Angle   int8     `json:"a"`  //[PARAMS.dir, 'a'],
+	Angle   int16    `json:"a"`  //[PARAMS.dir, 'a'],
 	Odo     float64  `json:"d"`  //[PARAMS.odo, 'd'],
 	Sensor  float64  `json:"sm"` //[PARAMS.sensor, 'sm'],
 	Relay   float64  `json:"rm"` //[PARAMS.relay, 'rm'],
@@ -232,6 +189,16 @@ type PrettyPosition struct {
 	Tire   map[uint16]float64 `json:"w"`  //[PARAMS.tire, 'w']
 	// other params
 	P map[uint16]float64 `json:"p"` //[PARAMS.p, 'p']
+
+	has uint16 // bits of single value fields set by ToPretty
+}
+
+// PrettyPositionExt pretty position with string, bytes and zones values
+type PrettyPositionExt struct {
+	PrettyPosition
+	Str   map[uint16]string `json:"str,omitempty"`
+	Bytes map[uint16][]byte `json:"bin,omitempty"`
+	Zones []ZoneInfo        `json:"zones,omitempty"`
 }
 
 type BinaryReader struct {
@@ -248,6 +215,25 @@ type BinaryReader struct {
 	pos            *BinaryPosition
 	flatPos        *FlatPosition
 	pass           bool
+	// Policy defines behaviour on corrupted frames
+	Policy DecodePolicy
+	// Registry enables rounding of values by registry precision,
+	// if nil only float values of legacy params are rounded as before registry
+	Registry *ParamRegistry
+	// Validate drops values out of registry range, DefaultRegistry range if Registry is nil
+	Validate     bool
+	summary      DecodeSummary
+	err          *DecodeError
+	frameStart   uint32
+	frameEnd     uint32
+	frameLen     uint32
+	frameVersion uint16
+	// Filter skips frames not matched by expression, time only part is checked before params decoding
+	Filter     *Filter
+	filterKeys map[uint16]bool // params needed by filter but not requested
+	compactPos *CompactPosition
+	filterPos  *FlatPosition // reused flat position for filter of compact positions
+	flatHint   int           // params count of previous flat position
 }
 
 type BinaryData struct {
@@ -263,33 +249,9 @@ type param struct {
 }
 
 // Params map with telemetry params
-var Params = map[string]param{
-	"paramTimeCan":        {8, 0, false},
-	"paramTimeReceive":    {9, 0, false},
-	"paramTimeFuel":       {10, 0, false},
-	"paramTimeFuel2":      {11, 0, false},
-	"paramStatus":         {1020, 0, false},
-	"paramBatteryV":       {1022, 0, false},
-	"paramAngle":          {1104, 0, false},
-	"paramSpeed":          {1105, 0, false},
-	"paramLat":            {1101, 0, true},
-	"paramLon":            {1102, 0, true},
-	"paramOdometer":       {1201, 0, true},
-	"paramMileageReserve": {1203, 0, false},
-	"paramCanStatus":      {2200, 0, false},
-	"paramCanTempr":       {2201, 0, false},
-	"paramCanSpeed":       {2202, 0, false},
-	"paramAdc0":           {2000, 0, false},
-	"paramAdc1":           {2001, 0, false},
-
-	"paramCalcOdo":    {3001, 0, false},
-	"paramDriftLevel": {3004, 0, false},
-	"paramSpeedAvg":   {3005, 0, false},
-	"paramFuel":       {3400, 0, true},
-	"paramFuel2":      {3401, 0, false},
-	"paramAvgFuel":    {3500, 0, true},
-	"paramAvgFuel2":   {3501, 0, false},
-}
+//
+// Deprecated: use DefaultRegistry
+var Params = DefaultRegistry.legacyParams()
 
 // GetParamCode prepare uit16 code from interface
 func GetParamCode(id interface{}) uint16 {
@@ -306,9 +268,8 @@ func GetParamCode(id interface{}) uint16 {
 		sid := id.(string)
 		if val, err := strconv.Atoi(sid); err == nil {
 			return uint16(val)
-		} else if p, ok := Params[sid]; ok {
-			return p.P
 		}
+		return DefaultRegistry.Code(sid)
 	}
 	return 0
 }
@@ -353,7 +314,7 @@ func (pos *FlatPosition) IfEvent(event uint16) bool {
 
 // ParamCode get param code by name
 func ParamCode(name string) uint16 {
-	return Params[name].P
+	return DefaultRegistry.Code(name)
 }
 
 // FuelParams array with fuel params
@@ -380,13 +341,11 @@ func FindZone(list []ZoneInfo, id string) *ZoneInfo {
 	return nil
 }
 
+// TranslatePos returns position params by registry titles
 func TranslatePos(p *FlatPosition) map[string]interface{} {
 	tPos := make(map[string]interface{})
 	for c, v := range p.P {
-		if mapParamsPrecision[c] > 0 {
-			v = math.Round(float64(v)*mapParamsPrecision[c]) / mapParamsPrecision[c]
-		}
-		tPos[telemetryParams[c]] = v
+		tPos[DefaultRegistry.Title(c)] = DefaultRegistry.legacyRound(c, v)
 	}
 	return tPos
 }
@@ -413,10 +372,47 @@ func ReadFloat64(buf []byte) float64 {
 
 func (pos *BinaryPosition) Init() {
 	pos.I16 = make([]ParamsInt16, 0)
+	pos.I32 = make([]ParamsInt32, 0)
 	pos.UI32 = make([]ParamsUint32, 0)
 	pos.F32 = make([]ParamsFloat32, 0)
 }
 
+// Flat converts struct position to flat position
+func (pos *BinaryPosition) Flat() *FlatPosition {
+	res := &FlatPosition{Time: pos.Time, P: make(map[uint16]float64), Zones: pos.Zones}
+	for _, p := range pos.I16 {
+		res.P[p.K] = float64(p.V)
+	}
+	for _, p := range pos.I32 {
+		res.P[p.K] = float64(p.V)
+	}
+	for _, p := range pos.UI32 {
+		res.P[p.K] = float64(p.V)
+	}
+	for _, p := range pos.F32 {
+		res.P[p.K] = float64(p.V)
+	}
+	for _, p := range pos.F64 {
+		res.P[p.K] = p.V
+	}
+	if len(pos.Str) > 0 {
+		res.S = make(map[uint16]string, len(pos.Str))
+		for _, p := range pos.Str {
+			res.S[p.K] = p.V
+		}
+	}
+	if len(pos.Bytes) > 0 {
+		res.B = make(map[uint16][]byte, len(pos.Bytes))
+		for _, p := range pos.Bytes {
+			res.B[p.K] = p.V
+		}
+	}
+	if len(pos.E) > 0 {
+		res.E = append([]uint16(nil), pos.E...)
+	}
+	return res
+}
+
 func (r *BinaryReader) CheckSign() bool {
 	if r.Buf[r.offset] != uint8(binaryID[0]) || (r.Buf)[r.offset+1] != uint8(binaryID[1]) {
 		return false
@@ -424,38 +420,43 @@ func (r *BinaryReader) CheckSign() bool {
 	return true
 }
 
+// CheckVersion checks protocol version of frame at current offset
 func (r *BinaryReader) CheckVersion() bool {
-	offset := 2
-	if protocolVersion != ReadUint16(r.Buf[offset:offset+2]) {
-		return false
-	}
-	return true
+	offset := r.offset + 2
+	return isSupportedVersion(ReadUint16(r.Buf[offset : offset+2]))
 }
 
+// ReadArray reads events array, returns legacy error code
 func (r *BinaryReader) ReadArray(kind uint8) int16 {
-	bufLen := uint32(len(r.Buf))
+	return errorCode(r.DecodeArray(kind))
+}
+
+// DecodeArray reads events array
+func (r *BinaryReader) DecodeArray(kind uint8) error {
 	nibble := uint32(kind & 0x0F)
-	if bufLen < r.offset+2 {
-		return errorBinaryLen
+	if err := r.need(2); err != nil {
+		return err
 	}
 	elCount := uint32(ReadUint16(r.Buf[r.offset : r.offset+2]))
 	r.offset += 2
-	if bufLen < r.offset+elCount*nibble {
-		return errorBinaryLen
+	if err := r.need(elCount * nibble); err != nil {
+		return err
 	}
 	if r.PositionFormat == "flat" {
-		r.flatPos.E = make([]uint16, 0)
+		r.flatPos.E = make([]uint16, 0, elCount)
+	} else if r.PositionFormat == "compact" {
+		r.compactPos.E = r.compactPos.E[:0]
 	} else {
-		r.pos.E = make([]uint16, 0)
+		r.pos.E = make([]uint16, 0, elCount)
 	}
 
 	for index := uint32(0); index < elCount; index++ {
-		err := r.ReadValue(binaryArray, uint16(index))
-		if err != 0 {
-			continue
+		err := r.DecodeValue(binaryArray, uint16(index))
+		if err != nil {
+			return err
 		}
 	}
-	return 0
+	return nil
 }
 
 func (r *BinaryReader) Reset() {
@@ -463,6 +464,23 @@ func (r *BinaryReader) Reset() {
 	r.Size = uint32(len(r.Buf))
 	r.lenEvents = len(r.Events)
 	r.lenParams = len(r.Params)
+	r.summary = DecodeSummary{}
+	r.err = nil
+	r.frameStart = 0
+	r.frameEnd = 0
+	r.frameLen = 0
+	r.frameVersion = 0
+	r.filterKeys = nil
+	if r.Filter != nil && r.lenParams > 0 {
+		for _, key := range r.Filter.Params() {
+			if !r.Params[key] {
+				if r.filterKeys == nil {
+					r.filterKeys = make(map[uint16]bool)
+				}
+				r.filterKeys[key] = true
+			}
+		}
+	}
 }
 
 func (r *BinaryReader) ReadInt8() int8 {
@@ -555,68 +573,6 @@ func uint32ToByte(f uint32) []byte {
 // 	return buf[:]
 // }
 
-func getNumberKind(value float64) int {
-	if value == float64(int64(value)) {
-		if value == 0 {
-			return binaryZero
-		}
-		if value < 0 {
-			if value >= -128 {
-				return binaryInt8
-			}
-			if value >= -32768 {
-				return binaryInt16
-			}
-			return binaryInt32
-		}
-		if value < 0xff {
-			return binaryUint8
-		}
-		if value < 0xffff {
-			return binaryUint16
-		}
-		if value < 0xffffffff {
-			return binaryUint32
-		}
-		return binaryFloat64
-	}
-	if value > 10000000 {
-		return binaryFloat64
-	}
-	return binaryFloat32
-}
-
-func writeNumber(value float64, bytes *[]byte) {
-
-	kind := getNumberKind(value)
-
-	var res []byte
-	switch kind {
-	case binaryInt8:
-		res = []byte{byte(int8(value))}
-	case binaryInt16:
-		res = int16ToByte(int16(value))
-	case binaryInt32:
-		res = int32ToByte(int32(value))
-	case binaryUint8:
-		res = []byte{byte(uint8(value))}
-	case binaryUint16:
-		res = uint16ToByte(uint16(value))
-	case binaryUint32:
-		res = uint32ToByte(uint32(value))
-	case binaryFloat32:
-		res = float32ToByte(float32(value))
-	case binaryFloat64:
-		res = float64ToByte(value)
-	}
-
-	*bytes = append(*bytes, byte(kind))
-	if len(res) > 0 {
-		*bytes = append(*bytes, res...)
-	}
-
-}
-
 func (r *BinaryReader) ReadLen() uint32 {
 	v := ReadUint32(r.Buf[r.offset : r.offset+4])
 	r.offset += 4
@@ -640,39 +596,86 @@ func (r *BinaryReader) ReadKind() uint8 {
 	return v
 }
 
-func (r *BinaryReader) Skip(kind uint8, key uint16) {
+// kindSize returns size of value by kind
+func kindSize(kind uint8) (uint32, bool) {
 	switch kind {
-	case binaryInt8:
-		r.offset++
-	case binaryUint8:
-		r.offset++
-	case binaryInt16:
-		r.offset += 2
-	case binaryUint16:
-		r.offset += 2
-	case binaryInt32:
-		r.offset += 4
-	case binaryUint32:
-		r.offset += 4
-	case binaryFloat32:
-		r.offset += 4
+	case binaryZero:
+		return 0, true
+	case binaryInt8, binaryUint8:
+		return 1, true
+	case binaryInt16, binaryUint16, binaryArray:
+		return 2, true
+	case binaryInt32, binaryUint32, binaryFloat32:
+		return 4, true
 	case binaryFloat64:
-		r.offset += 8
+		return 8, true
 	}
+	return 0, false
 }
 
+// valueSize returns size of value at current offset by kind
+func (r *BinaryReader) valueSize(kind uint8) (uint32, error) {
+	if kind == binaryString || kind == binaryBytes {
+		if r.frameVersion < protocolVersionCRC {
+			return 0, r.decodeError(ErrFrameKind, r.frameStart, 0, 0)
+		}
+		if err := r.need(2); err != nil {
+			return 0, err
+		}
+		return 2 + uint32(ReadUint16(r.Buf[r.offset:r.offset+2])), nil
+	}
+	size, ok := kindSize(kind)
+	if !ok {
+		return 0, r.decodeError(ErrFrameKind, r.frameStart, 0, 0)
+	}
+	return size, nil
+}
+
+// checkValue checks value kind and its size in current frame
+func (r *BinaryReader) checkValue(kind uint8, key uint16) error {
+	size, err := r.valueSize(kind)
+	if err == nil {
+		err = r.need(size)
+	}
+	if err != nil {
+		err.(*DecodeError).Key, err.(*DecodeError).Kind = key, kind
+		return err
+	}
+	return nil
+}
+
+func (r *BinaryReader) Skip(kind uint8, key uint16) {
+	size, _ := r.valueSize(kind)
+	r.offset += size
+}
+
+// ReadBytes reads uint16 length prefixed bytes
+func (r *BinaryReader) ReadBytes() []byte {
+	l := uint32(r.ReadUint16())
+	v := r.Buf[r.offset : r.offset+l]
+	r.offset += l
+	return v
+}
+
+// ReadValue reads param value, returns legacy error code
 func (reader *BinaryReader) ReadValue(kind uint8, key uint16) int16 {
+	return errorCode(reader.DecodeValue(kind, key))
+}
+
+// DecodeValue reads param value to position of reader format
+func (reader *BinaryReader) DecodeValue(kind uint8, key uint16) error {
 	if reader.PositionFormat == "flat" {
-		return reader.ReadFlatValue(kind, key)
+		return reader.DecodeFlatValue(kind, key)
 	}
-	bufLen := uint32(len(reader.Buf))
-	nibble := uint32(kind & 0x0F)
-	if bufLen < reader.offset+nibble {
-		return errorBinaryLen
+	if reader.PositionFormat == "compact" {
+		return reader.DecodeCompactValue(kind, key)
+	}
+	if err := reader.checkValue(kind, key); err != nil {
+		return err
 	}
-	if kind != binaryArray && reader.lenParams > 0 && !reader.Params[key] {
+	if kind != binaryArray && reader.lenParams > 0 && !reader.Params[key] && !reader.filterKeys[key] {
 		reader.Skip(kind, key)
-		return 0
+		return nil
 	}
 	switch kind {
 	case binaryArray:
@@ -692,27 +695,39 @@ func (reader *BinaryReader) ReadValue(kind uint8, key uint16) int16 {
 	case binaryUint16:
 		reader.pos.UI32 = append(reader.pos.UI32, ParamsUint32{key, uint32(reader.ReadUint16())})
 	case binaryInt32:
-		reader.pos.I16 = append(reader.pos.I16, ParamsInt16{key, int16(reader.ReadInt32())})
+		reader.pos.I32 = append(reader.pos.I32, ParamsInt32{key, reader.ReadInt32()})
 	case binaryUint32:
 		reader.pos.UI32 = append(reader.pos.UI32, ParamsUint32{key, reader.ReadUint32()})
 	case binaryFloat32:
 		reader.pos.F32 = append(reader.pos.F32, ParamsFloat32{key, reader.ReadFloat32()})
 	case binaryFloat64:
 		reader.pos.F64 = append(reader.pos.F64, ParamsFloat64{key, reader.ReadFloat64()})
+	case binaryString:
+		reader.pos.Str = append(reader.pos.Str, ParamsString{key, string(reader.ReadBytes())})
+	case binaryBytes:
+		val := append([]byte(nil), reader.ReadBytes()...)
+		if key == paramZones {
+			return reader.readZones(&reader.pos.Zones, val, kind)
+		}
+		reader.pos.Bytes = append(reader.pos.Bytes, ParamsBytes{key, val})
 	}
 
-	return 0
+	return nil
 }
 
+// ReadFlatValue reads param value to flat position, returns legacy error code
 func (reader *BinaryReader) ReadFlatValue(kind uint8, key uint16) int16 {
-	bufLen := uint32(len(reader.Buf))
-	nibble := uint32(kind & 0x0F)
-	if bufLen < reader.offset+nibble {
-		return errorBinaryLen
+	return errorCode(reader.DecodeFlatValue(kind, key))
+}
+
+// DecodeFlatValue reads param value to flat position
+func (reader *BinaryReader) DecodeFlatValue(kind uint8, key uint16) error {
+	if err := reader.checkValue(kind, key); err != nil {
+		return err
 	}
-	if kind != binaryArray && reader.lenParams > 0 && !reader.Params[key] {
+	if kind != binaryArray && reader.lenParams > 0 && !reader.Params[key] && !reader.filterKeys[key] {
 		reader.Skip(kind, key)
-		return 0
+		return nil
 	}
 	switch kind {
 	case binaryArray:
@@ -722,208 +737,324 @@ func (reader *BinaryReader) ReadFlatValue(kind uint8, key uint16) int16 {
 			reader.pass = true
 		}
 	case binaryZero:
-		reader.flatPos.P[key] = float64(0)
+		reader.setFlatValue(key, 0)
 	case binaryInt8:
-		reader.flatPos.P[key] = float64(reader.ReadInt8())
+		reader.setFlatValue(key, float64(reader.ReadInt8()))
 	case binaryUint8:
-		reader.flatPos.P[key] = float64(reader.ReadUint8())
+		reader.setFlatValue(key, float64(reader.ReadUint8()))
 	case binaryInt16:
-		reader.flatPos.P[key] = float64(reader.ReadInt16())
+		reader.setFlatValue(key, float64(reader.ReadInt16()))
 	case binaryUint16:
-		reader.flatPos.P[key] = float64(reader.ReadUint16())
+		reader.setFlatValue(key, float64(reader.ReadUint16()))
 	case binaryInt32:
-		reader.flatPos.P[key] = float64(reader.ReadInt32())
+		reader.setFlatValue(key, float64(reader.ReadInt32()))
 	case binaryUint32:
-		reader.flatPos.P[key] = float64(reader.ReadUint32())
+		reader.setFlatValue(key, float64(reader.ReadUint32()))
 	case binaryFloat64:
-		if mapParamsPrecision[key] > 0 {
-			reader.flatPos.P[key] = math.Round(float64(reader.ReadFloat64())*mapParamsPrecision[key]) / mapParamsPrecision[key]
-		} else {
-			reader.flatPos.P[key] = float64(reader.ReadFloat64())
-		}
+		reader.setFlatValue(key, reader.readFloatValue(key, binaryFloat64))
 	case binaryFloat32:
-		if mapParamsPrecision[key] > 0 {
-			p := reader.ReadFloat32()
-			// log.Debug("old:", p)
-			reader.flatPos.P[key] = math.Round(float64(p)*mapParamsPrecision[key]) / mapParamsPrecision[key]
-			// log.Debug("new", reader.flatPos.P[key])
-		} else {
-			reader.flatPos.P[key] = float64(reader.ReadFloat32())
+		reader.setFlatValue(key, reader.readFloatValue(key, binaryFloat32))
+	case binaryString:
+		if reader.flatPos.S == nil {
+			reader.flatPos.S = make(map[uint16]string)
+		}
+		reader.flatPos.S[key] = string(reader.ReadBytes())
+	case binaryBytes:
+		val := append([]byte(nil), reader.ReadBytes()...)
+		if key == paramZones {
+			return reader.readZones(&reader.flatPos.Zones, val, kind)
 		}
+		if reader.flatPos.B == nil {
+			reader.flatPos.B = make(map[uint16][]byte)
+		}
+		reader.flatPos.B[key] = val
 	}
 
-	return 0
+	return nil
 }
 
-func (reader *BinaryReader) ReadBinaryPosition() (uint16, string, []byte, float64) {
-	if reader.Size < reader.offset+8 {
-		return errorBinarySize, "", nil, 0.00
+// setFlatValue rounds value by reader registry and sets it to flat position
+func (reader *BinaryReader) setFlatValue(key uint16, raw float64) {
+	if v, ok := reader.roundValue(key, raw); ok {
+		reader.flatPos.P[key] = v
 	}
-	startOffset := reader.offset
+}
+
+// readFloatValue reads float value, rounded by legacy params of DefaultRegistry if reader has no registry
+func (reader *BinaryReader) readFloatValue(key uint16, kind uint8) float64 {
+	var v float64
+	if kind == binaryFloat32 {
+		v = float64(reader.ReadFloat32())
+	} else {
+		v = reader.ReadFloat64()
+	}
+	if reader.Registry == nil {
+		v = DefaultRegistry.legacyRound(key, v)
+	}
+	return v
+}
+
+// roundValue rounds stored value by reader registry and checks its range,
+// registry scale is not applied as stored values are already scaled
+func (reader *BinaryReader) roundValue(key uint16, v float64) (float64, bool) {
+	registry := reader.Registry
+	if registry != nil {
+		v = registry.Round(key, v)
+	}
+	if !reader.Validate {
+		return v, true
+	}
+	if registry == nil {
+		registry = DefaultRegistry
+	}
+	info, ok := registry.Param(key)
+	return v, !ok || info.Valid(v)
+}
+
+// readHeader checks frame sign and length, returns declared frame length
+func (reader *BinaryReader) readHeader() (uint32, error) {
+	reader.frameStart = reader.offset
+	reader.frameEnd = 0
+	reader.frameLen = 0
+	//check size
+	if reader.Size < reader.offset+16 {
+		return 0, reader.decodeError(ErrFrameSize, reader.frameStart, 16, reader.Size-reader.offset)
+	}
+	//check sign
+	if !reader.CheckSign() {
+		return 0, reader.decodeError(ErrFrameSign, reader.frameStart, 0, 0)
+	}
+	//check version
+	if !reader.CheckVersion() {
+		return 0, reader.decodeError(ErrFrameVersion, reader.frameStart, 0, 0)
+	}
+	reader.frameVersion = ReadUint16(reader.Buf[reader.offset+2 : reader.offset+4])
+	//pass 2 sign and 2 version bytes
 	reader.offset += 4
 	len := reader.ReadLen()
-	if reader.Size < len+reader.offset {
-		return 0, "", nil, 0
+	minLen := uint32(8)
+	if reader.frameVersion >= protocolVersionCRC {
+		minLen += 4
+	}
+	// compared by remaining size, len+offset overflows on huge declared length
+	if len < minLen || len > reader.Size-reader.offset {
+		return 0, reader.decodeError(ErrFrameLength, reader.frameStart, len, reader.Size-reader.offset)
+	}
+	reader.frameLen = len
+	reader.frameEnd = reader.offset + len
+	if reader.frameVersion >= protocolVersionCRC {
+		reader.frameEnd -= 4
+		crc := ReadUint32(reader.Buf[reader.frameEnd : reader.frameEnd+4])
+		if crc != crc32.ChecksumIEEE(reader.Buf[reader.frameStart:reader.frameEnd]) {
+			return 0, reader.decodeError(ErrFrameCRC, reader.frameStart, 0, 0)
+		}
+	}
+	return len, nil
+}
+
+func (reader *BinaryReader) ReadBinaryPosition() (uint16, string, []byte, float64) {
+	startOffset := reader.offset
+	_, err := reader.readHeader()
+	if err != nil {
+		reader.err = err.(*DecodeError)
+		return uint16(reader.err.Code()), "", nil, 0
 	}
 	posTime := reader.ReadTime()
 	t := time.Unix(int64(posTime)/1000, 0)
 	day := t.Format("20060102")
-	reader.offset += len
+	reader.offset = reader.frameStart + 8 + reader.frameLen
+	reader.frameEnd = 0
 	result := reader.Buf[startOffset:reader.offset]
 	return 0, day, result, posTime
 }
 
-func (reader *BinaryReader) ReadStructPositions() (int16, []BinaryPosition) {
-	reader.PositionFormat = "struct"
-	reader.Reset()
-	posArr := make([]BinaryPosition, 0)
+// readPositions reads all positions from buffer and calls cb on each accepted position
+func (reader *BinaryReader) readPositions(cb func()) int16 {
 	for reader.Size > reader.offset {
-		res := reader.readPosition()
-		if res < 0 {
-			reader.offset++
-			continue
-		}
-		if res == errorBinarySize || res == errorBinaryLen || res == errorBinaryRead || res == errorProtoTime {
-			return res, posArr
+		ok, err := reader.readPosition()
+		if err != nil {
+			derr := err.(*DecodeError)
+			if reader.recoverFrame(derr) {
+				continue
+			}
+			reader.err = derr
+			return derr.Code()
 		}
-		if reader.flatPos != nil && (reader.lenEvents == 0 || reader.pass == true) {
-			posArr = append(posArr, *reader.pos)
+		if !ok || (reader.lenEvents > 0 && !reader.pass) {
+			reader.summary.Skipped++
+			continue
 		}
+		reader.summary.Good++
+		cb()
 	}
-	return 0, posArr
+	return 0
+}
+
+func (reader *BinaryReader) ReadStructPositions() (int16, []BinaryPosition) {
+	reader.PositionFormat = "struct"
+	reader.Reset()
+	posArr := make([]BinaryPosition, 0)
+	res := reader.readPositions(func() {
+		posArr = append(posArr, *reader.pos)
+	})
+	return res, posArr
 }
 
 func (reader *BinaryReader) ReadFlatPositions() (int16, []FlatPosition) {
 	reader.PositionFormat = "flat"
 	reader.Reset()
 	posArr := make([]FlatPosition, 0)
-	for reader.Size > reader.offset {
-		res := reader.readPosition()
-		if res < 0 {
-			reader.offset++
-			continue
-		}
-		if res == errorBinarySize || res == errorBinaryLen || res == errorBinaryRead || res == errorProtoTime {
-			return res, posArr
-		}
-		if reader.flatPos != nil && (reader.lenEvents == 0 || reader.pass == true) {
-			posArr = append(posArr, *reader.flatPos)
-		}
-	}
-	return 0, posArr
+	res := reader.readPositions(func() {
+		posArr = append(posArr, *reader.flatPos)
+	})
+	return res, posArr
+}
+
+// ReadFlatPositionsFunc reads positions one by one without collecting them
+func (reader *BinaryReader) ReadFlatPositionsFunc(cb func(pos *FlatPosition)) int16 {
+	reader.PositionFormat = "flat"
+	reader.Reset()
+	return reader.readPositions(func() {
+		cb(reader.flatPos)
+	})
 }
 
+// FlatPositionToBinary writes position params and events to base protocol frame
 func FlatPositionToBinary(pos *FlatPosition) (res []byte) {
+	enc := Encoder{Version: protocolVersion}
+	res, _ = enc.AppendFlat(nil, &FlatPosition{Time: pos.Time, P: pos.P, E: pos.E})
+	return res
+}
 
-	// position structure
-	// 2 byte sign + 2 byte version + 4 bytes length + 8 bytes time + params and events
-	sign := []byte{98, 116, 0, 0}
-	res = append(res, sign...)
-	var data []byte
-	for p := range pos.P {
-		data = append(data, uint16ToByte(uint16(p))...)
-		writeNumber(pos.P[p], &data)
-	}
-	if len(pos.E) > 0 {
-		data = append(data, uint16ToByte(uint16(paramEvent))...)
-		data = append(data, byte(binaryArray|binaryUint16))
-		data = append(data, uint16ToByte(uint16(len(pos.E)))...)
-		for e := range pos.E {
-			data = append(data, uint16ToByte(uint16(pos.E[e]))...)
-		}
+// readZones decodes json zones value
+func (reader *BinaryReader) readZones(zones *[]ZoneInfo, data []byte, kind uint8) error {
+	if err := json.Unmarshal(data, zones); err != nil {
+		derr := reader.decodeError(ErrFrameKind, reader.frameStart, 0, 0)
+		derr.Key, derr.Kind = paramZones, kind
+		return derr
 	}
-
-	res = append(res, uint32ToByte(uint32(len(data)+8))...)
-	res = append(res, float64ToByte(pos.Time)...)
-	res = append(res, data...)
-
-	return res
+	return nil
 }
 
-func (reader *BinaryReader) readPosition() int16 {
+// readPosition reads one frame, returns false if frame passed by time filter
+func (reader *BinaryReader) readPosition() (bool, error) {
 
 	// position structure
 	// 2 byte sign + 2 byte version + 4 bytes length + 8 bytes time + params and events
 	reader.pass = false
-	//check size
-	if reader.Size < reader.offset+8 {
-		return errorBinarySize
-	}
-	//check sign and pass invalid data
-	for !reader.CheckSign() {
-		log.Warn("check sign err:", reader.Buf[reader.offset:reader.offset+1])
-		return errorBinarySize
-	}
-	//recheck size
-	if reader.Size < reader.offset+8 {
-		return errorBinarySize
-	}
-
-	//pass 2 sign and 2 version bytes
-	reader.offset += 4
-	len := reader.ReadLen()
-	if reader.Size < len+reader.offset {
-		return 1
+	_, err := reader.readHeader()
+	if err != nil {
+		return false, err
 	}
+	frameEnd := reader.frameEnd
+	next := reader.frameStart + 8 + reader.frameLen
+	defer func() {
+		reader.frameEnd = 0
+	}()
 	timePos := reader.ReadTime()
+	if math.IsNaN(timePos) || math.IsInf(timePos, 0) {
+		return false, reader.decodeError(ErrFrameTime, reader.frameStart, 0, 0)
+	}
 	beginUnix := reader.BeginTime.Unix() * 1000
 	endUnix := reader.EndTime.Unix() * 1000
-	if (reader.BeginTime.IsZero() && reader.EndTime.IsZero()) || (int64(timePos) >= beginUnix && int64(timePos) <= endUnix) {
-		if reader.PositionFormat == "struct" {
-			reader.newPosition(timePos)
+	if !(reader.BeginTime.IsZero() && reader.EndTime.IsZero()) && (int64(timePos) < beginUnix || int64(timePos) > endUnix) {
+		reader.offset = next
+		return false, nil
+	}
+	if reader.Filter != nil && !reader.Filter.MatchTime(timePos) {
+		reader.offset = next
+		return false, nil
+	}
+	switch reader.PositionFormat {
+	case "struct":
+		reader.newPosition(timePos)
+	case "compact":
+		reader.compactPos.reset(timePos)
+	default:
+		reader.newFlatPosition(timePos)
+	}
+	reader.offset += 8
+	for frameEnd >= reader.offset+3 {
+		key := reader.ReadKey()
+		kind := reader.ReadKind()
+		if (kind & binaryArray) != 0 {
+			err = reader.DecodeArray(binaryUint16)
 		} else {
-			reader.newFlatPosition(timePos)
+			err = reader.DecodeValue(kind, key)
 		}
-		reader.offset += 8
-		len -= 8
-		var res int16
-		reader.pos = new(BinaryPosition)
-		reader.pos.Init()
-		for reader.Size >= len && len >= 3 {
-			startOffset := reader.offset
-			key := reader.ReadKey()
-			kind := reader.ReadKind()
-			if (kind & binaryArray) != 0 {
-				res = reader.ReadArray(binaryUint16)
-			} else {
-				res = reader.ReadValue(kind, key)
-			}
-			if res < 0 {
-				return res
-			}
-			len -= reader.offset - startOffset
+		if err != nil {
+			derr := err.(*DecodeError)
+			derr.Key, derr.Kind = key, kind
+			return false, derr
 		}
-	} else {
-		reader.offset += len - 1
-		return -1
 	}
+	reader.offset = next
+	if reader.flatPos != nil && reader.PositionFormat == "flat" {
+		reader.flatHint = len(reader.flatPos.P)
+	}
+	if reader.Filter != nil {
+		return reader.applyFilter(), nil
+	}
+	return true, nil
+}
 
-	return 0
+// applyFilter checks decoded position by filter and removes params read only for filter
+func (reader *BinaryReader) applyFilter() bool {
+	if reader.PositionFormat == "compact" {
+		return reader.applyCompactFilter()
+	}
+	if reader.PositionFormat == "struct" {
+		if !reader.Filter.Match(reader.pos.Flat()) {
+			return false
+		}
+		if len(reader.filterKeys) > 0 {
+			reader.pos.removeKeys(reader.filterKeys)
+		}
+		return true
+	}
+	if !reader.Filter.Match(reader.flatPos) {
+		return false
+	}
+	for key := range reader.filterKeys {
+		delete(reader.flatPos.P, key)
+		if key == paramZones {
+			reader.flatPos.Zones = nil
+		}
+	}
+	return true
 }
 
+// ReadBinaryPositions splits buffer to frames blocks by days
 func (reader *BinaryReader) ReadBinaryPositions() (err uint16, result []BinaryData) {
 	var curDay string
+	var curTime float64
 	var posData []byte
-	var currPos BinaryData
 	reader.Reset()
 	for reader.Size > reader.offset {
-		err, day, newData, posTime := reader.ReadBinaryPosition()
-		if err != 0 {
-			log.Warn("error code:", err)
-			continue
+		code, day, newData, posTime := reader.ReadBinaryPosition()
+		if code != 0 {
+			log.Warn("read binary positions: ", reader.err)
+			if reader.recoverFrame(reader.err) {
+				continue
+			}
+			err = code
+			break
 		}
+		reader.summary.Good++
 		if curDay != day && curDay != "" {
-			currPos = BinaryData{curDay, posTime, posData}
-			result = append(result, currPos)
-		} else if reader.Size <= reader.offset {
-			posData = append(posData, newData...)
-			currPos = BinaryData{day, posTime, posData}
-			result = append(result, currPos)
-			break
+			result = append(result, BinaryData{curDay, curTime, posData})
+			posData = nil
+		}
+		if curDay != day {
+			curDay = day
+			curTime = posTime
 		}
 		posData = append(posData, newData...)
 	}
-	return 0, result
+	if len(posData) > 0 {
+		result = append(result, BinaryData{curDay, curTime, posData})
+	}
+	return err, result
 }
 
 func (reader *BinaryReader) newPosition(time float64) *BinaryPosition {
@@ -935,7 +1066,7 @@ func (reader *BinaryReader) newPosition(time float64) *BinaryPosition {
 
 func (reader *BinaryReader) newFlatPosition(time float64) *FlatPosition {
 	reader.flatPos = new(FlatPosition)
-	reader.flatPos.P = make(map[uint16]float64)
+	reader.flatPos.P = make(map[uint16]float64, reader.flatHint)
 	reader.flatPos.Time = time
 	return reader.flatPos
 }
@@ -1001,6 +1132,18 @@ func (pos *FlatPosition) CopyTo(newPos *FlatPosition, extinfo bool) *FlatPositio
 	for key, val := range pos.P {
 		newPos.P[key] = val
 	}
+	if pos.S != nil {
+		newPos.S = make(map[uint16]string, len(pos.S))
+		for key, val := range pos.S {
+			newPos.S[key] = val
+		}
+	}
+	if pos.B != nil {
+		newPos.B = make(map[uint16][]byte, len(pos.B))
+		for key, val := range pos.B {
+			newPos.B[key] = append([]byte(nil), val...)
+		}
+	}
 	newPos.E = make([]uint16, len(pos.E))
 	copy(newPos.E, pos.E)
 	if extinfo {
@@ -1022,6 +1165,7 @@ type TmtField struct {
 	Field string
 	Code  uint16
 	Value float64
+	Zone  string // zone id of "z" field, zone ids may be not numeric
 }
 
 // TmtFilter is a base struct for parsing filters
@@ -1030,6 +1174,28 @@ type TmtFilter struct {
 	Pos        []TmtField
 }
 
+// parseTmtField parses field.code and value of filter
+func parseTmtField(fieldStr, valueStr string) (TmtField, bool) {
+	fieldCode := strings.Split(fieldStr, ".")
+	if len(fieldCode) < 2 {
+		return TmtField{}, false
+	}
+	code, err := strconv.Atoi(fieldCode[1])
+	if err != nil {
+		return TmtField{}, false
+	}
+	res := TmtField{Field: fieldCode[0], Code: uint16(code)}
+	if res.Field == "z" {
+		res.Zone = valueStr
+	}
+	v, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil && res.Zone == "" {
+		return TmtField{}, false
+	}
+	res.Value = v
+	return res, true
+}
+
 // ParseTelemetryParams parses filtered params from URL
 func ParseTelemetryParams(filtered string) (res []TmtFilter) {
 	filters := strings.Split(filtered, "$")
@@ -1047,52 +1213,10 @@ func ParseTelemetryParams(filtered string) (res []TmtFilter) {
 		if len(f) < 2 {
 			continue
 		}
-		valueStr := f[1]
-		numFields := strings.Split(f[0], ",")
-		lenMultiFields := len(numFields)
-		if lenMultiFields > 1 {
-			for i := 0; i < lenMultiFields; i++ {
-				multiField := numFields[i]
-				fieldCode := strings.Split(multiField, ".")
-				if len(fieldCode) < 2 {
-					continue
-				}
-				field := fieldCode[0]
-				codeStr := fieldCode[1]
-				code, err := strconv.Atoi(codeStr)
-				if err != nil {
-					continue
-				}
-				v, err := strconv.ParseFloat(valueStr, 64)
-				if err != nil {
-					continue
-				}
-				filterArray = append(filterArray, TmtField{
-					Field: field,
-					Code:  uint16(code),
-					Value: v,
-				})
-			}
-		} else if len(numFields) > 0 {
-			fieldCode := strings.Split(numFields[0], ".")
-			if len(fieldCode) < 2 {
-				continue
-			}
-			field := fieldCode[0]
-			codeStr := fieldCode[1]
-			code, err := strconv.Atoi(codeStr)
-			if err != nil {
-				continue
-			}
-			v, err := strconv.ParseFloat(valueStr, 64)
-			if err != nil {
-				continue
+		for _, fieldStr := range strings.Split(f[0], ",") {
+			if field, ok := parseTmtField(fieldStr, f[1]); ok {
+				filterArray = append(filterArray, field)
 			}
-			filterArray = append(filterArray, TmtField{
-				Field: field,
-				Code:  uint16(code),
-				Value: v,
-			})
 		}
 		res = append(res, TmtFilter{
 			FilterType: filterType,
@@ -1102,45 +1226,65 @@ func ParseTelemetryParams(filtered string) (res []TmtFilter) {
 	return res
 }
 
-// CheckFilter checks object position by provided filters
+// InZone checks position is in zone with id
+func (pos *FlatPosition) InZone(id string) bool {
+	for i := range pos.Zones {
+		if pos.Zones[i].ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckFilter checks object position by provided filters,
+// all filters must match, fields of one filter are alternatives
 func (pos *FlatPosition) CheckFilter(filters []TmtFilter) bool {
 	numFilters := len(filters)
 	isChecked := false
 	for i := 0; i < numFilters; i++ {
 		filter := filters[i]
-		numFilterParams := len(filter.Pos)
-		if numFilterParams > 1 {
-			for j := 0; j < numFilterParams; j++ {
-				filteredParam := filter.Pos[j]
-				isChecked = pos.CheckCondition(filter.FilterType, filteredParam.Field, filteredParam.Code, filteredParam.Value)
-				if isChecked {
+		isChecked = false
+		for _, filteredParam := range filter.Pos {
+			if filteredParam.Zone != "" && (filter.FilterType == "eq" || filter.FilterType == "noteq") {
+				if pos.InZone(filteredParam.Zone) == (filter.FilterType == "eq") {
+					isChecked = true
 					break
 				}
+				continue
 			}
-		} else if numFilterParams > 0 {
-			filteredParam := filter.Pos[0]
-			isChecked = pos.CheckCondition(filter.FilterType, filteredParam.Field, filteredParam.Code, filteredParam.Value)
+			if pos.CheckCondition(filter.FilterType, filteredParam.Field, filteredParam.Code, filteredParam.Value) {
+				isChecked = true
+				break
+			}
+		}
+		if !isChecked {
+			return false
 		}
 	}
 	return isChecked
 }
 
-// CheckCondition checks field of position by code , filterType and value
+// CheckCondition checks field of position by code , filterType and value.
+// "z" field with "eq" and "noteq" checks membership in zone with id equal to value,
+// only numeric zone ids can be checked by value, CheckFilter checks any zone ids.
+// Other conditions of "z" field compare count of position zones.
+// Missing param matches only "lten" and "gten" conditions, "n" means "or not set"
 func (pos *FlatPosition) CheckCondition(filterType, field string, code uint16, v float64) bool {
 	var comparedValue float64
-	var ok bool
+	ok := true
 	switch field {
 	case "p":
 		comparedValue, ok = pos.P[code]
-		if !ok {
-			return false
-		}
-		break
 	case "t":
 		comparedValue = pos.Time
-		break
 	case "z":
-		break
+		if filterType == "eq" || filterType == "noteq" {
+			return pos.InZone(strconv.FormatFloat(v, 'f', -1, 64)) == (filterType == "eq")
+		}
+		comparedValue = float64(len(pos.Zones))
+	}
+	if !ok {
+		return filterType == "lten" || filterType == "gten"
 	}
 
 	switch filterType {
@@ -1152,14 +1296,10 @@ func (pos *FlatPosition) CheckCondition(filterType, field string, code uint16, v
 		return int64(comparedValue)&int64(v) > 0
 	case "notMask":
 		return int64(comparedValue)&int64(v) == 0
-	case "lte":
+	case "lte", "lten":
 		return comparedValue <= v
-	case "lten":
-		return comparedValue <= v || !ok
-	case "gte":
+	case "gte", "gten":
 		return comparedValue >= v
-	case "gten":
-		return comparedValue >= v || ok
 	case "lt":
 		return comparedValue < v
 	case "gt":
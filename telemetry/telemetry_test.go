@@ -0,0 +1,67 @@
+package telemetry
+
+import "testing"
+
+func TestCheckConditionZones(t *testing.T) {
+	pos := &FlatPosition{Time: 1, P: map[uint16]float64{ParamSpeed: 50}, Zones: []ZoneInfo{{ID: "15"}, {ID: "20"}}}
+	cases := []struct {
+		filter string
+		match  bool
+	}{
+		{"eq->z.0~15", true},
+		{"eq->z.0~16", false},
+		{"noteq->z.0~16", true},
+		{"noteq->z.0~20", false},
+		{"eq->z.0~16$gt->z.0~0", false},
+		{"eq->z.0~15$gt->z.0~0", true},
+		{"gt->z.0~1", true},
+		{"gt->z.0~2", false},
+	}
+	for _, tc := range cases {
+		if res := pos.CheckFilter(ParseTelemetryParams(tc.filter)); res != tc.match {
+			t.Errorf("filter %s: %v, expected %v", tc.filter, res, tc.match)
+		}
+	}
+	if (&FlatPosition{}).CheckCondition("eq", "z", 0, 15) {
+		t.Error("position without zones is in zone")
+	}
+	pos.Zones = []ZoneInfo{{ID: "5f1a2b"}, {ID: "depot-1"}}
+	for filter, match := range map[string]bool{
+		"eq->z.0~5f1a2b":       true,
+		"eq->z.0~depot-2":      false,
+		"noteq->z.0~depot-1":   false,
+		"noteq->z.0~depot-2":   true,
+		"eq->z.0,p.24~depot-1": true,
+		"eq->p.24~depot-1":     false,
+	} {
+		if res := pos.CheckFilter(ParseTelemetryParams(filter)); res != match {
+			t.Errorf("filter %s: %v, expected %v", filter, res, match)
+		}
+	}
+}
+
+func TestCheckConditionMissingParam(t *testing.T) {
+	pos := &FlatPosition{Time: 1, P: map[uint16]float64{ParamSpeed: 50}}
+	cases := []struct {
+		filterType string
+		code       uint16
+		value      float64
+		match      bool
+	}{
+		{"lte", ParamSpeed, 40, false},
+		{"lten", ParamSpeed, 40, false},
+		{"gte", ParamSpeed, 50, true},
+		{"gten", ParamSpeed, 50, true},
+		{"gten", ParamSpeed, 100, false},
+		{"lte", 9999, 50, false},
+		{"gte", 9999, 50, false},
+		{"eq", 9999, 50, false},
+		{"lten", 9999, 50, true},
+		{"gten", 9999, 50, true},
+	}
+	for _, tc := range cases {
+		if res := pos.CheckCondition(tc.filterType, "p", tc.code, tc.value); res != tc.match {
+			t.Errorf("%s p.%d~%v: %v, expected %v", tc.filterType, tc.code, tc.value, res, tc.match)
+		}
+	}
+}
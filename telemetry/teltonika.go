@@ -0,0 +1,199 @@
+package telemetry
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+const (
+	teltonikaCodec8    = 0x08
+	teltonikaCodec8E   = 0x8E
+	teltonikaMaxPacket = 1 << 20
+)
+
+// TeltonikaMapping default mapping of Teltonika values, IO elements are named "io:<id>",
+// record event IO ids are named "event:<id>" and mapped to position events
+var TeltonikaMapping = ProtocolMapping{
+	"speed":  {Code: ParamSpeed},
+	"course": {Code: ParamAngle},
+	"alt":    {Code: ParamAlt},
+	"sats":   {Code: 1024},
+	"io:1":   {Code: 2010},                        // digital input 1
+	"io:2":   {Code: 2011},                        // digital input 2
+	"io:3":   {Code: 2012},                        // digital input 3
+	"io:9":   {Code: 2000, Scale: 0.001},          // analog input 1, mV
+	"io:6":   {Code: 2001, Scale: 0.001},          // analog input 2, mV
+	"io:16":  {Code: ParamOdometer, Scale: 0.001}, // total odometer, m
+	"io:21":  {Code: 1023},                        // gsm signal
+	"io:66":  {Code: 1021, Scale: 0.001},          // external voltage, mV
+	"io:67":  {Code: 1022, Scale: 0.001},          // battery voltage, mV
+	"io:72":  {Code: 2400, Scale: 0.1},            // dallas temperature 1
+	"io:73":  {Code: 2401, Scale: 0.1},            // dallas temperature 2
+	"io:74":  {Code: 2402, Scale: 0.1},            // dallas temperature 3
+	"io:179": {Code: 1902},                        // digital output 1
+	"io:239": {Code: 1901},                        // ignition
+}
+
+// TeltonikaDecoder decodes Teltonika Codec 8 and Codec 8 Extended TCP stream
+type TeltonikaDecoder struct {
+	Mapping  ProtocolMapping
+	DeviceID string
+}
+
+// NewTeltonikaDecoder create Teltonika decoder, TeltonikaMapping is used if mapping is nil
+func NewTeltonikaDecoder(mapping ProtocolMapping) *TeltonikaDecoder {
+	if mapping == nil {
+		mapping = TeltonikaMapping
+	}
+	return &TeltonikaDecoder{Mapping: mapping}
+}
+
+// Decode decodes imei handshake and complete AVL packets
+func (d *TeltonikaDecoder) Decode(data []byte) (*ProtocolResult, error) {
+	res := &ProtocolResult{}
+	defer func() {
+		res.DeviceID = d.DeviceID
+	}()
+	for res.Consumed < len(data) {
+		buf := data[res.Consumed:]
+		if d.DeviceID == "" {
+			// 2 bytes length + imei
+			if len(buf) < 2 {
+				return res, nil
+			}
+			l := int(binary.BigEndian.Uint16(buf))
+			if l == 0 || l > 32 {
+				return res, ErrProtocolData
+			}
+			if len(buf) < 2+l {
+				return res, nil
+			}
+			d.DeviceID = string(buf[2 : 2+l])
+			res.Consumed += 2 + l
+			res.Ack = append(res.Ack, 0x01)
+			continue
+		}
+		// 4 zero bytes + 4 bytes data length + data + 4 bytes crc
+		if len(buf) < 8 {
+			return res, nil
+		}
+		if binary.BigEndian.Uint32(buf) != 0 {
+			return res, ErrProtocolData
+		}
+		l := int(binary.BigEndian.Uint32(buf[4:]))
+		if l > teltonikaMaxPacket {
+			return res, ErrProtocolData
+		}
+		if len(buf) < 12+l {
+			return res, nil
+		}
+		avl := buf[8 : 8+l]
+		if uint32(crc16ARC(avl)) != binary.BigEndian.Uint32(buf[8+l:]) {
+			return res, ErrProtocolCRC
+		}
+		positions, err := d.decodeAVL(avl)
+		if err != nil {
+			return res, err
+		}
+		res.Positions = append(res.Positions, positions...)
+		res.Ack = append(res.Ack, uint32ToByte(uint32(len(positions)))...)
+		res.Consumed += 12 + l
+	}
+	return res, nil
+}
+
+// teltonikaBuf big endian reader with bounds check
+type teltonikaBuf struct {
+	data []byte
+	off  int
+	err  bool
+}
+
+func (b *teltonikaBuf) next(n int) []byte {
+	if b.err || b.off+n > len(b.data) {
+		b.err = true
+		return make([]byte, n)
+	}
+	v := b.data[b.off : b.off+n]
+	b.off += n
+	return v
+}
+
+func (b *teltonikaBuf) uint(n int) uint64 {
+	var v uint64
+	for _, c := range b.next(n) {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// decodeAVL decodes codec id, records and records count
+func (d *TeltonikaDecoder) decodeAVL(avl []byte) ([]FlatPosition, error) {
+	b := &teltonikaBuf{data: avl}
+	codec := b.uint(1)
+	if codec != teltonikaCodec8 && codec != teltonikaCodec8E {
+		return nil, ErrProtocolData
+	}
+	// ids and counts are 1 byte in codec 8 and 2 bytes in codec 8E
+	size := 1
+	if codec == teltonikaCodec8E {
+		size = 2
+	}
+	count := int(b.uint(1))
+	positions := make([]FlatPosition, 0, count)
+	for i := 0; i < count && !b.err; i++ {
+		t := float64(b.uint(8))
+		b.next(1) // priority
+		lon := float64(int32(b.uint(4))) / 1e7
+		lat := float64(int32(b.uint(4))) / 1e7
+		pos := newProtocolPosition(t, lat, lon)
+		d.Mapping.set(&pos, "alt", float64(int16(b.uint(2))))
+		d.Mapping.set(&pos, "course", float64(b.uint(2)))
+		d.Mapping.set(&pos, "sats", float64(b.uint(1)))
+		d.Mapping.set(&pos, "speed", float64(b.uint(2)))
+		if event := b.uint(size); event != 0 {
+			if target, ok := d.Mapping["event:"+strconv.FormatUint(event, 10)]; ok {
+				pos.E = append(pos.E, target.Code)
+			}
+		}
+		b.uint(size) // total io count
+		for _, valueSize := range []int{1, 2, 4, 8} {
+			n := int(b.uint(size))
+			for j := 0; j < n && !b.err; j++ {
+				id := b.uint(size)
+				v := b.uint(valueSize)
+				var value float64
+				switch valueSize {
+				case 1:
+					value = float64(v)
+				case 2:
+					value = float64(uint16(v))
+				case 4:
+					value = float64(int32(v))
+				default:
+					value = float64(int64(v))
+				}
+				d.Mapping.set(&pos, "io:"+strconv.FormatUint(id, 10), value)
+			}
+		}
+		if codec == teltonikaCodec8E {
+			// variable length io elements
+			n := int(b.uint(2))
+			for j := 0; j < n && !b.err; j++ {
+				id := b.uint(2)
+				value := b.next(int(b.uint(2)))
+				if target, ok := d.Mapping["io:"+strconv.FormatUint(id, 10)]; ok {
+					if pos.B == nil {
+						pos.B = make(map[uint16][]byte)
+					}
+					pos.B[target.Code] = append([]byte(nil), value...)
+				}
+			}
+		}
+		positions = append(positions, pos)
+	}
+	if b.uint(1) != uint64(count) || b.err {
+		return nil, ErrProtocolData
+	}
+	return positions, nil
+}
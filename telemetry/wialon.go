@@ -0,0 +1,276 @@
+package telemetry
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WialonMapping default mapping of Wialon IPS values,
+// params of #D# packets are mapped by name
+var WialonMapping = ProtocolMapping{
+	"speed":    {Code: ParamSpeed},
+	"course":   {Code: ParamAngle},
+	"alt":      {Code: ParamAlt},
+	"sats":     {Code: 1024},
+	"inputs":   {Code: 1901},
+	"outputs":  {Code: 1902},
+	"adc1":     {Code: 2000},
+	"adc2":     {Code: 2001},
+	"adc3":     {Code: 2002},
+	"adc4":     {Code: 2003},
+	"adc5":     {Code: 2004},
+	"pwr_ext":  {Code: 1021},
+	"pwr_int":  {Code: 1022},
+	"gsm":      {Code: 1023},
+	"odometer": {Code: ParamOdometer},
+	"temp1":    {Code: 2400},
+	"temp2":    {Code: 2401},
+	"temp3":    {Code: 2402},
+}
+
+// WialonDecoder decodes Wialon IPS 1.1 and 2.0 text protocol
+type WialonDecoder struct {
+	Mapping  ProtocolMapping
+	DeviceID string
+	Version  string    // protocol version from login packet, 2.0 packets have crc
+	Received time.Time // time of records without date and time, such records are rejected if zero
+}
+
+// NewWialonDecoder create Wialon IPS decoder, WialonMapping is used if mapping is nil
+func NewWialonDecoder(mapping ProtocolMapping) *WialonDecoder {
+	if mapping == nil {
+		mapping = WialonMapping
+	}
+	return &WialonDecoder{Mapping: mapping}
+}
+
+// Wialon IPS data packet result codes
+const (
+	wialonStructError = "-1"
+	wialonTimeError   = "0"
+	wialonOK          = "1"
+	wialonCoordError  = "10"
+	wialonCRCError    = "16"
+)
+
+// Decode decodes complete \r\n terminated packets
+func (d *WialonDecoder) Decode(data []byte) (*ProtocolResult, error) {
+	res := &ProtocolResult{}
+	var ack bytes.Buffer
+	for {
+		end := bytes.Index(data[res.Consumed:], []byte("\r\n"))
+		if end < 0 {
+			break
+		}
+		line := string(data[res.Consumed : res.Consumed+end])
+		res.Consumed += end + 2
+		if line == "" {
+			continue
+		}
+		ack.WriteString(d.decodePacket(line, res))
+		ack.WriteString("\r\n")
+	}
+	res.DeviceID = d.DeviceID
+	if ack.Len() > 0 {
+		res.Ack = ack.Bytes()
+	}
+	return res, nil
+}
+
+// checkCRC checks and strips crc of 2.0 packet body, crc follows last separator and covers it
+func (d *WialonDecoder) checkCRC(body string, sep byte) (string, bool) {
+	if d.Version != "2.0" {
+		return body, true
+	}
+	i := strings.LastIndexByte(body, sep)
+	if i < 0 {
+		return body, false
+	}
+	crc, err := strconv.ParseUint(body[i+1:], 16, 16)
+	if err != nil {
+		return body, false
+	}
+	return body[:i], uint16(crc) == crc16ARC([]byte(body[:i+1]))
+}
+
+// decodePacket decodes one packet and returns its response
+func (d *WialonDecoder) decodePacket(line string, res *ProtocolResult) string {
+	parts := strings.SplitN(line, "#", 3)
+	if len(parts) != 3 || parts[0] != "" {
+		return "#AD#" + wialonStructError
+	}
+	kind, body := parts[1], parts[2]
+	switch kind {
+	case "L":
+		return d.login(body)
+	case "P":
+		return "#AP#"
+	case "SD", "D":
+		body, ok := d.checkCRC(body, ';')
+		if !ok {
+			if kind == "SD" {
+				return "#ASD#13"
+			}
+			return "#AD#" + wialonCRCError
+		}
+		pos, code := d.decodeRecord(strings.Split(body, ";"), kind == "D")
+		if code == wialonOK {
+			res.Positions = append(res.Positions, pos)
+		}
+		return "#A" + kind + "#" + code
+	case "B":
+		body, ok := d.checkCRC(body, '|')
+		if !ok {
+			return "#AB#"
+		}
+		cnt := 0
+		for _, rec := range strings.Split(body, "|") {
+			if rec == "" {
+				continue
+			}
+			fields := strings.Split(rec, ";")
+			pos, code := d.decodeRecord(fields, len(fields) > 10)
+			if code != wialonOK {
+				continue
+			}
+			res.Positions = append(res.Positions, pos)
+			cnt++
+		}
+		return "#AB#" + strconv.Itoa(cnt)
+	}
+	return "#AD#" + wialonStructError
+}
+
+// login decodes "1.1 imei;password" or "2.0 version;imei;password;crc" login
+func (d *WialonDecoder) login(body string) string {
+	fields := strings.Split(body, ";")
+	if len(fields) >= 4 && fields[0] == "2.0" {
+		d.Version = "2.0"
+		if _, ok := d.checkCRC(body, ';'); !ok {
+			return "#AL#10"
+		}
+		d.DeviceID = fields[1]
+		return "#AL#1"
+	}
+	if len(fields) < 2 || fields[0] == "" {
+		return "#AL#0"
+	}
+	d.Version = "1.1"
+	d.DeviceID = fields[0]
+	return "#AL#1"
+}
+
+func wialonNumber(s string) (float64, bool) {
+	if s == "" || s == "NA" {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil
+}
+
+// wialonCoord parses DDMM.MMMM or DDDMM.MMMM coordinate with hemisphere
+func wialonCoord(value, hemisphere string) (float64, bool) {
+	v, ok := wialonNumber(value)
+	if !ok {
+		return 0, false
+	}
+	deg := float64(int(v / 100))
+	coord := deg + (v-deg*100)/60
+	if hemisphere == "S" || hemisphere == "W" {
+		coord = -coord
+	}
+	return coord, true
+}
+
+// decodeRecord decodes short or full data record fields
+func (d *WialonDecoder) decodeRecord(fields []string, full bool) (FlatPosition, string) {
+	if len(fields) < 10 || (full && len(fields) < 16) {
+		return FlatPosition{}, wialonStructError
+	}
+	var t time.Time
+	var err error
+	if fields[0] == "NA" || fields[1] == "NA" {
+		if d.Received.IsZero() {
+			return FlatPosition{}, wialonTimeError
+		}
+		t = d.Received
+	} else if t, err = time.Parse("020106150405", fields[0]+fields[1]); err != nil {
+		return FlatPosition{}, wialonTimeError
+	}
+	lat, okLat := wialonCoord(fields[2], fields[3])
+	lon, okLon := wialonCoord(fields[4], fields[5])
+	if okLat != okLon || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return FlatPosition{}, wialonCoordError
+	}
+	pos := newProtocolPosition(float64(t.UnixNano()/int64(time.Millisecond)), lat, lon)
+	for i, name := range []string{"speed", "course", "alt", "sats"} {
+		if v, ok := wialonNumber(fields[6+i]); ok {
+			d.Mapping.set(&pos, name, v)
+		}
+	}
+	if !full {
+		return pos, wialonOK
+	}
+	if v, ok := wialonNumber(fields[10]); ok {
+		d.Mapping.set(&pos, "hdop", v)
+	}
+	if v, ok := wialonNumber(fields[11]); ok {
+		d.Mapping.set(&pos, "inputs", v)
+	}
+	if v, ok := wialonNumber(fields[12]); ok {
+		d.Mapping.set(&pos, "outputs", v)
+	}
+	if fields[13] != "" && fields[13] != "NA" {
+		for i, s := range strings.Split(fields[13], ",") {
+			if v, ok := wialonNumber(s); ok {
+				d.Mapping.setIndexed(&pos, "adc", i+1, v)
+			}
+		}
+	}
+	if target, ok := d.Mapping["ibutton"]; ok && fields[14] != "" && fields[14] != "NA" {
+		if pos.S == nil {
+			pos.S = make(map[uint16]string)
+		}
+		pos.S[target.Code] = fields[14]
+	}
+	// params may contain ';' in string values
+	if code := d.decodeParams(&pos, strings.Join(fields[15:], ";")); code != wialonOK {
+		return FlatPosition{}, code
+	}
+	return pos, wialonOK
+}
+
+// decodeParams decodes name:type:value params, type 1 - int, 2 - double, 3 - string
+func (d *WialonDecoder) decodeParams(pos *FlatPosition, params string) string {
+	if params == "" || params == "NA" {
+		return wialonOK
+	}
+	for _, param := range strings.Split(params, ",") {
+		p := strings.SplitN(param, ":", 3)
+		if len(p) != 3 {
+			return "15"
+		}
+		target, ok := d.Mapping[p[0]]
+		if !ok {
+			continue
+		}
+		switch p[1] {
+		case "1", "2":
+			v, err := strconv.ParseFloat(p[2], 64)
+			if err != nil {
+				return "15"
+			}
+			d.Mapping.set(pos, p[0], v)
+		case "3":
+			if pos.S == nil {
+				pos.S = make(map[uint16]string)
+			}
+			pos.S[target.Code] = p[2]
+		default:
+			return "15"
+		}
+	}
+	return wialonOK
+}
@@ -0,0 +1,79 @@
+package zonestore
+
+import (
+	"errors"
+	"strings"
+
+	dbc "gitlab.com/battler/modules/sql"
+	"gitlab.com/battler/modules/telemetry"
+)
+
+// Zone row of zones table, path is PostGIS geometry
+type Zone struct {
+	ID       string   `db:"id" key:"1"`
+	Name     *string  `db:"name"`
+	Type     *string  `db:"tid"`
+	Path     *string  `db:"path" type:"geometry" index:"gist" ext:"postgis"`
+	Additive *float64 `db:"additive"`
+	Distance *float64 `db:"distance"`
+	Buffer   *float64 `db:"buffer"`
+}
+
+// columns of telemetry.ZoneRecord
+var columns = []string{"id", "name", "tid", "path", "additive", "distance", "buffer"}
+
+// NewSchema create schema table of zones
+func NewSchema(name string) *dbc.SchemaTable {
+	return dbc.NewSchemaTable(name, Zone{}, nil)
+}
+
+// selectQuery returns query of zone records from table,
+// geometry columns are selected as GeoJSON, missing optional columns are skipped
+func selectQuery(table *dbc.SchemaTable, where string) (string, error) {
+	fields := make([]string, 0, len(columns))
+	for _, name := range columns {
+		_, field := table.FindField(name)
+		switch {
+		case field == nil && (name == "id" || name == "path"):
+			return "", errors.New("zones table " + table.Name + " has no " + name + " column")
+		case field == nil:
+			continue
+		case field.Type == "geometry":
+			fields = append(fields, `st_asgeojson("`+name+`") as "`+name+`"`)
+		default:
+			fields = append(fields, `"`+name+`"`)
+		}
+	}
+	query := "SELECT " + strings.Join(fields, ", ") + ` FROM "` + table.Name + `"`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	return query, nil
+}
+
+// Load returns zone records of table rows matching where condition
+func Load(table *dbc.SchemaTable, where string, args ...interface{}) ([]telemetry.ZoneRecord, error) {
+	query, err := selectQuery(table, where)
+	if err != nil {
+		return nil, err
+	}
+	db := table.DB
+	if db == nil {
+		db = dbc.DB
+	}
+	if db == nil {
+		return nil, errors.New("zones table " + table.Name + " has no database")
+	}
+	var recs []telemetry.ZoneRecord
+	if err = db.Select(&recs, query, args...); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// Loader returns zones loader of table for Geofence.LoadZones
+func Loader(table *dbc.SchemaTable, where string, args ...interface{}) func() ([]telemetry.ZoneRecord, error) {
+	return func() ([]telemetry.ZoneRecord, error) {
+		return Load(table, where, args...)
+	}
+}
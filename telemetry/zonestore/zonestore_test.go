@@ -0,0 +1,30 @@
+package zonestore
+
+import (
+	"testing"
+
+	dbc "gitlab.com/battler/modules/sql"
+)
+
+func TestSelectQuery(t *testing.T) {
+	query, err := selectQuery(NewSchema("zones_test"), `"tid" = $1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `SELECT "id", "name", "tid", st_asgeojson("path") as "path", "additive", "distance", "buffer" FROM "zones_test" WHERE "tid" = $1`
+	if query != expected {
+		t.Errorf("query %s, expected %s", query, expected)
+	}
+	// path is stored as GeoJSON text, optional columns are missing
+	table := dbc.NewSchemaTableFields("zones_text", &dbc.SchemaField{Name: "id", Type: "varchar"}, &dbc.SchemaField{Name: "path", Type: "jsonb"}, &dbc.SchemaField{Name: "buffer", Type: "float8"})
+	if query, err = selectQuery(table, ""); err != nil || query != `SELECT "id", "path", "buffer" FROM "zones_text"` {
+		t.Errorf("query %s, err %v", query, err)
+	}
+	table = dbc.NewSchemaTableFields("zones_no_path", &dbc.SchemaField{Name: "id", Type: "varchar"})
+	if _, err = selectQuery(table, ""); err == nil || err.Error() != "zones table zones_no_path has no path column" {
+		t.Errorf("table without path: %v", err)
+	}
+	if _, err = Load(table, ""); err == nil {
+		t.Error("zones are loaded from table without path")
+	}
+}